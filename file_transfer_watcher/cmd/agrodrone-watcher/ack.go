@@ -0,0 +1,156 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+)
+
+// CleanupOn values: clean up once we've verified a batch ourselves, or
+// only once the ground station acks it
+const (
+	cleanupVerified = "verified"
+	cleanupAck      = "ack"
+)
+
+// The manifest and ack go next to the batch in its remote dir, as
+// <batch>.manifest.json and <batch>.ack.json
+const (
+	ackManifestExt = ".manifest.json"
+	ackExt         = ".ack.json"
+)
+
+// verdictOK is the ack verdict for a file the ground station has stored
+// safely; anything else is a rejection
+const verdictOK = "ok"
+
+// ackManifest is what was sent in a batch, for the ground station to check
+// before it acks it
+type ackManifest struct {
+	Batch    string
+	DeviceID string `json:",omitempty"`
+	Files    []ackFile
+}
+
+type ackFile struct {
+	Path   string // relative to the manifest
+	Size   int64
+	SHA256 string `json:",omitempty"`
+}
+
+// ackReply is the ground station's ack: a verdict for each file in the
+// manifest, "ok" or anything else (with a Reason) to reject it
+type ackReply struct {
+	Batch string
+	Files []ackVerdict
+}
+
+type ackVerdict struct {
+	Path    string
+	Verdict string
+	Reason  string `json:",omitempty"`
+}
+
+// ackPath is where f is relative to the batch's remote dir
+func ackPath(dir string, f sentFile) string {
+	if rel, ok := strings.CutPrefix(f.Remote, strings.TrimSuffix(dir, "/")+"/"); ok {
+		return rel
+	}
+	return f.Remote
+}
+
+// cleanupAcked uploads the manifest of what was sent in batch b, waits for
+// the ground station to ack it and cleans up the files it accepted. Ones
+// it rejected, or left out, are kept and sent again. With no ack within
+// AckTimeout everything is kept, unless AckFallback
+func cleanupAcked(ctx context.Context, cfg *Config, addr string, b batchInfo, sent []sentFile) error {
+	man := ackManifest{Batch: b.ID, DeviceID: cfg.DeviceID}
+	for _, f := range sent {
+		man.Files = append(man.Files, ackFile{Path: ackPath(b.RemoteDir, f), Size: f.Size, SHA256: f.SHA256})
+	}
+	if err := remoteWriteJSON(addr, sshConfig(cfg), path.Join(b.RemoteDir, b.ID+ackManifestExt), man); err != nil {
+		return fmt.Errorf("upload the manifest for batch %s, keeping its %d files: %w", b.ID, len(sent), err)
+	}
+	slog.Info("Waiting for the ground station's ack", "files", len(sent), "timeout", cfg.AckTimeout.Duration)
+	status.update(func(s *statusData) { s.Phase = "waiting-for-ack" })
+	reply, err := awaitAck(ctx, cfg, addr, b)
+	if err != nil {
+		metrics.failed("ack")
+		if cfg.AckFallback && ctx.Err() == nil {
+			slog.Warn("No ack from the ground station; cleaning up what we verified ourselves", "error", err)
+			return cleanupSent(cfg, sent)
+		}
+		return fmt.Errorf("batch %s: %w; keeping its %d files", b.ID, err, len(sent))
+	}
+
+	verdicts := map[string]ackVerdict{}
+	for _, v := range reply.Files {
+		verdicts[v.Path] = v
+	}
+	var accepted []sentFile
+	dedup := loadDedupIndex(cfg)
+	for _, f := range sent {
+		v, ok := verdicts[ackPath(b.RemoteDir, f)]
+		switch {
+		case !ok:
+			slog.Warn("The ack doesn't mention the file; keeping it", "batch", b.ID, "file", f.Path)
+		case v.Verdict == verdictOK:
+			accepted = append(accepted, f)
+			continue
+		default:
+			err := fmt.Errorf("rejected by the ground station: %s", cmp.Or(v.Reason, v.Verdict))
+			slog.Error("File rejected; keeping it", "batch", b.ID, "file", f.Path, "error", err)
+			journal.record(stateFailed, err.Error(), sentFile{Path: f.Path})
+			recordFailure(cfg, f.Path, err)
+		}
+		// so it's sent again rather than skipped as already there
+		if dedup != nil {
+			dedup.forget(f.Remote)
+		}
+	}
+	if dedup != nil {
+		dedup.save()
+	}
+	slog.Info("Ground station acked the batch", "accepted", len(accepted), "kept", len(sent)-len(accepted))
+	return cleanupSent(cfg, accepted)
+}
+
+// awaitAck checks for b's ack every AckPollInterval until it turns up or
+// AckTimeout passes. One that doesn't parse may still be being written, so
+// it's checked again too
+func awaitAck(ctx context.Context, cfg *Config, addr string, b batchInfo) (ackReply, error) {
+	p := path.Join(b.RemoteDir, b.ID+ackExt)
+	deadline := time.Now().Add(cfg.AckTimeout.Duration)
+	for {
+		var reply ackReply
+		data, err := remoteRead(addr, sshConfig(cfg), p)
+		switch {
+		case err != nil:
+		case data == nil:
+			err = errors.New("no ack at " + p)
+		default:
+			if err = json.Unmarshal(data, &reply); err != nil {
+				err = fmt.Errorf("bad ack at %s: %w", p, err)
+			} else if reply.Batch != "" && reply.Batch != b.ID {
+				err = fmt.Errorf("the ack at %s is for batch %s", p, reply.Batch)
+			} else {
+				return reply, nil
+			}
+		}
+		slog.Debug("Still waiting for the ack", "error", err)
+		if time.Now().After(deadline) {
+			return ackReply{}, fmt.Errorf("no ack within %s: %w", cfg.AckTimeout.Duration, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ackReply{}, ctx.Err()
+		case <-time.After(cfg.AckPollInterval.Duration):
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Failure categories, for counting failed cycles
+const (
+	failWifi     = "wifi"
+	failConnect  = "connect"
+	failTransfer = "transfer"
+	failCleanup  = "cleanup"
+)
+
+// incident is a run of failed cycles long enough to tell someone about
+type incident struct {
+	ID string
+	// Category is the kind of failure that crossed AlertFailures
+	Category string
+	Error    string
+	// Failures is how many cycles in a row had failed when it was opened,
+	// across all categories
+	Failures    int
+	Since       time.Time
+	RecoveredAt *time.Time `json:",omitempty"`
+}
+
+// alertNotifier is told once when an incident opens and once when it's
+// over (with RecoveredAt set)
+type alertNotifier interface {
+	alert(inc incident)
+}
+
+// incidentTracker counts failed cycles per category. Once any category
+// reaches threshold in a row an incident is opened, and it's only closed
+// after recoverAfter successful cycles in a row, so a link that keeps
+// flapping stays one incident rather than many
+type incidentTracker struct {
+	threshold    int
+	recoverAfter int
+	notifiers    []alertNotifier
+
+	mu        sync.Mutex
+	counts    map[string]int
+	failures  int
+	since     time.Time
+	successes int
+	open      *incident
+}
+
+var alerts = newIncidentTracker(3, 2)
+
+// newIncidentTracker returns a tracker that tells all of notifiers
+func newIncidentTracker(threshold, recoverAfter int, notifiers ...alertNotifier) *incidentTracker {
+	return &incidentTracker{threshold: threshold, recoverAfter: recoverAfter, notifiers: notifiers}
+}
+
+// failed counts a failed cycle in category
+func (t *incidentTracker) failed(category string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts == nil {
+		t.counts = map[string]int{}
+	}
+	if t.failures == 0 {
+		t.since = time.Now()
+	}
+	t.counts[category]++
+	t.failures++
+	t.successes = 0
+	if t.open != nil || t.counts[category] < t.threshold {
+		return
+	}
+	t.open = &incident{
+		ID:       t.since.UTC().Format("20060102T150405Z") + "-" + category,
+		Category: category,
+		Error:    err.Error(),
+		Failures: t.failures,
+		Since:    t.since,
+	}
+	t.notify(*t.open)
+}
+
+// succeeded counts a successful cycle, closing the open incident once
+// there have been enough in a row
+func (t *incidentTracker) succeeded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clear(t.counts)
+	t.failures = 0
+	if t.open == nil {
+		return
+	}
+	t.successes++
+	if t.successes < t.recoverAfter {
+		return
+	}
+	now := time.Now()
+	t.open.RecoveredAt = &now
+	t.notify(*t.open)
+	t.open, t.successes = nil, 0
+}
+
+func (t *incidentTracker) notify(inc incident) {
+	for _, n := range t.notifiers {
+		n.alert(inc)
+	}
+}
+
+// logAlerts logs incidents at ERROR, and their recovery
+type logAlerts struct{}
+
+func (logAlerts) alert(inc incident) {
+	if inc.RecoveredAt == nil {
+		slog.Error(fmt.Sprintf("Every cycle has failed since %s", inc.Since.Format(time.DateTime)),
+			"incident", inc.ID, "category", inc.Category, "failures", inc.Failures, "error", inc.Error)
+		return
+	}
+	slog.Info("Recovered", "incident", inc.ID, "category", inc.Category,
+		"duration_ms", inc.RecoveredAt.Sub(inc.Since).Milliseconds())
+}
+
+// statusAlerts puts the open incident in the status file
+type statusAlerts struct{}
+
+func (statusAlerts) alert(inc incident) {
+	status.update(func(s *statusData) {
+		if inc.RecoveredAt == nil {
+			s.Incident = &inc
+		} else {
+			s.Incident = nil
+		}
+	})
+}
+
+// mqttAlerts publishes incidents on the incident topic
+type mqttAlerts struct{}
+
+func (mqttAlerts) alert(inc incident) {
+	mqtt.publish("incident", inc)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeNotifier records what it's told
+type fakeNotifier struct {
+	got []incident
+}
+
+func (f *fakeNotifier) alert(inc incident) { f.got = append(f.got, inc) }
+
+var errLink = errors.New("no route to host")
+
+func TestIncidentOpensOnceAtThreshold(t *testing.T) {
+	n := &fakeNotifier{}
+	tr := newIncidentTracker(3, 2, n)
+	tr.failed(failConnect, errLink)
+	tr.failed(failConnect, errLink)
+	if len(n.got) != 0 {
+		t.Fatalf("alerted below the threshold: %+v", n.got)
+	}
+	for range 5 {
+		tr.failed(failConnect, errLink)
+	}
+	if len(n.got) != 1 {
+		t.Fatalf("got %d alerts, want one per incident", len(n.got))
+	}
+	inc := n.got[0]
+	if inc.Category != failConnect || inc.Failures != 3 || inc.Error != errLink.Error() || inc.RecoveredAt != nil {
+		t.Errorf("got %+v", inc)
+	}
+	if !strings.HasSuffix(inc.ID, "-"+failConnect) {
+		t.Errorf("incident ID %q doesn't name the category", inc.ID)
+	}
+}
+
+func TestIncidentCountsPerCategory(t *testing.T) {
+	n := &fakeNotifier{}
+	tr := newIncidentTracker(3, 2, n)
+	tr.failed(failWifi, errLink)
+	tr.failed(failWifi, errLink)
+	tr.failed(failConnect, errLink)
+	if len(n.got) != 0 {
+		t.Fatalf("alerted with no category at the threshold: %+v", n.got)
+	}
+	tr.failed(failWifi, errLink)
+	if len(n.got) != 1 || n.got[0].Category != failWifi || n.got[0].Failures != 4 {
+		t.Fatalf("got %+v, want a wifi incident after 4 failed cycles", n.got)
+	}
+}
+
+func TestSuccessBeforeThresholdStartsAgain(t *testing.T) {
+	n := &fakeNotifier{}
+	tr := newIncidentTracker(3, 2, n)
+	for range 3 {
+		tr.failed(failTransfer, errLink)
+		tr.failed(failTransfer, errLink)
+		tr.succeeded()
+	}
+	if len(n.got) != 0 {
+		t.Errorf("alerted though no run of failures reached the threshold: %+v", n.got)
+	}
+}
+
+func TestFlappingStaysOneIncident(t *testing.T) {
+	n, other := &fakeNotifier{}, &fakeNotifier{}
+	tr := newIncidentTracker(2, 3, n, other)
+	tr.failed(failConnect, errLink)
+	tr.failed(failConnect, errLink)
+	// a success now and then isn't a recovery
+	for range 4 {
+		tr.succeeded()
+		tr.succeeded()
+		tr.failed(failConnect, errLink)
+	}
+	if len(n.got) != 1 {
+		t.Fatalf("got %d alerts while flapping, want 1: %+v", len(n.got), n.got)
+	}
+	for range 3 {
+		tr.succeeded()
+	}
+	if len(n.got) != 2 {
+		t.Fatalf("got %d alerts, want the incident and its recovery", len(n.got))
+	}
+	rec := n.got[1]
+	if rec.ID != n.got[0].ID || rec.RecoveredAt == nil {
+		t.Errorf("recovery %+v doesn't close incident %s", rec, n.got[0].ID)
+	}
+	if len(other.got) != 2 {
+		t.Errorf("the second notifier got %d alerts, want 2", len(other.got))
+	}
+
+	// and the next run of failures is a new incident
+	tr.failed(failCleanup, errLink)
+	tr.failed(failCleanup, errLink)
+	if len(n.got) != 3 || n.got[2].Category != failCleanup || n.got[2].RecoveredAt != nil {
+		t.Errorf("got %+v, want a new cleanup incident", n.got[2:])
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff hands out exponentially growing sleeps (base, 2*base, 4*base, ...)
+// capped at max, each with up to 20% random jitter so several drones don't
+// retry in lockstep
+type backoff struct {
+	base  time.Duration
+	max   time.Duration
+	level int
+}
+
+// next returns how long to sleep before the next attempt and bumps the level
+func (b *backoff) next() time.Duration {
+	d := b.base << b.level
+	if d > b.max || d <= 0 {
+		d = b.max
+	} else {
+		b.level++
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// reset goes back to the base interval, e.g. after a successful connection
+func (b *backoff) reset() {
+	b.level = 0
+}
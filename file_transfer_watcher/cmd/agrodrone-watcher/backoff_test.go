@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowsToMax(t *testing.T) {
+	b := backoff{base: 5 * time.Second, max: time.Minute}
+	// each is within the 20% jitter of base doubling up to max
+	for _, want := range []time.Duration{5, 10, 20, 40, 60, 60} {
+		want *= time.Second
+		if d := b.next(); d < want || d > want+want/5 {
+			t.Errorf("got %v, want %v plus up to 20%%", d, want)
+		}
+	}
+	b.reset()
+	if d := b.next(); d < 5*time.Second || d > 6*time.Second {
+		t.Errorf("after reset got %v, want about the base", d)
+	}
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+)
+
+// PriorityGroup is a set of files sent together. Groups are sent in the
+// order they're configured, so a marginal link gets the small, important
+// files across first
+type PriorityGroup struct {
+	Name string
+	// Extensions like ".csv", matched case-insensitively. "*" matches any
+	// file not claimed by an earlier group
+	Extensions []string
+	// Patterns like "logs/**" or "**/*.bin", matched against the path
+	// relative to the export dir as with Include
+	Patterns []string
+}
+
+// batchFile is a file picked for a batch
+type batchFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	// Priority is the index of its group in Config.Priorities
+	Priority int
+	// Remote, if set, is the path to send it to relative to the ingest dir,
+	// instead of its path relative to the export dir
+	Remote string
+	// Capture is the capture set it belongs to, with CapturePattern
+	Capture string
+	// Source, if set, is what's actually sent in its place, e.g. a
+	// recompressed copy; Size is then Source's size
+	Source string
+}
+
+// priorityOf returns which of cfg.Priorities path belongs to, or false if
+// none claims it. With no groups everything has the same priority
+func priorityOf(cfg *Config, path string) (int, bool) {
+	if len(cfg.Priorities) == 0 {
+		return 0, true
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	rel, _ := filepath.Rel(cfg.ExportDir, path)
+	rel = filepath.ToSlash(rel)
+	for i, g := range cfg.Priorities {
+		for _, e := range g.Extensions {
+			if e == "*" || strings.ToLower(e) == ext {
+				return i, true
+			}
+		}
+		for _, pattern := range g.Patterns {
+			if doublestar.MatchUnvalidated(pattern, rel) {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// priorityName is the name of f's priority group, or "" without any
+func priorityName(cfg *Config, f batchFile) string {
+	if f.Priority < len(cfg.Priorities) {
+		return cfg.Priorities[f.Priority].Name
+	}
+	return ""
+}
+
+// Orders files within a batch can be sent in
+const (
+	orderOldest   = "oldest"
+	orderNewest   = "newest"
+	orderSmallest = "smallest"
+	orderLargest  = "largest"
+)
+
+// orderFunc returns how to sort files for the given Order; ties go by path
+// so the order is the same every time
+func orderFunc(order string) func(a, b batchFile) bool {
+	var less func(a, b batchFile) int
+	switch order {
+	case orderNewest:
+		less = func(a, b batchFile) int { return b.ModTime.Compare(a.ModTime) }
+	case orderSmallest:
+		less = func(a, b batchFile) int { return cmp.Compare(a.Size, b.Size) }
+	case orderLargest:
+		less = func(a, b batchFile) int { return cmp.Compare(b.Size, a.Size) }
+	default:
+		less = func(a, b batchFile) int { return a.ModTime.Compare(b.ModTime) }
+	}
+	return func(a, b batchFile) bool {
+		if c := less(a, b); c != 0 {
+			return c < 0
+		}
+		return a.Path < b.Path
+	}
+}
+
+// buildBatch lists the files in exportDir that are ready to send: let
+// through by filter, finished according to stable, and in one of
+// cfg.Priorities if any are configured. They come back in priority order,
+// and in cfg.Order within a priority
+func buildBatch(cfg *Config, filter *fileFilter, stable *stabilityCheck) []batchFile {
+	var files []batchFile
+	watch.Walk(cfg.ExportDir, filter, func(path string, d fs.DirEntry) {
+		if !d.Type().IsRegular() {
+			return
+		}
+		info, err := d.Info()
+		if err != nil {
+			return
+		}
+		if ok, why := stable.Ready(path, info); !ok {
+			slog.Debug("Skipping file for now", "file", path, "reason", why)
+			return
+		}
+		prio, ok := priorityOf(cfg, path)
+		if !ok {
+			slog.Debug("Skipping file: not in any priority group", "file", path)
+			return
+		}
+		files = append(files, batchFile{Path: path, Size: info.Size(), ModTime: info.ModTime(), Priority: prio})
+	})
+	before := orderFunc(cfg.Order)
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Priority != files[j].Priority {
+			return files[i].Priority < files[j].Priority
+		}
+		return before(files[i], files[j])
+	})
+	for _, f := range files {
+		if len(cfg.Priorities) > 0 {
+			slog.Debug("Prioritised file", "file", f.Path, "priority", f.Priority, "group", cfg.Priorities[f.Priority].Name)
+		}
+	}
+	return files
+}
+
+// pendingFiles lists the files in exportDir, with their mtimes, that a
+// batch would pick up once they're finished
+func pendingFiles(cfg *Config, filter *fileFilter) map[string]time.Time {
+	files := map[string]time.Time{}
+	watch.Walk(cfg.ExportDir, filter, func(path string, d fs.DirEntry) {
+		if _, ok := priorityOf(cfg, path); !ok || !d.Type().IsRegular() {
+			return
+		}
+		if info, err := d.Info(); err == nil {
+			files[path] = info.ModTime()
+		}
+	})
+	return files
+}
+
+// settle waits out a burst of new files, like the camera dumping a flight
+// after landing, so it goes in one batch: until no new file has shown up
+// for cfg.BatchSettle, or for at most cfg.BatchSettleMax. Files that have
+// been sitting there a while don't hold anything up
+func settle(cfg *Config, filter *fileFilter) {
+	window := cfg.BatchSettle.Duration
+	if window <= 0 {
+		return
+	}
+	deadline := time.Now().Add(cfg.BatchSettleMax.Duration)
+	seen := pendingFiles(cfg, filter)
+	var quietSince time.Time
+	for _, mtime := range seen {
+		if mtime.After(quietSince) {
+			quietSince = mtime
+		}
+	}
+	for time.Since(quietSince) < window && time.Now().Before(deadline) {
+		status.update(func(s *statusData) { s.Phase = "settling" })
+		sleep(time.Second)
+		now := pendingFiles(cfg, filter)
+		for path := range now {
+			if _, ok := seen[path]; !ok {
+				quietSince = time.Now()
+				break
+			}
+		}
+		seen = now
+	}
+	slog.Debug("Files settled", "files", len(seen))
+}
+
+// batchUnit is one flight's directory in the export dir, or the files
+// sitting loose at its top level
+type batchUnit struct {
+	// Name is the directory, or "" for the loose files
+	Name  string
+	Files []batchFile
+	// Session is set for loose files grouped into a flight session, which
+	// are sent under Name on the remote but are still loose here
+	Session bool
+	// Count is how many files it was expected to have, if it says
+	Count *flightCount
+}
+
+// sentFiles lists the unit's files, for the journal
+func (u batchUnit) sentFiles() []sentFile {
+	files := make([]sentFile, len(u.Files))
+	for i, f := range u.Files {
+		files[i] = sentFile{Path: f.Path, Size: f.Size}
+	}
+	return files
+}
+
+func (u batchUnit) String() string {
+	if u.Name == "" {
+		return "loose files"
+	}
+	return u.Name
+}
+
+// splitUnits groups files (as from buildBatch) by their first-level
+// directory under exportDir, keeping their order within each. Units come
+// back oldest first, by their oldest file
+func splitUnits(exportDir string, files []batchFile) []batchUnit {
+	var units []batchUnit
+	index := map[string]int{}
+	oldest := map[string]time.Time{}
+	for _, f := range files {
+		rel, err := filepath.Rel(exportDir, f.Path)
+		if err != nil {
+			continue
+		}
+		name, _, nested := strings.Cut(filepath.ToSlash(rel), "/")
+		if !nested {
+			name = ""
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(units)
+			index[name] = i
+			units = append(units, batchUnit{Name: name})
+		}
+		units[i].Files = append(units[i].Files, f)
+		if t, ok := oldest[name]; !ok || f.ModTime.Before(t) {
+			oldest[name] = f.ModTime
+		}
+	}
+	sort.SliceStable(units, func(i, j int) bool { return oldest[units[i].Name].Before(oldest[units[j].Name]) })
+	return units
+}
+
+// divertInvalid quarantines the files that fail validateImage and returns
+// the rest, along with how many were quarantined
+func divertInvalid(cfg *Config, files []batchFile) ([]batchFile, int) {
+	var valid []batchFile
+	invalid := 0
+	for _, f := range files {
+		err := validateImage(f.Path, cfg.RequireGeoTIFF)
+		if err == nil {
+			valid = append(valid, f)
+			continue
+		}
+		why := "failed validation (" + invalidReason(err) + "): " + err.Error()
+		slog.Warn("File failed validation", "file", f.Path, "reason", why)
+		if err := quarantineFile(cfg, f.Path, why); err != nil {
+			slog.Error("Failed to quarantine file", "file", f.Path, "error", err)
+			continue
+		}
+		noteInvalid(cfg, f.Path, err)
+		noteQuarantined(f.Path, why)
+		invalid++
+	}
+	return valid, invalid
+}
+
+// checkRemote cross-checks sent against a listing of the remote and
+// returns the files that are really there. The rest are moved to res.Failed
+// (and forgotten by dedup, so they're sent again properly). If the remote
+// can't be listed nothing is cleaned up this time
+func checkRemote(cfg *Config, addr string, sent []sentFile, res *BatchResult, dedup *dedupIndex) []sentFile {
+	ok, missing, err := verifyRemote(addr, sshConfig(cfg), sent)
+	if err != nil {
+		slog.Warn("Couldn't list the remote to verify the transfer; keeping the files", "files", len(sent), "error", err)
+		return nil
+	}
+	for _, f := range missing {
+		res.Failed = append(res.Failed, &fileError{Path: f.Path, Err: fmt.Errorf("not found on the remote at %s after sending", f.Remote)})
+		res.Bytes -= f.Size
+		metrics.failed("verify")
+		if dedup != nil {
+			dedup.forget(f.Remote)
+		}
+	}
+	return ok
+}
+
+// unitResult is how one unit of a batch went
+type unitResult struct {
+	Name  string
+	Files int
+	Sent  int
+	// Skipped files disappeared or changed before they could be sent, and
+	// Failed ones couldn't be read or were rejected; both are left for the
+	// next batch
+	Skipped int
+	Failed  int
+	// Invalid files failed validation and were quarantined instead
+	Invalid int
+	// Retries is how many had failed in an earlier batch
+	Retries  int
+	Bytes    int64
+	Duration string
+	// Status is "complete", "partial" or "failed"
+	Status string
+	// RemoteDir is where its files went
+	RemoteDir string
+	// Count is how many files it was expected to have, if it says
+	Count *flightCount `json:",omitempty"`
+
+	AvgBytesPerSec  int64
+	PeakBytesPerSec int64
+
+	// index is the EXIF of the files sent, with BatchIndex
+	index map[string]imageMeta
+	// clean is what to clean up once the ground station acks it, with
+	// CleanupOn ack
+	clean []sentFile
+}
+
+// sendUnits transfers units one after the other. A flight directory is only
+// cleaned up once every file in it has made it across; loose files are
+// cleaned up as they're confirmed. Files that fail on their own count
+// towards quarantining them. It stops at the first error affecting the
+// whole transfer and returns it, along with any cleanup failures
+func sendUnits(ctx context.Context, cfg *Config, units []batchUnit, ingestDir, addr string, preempt *preemptCheck) (results []unitResult, err, cleanupErr error) {
+	var cleanupErrs []error
+	dedup := loadDedupIndex(cfg)
+	for _, u := range units {
+		journal.record(stateQueued, "", u.sentFiles()...)
+	}
+	base := batchDir(cfg, ingestDir, units)
+	for _, u := range units {
+		start := time.Now()
+		dir := unitDir(cfg, ingestDir, u)
+		u.Files = unitFiles(cfg, u, ingestDir)
+		if templated(ingestDir) {
+			if err := remoteMkdir(addr, sshConfig(cfg), remoteDirs(cfg.ExportDir, dir, u.Files)...); err != nil {
+				slog.Warn("Failed to make the remote dirs", "remote_host", addr, "dir", dir, "error", err)
+			}
+		}
+		files, invalid := u.Files, 0
+		if cfg.ValidateImages {
+			files, invalid = divertInvalid(cfg, u.Files)
+			// the rest of a set missing a file waits to be quarantined too
+			files = wholeSets(u.Files, files)
+		}
+		if cfg.RecompressOver > 0 {
+			files = recompressFiles(ctx, cfg, files)
+		}
+		failures := loadFailures(cfg)
+		var res BatchResult
+		res, err = scpDir(ctx, cfg.ExportDir, files, dir, addr, sshConfig(cfg), cfg.StallTimeout.Duration, dedup, newSidecarWriter(cfg), newSegmenter(cfg), preempt)
+		for _, f := range files {
+			if failures[f.Path].Count > 0 {
+				res.Retries++
+			}
+		}
+		sent := res.Transferred
+		if cfg.VerifyRemote && len(sent) > 0 {
+			sent = checkRemote(cfg, addr, sent, &res, dedup)
+			res.Transferred = sent
+		}
+		if cfg.CapturePattern != "" {
+			sent = wholeSent(files, sent)
+		}
+		recordFiles(cfg, journal.currentBatch(), res)
+		csvFiles(cfg, journal.currentBatch(), res)
+		if dedup != nil {
+			dedup.save()
+		}
+		journal.record(stateVerified, "", sent...)
+		clearFailures(cfg, sent)
+		for _, fe := range res.Failed {
+			journal.record(stateFailed, fe.Err.Error(), sentFile{Path: fe.Path})
+			recordFailure(cfg, fe.Path, fe.Err)
+		}
+
+		r := unitResult{
+			Name:     u.String(),
+			Files:    len(files),
+			Sent:     len(sent),
+			Skipped:  len(res.Skipped),
+			Failed:   len(res.Failed),
+			Invalid:  invalid,
+			Retries:  res.Retries,
+			Bytes:    res.Bytes,
+			Duration: time.Since(start).Round(time.Second).String(),
+
+			RemoteDir: dir,
+			Count:     u.Count,
+
+			AvgBytesPerSec:  res.avgBytesPerSec(),
+			PeakBytesPerSec: res.PeakBytesPerSec,
+		}
+		switch {
+		case len(sent) == len(files):
+			r.Status = "complete"
+		case len(sent) > 0:
+			r.Status = "partial"
+		default:
+			r.Status = "failed"
+		}
+		if cfg.BatchIndex {
+			r.index = indexSent(base, sent)
+		}
+		slog.Info("Unit done", "unit", r.Name, "status", r.Status, "sent", r.Sent, "files", r.Files,
+			"skipped", r.Skipped, "failed", r.Failed, "invalid", r.Invalid, "bytes", r.Bytes, "duration", r.Duration)
+
+		if u.Session && len(sent) > 0 {
+			for _, s := range unitSessions([]batchUnit{u}) {
+				rememberSession(cfg, s)
+			}
+		}
+		cleanup := u.Name == "" || u.Session || r.Status == "complete"
+		// with CleanupOn ack it waits for the ground station, at the end of
+		// the batch
+		acked := cleanup && cfg.CleanupOn == cleanupAck
+		if cfg.RecompressOver > 0 {
+			var clean []sentFile
+			if cleanup && !acked {
+				clean = sent
+			}
+			sentRecompressed(cfg, files, clean)
+		}
+		switch {
+		case acked:
+			r.clean = sent
+		case cleanup:
+			cleanupErrs = append(cleanupErrs, cleanupSent(cfg, sent))
+		case len(sent) > 0:
+			slog.Info("Keeping unit until all of it is transferred", "unit", u.Name)
+		}
+		results = append(results, r)
+		if err != nil {
+			break
+		}
+	}
+	return results, err, errors.Join(cleanupErrs...)
+}
+
+// splitByPriority splits units so that every unit's files of one priority
+// go before any unit's files of the next, keeping the units' order within
+// each priority. With a single priority units come back as they are
+func splitByPriority(units []batchUnit) []batchUnit {
+	var prios []int
+	seen := map[int]bool{}
+	for _, u := range units {
+		for _, f := range u.Files {
+			if !seen[f.Priority] {
+				seen[f.Priority] = true
+				prios = append(prios, f.Priority)
+			}
+		}
+	}
+	if len(prios) < 2 {
+		return units
+	}
+	sort.Ints(prios)
+	var split []batchUnit
+	for _, prio := range prios {
+		for _, u := range units {
+			piece := batchUnit{Name: u.Name, Session: u.Session, Count: u.Count}
+			for _, f := range u.Files {
+				if f.Priority == prio {
+					piece.Files = append(piece.Files, f)
+				}
+			}
+			if len(piece.Files) > 0 {
+				split = append(split, piece)
+			}
+		}
+	}
+	return split
+}
+
+// chunkUnits splits units into successive batches of at most maxFiles files
+// and maxBytes bytes (zero is no limit), keeping the order. A unit that
+// doesn't fit is split across batches, but never in the middle of a capture
+// set; a single file over maxBytes goes in a batch of its own
+func chunkUnits(units []batchUnit, maxFiles int, maxBytes int64) [][]batchUnit {
+	var batches [][]batchUnit
+	var cur []batchUnit
+	files, bytes := 0, int64(0)
+	for _, u := range units {
+		piece := batchUnit{Name: u.Name, Session: u.Session, Count: u.Count}
+		for _, f := range gatherSets(u.Files) {
+			full := (maxFiles > 0 && files+1 > maxFiles) || (maxBytes > 0 && bytes+f.Size > maxBytes)
+			// a capture set is never split, even if that overfills the batch
+			together := f.Capture != "" && len(piece.Files) > 0 && piece.Files[len(piece.Files)-1].Capture == f.Capture
+			if full && files > 0 && !together {
+				if len(piece.Files) > 0 {
+					cur = append(cur, piece)
+					piece = batchUnit{Name: u.Name, Session: u.Session, Count: u.Count}
+				}
+				batches = append(batches, cur)
+				cur, files, bytes = nil, 0, 0
+			}
+			piece.Files = append(piece.Files, f)
+			files++
+			bytes += f.Size
+		}
+		if len(piece.Files) > 0 {
+			cur = append(cur, piece)
+		}
+	}
+	if len(cur) > 0 {
+		batches = append(batches, cur)
+	}
+	return batches
+}
+
+// backlogProgress is how far through a backlog split into batches we are
+type backlogProgress struct {
+	Batch     int
+	Batches   int
+	Files     int
+	FilesSent int
+	Bytes     int64
+	BytesSent int64
+}
+
+// sendBatches sends each of batches with sendUnits in turn, pausing
+// cfg.BatchPause between them so other traffic on the link gets a look in.
+// Each batch is cleaned up on its own, so a failure only costs the batch
+// it happened in. It stops at the first error affecting the whole transfer
+func sendBatches(ctx context.Context, cfg *Config, batches [][]batchUnit, ingestDir, addr string) (results []unitResult, err, cleanupErr error) {
+	backlog := backlogProgress{Batches: len(batches)}
+	for _, b := range batches {
+		for _, u := range b {
+			backlog.Files += len(u.Files)
+			for _, f := range u.Files {
+				backlog.Bytes += f.Size
+			}
+		}
+	}
+	progress.start(backlog.Files, backlog.Bytes)
+	preempt := newPreemptCheck(cfg, batches)
+	defer setLogBatch("")
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	go progress.run(progressCtx, 5*time.Second)
+
+	var cleanupErrs []error
+	for i, b := range batches {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return results, ctx.Err(), errors.Join(cleanupErrs...)
+			case <-time.After(cfg.BatchPause.Duration):
+			}
+		}
+		backlog.Batch = i + 1
+		p := backlog
+		status.update(func(s *statusData) { s.Backlog = &p })
+
+		info := batchInfo{ID: journal.startBatch()}
+		info.RemoteDir = batchDir(cfg, ingestDir, b)
+		setLogBatch(info.ID)
+		metrics.batch(info.ID)
+		h := historyBatch{ID: info.ID, Start: time.Now(), RemoteHost: addr, RemoteDir: info.RemoteDir, ClockSkew: status.snapshot().ClockSkew}
+		h.Sessions = unitSessions(b)
+		entries := renameFiles(cfg, b)
+		if entries == nil && (len(cfg.Priorities) > 0 || cfg.CapturePattern != "") {
+			entries = manifestEntries(cfg, b)
+		}
+		h.CountMismatches = countMismatches(b)
+		writeManifest(cfg, info.ID, entries, h.Sessions, unitCounts(b))
+		preempt.add(b)
+		for _, s := range h.Sessions {
+			slog.Info("Flight session", "session", s.Name, "start", s.Start.UTC().Format(time.RFC3339),
+				"end", s.End.UTC().Format(time.RFC3339), "files", s.Files, "bytes", s.Bytes)
+		}
+		signalStart := linkSignal(cfg)
+		var r []unitResult
+		r, err, cleanupErr = sendUnits(ctx, cfg, b, ingestDir, addr, preempt)
+		results = append(results, r...)
+		cleanupErrs = append(cleanupErrs, cleanupErr)
+		for _, u := range r {
+			info.Files += u.Sent
+			info.Bytes += u.Bytes
+			h.Files += u.Files
+			h.Failed += u.Failed
+			h.Retries += u.Retries
+			h.PeakBytesPerSec = max(h.PeakBytesPerSec, u.PeakBytesPerSec)
+		}
+		if cfg.BatchIndex && info.Files > 0 {
+			idx := batchIndex{Batch: info.ID, Files: map[string]imageMeta{}}
+			for _, u := range r {
+				maps.Copy(idx.Files, u.index)
+			}
+			if err := uploadIndex(cfg, addr, info.RemoteDir, idx); err != nil {
+				slog.Warn("Failed to upload the batch index", "remote_host", addr, "error", err)
+			}
+		}
+		if cfg.OutboxDir != "" && err == nil {
+			got, err := syncOutbox(ctx, cfg, addr)
+			if err != nil {
+				slog.Warn("Failed to sync the outbox", "remote_host", addr, "dir", cfg.OutboxDir, "error", err)
+			}
+			h.Received, h.ReceivedBytes = got.Files, got.Bytes
+		}
+		h.End, h.Sent, h.Bytes = time.Now(), info.Files, info.Bytes
+		if wall := h.End.Sub(h.Start).Seconds(); wall > 0 {
+			h.AvgBytesPerSec = int64(float64(h.Bytes) / wall)
+		}
+		slog.Info("Batch summary", "remote_dir", h.RemoteDir, "files", h.Sent, "of", h.Files, "bytes", h.Bytes,
+			"duration_ms", h.End.Sub(h.Start).Milliseconds(), "avg_bytes_per_sec", h.AvgBytesPerSec,
+			"peak_bytes_per_sec", h.PeakBytesPerSec, "retries", h.Retries, "failures", h.Failed, "clock_skew", h.ClockSkew, "sessions", len(h.Sessions),
+			"received", h.Received, "received_bytes", h.ReceivedBytes, "count_mismatches", len(h.CountMismatches))
+		switch {
+		case err == nil && h.Sent == h.Files:
+			h.Outcome = "complete"
+		case h.Sent > 0:
+			h.Outcome = "partial"
+		default:
+			h.Outcome = "failed"
+		}
+		if err != nil {
+			h.Error = err.Error()
+		}
+		recordBatch(cfg, h)
+		csvBatch(cfg, h, signalStart, linkSignal(cfg))
+		mqtt.publish("last_batch", h)
+		status.update(func(s *statusData) { s.LastBatch = &h })
+		webhooks.batch(h)
+		backlog.FilesSent += info.Files
+		backlog.BytesSent += info.Bytes
+		if info.Files > 0 {
+			runHooks(cfg, addr, info)
+		}
+		if cfg.CleanupOn == cleanupAck {
+			var sent []sentFile
+			for _, u := range r {
+				sent = append(sent, u.clean...)
+			}
+			if len(sent) > 0 {
+				cleanupErrs = append(cleanupErrs, cleanupAcked(ctx, cfg, addr, info, sent))
+			}
+		}
+		if len(batches) > 1 {
+			pct := 100.0
+			if backlog.Bytes > 0 {
+				pct = float64(backlog.BytesSent) / float64(backlog.Bytes) * 100
+			}
+			slog.Info("Batch done", "batch_num", backlog.Batch, "batches", backlog.Batches,
+				"files_sent", backlog.FilesSent, "files", backlog.Files, "percent", math.Round(pct), "bytes", backlog.Bytes)
+		}
+		p = backlog
+		status.update(func(s *statusData) { s.Backlog = &p })
+		setLogBatch("")
+		if err != nil {
+			break
+		}
+	}
+	return results, err, errors.Join(cleanupErrs...)
+}
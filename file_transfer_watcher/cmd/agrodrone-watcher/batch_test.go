@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+	"golang.org/x/crypto/ssh"
+)
+
+// unitsOf builds the batch's units from what's in the export dir, as the
+// main loop does
+func unitsOf(t *testing.T, cfg *Config) []batchUnit {
+	t.Helper()
+	files := buildBatch(cfg, newFileFilter(cfg), newStabilityCheck(cfg))
+	return splitUnits(cfg.ExportDir, files)
+}
+
+func TestSendUnitsPartialFailureCleansUpOnlySent(t *testing.T) {
+	cfg := testConfig(t)
+	fake := fakeUploader(t)
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "b.jpg", "c.jpg")
+	fake.Fail[paths[1]] = []error{errors.New("permission denied")}
+	ago := time.Now().Add(-time.Hour)
+	for _, p := range paths {
+		os.Chtimes(p, ago, ago)
+	}
+
+	results, err, cleanupErr := sendUnits(context.Background(), cfg, unitsOf(t, cfg), cfg.IngestDir, "drone:22", nil)
+	if err != nil || cleanupErr != nil {
+		t.Fatalf("sendUnits: %v, cleanup %v", err, cleanupErr)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results", len(results))
+	}
+	r := results[0]
+	if r.Status != "partial" || r.Sent != 2 || r.Failed != 1 || r.Files != 3 {
+		t.Errorf("got %s, %d/%d sent, %d failed; want partial, 2/3, 1", r.Status, r.Sent, r.Files, r.Failed)
+	}
+	// loose files are cleaned up as they go
+	if exists(paths[0]) || exists(paths[2]) {
+		t.Error("sent files were left behind")
+	}
+	if !exists(paths[1]) {
+		t.Error("the failed file was cleaned up")
+	}
+	if _, ok := fake.Files["/ingest/b.jpg"]; ok {
+		t.Error("the failed file is on the remote")
+	}
+	if string(fake.Files["/ingest/c.jpg"]) != "c.jpg" {
+		t.Errorf("remote c.jpg is %q", fake.Files["/ingest/c.jpg"])
+	}
+
+	// and only the failure goes again
+	fake.Uploads = nil
+	results, err, _ = sendUnits(context.Background(), cfg, unitsOf(t, cfg), cfg.IngestDir, "drone:22", nil)
+	if err != nil || results[0].Status != "complete" {
+		t.Fatalf("retry: %v, %+v", err, results)
+	}
+	if len(fake.Uploads) != 1 || fake.Uploads[0] != paths[1] {
+		t.Errorf("retry uploaded %q", fake.Uploads)
+	}
+	if exists(paths[1]) {
+		t.Error("the retried file was left behind")
+	}
+}
+
+func TestSendUnitsKeepsFlightUntilComplete(t *testing.T) {
+	cfg := testConfig(t)
+	fake := fakeUploader(t)
+	paths := writeFiles(t, cfg.ExportDir, "flight1/a.jpg", "flight1/b.jpg")
+	fake.Fail[paths[0]] = []error{errors.New("no space left on device")}
+	ago := time.Now().Add(-time.Hour)
+	for _, p := range paths {
+		os.Chtimes(p, ago, ago)
+	}
+
+	results, err, cleanupErr := sendUnits(context.Background(), cfg, unitsOf(t, cfg), cfg.IngestDir, "drone:22", nil)
+	if err != nil || cleanupErr != nil {
+		t.Fatalf("sendUnits: %v, cleanup %v", err, cleanupErr)
+	}
+	if r := results[0]; r.Status != "partial" || r.Sent != 1 {
+		t.Errorf("got %s with %d sent; want partial with 1", r.Status, r.Sent)
+	}
+	for _, p := range paths {
+		if !exists(p) {
+			t.Errorf("%s was cleaned up before the flight was all across", p)
+		}
+	}
+}
+
+func TestSendUnitsConnectFailure(t *testing.T) {
+	cfg := testConfig(t)
+	old := dialUploader
+	dialUploader = func(string, *ssh.ClientConfig) (transfer.Uploader, error) { return nil, errors.New("no route to host") }
+	t.Cleanup(func() { dialUploader = old })
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg")
+	ago := time.Now().Add(-time.Hour)
+	os.Chtimes(paths[0], ago, ago)
+
+	results, err, _ := sendUnits(context.Background(), cfg, unitsOf(t, cfg), cfg.IngestDir, "drone:22", nil)
+	if err == nil || results[0].Status != "failed" {
+		t.Fatalf("got %v, %+v; want a connect error and a failed unit", err, results)
+	}
+	if !exists(paths[0]) {
+		t.Error("a file that never went was cleaned up")
+	}
+}
+
+func TestSendUnitsConnectionDropsPartWay(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.QuarantineAfter = 1
+	fake := fakeUploader(t)
+	fake.Drop = 1
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "b.jpg", "c.jpg")
+	ago := time.Now().Add(-time.Hour)
+	for _, p := range paths {
+		os.Chtimes(p, ago, ago)
+	}
+
+	results, err, _ := sendUnits(context.Background(), cfg, unitsOf(t, cfg), cfg.IngestDir, "drone:22", nil)
+	if !errors.Is(err, transfer.ErrConnLost) {
+		t.Fatalf("got %v, want ErrConnLost", err)
+	}
+	if r := results[0]; r.Sent != 1 || r.Failed != 0 {
+		t.Errorf("got %d sent, %d failed; want 1 and none put down to the files", r.Sent, r.Failed)
+	}
+	if failures := loadFailures(cfg); len(failures) != 0 {
+		t.Errorf("failures counted against files for a dropped link: %v", failures)
+	}
+	for _, p := range paths[1:] {
+		if !exists(p) {
+			t.Errorf("%s was quarantined or cleaned up", p)
+		}
+	}
+}
+
+func TestOrderFunc(t *testing.T) {
+	t0 := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	// a and c were written together, b and d are the same size, and they're
+	// listed backwards so ties can't just keep the order they came in
+	files := []batchFile{
+		{Path: "d.jpg", Size: 10, ModTime: t0.Add(3 * time.Second)},
+		{Path: "c.jpg", Size: 20, ModTime: t0.Add(2 * time.Second)},
+		{Path: "b.jpg", Size: 10, ModTime: t0.Add(1 * time.Second)},
+		{Path: "a.jpg", Size: 30, ModTime: t0.Add(2 * time.Second)},
+	}
+	for _, tt := range []struct {
+		order string
+		want  string
+	}{
+		{orderOldest, "b.jpg a.jpg c.jpg d.jpg"},
+		{orderNewest, "d.jpg a.jpg c.jpg b.jpg"},
+		{orderSmallest, "b.jpg d.jpg c.jpg a.jpg"},
+		{orderLargest, "a.jpg c.jpg b.jpg d.jpg"},
+		{"", "b.jpg a.jpg c.jpg d.jpg"}, // oldest when unset
+	} {
+		sorted := slices.Clone(files)
+		before := orderFunc(tt.order)
+		sort.SliceStable(sorted, func(i, j int) bool { return before(sorted[i], sorted[j]) })
+		var got []string
+		for _, f := range sorted {
+			got = append(got, f.Path)
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%q: got %v, want %s", tt.order, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BatterySource values
+const (
+	batterySysfs   = "sysfs"
+	batteryINA219  = "ina219"
+	batteryMAVLink = "mavlink"
+)
+
+// batteryPoll is how long a battery reading is good for, and how often it's
+// read again while the battery holds off sending
+const batteryPoll = 10 * time.Second
+
+// errBatteryLow is returned by scpDir when it stops before a file because
+// the battery has gone critical
+var errBatteryLow = errors.New("battery critical")
+
+// INA219 registers and the I2C_SLAVE ioctl to address it
+const (
+	ina219Shunt = 0x01 // signed, 10µV a bit
+	ina219Bus   = 0x02 // bits 15-3, 4mV a bit
+	i2cSlave    = 0x0703
+)
+
+// batteryStatus is the battery as shown in the status file
+type batteryStatus struct {
+	Percent  int
+	Charging bool
+	// Held is set while the battery is holding off sending, with why
+	Held   bool
+	Reason string `json:",omitempty"`
+	ReadAt time.Time
+}
+
+// batteryMonitor reads the battery's charge from BatterySource and holds
+// off sending while it's low. A nil monitor never does
+type batteryMonitor struct {
+	cfg      *Config
+	override bool
+
+	mu       sync.Mutex
+	percent  int
+	charging bool
+	err      error
+	readAt   time.Time
+	held     bool
+	last     batteryStatus
+}
+
+var battery *batteryMonitor
+
+// startBattery sets up the monitor if BatterySource is set. override sends
+// regardless, for the bench
+func startBattery(cfg *Config, override bool) {
+	if cfg.BatterySource == "" {
+		return
+	}
+	if override {
+		slog.Warn("Ignoring the battery; files are sent however low it is")
+	}
+	battery = &batteryMonitor{cfg: cfg, override: override}
+}
+
+// read reads the battery, or returns the last reading if it's recent
+func (b *batteryMonitor) read() (percent int, charging bool, err error) {
+	if time.Since(b.readAt) < batteryPoll {
+		return b.percent, b.charging, b.err
+	}
+	switch b.cfg.BatterySource {
+	case batterySysfs:
+		percent, charging, err = readSysfsBattery(cmp.Or(b.cfg.BatteryPath, "/sys/class/power_supply/BAT0"))
+	case batteryINA219:
+		percent, charging, err = readINA219(cmp.Or(b.cfg.BatteryPath, "/dev/i2c-1"), b.cfg.BatteryI2CAddr,
+			b.cfg.BatteryEmptyVolts, b.cfg.BatteryFullVolts)
+	case batteryMAVLink:
+		percent, err = mav.batteryPercent(time.Now())
+	}
+	if err != nil {
+		slog.Warn("Failed to read the battery; sending anyway", "source", b.cfg.BatterySource, "error", err)
+	}
+	b.percent, b.charging, b.err, b.readAt = percent, charging, err, time.Now()
+	return percent, charging, err
+}
+
+// allows reports whether a batch may start, and if not why not: the
+// battery has to be at BatteryMin or charging. One that can't be read
+// doesn't stop anything
+func (b *batteryMonitor) allows() (bool, string) {
+	if b == nil {
+		return true, ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	percent, charging, err := b.read()
+	var why string
+	switch {
+	case err != nil:
+	case b.override || charging || percent >= b.cfg.BatteryMin:
+	default:
+		why = fmt.Sprintf("%d%%, below BatteryMin of %d%% and not charging", percent, b.cfg.BatteryMin)
+	}
+	b.note(why != "", why)
+	return why == "", why
+}
+
+// critical reports whether the battery has dropped below BatteryCritical
+// and isn't charging, so sending should stop before the next file
+func (b *batteryMonitor) critical() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	percent, charging, err := b.read()
+	if err != nil || b.override || charging || percent >= b.cfg.BatteryCritical {
+		return false
+	}
+	b.note(true, fmt.Sprintf("%d%%, below BatteryCritical of %d%%", percent, b.cfg.BatteryCritical))
+	return true
+}
+
+// note logs whenever sending is held off or let go, and keeps the status
+// file up to date
+func (b *batteryMonitor) note(held bool, why string) {
+	if held != b.held {
+		if held {
+			slog.Warn("Battery low; holding off sending", "reason", why)
+		} else {
+			slog.Info("Battery fine; sending again", "percent", b.percent, "charging", b.charging)
+		}
+		b.held = held
+	}
+	s := batteryStatus{Percent: b.percent, Charging: b.charging, Held: held, Reason: why, ReadAt: b.readAt}
+	if s != b.last {
+		b.last = s
+		status.update(func(d *statusData) { d.Battery = &s })
+	}
+}
+
+// readSysfsBattery reads capacity and status from a power_supply dir, e.g.
+// /sys/class/power_supply/BAT0
+func readSysfsBattery(dir string) (int, bool, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "capacity"))
+	if err != nil {
+		return 0, false, err
+	}
+	percent, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, false, fmt.Errorf("%s/capacity: %w", dir, err)
+	}
+	st, _ := os.ReadFile(filepath.Join(dir, "status"))
+	switch strings.TrimSpace(string(st)) {
+	case "Charging", "Full":
+		return percent, true, nil
+	}
+	return percent, false, nil
+}
+
+// readINA219 estimates the charge from the bus voltage an INA219 at addr on
+// the I2C bus dev measures, as a straight line from emptyV to fullV. Current
+// into the battery (a negative shunt voltage) means it's charging
+func readINA219(dev string, addr int, emptyV, fullV float64) (int, bool, error) {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	if err := unix.IoctlSetInt(int(f.Fd()), i2cSlave, addr); err != nil {
+		return 0, false, fmt.Errorf("address INA219 at %#x on %s: %w", addr, dev, err)
+	}
+	reg := func(r byte) (uint16, error) {
+		if _, err := f.Write([]byte{r}); err != nil {
+			return 0, err
+		}
+		buf := make([]byte, 2)
+		if _, err := f.Read(buf); err != nil {
+			return 0, err
+		}
+		return uint16(buf[0])<<8 | uint16(buf[1]), nil
+	}
+	bus, err := reg(ina219Bus)
+	if err != nil {
+		return 0, false, fmt.Errorf("INA219 bus voltage: %w", err)
+	}
+	shunt, err := reg(ina219Shunt)
+	if err != nil {
+		return 0, false, fmt.Errorf("INA219 shunt voltage: %w", err)
+	}
+	volts := float64(bus>>3) * 0.004
+	percent := math.Round((volts - emptyV) / (fullV - emptyV) * 100)
+	return int(max(0, min(100, percent))), int16(shunt) < 0, nil
+}
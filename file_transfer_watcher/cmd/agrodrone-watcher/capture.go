@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// captureKey is the capture set path belongs to: its directory relative to
+// the export dir and the key re pulls out of its name, or "" if re doesn't
+// match
+func captureKey(re *regexp.Regexp, exportDir, p string) string {
+	m := re.FindStringSubmatch(filepath.Base(p))
+	if m == nil {
+		return ""
+	}
+	rel, err := filepath.Rel(exportDir, filepath.Dir(p))
+	if err != nil {
+		return ""
+	}
+	return path.Join(filepath.ToSlash(rel), m[1])
+}
+
+// captureSets applies CapturePattern to files (as from buildBatch): the
+// files of each complete set get its key and the highest priority among
+// them, so they go in one batch together (see chunkUnits). Incomplete sets are held back until CaptureGrace after their newest file,
+// then quarantined
+func captureSets(cfg *Config, files []batchFile) []batchFile {
+	if cfg.CapturePattern == "" {
+		return files
+	}
+	re := regexp.MustCompile(cfg.CapturePattern)
+	sets := map[string][]int{}
+	for i := range files {
+		if k := captureKey(re, cfg.ExportDir, files[i].Path); k != "" {
+			files[i].Capture = k
+			sets[k] = append(sets[k], i)
+		}
+	}
+	held := map[string]bool{}
+	for k, members := range sets {
+		if len(members) == cfg.CaptureSetSize {
+			prio := files[members[0]].Priority
+			for _, i := range members {
+				prio = min(prio, files[i].Priority)
+			}
+			for _, i := range members {
+				files[i].Priority = prio
+			}
+			continue
+		}
+		held[k] = true
+		var newest time.Time
+		for _, i := range members {
+			if files[i].ModTime.After(newest) {
+				newest = files[i].ModTime
+			}
+		}
+		if time.Since(newest) < cfg.CaptureGrace.Duration {
+			slog.Debug("Holding capture set", "capture_set", k, "files", len(members), "expected", cfg.CaptureSetSize)
+			continue
+		}
+		why := fmt.Sprintf("incomplete capture set %s: %d of %d files", k, len(members), cfg.CaptureSetSize)
+		for _, i := range members {
+			slog.Warn("File is in an incomplete capture set", "file", files[i].Path, "reason", why)
+			if err := quarantineFile(cfg, files[i].Path, why); err != nil {
+				slog.Error("Failed to quarantine file", "file", files[i].Path, "error", err)
+				continue
+			}
+			noteQuarantined(files[i].Path, why)
+		}
+	}
+
+	var out []batchFile
+	for _, f := range files {
+		if !held[f.Capture] {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// gatherSets moves the files of each capture set to where the first of them
+// is, keeping everything else in order
+func gatherSets(files []batchFile) []batchFile {
+	sets := map[string][]batchFile{}
+	for _, f := range files {
+		if f.Capture != "" {
+			sets[f.Capture] = append(sets[f.Capture], f)
+		}
+	}
+	if len(sets) == 0 {
+		return files
+	}
+	out := make([]batchFile, 0, len(files))
+	for _, f := range files {
+		switch members, ok := sets[f.Capture]; {
+		case f.Capture == "":
+			out = append(out, f)
+		case ok:
+			out = append(out, members...)
+			delete(sets, f.Capture)
+		}
+	}
+	return out
+}
+
+// brokenSets returns the capture sets in all that aren't entirely in have
+func brokenSets(all []batchFile, have map[string]bool) map[string]bool {
+	broken := map[string]bool{}
+	for _, f := range all {
+		if f.Capture != "" && !have[f.Path] {
+			broken[f.Capture] = true
+		}
+	}
+	return broken
+}
+
+// wholeSets drops the files in files whose capture set isn't all there,
+// compared with all
+func wholeSets(all, files []batchFile) []batchFile {
+	have := map[string]bool{}
+	for _, f := range files {
+		have[f.Path] = true
+	}
+	broken := brokenSets(all, have)
+	if len(broken) == 0 {
+		return files
+	}
+	var kept []batchFile
+	for _, f := range files {
+		if !broken[f.Capture] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// wholeSent drops the files in sent whose capture set didn't all make it,
+// so none of the set is cleaned up and it's all sent again
+func wholeSent(all []batchFile, sent []sentFile) []sentFile {
+	have := map[string]bool{}
+	for _, f := range sent {
+		have[f.Path] = true
+	}
+	broken := brokenSets(all, have)
+	if len(broken) == 0 {
+		return sent
+	}
+	capture := map[string]string{}
+	for _, f := range all {
+		capture[f.Path] = f.Capture
+	}
+	var kept []sentFile
+	for _, f := range sent {
+		if !broken[capture[f.Path]] {
+			kept = append(kept, f)
+		}
+	}
+	for k := range broken {
+		slog.Info("Capture set didn't all make it; keeping it to send again", "capture_set", k)
+	}
+	return kept
+}
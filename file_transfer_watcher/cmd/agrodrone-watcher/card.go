@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+)
+
+// cardUUIDDir is where udev links filesystems by their UUID
+const cardUUIDDir = "/dev/disk/by-uuid"
+
+// seenFile is what a file on a card was when it was last copied off
+type seenFile struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// cardResult is what was copied off a card
+type cardResult struct {
+	Files int
+	Bytes int64
+}
+
+// startCards watches for camera SD cards being mounted, at CardMounts or
+// anywhere if CardAutoDetect, and copies what's new in their DCIM into
+// ExportDir each time one is
+func startCards(cfg *Config) {
+	if len(cfg.CardMounts) == 0 && !cfg.CardAutoDetect {
+		return
+	}
+	go func() {
+		// mounted last time round, so each card is only scanned once per
+		// time it goes in
+		present := map[mount]bool{}
+		for {
+			now := map[mount]bool{}
+			for _, m := range cardMounts(cfg) {
+				now[m] = true
+				if present[m] {
+					continue
+				}
+				res, err := ingestCard(cfg, m)
+				if err != nil {
+					slog.Error("Failed to copy everything off the card", "device", m.Device, "mount", m.Dir, "files", res.Files, "error", err)
+				} else if res.Files > 0 {
+					slog.Info("Copied new files off the card", "device", m.Device, "mount", m.Dir, "files", res.Files, "bytes", res.Bytes)
+				}
+			}
+			present = now
+			time.Sleep(cfg.CardPollInterval.Duration)
+		}
+	}()
+}
+
+// cardMounts lists the cards mounted now: whatever is mounted at one of
+// CardMounts, and with CardAutoDetect any removable media with a DCIM dir.
+// The USBLabel drive is never one
+func cardMounts(cfg *Config) []mount {
+	mounts, err := readMounts()
+	if err != nil {
+		slog.Debug("Failed to list mounts", "error", err)
+		return nil
+	}
+	var offload string
+	if cfg.USBLabel != "" {
+		offload, _ = filepath.EvalSymlinks(filepath.Join(usbLabelDir, cfg.USBLabel))
+	}
+	var cards []mount
+	for _, m := range mounts {
+		if m.Device == offload {
+			continue
+		}
+		configured := slices.ContainsFunc(cfg.CardMounts, func(dir string) bool { return filepath.Clean(dir) == m.Dir })
+		if !configured && !(cfg.CardAutoDetect && removable(m.Device)) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(m.Dir, "DCIM")); err != nil || !info.IsDir() {
+			if configured {
+				slog.Debug("No DCIM on the card", "dir", m.Dir)
+			}
+			continue
+		}
+		cards = append(cards, m)
+	}
+	return cards
+}
+
+// removable reports whether the kernel says dev, or the disk it's a
+// partition of, is removable media
+func removable(dev string) bool {
+	sys, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", filepath.Base(dev)))
+	if err != nil {
+		return false
+	}
+	for _, p := range []string{filepath.Join(sys, "removable"), filepath.Join(filepath.Dir(sys), "removable")} {
+		if b, err := os.ReadFile(p); err == nil {
+			return strings.TrimSpace(string(b)) == "1"
+		}
+	}
+	return false
+}
+
+// cardID is what a card is known by: its filesystem UUID, or failing that
+// its device name
+func cardID(dev string) string {
+	entries, _ := os.ReadDir(cardUUIDDir)
+	for _, e := range entries {
+		if p, err := filepath.EvalSymlinks(filepath.Join(cardUUIDDir, e.Name())); err == nil && p == dev {
+			return e.Name()
+		}
+	}
+	return filepath.Base(dev)
+}
+
+func loadSeen(cfg *Config, id string) map[string]seenFile {
+	seen := map[string]seenFile{}
+	b, err := os.ReadFile(cfg.cardSeenPath(id))
+	if err == nil {
+		err = json.Unmarshal(b, &seen)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("Failed to read what was copied off the card", "card", id, "error", err)
+	}
+	return seen
+}
+
+// ingestCard copies the files in m's DCIM that are new, or have changed
+// by size or mtime, since they were last copied off this card into
+// ExportDir/card-<id>, keeping their paths. With CardDelete each is then
+// deleted from the card
+func ingestCard(cfg *Config, m mount) (res cardResult, err error) {
+	id := cardID(m.Device)
+	seen := loadSeen(cfg, id)
+	defer func() {
+		if err := writeFileAtomic(cfg.cardSeenPath(id), seen); err != nil {
+			slog.Error("Failed to write what was copied off the card", "card", id, "error", err)
+		}
+	}()
+	// whatever the camera left half written, and its own dotfiles
+	ignore := &fileFilter{Ignore: watch.DefaultIgnore}
+	var errs []error
+	walkErr := filepath.WalkDir(filepath.Join(m.Dir, "DCIM"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		rel, _ := filepath.Rel(m.Dir, p)
+		if skip, _ := ignore.Skip(filepath.ToSlash(rel), d.IsDir()); skip {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		if prev, ok := seen[key]; !ok || prev.Size != info.Size() || !prev.ModTime.Equal(info.ModTime()) {
+			dst := filepath.Join(cfg.ExportDir, "card-"+id, rel)
+			if err := copyOffCard(p, dst, info); err != nil {
+				slog.Error("Failed to copy off the card", "file", p, "error", err)
+				errs = append(errs, err)
+				return nil
+			}
+			seen[key] = seenFile{Size: info.Size(), ModTime: info.ModTime()}
+			res.Files++
+			res.Bytes += info.Size()
+		}
+		if cfg.CardDelete {
+			if err := os.Remove(p); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return nil
+	})
+	return res, errors.Join(append(errs, walkErr)...)
+}
+
+// copyOffCard copies src, as described by info, to dst under a temporary
+// name the export dir ignores, checks it came out the same size and only
+// then moves it into place with src's mtime. Something already at dst
+// that isn't the same size is kept, and the copy goes next to it
+func copyOffCard(src, dst string, info fs.FileInfo) error {
+	if have, err := os.Stat(dst); err == nil {
+		if have.Size() == info.Size() {
+			return nil
+		}
+		dst = uniqueName(dst, map[string]bool{}, func(p string) bool {
+			_, err := os.Stat(p)
+			return err == nil
+		})
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp := dst + ".partial"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	n, err := io.Copy(out, in)
+	if err != nil {
+		return fmt.Errorf("copy %q -> %q: %w", src, dst, err)
+	}
+	if n != info.Size() {
+		return fmt.Errorf("%s is %d bytes but %d were copied", src, info.Size(), n)
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if got, err := os.Stat(tmp); err != nil || got.Size() != info.Size() {
+		return fmt.Errorf("the copy of %s didn't come out %d bytes", src, info.Size())
+	}
+	if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		slog.Debug("Failed to keep the mtime", "file", dst, "error", err)
+	}
+	return os.Rename(tmp, dst)
+}
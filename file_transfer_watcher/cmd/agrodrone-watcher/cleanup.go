@@ -0,0 +1,293 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveBatchFormat is the time at the start of each batch's ID, which
+// also names its directory in the archive; it sorts chronologically
+const archiveBatchFormat = "20060102T150405"
+
+// newBatchID returns an ID for a batch starting now: the time, so IDs sort
+// chronologically, a random suffix so two can't collide, and the device
+// it's from, e.g. 20250412T101500-3fa2-drone1
+func newBatchID(device string) string {
+	id := fmt.Sprintf("%s-%04x", time.Now().Format(archiveBatchFormat), rand.IntN(1<<16))
+	if device != "" {
+		id += "-" + device
+	}
+	return id
+}
+
+// batchTime is when the batch with ID id started. IDs from before the
+// suffix was added are just the time
+func batchTime(id string) (time.Time, error) {
+	t, _, _ := strings.Cut(id, "-")
+	return time.ParseInLocation(archiveBatchFormat, t, time.Local)
+}
+
+// batchMarker is written into an archived batch's directory once every file
+// has been moved in, so an interrupted batch isn't counted as a whole one
+const batchMarker = ".complete"
+
+// cleanupSent gets the files in sent out of the export dir once they've
+// been transferred: archived if cfg.ArchiveDir is set, deleted otherwise.
+// Failures for individual files don't stop the rest; they're all returned
+// together
+func cleanupSent(cfg *Config, sent []sentFile) error {
+	if len(sent) == 0 {
+		return nil
+	}
+	if cfg.ArchiveDir == "" {
+		slog.Info("Deleting transferred files", "files", len(sent))
+		return deleteSent(cfg.ExportDir, sent, cfg.auditPath())
+	}
+	slog.Info("Archiving transferred files", "files", len(sent))
+	err := archiveSent(cfg.ExportDir, cfg.ArchiveDir, sent, cfg.auditPath())
+	pruneArchive(cfg.ArchiveDir, cfg.ArchiveMaxAge.Duration, cfg.ArchiveKeepBatches, cfg.ArchiveMaxBytes)
+	return err
+}
+
+// deleteSent removes exactly the files in sent from exportDir, and then any
+// directories that left empty. The list is appended to the audit log at
+// auditPath first, so there's a record of what went even if we crash
+// part way. Nothing is deleted if the audit log can't be written
+func deleteSent(exportDir string, sent []sentFile, auditPath string) error {
+	if err := appendAudit(auditPath, "deleted", sent); err != nil {
+		return fmt.Errorf("audit log, not deleting anything: %w", err)
+	}
+	var errs []error
+	var removed []string
+	for _, f := range sent {
+		// sidecars first, so none is left without its file; a file left
+		// without them is just sent again
+		if err := removeSidecars(f.Path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// already gone is as good as deleted
+		if err := os.Remove(f.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		journal.record(stateDeleted, "", f)
+		removed = append(removed, f.Path)
+	}
+	removeEmptyParents(exportDir, removed)
+	return errors.Join(errs...)
+}
+
+// archiveSent moves the files in sent out of exportDir into
+// archiveDir/<batch time>/<path relative to exportDir>, keeping a local copy
+// in case the ground station turns out not to have them after all. Like
+// deleteSent, it writes the audit log first. The batch is only marked
+// complete if every file made it
+func archiveSent(exportDir, archiveDir string, sent []sentFile, auditPath string) error {
+	if err := appendAudit(auditPath, "archived", sent); err != nil {
+		return fmt.Errorf("audit log, not archiving anything: %w", err)
+	}
+	batchDir := filepath.Join(archiveDir, cmp.Or(journal.currentBatch(), newBatchID(journal.device)))
+	var errs []error
+	var moved []string
+	for _, f := range sent {
+		rel, err := filepath.Rel(exportDir, f.Path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// the sidecars go with their file, first as in deleteSent
+		var sidecarErr error
+		for _, sc := range sidecarsOf(f.Path) {
+			sidecarErr = errors.Join(sidecarErr, moveFile(sc, filepath.Join(batchDir, rel+strings.TrimPrefix(sc, f.Path))))
+		}
+		if sidecarErr != nil {
+			errs = append(errs, sidecarErr)
+			continue
+		}
+		if err := moveFile(f.Path, filepath.Join(batchDir, rel)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		journal.record(stateArchived, "", f)
+		moved = append(moved, f.Path)
+	}
+	removeEmptyParents(exportDir, moved)
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if err := os.WriteFile(filepath.Join(batchDir, batchMarker), nil, 0o644); err != nil {
+		return fmt.Errorf("mark %s complete: %w", batchDir, err)
+	}
+	return nil
+}
+
+// moveFile renames src to dst, creating dst's directory. If they're on
+// different filesystems it copies and then removes src instead
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("copy %q -> %q: %w", src, dst, err)
+	}
+	// the copy has to be safely on disk before the original goes
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// pruneArchive removes archived batches older than maxAge, complete
+// batches beyond the newest keep, and then the oldest remaining ones until
+// the archive is no bigger than maxBytes, so it can't fill the SD card. A
+// zero maxAge, keep or maxBytes turns that limit off. Batches still missing
+// their marker (archiving was interrupted) don't count towards keep. It only
+// looks at what's on disk, so it's safe to rerun after a restart
+func pruneArchive(archiveDir string, maxAge time.Duration, keep int, maxBytes ByteSize) {
+	entries, err := os.ReadDir(archiveDir)
+	if err != nil {
+		slog.Error("Failed to read archive", "dir", archiveDir, "error", err)
+		return
+	}
+	type batch struct {
+		dir      string
+		at       time.Time
+		size     int64
+		complete bool
+	}
+	var batches []batch
+	var total int64
+	complete := 0
+	for _, e := range entries {
+		at, err := batchTime(e.Name())
+		if !e.IsDir() || err != nil {
+			continue // not one of ours
+		}
+		b := batch{dir: filepath.Join(archiveDir, e.Name()), at: at}
+		b.size = dirSize(b.dir)
+		if _, err := os.Stat(filepath.Join(b.dir, batchMarker)); err == nil {
+			b.complete = true
+			complete++
+		}
+		total += b.size
+		batches = append(batches, b)
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].at.Before(batches[j].at) })
+
+	for _, b := range batches {
+		var why string
+		switch {
+		case maxAge > 0 && time.Since(b.at) > maxAge:
+			why = "older than " + maxAge.String()
+		case keep > 0 && b.complete && complete > keep:
+			why = fmt.Sprintf("more than %d batches", keep)
+		case maxBytes > 0 && uint64(total) > uint64(maxBytes):
+			why = fmt.Sprintf("archive over %d bytes", maxBytes)
+		default:
+			continue
+		}
+		slog.Info("Pruning archived batch", "dir", b.dir, "bytes", b.size, "reason", why)
+		if err := os.RemoveAll(b.dir); err != nil {
+			slog.Error("Failed to prune archive", "dir", b.dir, "error", err)
+			continue
+		}
+		total -= b.size
+		if b.complete {
+			complete--
+		}
+	}
+}
+
+// dirSize adds up the sizes of the regular files under root
+func dirSize(root string) int64 {
+	var n int64
+	filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// appendAudit records files about to be deleted or archived, one per line
+// with the time, action and size
+func appendAudit(path, action string, sent []sentFile) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	var b strings.Builder
+	now := time.Now().Format(time.RFC3339)
+	for _, f := range sent {
+		fmt.Fprintf(&b, "%s\t%s\t%d\t%s\n", now, action, f.Size, f.Path)
+	}
+	audit, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := audit.WriteString(b.String()); err != nil {
+		audit.Close()
+		return err
+	}
+	// make sure the record is on disk before the files it describes go
+	if err := audit.Sync(); err != nil {
+		audit.Close()
+		return err
+	}
+	return audit.Close()
+}
+
+// removeEmptyParents removes the directories that removing paths left
+// empty, from each one's parent up towards root. root itself stays, and so
+// does an empty directory nothing was removed from, e.g. one the camera has
+// only just made
+func removeEmptyParents(root string, paths []string) {
+	root = filepath.Clean(root)
+	for _, p := range paths {
+		for dir := filepath.Dir(p); strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+			// fails harmlessly on one that isn't empty, and then nothing
+			// above it is either
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+}
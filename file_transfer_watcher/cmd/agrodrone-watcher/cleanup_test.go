@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeleteSentKeepsUnrelatedEmptyDirs(t *testing.T) {
+	cfg := testConfig(t)
+	paths := writeFiles(t, cfg.ExportDir, "flight1/row2/a.jpg", "flight1/b.jpg", "flight2/c.jpg")
+	// made by the camera for the next flight, with nothing in it yet
+	next := filepath.Join(cfg.ExportDir, "flight3")
+	if err := os.MkdirAll(next, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := []sentFile{{Path: paths[0], Size: 17}, {Path: paths[1], Size: 13}}
+	if err := deleteSent(cfg.ExportDir, sent, cfg.auditPath()); err != nil {
+		t.Fatal(err)
+	}
+	for _, gone := range []string{"flight1/row2", "flight1"} {
+		if exists(filepath.Join(cfg.ExportDir, gone)) {
+			t.Errorf("%s was left behind empty", gone)
+		}
+	}
+	for _, kept := range []string{"flight2/c.jpg", "flight3"} {
+		if !exists(filepath.Join(cfg.ExportDir, kept)) {
+			t.Errorf("%s was removed", kept)
+		}
+	}
+	if !exists(cfg.ExportDir) {
+		t.Error("the export dir itself was removed")
+	}
+}
+
+func TestArchiveSentKeepsUnrelatedEmptyDirs(t *testing.T) {
+	cfg := testConfig(t)
+	archive := t.TempDir()
+	paths := writeFiles(t, cfg.ExportDir, "flight1/a.jpg", "flight2/b.jpg")
+	next := filepath.Join(cfg.ExportDir, "flight3")
+	if err := os.MkdirAll(next, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := archiveSent(cfg.ExportDir, archive, []sentFile{{Path: paths[0], Size: 13}}, cfg.auditPath()); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(cfg.ExportDir, "flight1")) {
+		t.Error("flight1 was left behind empty")
+	}
+	if !exists(next) || !exists(paths[1]) {
+		t.Error("archiving removed something it didn't move")
+	}
+}
+
+func TestRemoveEmptyParentsStopsAtRoot(t *testing.T) {
+	root := t.TempDir()
+	p := filepath.Join(root, "a", "b", "c.jpg")
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	removeEmptyParents(root, []string{p})
+	if exists(filepath.Join(root, "a")) {
+		t.Error("a was left behind empty")
+	}
+	if !exists(root) {
+		t.Error("root was removed")
+	}
+	// a path outside root is left well alone
+	outside := filepath.Join(t.TempDir(), "x", "y.jpg")
+	if err := os.MkdirAll(filepath.Dir(outside), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	removeEmptyParents(root, []string{outside})
+	if !exists(filepath.Dir(outside)) {
+		t.Error("removed a directory outside root")
+	}
+}
+
+func TestCleanupSentReportsAnUndeletableEntry(t *testing.T) {
+	cfg := testConfig(t)
+	if err := os.MkdirAll(cfg.StateDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "stuck.jpg/inside", "c.jpg")
+	// a non-empty directory can't be removed, even by root
+	stuck := filepath.Dir(paths[1])
+	sent := []sentFile{
+		{Path: paths[0], Size: 5},
+		{Path: stuck, Size: 0},
+		{Path: paths[2], Size: 5},
+		{Path: filepath.Join(cfg.ExportDir, "already-gone.jpg"), Size: 1},
+	}
+	err := cleanupSent(cfg, sent)
+	if err == nil {
+		t.Fatal("a failed delete wasn't reported")
+	}
+	if !strings.Contains(err.Error(), stuck) {
+		t.Errorf("the error doesn't say what failed: %v", err)
+	}
+	// the failure doesn't stop the rest
+	for _, p := range []string{paths[0], paths[2]} {
+		if exists(p) {
+			t.Errorf("%s wasn't deleted", p)
+		}
+	}
+	if !exists(stuck) {
+		t.Errorf("%s was somehow deleted", stuck)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// remoteClock asks the ground station for its time and works out how far
+// ahead of ours it is, and how long the round trip took
+func remoteClock(addr string, config *ssh.ClientConfig) (skew, rtt time.Duration, err error) {
+	client, err := transfer.DialSSH(addr, config)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer session.Close()
+	sent := time.Now()
+	out, err := session.Output("date +%s%N")
+	received := time.Now()
+	if err != nil {
+		return 0, 0, err
+	}
+	ns, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected output from date: %q", out)
+	}
+	return clockSkew(sent, received, time.Unix(0, ns)), received.Sub(sent), nil
+}
+
+// clockSkew is how far remote is ahead of our clock, taking the remote time
+// to have been read halfway through the round trip
+func clockSkew(sent, received, remote time.Time) time.Duration {
+	return remote.Sub(sent.Add(received.Sub(sent) / 2))
+}
+
+// checkClock compares our clock with the ground station's, warning if
+// they're further apart than ClockSkewWarn. The skew goes in the status
+// for the batch summary, or is cleared if it couldn't be read
+func checkClock(cfg *Config, addr string) {
+	if cfg.ClockSkewWarn.Duration <= 0 {
+		return
+	}
+	skew, rtt, err := remoteClock(addr, sshConfig(cfg))
+	if err != nil {
+		slog.Debug("Couldn't read the ground station's clock", "remote_host", addr, "error", err)
+		status.update(func(s *statusData) { s.ClockSkew = "" })
+		return
+	}
+	skew = skew.Round(time.Millisecond)
+	status.update(func(s *statusData) { s.ClockSkew = skew.String() })
+	if skew.Abs() > cfg.ClockSkewWarn.Duration {
+		slog.Warn("CLOCK SKEW: our clock disagrees with the ground station's; batch times and file ordering may be wrong",
+			"remote_host", addr, "skew", skew.String(), "rtt_ms", rtt.Milliseconds(), "ntp_synced", ntpSynced())
+		return
+	}
+	slog.Debug("Clock checked", "remote_host", addr, "skew", skew.String(), "rtt_ms", rtt.Milliseconds())
+}
+
+// ntpSynced reports whether our clock has been set by NTP, asking timedatectl
+// and falling back to the kernel's unsynchronised flag without systemd
+func ntpSynced() bool {
+	if out, err := exec.Command("timedatectl", "show", "-p", "NTPSynchronized", "--value").Output(); err == nil {
+		return strings.TrimSpace(string(out)) == "yes"
+	}
+	var tx unix.Timex
+	state, err := unix.Adjtimex(&tx)
+	return err == nil && state != unix.TIME_ERROR && tx.Status&unix.STA_UNSYNC == 0
+}
+
+// holdForClock is whether to hold off sending until NTP has set our clock,
+// since RenameTemplate would put a bogus time in every name
+func holdForClock(cfg *Config) bool {
+	return cfg.HoldUntilNTPSync && strings.Contains(cfg.RenameTemplate, "{batch_ts}") && !ntpSynced()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	sent := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	ms := time.Millisecond
+	for _, tt := range []struct {
+		name string
+		// skew is how far ahead the remote really is; out and back are how
+		// long the request and the reply took
+		skew, out, back time.Duration
+		want            time.Duration
+	}{
+		{name: "in step", out: 50 * ms, back: 50 * ms},
+		{name: "ahead", skew: 3 * time.Second, out: 50 * ms, back: 50 * ms, want: 3 * time.Second},
+		{name: "behind", skew: -2 * time.Second, out: 50 * ms, back: 50 * ms, want: -2 * time.Second},
+		{name: "no round trip", skew: 5 * time.Second, want: 5 * time.Second},
+		// the remote's reading is taken as halfway, so a lopsided round
+		// trip is off by half the difference, and never more than half of it
+		{name: "slow reply", skew: time.Second, out: 10 * ms, back: 90 * ms, want: time.Second - 40*ms},
+		{name: "slow request", out: 90 * ms, back: 10 * ms, want: 40 * ms},
+		{name: "all one way", skew: -time.Second, out: 200 * ms, want: -time.Second + 100*ms},
+	} {
+		remote := sent.Add(tt.out).Add(tt.skew)
+		received := sent.Add(tt.out + tt.back)
+		got := clockSkew(sent, received, remote)
+		if got != tt.want {
+			t.Errorf("%s: skew %v, want %v", tt.name, got, tt.want)
+		}
+		if rtt := received.Sub(sent); (got - tt.skew).Abs() > rtt/2 {
+			t.Errorf("%s: off by %v, more than half the %v round trip", tt.name, got-tt.skew, rtt)
+		}
+	}
+}
+
+func TestRemoteClock(t *testing.T) {
+	cfg := testConfig(t)
+	testSSHConfig(cfg)
+	// the ground station's clock is an hour ahead
+	ahead := time.Now().Add(time.Hour).UnixNano()
+	addr := sshServer(t, func(string) string { return "echo " + strconv.FormatInt(ahead, 10) })
+
+	skew, rtt, err := remoteClock(addr, sshConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// it was read a little after ahead was worked out, so a little under
+	if skew > time.Hour || skew < time.Hour-rtt-time.Second {
+		t.Errorf("skew %v with a %v round trip, want just under an hour", skew, rtt)
+	}
+}
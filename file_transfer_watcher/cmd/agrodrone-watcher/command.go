@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+// commandTimeoutError is returned by runCommand when a command doesn't
+// finish in time. Callers can treat it as transient, e.g. NetworkManager
+// being mid-restart
+type commandTimeoutError struct {
+	Name  string
+	After time.Duration
+}
+
+func (e *commandTimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.Name, e.After)
+}
+
+// Timeout matches the net.Error convention
+func (e *commandTimeoutError) Timeout() bool { return true }
+
+// Transient reports that the command may well succeed if tried again
+func (e *commandTimeoutError) Transient() bool { return true }
+
+// isTransient reports whether err says it's worth retrying soon, rather than
+// backing off further
+func isTransient(err error) bool {
+	var t interface{ Transient() bool }
+	return errors.As(err, &t) && t.Transient()
+}
+
+// runCommand runs name with args and returns its stdout, killing it (and
+// anything it spawned) if it's still running after timeout. On failure the
+// returned error includes whatever the command wrote to stderr. Secrets
+// are masked in errors, since the argv or stderr may well include them
+func runCommand(timeout time.Duration, name string, args ...string) ([]byte, error) {
+	return runCommandEnv(timeout, nil, name, args...)
+}
+
+// runCommandEnv is runCommand with env added to the command's environment
+func runCommandEnv(timeout time.Duration, env []string, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	// run in its own process group so the whole group can be killed
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
+	out, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return out, &commandTimeoutError{Name: redact.String(name + " " + strings.Join(args, " ")), After: timeout}
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return out, fmt.Errorf("%w: %s", err, redact.String(msg))
+		}
+	}
+	return out, err
+}
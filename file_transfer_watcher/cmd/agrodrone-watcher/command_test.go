@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// running reports whether pid is still a live (not zombie) process
+func running(pid int) bool {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// the state follows the parenthesised command name
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestRunCommandTimesOut(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	start := time.Now()
+	// the sleep is a grandchild, so killing just the shell would leave it
+	_, err := runCommand(200*time.Millisecond, "sh", "-c", "sleep 30 & echo $! > "+pidFile+"; wait")
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("took %v to time out", d)
+	}
+	var timeout *commandTimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("got %v, want a *commandTimeoutError", err)
+	}
+	if !timeout.Timeout() || !isTransient(err) {
+		t.Errorf("a timeout should be transient: %v", err)
+	}
+
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); running(pid); {
+		if time.Now().After(deadline) {
+			t.Fatalf("sleep %d outlived the process group", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunCommandIncludesStderr(t *testing.T) {
+	_, err := runCommand(5*time.Second, "sh", "-c", "echo no wi-fi device >&2; exit 1")
+	if err == nil || !strings.Contains(err.Error(), "no wi-fi device") {
+		t.Fatalf("got %v, want stderr in the error", err)
+	}
+	if isTransient(err) {
+		t.Errorf("a plain failure isn't transient: %v", err)
+	}
+}
+
+func TestRunCommandEnv(t *testing.T) {
+	out, err := runCommandEnv(5*time.Second, []string{"AGRODRONE_TEST=yes"}, "sh", "-c", "echo $AGRODRONE_TEST")
+	if err != nil || strings.TrimSpace(string(out)) != "yes" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+}
@@ -0,0 +1,1028 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+)
+
+// Config holds everything that used to be hardcoded in main. It is read from
+// a JSON file passed with -config; anything left out keeps its default
+type Config struct {
+	// Debug turns on debug-level log lines
+	Debug bool
+
+	// StateDir holds the status file and any other state the watcher keeps
+	StateDir string
+
+	ExportDir string
+	// Watch is "fsnotify" to start on new files in ExportDir as soon as
+	// they've stopped changing for WatchDebounce, or "poll" to look every
+	// PollInterval, for filesystems where inotify doesn't work (e.g. NFS).
+	// With fsnotify the dir is still polled every WatchSafetyPoll in case
+	// an event is missed
+	Watch           string
+	WatchDebounce   Duration
+	WatchSafetyPoll Duration
+	PollInterval    Duration
+	// Trigger is "all" to send whatever turns up in ExportDir, or "mission"
+	// to send only what a mission_<id>.json manifest lists, as one batch
+	// with the manifest last, once every file is there and as listed.
+	// After MissionTimeout it goes with what there is, and a report of the
+	// rest
+	Trigger        string
+	MissionTimeout Duration
+	// Files modified within QuiescePeriod, or (with CheckOpenFiles) that a
+	// process has open for writing, are still being written and wait for
+	// the next batch
+	QuiescePeriod  Duration
+	CheckOpenFiles bool
+	// Once new files show up, a batch waits until none have arrived for
+	// BatchSettle, or BatchSettleMax at most, so a burst goes in one batch
+	BatchSettle    Duration
+	BatchSettleMax Duration
+	// A batch is capped at MaxFilesPerBatch files and MaxBytesPerBatch
+	// (e.g. "500MiB"); a bigger backlog is sent as several batches, each
+	// cleaned up as it completes, with BatchPause between them. Zero is no
+	// limit
+	MaxFilesPerBatch int
+	MaxBytesPerBatch ByteSize
+	BatchPause       Duration
+	// After each batch is verified and cleaned up, PostTransferCommand (an
+	// argv run locally) and PostTransferRemote (a shell command run on the
+	// ground station) are run with the batch ID, file and byte counts and
+	// remote directory in AGRODRONE_* environment variables. Each is tried
+	// up to HookAttempts times and killed after HookTimeout
+	PostTransferCommand []string
+	PostTransferRemote  string
+	HookAttempts        int
+	HookTimeout         Duration
+	// Files or directories in ExportDir with a name matching one of Ignore
+	// (by default dotfiles, *.tmp, *.partial, *.swp and lost+found) or
+	// ExtraIgnore are neither sent nor deleted. IncludeAll sends everything
+	Ignore      []string
+	ExtraIgnore []string
+	IncludeAll  bool
+	// Include and Exclude are glob patterns matched against paths relative
+	// to ExportDir, with ** spanning directories (e.g. "**/*.jpg"). With any
+	// Include patterns only matching files are sent; Exclude always wins.
+	// Filtered out files are left alone, not deleted
+	Include []string
+	Exclude []string
+	// Files smaller than MinFileSize or bigger than MaxFileSize (e.g. "4KiB",
+	// "2GiB"; 0 is no limit) aren't sent or deleted. With QuarantineSmall,
+	// too-small files are moved to QuarantineDir as likely corrupt
+	MinFileSize     ByteSize
+	MaxFileSize     ByteSize
+	QuarantineSmall bool
+	// Priorities, if set, are groups of extensions or patterns sent in
+	// order, e.g. telemetry logs before JPEGs before raw TIFFs. A group is
+	// sent from every flight before the next starts. Files in no group are
+	// left alone; add a group with "*" to send them last
+	Priorities []PriorityGroup
+	// ValidateImages checks JPEGs, TIFFs (and DNGs) and PNGs for truncation
+	// or corruption before sending them; bad ones are quarantined
+	ValidateImages bool
+	// RequireGeoTIFF, with ValidateImages, quarantines TIFFs without a
+	// GeoKey directory too
+	RequireGeoTIFF bool
+	// DedupWindow is how long the SHA256 of each file sent is remembered;
+	// zero (the default) turns it off. With DedupRemoteCopy the same content
+	// under a new name is recreated on the remote by copying the earlier
+	// file there instead of being sent again
+	DedupWindow     Duration
+	DedupRemoteCopy bool
+	// RenameTemplate, if set, renames each file sent, keeping its directory,
+	// e.g. "{device_id}_{batch_ts}_{orig_name}" with DeviceID and the batch
+	// time in UTC. Only the remote name changes unless RenameLocal is set.
+	// The mapping goes in the batch's manifest in StateDir
+	RenameTemplate string
+	RenameLocal    bool
+	// DeviceID tells this drone's uploads apart from other drones': it's in
+	// batch IDs, manifests, sidecars, MQTT topics, metrics and logs. It
+	// defaults to the hostname. With Fleet, for several drones sending to
+	// one ground station, it has to be set, and everything is sent under
+	// <IngestDir>/<DeviceID>/
+	DeviceID string
+	Fleet    bool
+	// RemoteNameTemplate, if set, is the path each file is sent to relative
+	// to the ingest dir, e.g. "{device}/{date}/{capture_ts}_{orig}", with
+	// DeviceID, the UTC date and time it was taken (from its EXIF, else its
+	// mtime), the directory it would have gone to and its name. Local files
+	// are left alone. It can't be used with RenameTemplate
+	RemoteNameTemplate string
+	// SessionGap, if set, groups loose files into flight sessions, starting
+	// a new one wherever their mtimes are more than this apart. Each is
+	// sent to flight_<UTC start>/ on the remote and listed in the manifest
+	SessionGap Duration
+	// CapturePattern, if set, is a regexp matched against file names whose
+	// first group is a capture's key, e.g. "^(IMG_\\d{4})_\\d\\.tif$" for a
+	// multispectral camera's bands. The CaptureSetSize files of a capture in
+	// one directory are sent and cleaned up together; a capture still short
+	// of files CaptureGrace after its newest one is quarantined
+	CapturePattern string
+	CaptureSetSize int
+	CaptureGrace   Duration
+	// Sidecars writes a <name>.meta.json with each file's provenance (device,
+	// batch, source path, size, SHA256, capture and transfer times) next to
+	// it, and sends it straight after the file
+	Sidecars bool
+	// HashSidecars writes a <name>.sha256 in sha256sum's format next to
+	// each file and sends it once the file is confirmed, after any other
+	// sidecar, so its presence on the remote means the file is complete
+	HashSidecars bool
+	// Previews sends a small JPEG of every JPEG and TIFF, at most
+	// PreviewMaxDim pixels on its longer side, to previews/ in the ingest
+	// dir before any of the originals. PreviewWorkers previews are made at
+	// a time
+	Previews       bool
+	PreviewMaxDim  int
+	PreviewQuality int
+	PreviewWorkers int
+	// RecompressOver, if set, re-encodes JPEGs bigger than it at
+	// RecompressQuality (with their EXIF) before sending, and sends that
+	// instead when it's smaller. RecompressWorkers are re-encoded at a time.
+	// With ArchiveDir the copy sent is what's archived, unless
+	// RecompressKeepOriginal
+	RecompressOver         ByteSize
+	RecompressQuality      int
+	RecompressWorkers      int
+	RecompressKeepOriginal bool
+	// SegmentOver, if set, sends files with SegmentExtensions bigger than
+	// it in SegmentSize pieces, each checked on the remote and then joined
+	// back together there. A dropped link only costs the piece it was on
+	SegmentOver       ByteSize
+	SegmentSize       ByteSize
+	SegmentExtensions []string
+	// BatchIndex uploads batch_index_<batch>.json to the ingest dir after
+	// each batch, with the GPS position and capture time of every file sent
+	BatchIndex bool
+	// OutboxDir, if set, is a dir on the ground station the drone fetches
+	// new and changed files from into InboxDir after each successful batch,
+	// e.g. mission plans and camera configs. With OutboxDelete they're then
+	// deleted there. InboxConflict says what happens when a file here has
+	// changed since it was last fetched: "remote-wins" overwrites it,
+	// "keep-both" puts the new one next to it with a _1 suffix
+	OutboxDir     string
+	InboxDir      string
+	OutboxDelete  bool
+	InboxConflict string
+	// USBLabel, if set, offloads ExportDir onto any USB drive with that
+	// filesystem label as soon as it's plugged in, for when there's no
+	// network to send it over. It's found under /dev/disk/by-label every
+	// USBPollInterval and mounted at USBMountDir, or left to the automounter
+	// if that's empty. Each offload goes into <batch>/ on the drive with a
+	// manifest.json, every file read back and checked against its SHA256.
+	// Files offloaded are kept here and still sent over the network,
+	// unless USBDelete
+	USBLabel        string
+	USBMountDir     string
+	USBPollInterval Duration
+	USBDelete       bool
+	// CardMounts are where a camera's SD card gets mounted when it goes in
+	// the card reader. Each time one is, every file in its DCIM that's new
+	// since it was last seen (by size and mtime, kept per card UUID) is
+	// copied into ExportDir/card-<UUID>/ with the same paths, checked for
+	// size, and sent from there like any other. CardAutoDetect does the
+	// same for any removable media with a DCIM dir, wherever it's mounted.
+	// Nothing's deleted from a card unless CardDelete
+	CardMounts       []string
+	CardAutoDetect   bool
+	CardPollInterval Duration
+	CardDelete       bool
+	// ExpectedCountGrace holds back a flight directory with fewer files
+	// than its expected_count marker (or mission manifest) says, for up to
+	// this long after the marker was written, waiting for stragglers.
+	// After that, or straight away if it's 0, it goes anyway with an
+	// expected_count.incomplete.json in it
+	ExpectedCountGrace Duration
+	// MAVLinkListen, e.g. ":14550", is where to listen for MAVLink from the
+	// autopilot over UDP, for LandedOverMAVLink and BatterySource
+	MAVLinkListen string
+	// LandedFile, FlyingFile and LandedOverMAVLink hold off sending while
+	// the drone is flying: until LandedFile exists, while FlyingFile does,
+	// or until the autopilot says over MAVLink (HEARTBEAT and
+	// EXTENDED_SYS_STATE) that it's disarmed and landed. Whichever are set
+	// must hold for LandedFor
+	LandedFile        string
+	FlyingFile        string
+	LandedOverMAVLink bool
+	LandedFor         Duration
+	// BatterySource is where to read the battery's charge: "sysfs" (a
+	// power_supply dir, BatteryPath), "ina219" (on I2C at BatteryPath and
+	// BatteryI2CAddr, from its voltage between BatteryEmptyVolts and
+	// BatteryFullVolts) or "mavlink" (SYS_STATUS). Below BatteryMin percent
+	// no batch starts, and below BatteryCritical one in progress stops
+	// before its next file, unless the battery is charging
+	BatterySource     string
+	BatteryPath       string
+	BatteryI2CAddr    int
+	BatteryEmptyVolts float64
+	BatteryFullVolts  float64
+	BatteryMin        int
+	BatteryCritical   int
+	// LoadMax, IOUtilMax and CaptureActiveFile hold off a batch while the
+	// capture pipeline is busy writing: the 1 minute load average over
+	// LoadMax, the export dir's device busy more than IOUtilMax percent of
+	// the time (as iostat's %util), or CaptureActiveFile existing. After
+	// LoadMaxDefer of that the batch goes anyway
+	LoadMax           float64
+	IOUtilMax         float64
+	CaptureActiveFile string
+	LoadMaxDefer      Duration
+	// ClockSkewWarn is how far our clock can be from the ground station's
+	// before a warning is logged; zero skips the check. HoldUntilNTPSync
+	// holds off sending while NTP hasn't set our clock, if RenameTemplate
+	// uses {batch_ts}
+	ClockSkewWarn    Duration
+	HoldUntilNTPSync bool
+	// MQTTBroker, e.g. "tcp://10.42.0.1:1883" or "tls://10.42.0.1:8883", is
+	// where status is published as retained JSON under
+	// <MQTTTopicPrefix>/<DeviceID>/watcher/. MQTTCAFile is a CA to trust
+	// for TLS
+	MQTTBroker      string
+	MQTTTopicPrefix string
+	MQTTUsername    string
+	MQTTPassword    string
+	MQTTCAFile      string
+	// MQTTPreviewsPerMinute, if set, streams a thumbnail of each JPEG and
+	// TIFF as it's sent to <MQTTTopicPrefix>/<DeviceID>/preview, at most
+	// that many a minute, so the ground station can watch them come in.
+	// Each is a bare JPEG, MQTTPreviewMaxDim pixels on its longer side and
+	// no bigger than MQTTPreviewMaxBytes. Images sent faster than that are
+	// skipped
+	MQTTPreviewsPerMinute int
+	MQTTPreviewMaxDim     int
+	MQTTPreviewMaxBytes   ByteSize
+	// An incident is opened once AlertFailures cycles in a row have failed
+	// the same way (WiFi, connecting, transferring or cleaning up), and
+	// closed after AlertRecoverAfter successful cycles in a row. It's
+	// logged, put in the status file and sent over MQTT and the webhook
+	AlertFailures     int
+	AlertRecoverAfter int
+	// WebhookURL, if set, gets a POST when an incident starts and ends, and
+	// with WebhookOnBatch after every batch. The body is JSON, or
+	// WebhookTemplate (a Go template) filled in from it
+	WebhookURL      string
+	WebhookTemplate string
+	WebhookOnBatch  bool
+	WebhookTimeout  Duration
+	// LEDChip, e.g. "gpiochip0", and LEDLine are a GPIO line driving a
+	// status LED; leave LEDChip empty when there isn't one. It stays solid
+	// for LEDSuccessHold after a batch and double-blinks once transfers
+	// have been failing for LEDErrorAfter
+	LEDChip        string
+	LEDLine        int
+	LEDActiveLow   bool
+	LEDSuccessHold Duration
+	LEDErrorAfter  Duration
+	// HealthInterfaces limits the -health-addr server to these interfaces.
+	// Its /healthz fails once the main loop hasn't been round for
+	// HealthMaxAge, which has to be longer than the loop ever sleeps
+	HealthInterfaces []string
+	HealthMaxAge     Duration
+	// SyslogAddr, e.g. "udp://10.42.0.1:514" or "tcp://10.42.0.1:514", is a
+	// syslog server to send a copy of the logs to. Up to SyslogBuffer lines
+	// are kept while it can't be reached
+	SyslogAddr   string
+	SyslogBuffer int
+	// HeartbeatFile, if set, has its mtime refreshed at least every
+	// HeartbeatInterval while the watcher is healthy; older than twice that
+	// means it's hung or a transfer has stalled
+	HeartbeatFile     string
+	HeartbeatInterval Duration
+	// Every batch and file sent is recorded in history.db in StateDir, and
+	// kept for HistoryDays; zero turns the history off
+	HistoryDays int
+	// ThroughputCSV, if set, gets a row per batch (and with
+	// ThroughputCSVFiles per file) for working out the link's range. A new
+	// file is started each month, e.g. throughput-2026-10.csv
+	ThroughputCSV      string
+	ThroughputCSVFiles bool
+	// VerifyRemote lists the remote directories each unit went to after
+	// sending it, and only cleans up files found there at their full size
+	VerifyRemote bool
+	// CleanupOn is "verified" to clean up files once they're verified as
+	// sent, or "ack" to leave that to the ground station: after each batch
+	// <batch>.manifest.json is uploaded to its remote dir, and files are
+	// only cleaned up once <batch>.ack.json there accepts them. It's checked
+	// every AckPollInterval; after AckTimeout the batch is kept and counts
+	// as a failed cleanup, or with AckFallback is cleaned up as verified
+	CleanupOn       string
+	AckTimeout      Duration
+	AckPollInterval Duration
+	AckFallback     bool
+	// Order is how files are sent within a priority: "oldest" (the
+	// default), "newest", "smallest" or "largest" first
+	Order string
+	// ArchiveDir, if set, is where transferred files are moved to (under a
+	// per-batch timestamp) instead of being deleted. Batches older than
+	// ArchiveMaxAge or beyond the newest ArchiveKeepBatches are pruned, as
+	// are the oldest ones while the total is over ArchiveMaxBytes
+	ArchiveDir         string
+	ArchiveMaxAge      Duration
+	ArchiveKeepBatches int
+	ArchiveMaxBytes    ByteSize
+	// A file that fails to transfer QuarantineAfter times in a row is moved
+	// out of the way to QuarantineDir (default .quarantine in ExportDir). So
+	// is one that keeps failing once it's older (by mtime) than MaxFileAge,
+	// or it's deleted with QuarantineDelete. Zero turns either rule off
+	QuarantineAfter  int
+	MaxFileAge       Duration
+	QuarantineDir    string
+	QuarantineDelete bool
+	// Once the export filesystem is more than DiskHighWater percent full,
+	// archived files are evicted, oldest first, down to DiskLowWater.
+	// Files that haven't been transferred are only evicted past
+	// DiskHardCeiling, and never if it's zero (the default). A zero
+	// DiskHighWater turns all of this off
+	DiskHighWater   float64
+	DiskLowWater    float64
+	DiskHardCeiling float64
+	// Below DiskWarnFree free space the watcher logs a warning; below
+	// DiskCriticalFree it also stops pausing between batches to drain the
+	// export dir faster. Either is a percentage ("10%") or a byte count
+	// (500000000 or "500M")
+	DiskWarnFree     Threshold
+	DiskCriticalFree Threshold
+	// RemoteHost is a hostname, IPv4 or IPv6 address, optionally with a port
+	// ("[fd00::1]:2222"); SSHPort is used when it has none
+	RemoteHost     string
+	SSHPort        int
+	RemoteUser     string
+	RemotePassword string
+	// IngestDir is where files go on the remote. It can use {device},
+	// {yyyy}, {mm} and {dd} (the batch's UTC start), {batch} and {session}
+	// (the flight directory or session), filled in per batch, and the
+	// directories are made as needed
+	IngestDir string
+	// StallTimeout aborts a transfer when no bytes move for this long
+	StallTimeout Duration
+	// HostKeyFingerprint pins the ground station's SSH host key, in the
+	// "SHA256:..." form printed by `ssh-keygen -lf`. Empty accepts any key
+	HostKeyFingerprint string
+
+	// Mode is "client" (join one of Networks) or "hotspot" (the drone is the
+	// AP and waits for RemoteHost to join it)
+	Mode string
+	// HotspotSSID/HotspotPSK, in hotspot mode, bring up a NetworkManager
+	// hotspot at startup. Leave empty if the hotspot is managed elsewhere
+	HotspotSSID string
+	HotspotPSK  string
+	// Direction is "push" to send ExportDir here to IngestDir on RemoteHost,
+	// or "pull" to run on the ground station and fetch from the drone
+	// instead: RemoteHost is then the drone, ExportDir the dir on it to
+	// fetch from and IngestDir where files go here. ArchiveDir is on the
+	// drone too. Networks aren't used
+	Direction string
+	// WifiBackend is "dbus" (NetworkManager's D-Bus API), "nmcli",
+	// "wpa_supplicant", or empty to pick whichever is available
+	WifiBackend string
+	// WifiInterface is the wireless interface, used by the wpa_supplicant
+	// backend
+	WifiInterface string
+	// Networks are the ground station APs in priority order. WiFi management
+	// is skipped entirely when this is empty
+	Networks []Network
+	// MinSignal is the lowest nmcli SIGNAL (0-100) we're willing to connect at
+	MinSignal int
+	// AbortSignal is the lower watermark; a transfer in flight is cancelled if
+	// the link drops below it. Zero disables the check
+	AbortSignal         int
+	SignalCheckInterval Duration
+	// AllowOpenNetworks permits joining networks without WPA2/WPA3. Off by
+	// default since credentials would then cross an unencrypted link
+	AllowOpenNetworks bool
+	// DiscoverMDNS looks the ground station up as _agrodrone-ingest._tcp over
+	// mDNS after connecting, falling back to RemoteHost/SSHPort if nothing
+	// answers within DiscoveryTimeout
+	DiscoverMDNS     bool
+	DiscoveryTimeout Duration
+	// ScanSubnet, when the ground station is unreachable at its configured
+	// address, probes ScanInterface's /24 for SSH servers (at most ScanRate
+	// per second) and picks the one presenting HostKeyFingerprint
+	ScanSubnet    bool
+	ScanInterface string
+	ScanRate      int
+	// PreferredInterfaces are tried in order when checking whether RemoteHost
+	// is already reachable (e.g. over a bench Ethernet cable); if it is, WiFi
+	// management is skipped for that cycle. Empty means any interface
+	PreferredInterfaces []string
+	// LeaseTimeout is how long to wait after associating for a DHCP lease
+	// and a route to the ground station before giving up on the network
+	LeaseTimeout Duration
+	// LinkStatsInterval is how often WifiInterface's signal, bitrate and
+	// retries are sampled during a transfer. Zero disables sampling
+	LinkStatsInterval Duration
+	// DisconnectAfterBatch takes the WiFi link down after a batch has been
+	// transferred and cleaned up, to save power; it's brought back up once
+	// there are new files
+	DisconnectAfterBatch bool
+	// ScanCacheTTL is how long a WiFi scan is reused while it shows one of
+	// our networks
+	ScanCacheTTL Duration
+	// HiddenAttempts bounds how many times a hidden network is tried per scan
+	HiddenAttempts int
+	// Failed connection attempts back off exponentially from WifiBackoffBase
+	// up to WifiBackoffMax
+	WifiBackoffBase Duration
+	WifiBackoffMax  Duration
+}
+
+// Network is a ground station AP and the host to transfer to once joined.
+// Host takes the same forms as Config.RemoteHost. Host and IngestDir fall back to Config.RemoteHost and Config.IngestDir
+type Network struct {
+	SSID      string
+	PSK       string
+	Host      string
+	IngestDir string
+	// BSSID pins the network to one AP's MAC address, for when several APs
+	// broadcast the same SSID. Unpinned, the strongest one is preferred
+	BSSID string
+	// Subnet, if set (e.g. "10.42.0.0/24"), is where our DHCP address must
+	// land before the link counts as up
+	Subnet string
+	// Hidden networks don't broadcast their SSID, so they are connected to
+	// even when they don't show up in a scan
+	Hidden bool
+}
+
+// target returns the host:port and ingest dir to use when connected to n. A
+// nil n (no WiFi management) uses the top-level config. With Fleet the
+// ingest dir is this drone's own dir inside it, unless it already has
+// {device} in it. Its variables are filled in per batch
+func (cfg Config) target(n *Network) (addr, ingestDir string, err error) {
+	host, ingestDir := cfg.RemoteHost, cfg.IngestDir
+	if n != nil && n.Host != "" {
+		host = n.Host
+	}
+	if n != nil && n.IngestDir != "" {
+		ingestDir = n.IngestDir
+	}
+	if cfg.Fleet && !strings.Contains(ingestDir, "{device}") {
+		ingestDir = path.Join(ingestDir, cfg.DeviceID)
+	}
+	addr, err = hostAddr(host, cfg.SSHPort)
+	return addr, ingestDir, err
+}
+
+// Duration lets durations be written as "30s" or "5m" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// ByteSize is a size in bytes, written as a plain number or with a unit:
+// "4KiB", "500M" and "2GiB" are powers of 1024, "4KB" and "2GB" of 1000
+type ByteSize uint64
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n uint64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be like \"4KiB\" or a byte count: %w", err)
+	}
+	v, err := parseByteSize(s)
+	*b = v
+	return err
+}
+
+// byteUnits are the suffixes parseByteSize understands, longest first so
+// "KiB" isn't taken for "B"
+var byteUnits = []struct {
+	suffix string
+	mult   uint64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseByteSize reads a size like "2GiB" or "512"
+func parseByteSize(s string) (ByteSize, error) {
+	num, mult := strings.TrimSpace(s), uint64(1)
+	for _, u := range byteUnits {
+		if v, ok := strings.CutSuffix(num, u.suffix); ok {
+			num, mult = strings.TrimSpace(v), u.mult
+			break
+		}
+	}
+	v, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	if v > math.MaxUint64/mult {
+		return 0, fmt.Errorf("size %q is too big", s)
+	}
+	return ByteSize(v * mult), nil
+}
+
+// Threshold is an amount of free disk space, either as a percentage of the
+// filesystem or in bytes. It's written as "10%", a size such as "500MiB"
+// (see ByteSize) or a plain number of bytes
+type Threshold struct {
+	Percent float64
+	Bytes   uint64
+}
+
+func (t *Threshold) UnmarshalJSON(b []byte) error {
+	var n uint64
+	if err := json.Unmarshal(b, &n); err == nil {
+		*t = Threshold{Bytes: n}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("threshold must be like \"10%%\", \"500MiB\" or a byte count: %w", err)
+	}
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 || v > 100 {
+			return fmt.Errorf("bad percentage %q", s)
+		}
+		*t = Threshold{Percent: v}
+		return nil
+	}
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*t = Threshold{Bytes: uint64(v)}
+	return nil
+}
+
+func (t Threshold) MarshalJSON() ([]byte, error) {
+	if t.Bytes > 0 {
+		return json.Marshal(t.Bytes)
+	}
+	return json.Marshal(strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%")
+}
+
+// below reports whether u has less free space than t. A zero threshold is
+// never crossed
+func (t Threshold) below(u diskUsage) bool {
+	if t.Bytes > 0 {
+		return u.FreeBytes < t.Bytes
+	}
+	return t.Percent > 0 && u.freePercent() < t.Percent
+}
+
+func defaultConfig() Config {
+	remoteUser := "sr-design"
+	return Config{
+		Mode:                modeClient,
+		Direction:           directionPush,
+		StateDir:            filepath.Join(os.Getenv("HOME"), ".agrodrone-watcher"),
+		ExportDir:           filepath.Join(os.Getenv("HOME"), "export"),
+		Watch:               watchFsnotify,
+		WatchDebounce:       Duration{2 * time.Second},
+		WatchSafetyPoll:     Duration{10 * time.Minute},
+		PollInterval:        Duration{5 * time.Second},
+		Trigger:             triggerAll,
+		MissionTimeout:      Duration{30 * time.Minute},
+		QuiescePeriod:       Duration{5 * time.Second},
+		CheckOpenFiles:      true,
+		BatchSettle:         Duration{15 * time.Second},
+		BatchSettleMax:      Duration{2 * time.Minute},
+		BatchPause:          Duration{5 * time.Second},
+		HookAttempts:        3,
+		HistoryDays:         90,
+		MQTTTopicPrefix:     "agrodrone",
+		MQTTPreviewMaxDim:   320,
+		MQTTPreviewMaxBytes: 50 << 10,
+		AlertFailures:       3,
+		AlertRecoverAfter:   2,
+		WebhookTimeout:      Duration{10 * time.Second},
+		LEDSuccessHold:      Duration{3 * time.Minute},
+		LEDErrorAfter:       Duration{2 * time.Minute},
+		HealthMaxAge:        Duration{15 * time.Minute},
+		HeartbeatInterval:   Duration{time.Minute},
+		ClockSkewWarn:       Duration{10 * time.Second},
+		SyslogBuffer:        1000,
+		PreviewMaxDim:       1024,
+		PreviewQuality:      60,
+		PreviewWorkers:      1,
+		RecompressQuality:   85,
+		RecompressWorkers:   1,
+		SegmentSize:         256 << 20,
+		SegmentExtensions:   []string{".mp4", ".h264"},
+		InboxConflict:       conflictRemoteWins,
+		USBPollInterval:     Duration{2 * time.Second},
+		CardPollInterval:    Duration{2 * time.Second},
+		CaptureGrace:        Duration{10 * time.Minute},
+		LandedFor:           Duration{10 * time.Second},
+		BatteryI2CAddr:      0x40,
+		BatteryMin:          30,
+		LoadMaxDefer:        Duration{10 * time.Minute},
+		BatteryCritical:     15,
+		HookTimeout:         Duration{5 * time.Minute},
+		Order:               orderOldest,
+		CleanupOn:           cleanupVerified,
+		AckTimeout:          Duration{10 * time.Minute},
+		AckPollInterval:     Duration{5 * time.Second},
+		Ignore:              watch.DefaultIgnore,
+		ArchiveMaxAge:       Duration{7 * 24 * time.Hour},
+		ArchiveMaxBytes:     2 << 30,
+		QuarantineAfter:     5,
+		MaxFileAge:          Duration{72 * time.Hour},
+		DiskHighWater:       90,
+		DiskLowWater:        80,
+		DiskWarnFree:        Threshold{Percent: 15},
+		DiskCriticalFree:    Threshold{Percent: 5},
+		RemoteHost:          "10.193.141.194",
+		SSHPort:             22,
+		RemoteUser:          remoteUser,
+		RemotePassword:      "EC463",
+		IngestDir:           filepath.Join("/", "home", remoteUser, "ingest"),
+		StallTimeout:        Duration{30 * time.Second},
+		MinSignal:           40,
+		AbortSignal:         20,
+		SignalCheckInterval: Duration{10 * time.Second},
+		HiddenAttempts:      3,
+		ScanCacheTTL:        Duration{30 * time.Second},
+		DiscoveryTimeout:    Duration{3 * time.Second},
+		WifiInterface:       "wlan0",
+		LeaseTimeout:        Duration{20 * time.Second},
+		LinkStatsInterval:   Duration{5 * time.Second},
+		ScanInterface:       "wlan0",
+		ScanRate:            20,
+		WifiBackoffBase:     Duration{5 * time.Second},
+		WifiBackoffMax:      Duration{5 * time.Minute},
+	}
+}
+
+// managesWifi reports whether we join the ground station's network ourselves
+func (cfg Config) managesWifi() bool {
+	return cfg.Mode == modeClient && len(cfg.Networks) > 0
+}
+
+// statusPath is where the status file lives
+func (cfg Config) statusPath() string {
+	return filepath.Join(cfg.StateDir, "status.json")
+}
+
+// quarantinePath is where stuck files are moved to
+func (cfg Config) quarantinePath() string {
+	if cfg.QuarantineDir != "" {
+		return cfg.QuarantineDir
+	}
+	return filepath.Join(cfg.ExportDir, ".quarantine")
+}
+
+// historyPath is the transfer history database
+func (cfg Config) historyPath() string {
+	return filepath.Join(cfg.StateDir, "history.db")
+}
+
+// manifestPath is where the manifest for batch is written
+func (cfg Config) manifestPath(batch string) string {
+	return filepath.Join(cfg.StateDir, "manifests", batch+".json")
+}
+
+// sessionPath is where the last flight session sent is remembered
+func (cfg Config) sessionPath() string {
+	return filepath.Join(cfg.StateDir, "session.json")
+}
+
+// indexPath is where the EXIF index for batch is kept
+func (cfg Config) indexPath(batch string) string {
+	return filepath.Join(cfg.StateDir, "manifests", batch+".index.json")
+}
+
+// previewPath is where previews are made before they're sent
+func (cfg Config) previewPath() string {
+	return filepath.Join(cfg.StateDir, "previews")
+}
+
+// recompressPath is where recompressed JPEGs wait to be sent
+func (cfg Config) recompressPath() string {
+	return filepath.Join(cfg.StateDir, "recompressed")
+}
+
+// sentPreviewsPath is where the originals whose previews were sent are kept
+func (cfg Config) sentPreviewsPath() string {
+	return filepath.Join(cfg.StateDir, "previews.json")
+}
+
+// inboxPath is where what was last fetched from the outbox is kept
+func (cfg Config) inboxPath() string {
+	return filepath.Join(cfg.StateDir, "inbox.json")
+}
+
+// cardSeenPath is where the files already copied off the card with
+// UUID id are kept
+func (cfg Config) cardSeenPath(id string) string {
+	return filepath.Join(cfg.StateDir, "cards", id+".json")
+}
+
+// journalPath is where per-file transfer states are logged
+func (cfg Config) journalPath() string {
+	return filepath.Join(cfg.StateDir, "journal.jsonl")
+}
+
+// dedupPath is where the hashes of sent files are kept
+func (cfg Config) dedupPath() string {
+	return filepath.Join(cfg.StateDir, "hashes.json")
+}
+
+// failuresPath is where per-file failure counts are kept
+func (cfg Config) failuresPath() string {
+	return filepath.Join(cfg.StateDir, "failures.json")
+}
+
+// auditPath is where every local deletion is recorded before it happens
+func (cfg Config) auditPath() string {
+	return filepath.Join(cfg.StateDir, "deleted.log")
+}
+
+// loadConfig reads the JSON config at path on top of the defaults. An empty
+// path just returns the defaults
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		cfg.DeviceID, _ = os.Hostname()
+		return cfg, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("read config: %w", err)
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse config %q: %w", path, err)
+	}
+	// one drone on its own can go by its hostname; a fleet can't
+	if cfg.DeviceID == "" && !cfg.Fleet {
+		cfg.DeviceID, _ = os.Hostname()
+	}
+	return cfg, cfg.validate()
+}
+
+// deviceIDPattern is what a DeviceID can look like; it goes in remote paths
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// validate catches config mistakes at startup rather than mid-flight
+func (cfg Config) validate() error {
+	if cfg.Mode != modeClient && cfg.Mode != modeHotspot {
+		return fmt.Errorf("Mode must be %q or %q, not %q", modeClient, modeHotspot, cfg.Mode)
+	}
+	if cfg.Direction != directionPush && cfg.Direction != directionPull {
+		return fmt.Errorf("Direction must be %q or %q, not %q", directionPush, directionPull, cfg.Direction)
+	}
+	if cfg.Direction == directionPull && len(cfg.Networks) > 0 {
+		return fmt.Errorf("Networks can't be used with Direction %q; the drone comes to the ground station", directionPull)
+	}
+	if cfg.Direction == directionPull && templated(cfg.IngestDir) {
+		return fmt.Errorf("IngestDir can't be a template with Direction %q", directionPull)
+	}
+	if _, _, err := cfg.target(nil); err != nil {
+		return fmt.Errorf("RemoteHost: %w", err)
+	}
+	for i := range cfg.Networks {
+		if _, _, err := cfg.target(&cfg.Networks[i]); err != nil {
+			return fmt.Errorf("network %q Host: %w", cfg.Networks[i].SSID, err)
+		}
+	}
+	if err := checkIngestDir(cfg.IngestDir); err != nil {
+		return fmt.Errorf("IngestDir: %w", err)
+	}
+	for _, n := range cfg.Networks {
+		if n.IngestDir == "" {
+			continue
+		}
+		if err := checkIngestDir(n.IngestDir); err != nil {
+			return fmt.Errorf("network %q IngestDir: %w", n.SSID, err)
+		}
+	}
+	switch {
+	case cfg.DeviceID == "" && cfg.Fleet:
+		return fmt.Errorf("Fleet needs DeviceID set, to tell this drone's uploads apart")
+	case cfg.DeviceID == "":
+		return fmt.Errorf("DeviceID isn't set and the hostname couldn't be read")
+	case !deviceIDPattern.MatchString(cfg.DeviceID):
+		return fmt.Errorf("DeviceID can only have letters, digits, '.', '_' and '-', and at most 64 of them, not %q", cfg.DeviceID)
+	}
+	if cfg.Watch != watchFsnotify && cfg.Watch != watchPoll {
+		return fmt.Errorf("Watch must be %q or %q, not %q", watchFsnotify, watchPoll, cfg.Watch)
+	}
+	if cfg.CleanupOn != cleanupVerified && cfg.CleanupOn != cleanupAck {
+		return fmt.Errorf("CleanupOn must be %q or %q, not %q", cleanupVerified, cleanupAck, cfg.CleanupOn)
+	}
+	if cfg.CleanupOn == cleanupAck && (cfg.AckTimeout.Duration <= 0 || cfg.AckPollInterval.Duration <= 0) {
+		return fmt.Errorf("AckTimeout and AckPollInterval must be positive")
+	}
+	if cfg.Trigger != triggerAll && cfg.Trigger != triggerMission {
+		return fmt.Errorf("Trigger must be %q or %q, not %q", triggerAll, triggerMission, cfg.Trigger)
+	}
+	if cfg.Trigger == triggerMission && cfg.MissionTimeout.Duration <= 0 {
+		return fmt.Errorf("MissionTimeout must be positive")
+	}
+	for _, pattern := range append(append([]string(nil), cfg.Ignore...), cfg.ExtraIgnore...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("ignore pattern %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range append(append([]string(nil), cfg.Include...), cfg.Exclude...) {
+		if !doublestar.ValidatePattern(pattern) {
+			return fmt.Errorf("bad include/exclude pattern %q", pattern)
+		}
+	}
+	for _, g := range cfg.Priorities {
+		for _, pattern := range g.Patterns {
+			if !doublestar.ValidatePattern(pattern) {
+				return fmt.Errorf("bad pattern %q in priority group %q", pattern, g.Name)
+			}
+		}
+	}
+	switch cfg.Order {
+	case orderOldest, orderNewest, orderSmallest, orderLargest:
+	default:
+		return fmt.Errorf("Order must be %q, %q, %q or %q, not %q",
+			orderOldest, orderNewest, orderSmallest, orderLargest, cfg.Order)
+	}
+	if (len(cfg.PostTransferCommand) > 0 || cfg.PostTransferRemote != "") && cfg.HookAttempts < 1 {
+		return fmt.Errorf("HookAttempts must be at least 1")
+	}
+	if strings.Contains(cfg.RenameTemplate, "/") {
+		return fmt.Errorf("RenameTemplate can only change the file name, not its directory")
+	}
+	if t := cfg.RemoteNameTemplate; t != "" {
+		if cfg.RenameTemplate != "" {
+			return fmt.Errorf("RemoteNameTemplate and RenameTemplate can't both be set")
+		}
+		if strings.HasPrefix(t, "/") || slices.Contains(strings.Split(t, "/"), "..") {
+			return fmt.Errorf("RemoteNameTemplate must stay inside the ingest dir")
+		}
+	}
+	if cfg.AlertFailures < 1 || cfg.AlertRecoverAfter < 1 {
+		return fmt.Errorf("AlertFailures and AlertRecoverAfter must be at least 1")
+	}
+	if cfg.MQTTPreviewsPerMinute < 0 {
+		return fmt.Errorf("MQTTPreviewsPerMinute can't be negative")
+	}
+	if cfg.MQTTPreviewsPerMinute > 0 {
+		if cfg.MQTTPreviewMaxDim < 16 {
+			return fmt.Errorf("MQTTPreviewMaxDim must be at least 16")
+		}
+		if cfg.MQTTPreviewMaxBytes < 1<<10 {
+			return fmt.Errorf("MQTTPreviewMaxBytes must be at least 1KiB")
+		}
+	}
+	if cfg.Previews {
+		if cfg.PreviewMaxDim < 16 {
+			return fmt.Errorf("PreviewMaxDim must be at least 16")
+		}
+		if cfg.PreviewQuality < 1 || cfg.PreviewQuality > 100 {
+			return fmt.Errorf("PreviewQuality must be between 1 and 100")
+		}
+		if cfg.PreviewWorkers < 1 {
+			return fmt.Errorf("PreviewWorkers must be at least 1")
+		}
+	}
+	if cfg.RecompressOver > 0 {
+		if cfg.RecompressQuality < 1 || cfg.RecompressQuality > 100 {
+			return fmt.Errorf("RecompressQuality must be between 1 and 100")
+		}
+		if cfg.RecompressWorkers < 1 {
+			return fmt.Errorf("RecompressWorkers must be at least 1")
+		}
+	}
+	if cfg.SegmentOver > 0 {
+		if cfg.SegmentSize < 1<<20 || cfg.SegmentSize >= cfg.SegmentOver {
+			return fmt.Errorf("SegmentSize must be at least 1MiB and smaller than SegmentOver")
+		}
+		if len(cfg.SegmentExtensions) == 0 {
+			return fmt.Errorf("SegmentExtensions must list at least one extension")
+		}
+	}
+	if cfg.OutboxDir != "" && cfg.InboxDir == "" {
+		return fmt.Errorf("OutboxDir needs InboxDir")
+	}
+	if cfg.InboxConflict != conflictRemoteWins && cfg.InboxConflict != conflictKeepBoth {
+		return fmt.Errorf("InboxConflict must be %q or %q, not %q", conflictRemoteWins, conflictKeepBoth, cfg.InboxConflict)
+	}
+	if cfg.USBLabel != "" {
+		if strings.Contains(cfg.USBLabel, "/") {
+			return fmt.Errorf("USBLabel can't contain /, not %q", cfg.USBLabel)
+		}
+		if cfg.Direction == directionPull {
+			return fmt.Errorf("USBLabel can't be used with Direction %q", directionPull)
+		}
+		if cfg.USBPollInterval.Duration <= 0 {
+			return fmt.Errorf("USBPollInterval must be positive")
+		}
+	}
+	if (len(cfg.CardMounts) > 0 || cfg.CardAutoDetect) && cfg.Direction == directionPull {
+		return fmt.Errorf("CardMounts and CardAutoDetect can't be used with Direction %q", directionPull)
+	}
+	if cfg.ExpectedCountGrace.Duration < 0 {
+		return fmt.Errorf("ExpectedCountGrace can't be negative")
+	}
+	if cfg.CardPollInterval.Duration <= 0 {
+		return fmt.Errorf("CardPollInterval must be positive")
+	}
+	if cfg.MAVLinkListen != "" {
+		if _, _, err := net.SplitHostPort(cfg.MAVLinkListen); err != nil {
+			return fmt.Errorf("MAVLinkListen must look like :14550, not %q", cfg.MAVLinkListen)
+		}
+	}
+	if cfg.LandedOverMAVLink && cfg.MAVLinkListen == "" {
+		return fmt.Errorf("LandedOverMAVLink needs MAVLinkListen")
+	}
+	switch cfg.BatterySource {
+	case "", batterySysfs:
+	case batteryINA219:
+		if cfg.BatteryEmptyVolts <= 0 || cfg.BatteryFullVolts <= cfg.BatteryEmptyVolts {
+			return fmt.Errorf("BatterySource %q needs BatteryEmptyVolts and a higher BatteryFullVolts", batteryINA219)
+		}
+	case batteryMAVLink:
+		if cfg.MAVLinkListen == "" {
+			return fmt.Errorf("BatterySource %q needs MAVLinkListen", batteryMAVLink)
+		}
+	default:
+		return fmt.Errorf("BatterySource must be %q, %q or %q, not %q", batterySysfs, batteryINA219, batteryMAVLink, cfg.BatterySource)
+	}
+	if cfg.LoadMax < 0 || cfg.IOUtilMax < 0 || cfg.IOUtilMax > 100 {
+		return fmt.Errorf("LoadMax can't be negative and IOUtilMax must be a percentage")
+	}
+	if cfg.LoadMaxDefer.Duration <= 0 {
+		return fmt.Errorf("LoadMaxDefer must be positive")
+	}
+	if cfg.BatteryCritical < 0 || cfg.BatteryCritical > cfg.BatteryMin || cfg.BatteryMin > 100 {
+		return fmt.Errorf("BatteryCritical and BatteryMin must be percentages, BatteryCritical no more than BatteryMin")
+	}
+	if cfg.RequireGeoTIFF && !cfg.ValidateImages {
+		return fmt.Errorf("RequireGeoTIFF needs ValidateImages")
+	}
+	if cfg.CapturePattern != "" {
+		re, err := regexp.Compile(cfg.CapturePattern)
+		if err != nil {
+			return fmt.Errorf("CapturePattern: %w", err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("CapturePattern needs a group for the capture key")
+		}
+		if cfg.CaptureSetSize < 2 {
+			return fmt.Errorf("CaptureSetSize must be at least 2")
+		}
+	}
+	if cfg.SyslogAddr != "" {
+		u, err := url.Parse(cfg.SyslogAddr)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Port() == "" {
+			return fmt.Errorf("SyslogAddr must look like udp://host:514 or tcp://host:514, not %q", cfg.SyslogAddr)
+		}
+		if cfg.SyslogBuffer < 1 {
+			return fmt.Errorf("SyslogBuffer must be at least 1")
+		}
+	}
+	if cfg.HeartbeatInterval.Duration < time.Second {
+		return fmt.Errorf("HeartbeatInterval must be at least 1s")
+	}
+	if cfg.LEDChip != "" && cfg.LEDLine < 0 {
+		return fmt.Errorf("LEDLine can't be negative")
+	}
+	if cfg.MaxFilesPerBatch < 0 {
+		return fmt.Errorf("MaxFilesPerBatch can't be negative")
+	}
+	if cfg.MaxFileSize > 0 && cfg.MinFileSize > cfg.MaxFileSize {
+		return fmt.Errorf("MinFileSize %d is bigger than MaxFileSize %d", cfg.MinFileSize, cfg.MaxFileSize)
+	}
+	if cfg.DiskHighWater > 0 && !(cfg.DiskLowWater < cfg.DiskHighWater && (cfg.DiskHardCeiling == 0 || cfg.DiskHighWater <= cfg.DiskHardCeiling)) {
+		return fmt.Errorf("need DiskLowWater < DiskHighWater <= DiskHardCeiling (if set), got %v, %v, %v",
+			cfg.DiskLowWater, cfg.DiskHighWater, cfg.DiskHardCeiling)
+	}
+	return nil
+}
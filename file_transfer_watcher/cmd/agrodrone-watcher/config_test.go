@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestArchiveMaxBytesTakesUnits(t *testing.T) {
+	for in, want := range map[string]ByteSize{
+		`"500MiB"`: 500 << 20,
+		`"2GB"`:    2e9,
+		`1048576`:  1 << 20,
+	} {
+		cfg := defaultConfig()
+		if err := json.Unmarshal([]byte(`{"ArchiveMaxBytes": `+in+`}`), &cfg); err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		if cfg.ArchiveMaxBytes != want {
+			t.Errorf("%s: got %d, want %d", in, cfg.ArchiveMaxBytes, want)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want ByteSize
+		ok   bool
+	}{
+		{"512", 512, true},
+		{"4KiB", 4 << 10, true},
+		{" 2 GB ", 2e9, true},
+		{"16EiB", 0, false}, // not a unit we know
+		{"16777216TiB", 0, false},
+		{"18446744073709551615", 1<<64 - 1, true},
+		{"18446744073709551615B", 1<<64 - 1, true},
+		{"18446744073709551615K", 0, false},
+		{"-1", 0, false},
+		{"lots", 0, false},
+	} {
+		got, err := parseByteSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v", tt.in, got, err)
+		}
+	}
+}
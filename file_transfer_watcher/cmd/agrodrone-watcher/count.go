@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expectedCountName is the marker the flight stack can leave in a flight
+// directory saying how many files the flight captured, e.g. "412"
+const expectedCountName = "expected_count"
+
+// incompleteName is written next to the marker when a flight goes with
+// fewer files than that, so the ground station knows
+const incompleteName = "expected_count.incomplete.json"
+
+// flightCount is how many files a flight directory was expected to have
+// against how many it went with
+type flightCount struct {
+	Flight   string
+	Expected int
+	Found    int
+	// Incomplete is set when it went with fewer
+	Incomplete bool `json:",omitempty"`
+}
+
+// countMarker reports whether the file at p is one of the files saying
+// what a flight should have, rather than one of the flight's own
+func countMarker(p string) bool {
+	name := filepath.Base(p)
+	return name == expectedCountName || name == incompleteName || isMissionManifest(name) || strings.HasSuffix(name, discrepanciesExt)
+}
+
+// expectedCount is how many files the flight directory u should have, and
+// when that was written: from its expected_count marker, or failing that
+// the number of files its mission manifest lists
+func expectedCount(cfg *Config, u batchUnit) (int, time.Time, bool) {
+	dir := filepath.Join(cfg.ExportDir, u.Name)
+	marker := filepath.Join(dir, expectedCountName)
+	if info, err := os.Stat(marker); err == nil {
+		b, err := os.ReadFile(marker)
+		if err != nil {
+			slog.Error("Failed to read file count", "file", marker, "error", err)
+			return 0, time.Time{}, false
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil || n < 0 {
+			slog.Warn("File count isn't a number; not checking it", "file", marker, "content", strings.TrimSpace(string(b)), "unit", u.Name)
+			return 0, time.Time{}, false
+		}
+		return n, info.ModTime(), true
+	}
+	for _, f := range u.Files {
+		if filepath.Dir(f.Path) != dir || !isMissionManifest(filepath.Base(f.Path)) {
+			continue
+		}
+		if man, err := readMissionManifest(f.Path); err == nil {
+			return len(man.Files), f.ModTime, true
+		}
+	}
+	return 0, time.Time{}, false
+}
+
+// checkCounts compares each flight directory in units that says how many
+// files it should have with how many are ready to go. One that's short is
+// held back for ExpectedCountGrace after its count was written, waiting
+// for stragglers, and then goes anyway with an incomplete marker. Every
+// flight checked has its count set
+func checkCounts(cfg *Config, units []batchUnit) []batchUnit {
+	var ready []batchUnit
+	for _, u := range units {
+		if u.Name == "" || u.Session {
+			ready = append(ready, u)
+			continue
+		}
+		expected, at, ok := expectedCount(cfg, u)
+		if !ok {
+			ready = append(ready, u)
+			continue
+		}
+		// a marker left from a try that didn't get through is made again
+		// if it's still short
+		stale := filepath.Join(cfg.ExportDir, u.Name, incompleteName)
+		if i := slices.IndexFunc(u.Files, func(f batchFile) bool { return f.Path == stale }); i >= 0 {
+			u.Files = slices.Delete(slices.Clone(u.Files), i, i+1)
+		}
+		os.Remove(stale)
+		c := flightCount{Flight: u.Name, Expected: expected}
+		for _, f := range u.Files {
+			if !countMarker(f.Path) {
+				c.Found++
+			}
+		}
+		if c.Found < expected && time.Since(at) < cfg.ExpectedCountGrace.Duration {
+			slog.Debug("Waiting for unit", "unit", u.Name, "files", c.Found, "expected", expected)
+			continue
+		}
+		if c.Found != expected {
+			slog.Warn("Unit doesn't have the files expected; sending it anyway", "unit", u.Name, "files", c.Found, "expected", expected)
+		}
+		if c.Found < expected {
+			c.Incomplete = true
+			u.Files = markIncomplete(cfg, u, c)
+		}
+		u.Count = &c
+		ready = append(ready, u)
+	}
+	return ready
+}
+
+// markIncomplete writes the incomplete marker into u's directory and
+// returns u's files with it added
+func markIncomplete(cfg *Config, u batchUnit, c flightCount) []batchFile {
+	p := filepath.Join(cfg.ExportDir, u.Name, incompleteName)
+	if err := writeFileAtomic(p, c); err != nil {
+		slog.Error("Failed to write incomplete marker", "file", p, "error", err)
+		return u.Files
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return u.Files
+	}
+	return append(u.Files, batchFile{Path: p, Size: info.Size(), ModTime: info.ModTime()})
+}
+
+// countMismatches lists the flights in b whose counts didn't match
+func countMismatches(b []batchUnit) []flightCount {
+	var off []flightCount
+	for _, c := range unitCounts(b) {
+		if c.Found != c.Expected {
+			off = append(off, c)
+		}
+	}
+	return off
+}
+
+// unitCounts lists the counts of the flights in b that have one
+func unitCounts(b []batchUnit) []flightCount {
+	var counts []flightCount
+	seen := map[string]bool{}
+	for _, u := range b {
+		if u.Count != nil && !seen[u.Name] {
+			seen[u.Name] = true
+			counts = append(counts, *u.Count)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dedupEntry is where a file with a given hash was sent, and when
+type dedupEntry struct {
+	RemotePath string
+	Size       int64
+	At         time.Time
+}
+
+// dedupIndex remembers the SHA256 of everything sent in the last window,
+// so a file the capture software re-exports under a new name isn't
+// uploaded again; with remoteCopy it's copied on the remote instead. It's
+// kept as JSON in StateDir
+type dedupIndex struct {
+	path       string
+	window     time.Duration
+	remoteCopy bool
+	entries    map[string]dedupEntry
+}
+
+// loadDedupIndex reads the index, or returns nil if deduplication is off
+func loadDedupIndex(cfg *Config) *dedupIndex {
+	if cfg.DedupWindow.Duration <= 0 {
+		return nil
+	}
+	d := &dedupIndex{
+		path:       cfg.dedupPath(),
+		window:     cfg.DedupWindow.Duration,
+		remoteCopy: cfg.DedupRemoteCopy,
+		entries:    map[string]dedupEntry{},
+	}
+	b, err := os.ReadFile(d.path)
+	if err == nil {
+		err = json.Unmarshal(b, &d.entries)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("Failed to read dedup index, starting afresh", "file", d.path, "error", err)
+	}
+	return d
+}
+
+// mayHave reports whether anything of size was sent in the window, which
+// is the only time a file is worth hashing before it's sent
+func (d *dedupIndex) mayHave(size int64) bool {
+	for _, e := range d.entries {
+		if e.Size == size && time.Since(e.At) <= d.window {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns where a file hashing to sum went, if it was in the window
+func (d *dedupIndex) lookup(sum string) (dedupEntry, bool) {
+	e, ok := d.entries[sum]
+	if !ok || time.Since(e.At) > d.window {
+		return dedupEntry{}, false
+	}
+	return e, true
+}
+
+func (d *dedupIndex) add(sum, remotePath string, size int64) {
+	d.entries[sum] = dedupEntry{RemotePath: remotePath, Size: size, At: time.Now()}
+}
+
+// forget drops whatever was recorded as sent to remotePath
+func (d *dedupIndex) forget(remotePath string) {
+	for sum, e := range d.entries {
+		if e.RemotePath == remotePath {
+			delete(d.entries, sum)
+		}
+	}
+}
+
+// save drops entries older than the window and writes the index out
+func (d *dedupIndex) save() {
+	for sum, e := range d.entries {
+		if time.Since(e.At) > d.window {
+			delete(d.entries, sum)
+		}
+	}
+	if err := writeFileAtomic(d.path, d.entries); err != nil {
+		slog.Error("Failed to write dedup index", "file", d.path, "error", err)
+	}
+}
+
+// hashFile returns the hex SHA256 of f, leaving it rewound to the start
+func hashFile(f *os.File) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashPath returns the hex SHA256 of the file at p
+func hashPath(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashFile(f)
+}
+
+// remoteCopy copies src to dst on the remote, which is much cheaper than
+// sending the same bytes again
+func remoteCopy(client *ssh.Client, src, dst string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	dir := dst[:max(strings.LastIndex(dst, "/"), 0)]
+	cmd := "mkdir -p " + shellQuote(dir) + " && cp -- " + shellQuote(src) + " " + shellQuote(dst)
+	if out, err := session.CombinedOutput(cmd); err != nil {
+		return errors.New(strings.TrimSpace(string(out)) + ": " + err.Error())
+	}
+	return nil
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
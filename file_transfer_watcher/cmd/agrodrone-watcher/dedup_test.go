@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sameContent writes names under dir all holding the same bytes, and
+// returns them as a batch
+func sameContent(t *testing.T, dir string, names ...string) []batchFile {
+	t.Helper()
+	var files []batchFile
+	for _, n := range names {
+		p := filepath.Join(dir, n)
+		if err := os.WriteFile(p, []byte("the same image"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, batchFile{Path: p, Size: 14})
+	}
+	return files
+}
+
+func TestDedupWithoutRemoteCopySkipsDuplicates(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DedupWindow = Duration{time.Hour}
+	fake := fakeUploader(t)
+	dedup := loadDedupIndex(cfg)
+	files := sameContent(t, cfg.ExportDir, "a.jpg", "b.jpg")
+
+	res, err := scpDir(context.Background(), cfg.ExportDir, files, "/ingest", "drone:22", sshConfig(cfg), time.Minute, dedup, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Uploads) != 1 || filepath.Base(fake.Uploads[0]) != "a.jpg" {
+		t.Errorf("uploaded %v, want only a.jpg", fake.Uploads)
+	}
+	if len(res.Transferred) != 2 {
+		t.Fatalf("transferred %v, want both files", res.Transferred)
+	}
+	// the duplicate counts as sent, to where the first one went
+	for _, f := range res.Transferred {
+		if f.Remote != "/ingest/a.jpg" {
+			t.Errorf("%s went to %s, want /ingest/a.jpg", f.Path, f.Remote)
+		}
+		if f.SHA256 == "" {
+			t.Errorf("%s wasn't hashed", f.Path)
+		}
+	}
+	if len(dedup.entries) != 1 {
+		t.Errorf("got %d index entries, want 1", len(dedup.entries))
+	}
+}
+
+func TestDedupRemoteCopy(t *testing.T) {
+	cfg := testConfig(t)
+	testSSHConfig(cfg)
+	cfg.DedupWindow = Duration{time.Hour}
+	cfg.DedupRemoteCopy = true
+	var mu sync.Mutex
+	var cmds []string
+	addr := sshServer(t, func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		cmds = append(cmds, cmd)
+		return cmd
+	})
+	ingest := t.TempDir()
+	dedup := loadDedupIndex(cfg)
+	files := sameContent(t, cfg.ExportDir, "a.jpg", "b.jpg")
+
+	for _, f := range files {
+		res, err := scpDir(context.Background(), cfg.ExportDir, []batchFile{f}, ingest, addr, sshConfig(cfg), cfg.StallTimeout.Duration, dedup, nil, nil, nil)
+		if err != nil || len(res.Transferred) != 1 {
+			t.Fatalf("sending %s: %v, %+v", f.Path, err, res)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(ingest, "b.jpg"))
+	if err != nil || string(b) != "the same image" {
+		t.Fatalf("b.jpg on the remote: %q, %v", b, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	scps := 0
+	for _, c := range cmds {
+		if strings.HasPrefix(c, "scp") {
+			scps++
+		}
+	}
+	if scps != 1 {
+		t.Errorf("ran scp %d times, want once for a.jpg only: %q", scps, cmds)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+)
+
+// diskUsage is how full the filesystem holding a directory is
+type diskUsage struct {
+	Path        string
+	TotalBytes  uint64
+	FreeBytes   uint64
+	UsedPercent float64
+	// Level is "ok", "warning" or "critical" against DiskWarnFree and
+	// DiskCriticalFree
+	Level string `json:",omitempty"`
+}
+
+// freePercent is the share of the filesystem still available
+func (u diskUsage) freePercent() float64 {
+	return 100 - u.UsedPercent
+}
+
+// Disk space levels, from diskLevel
+const (
+	diskOK       = "ok"
+	diskWarning  = "warning"
+	diskCritical = "critical"
+)
+
+// diskLevel rates u against the configured free-space thresholds
+func diskLevel(cfg *Config, u diskUsage) string {
+	switch {
+	case cfg.DiskCriticalFree.below(u):
+		return diskCritical
+	case cfg.DiskWarnFree.below(u):
+		return diskWarning
+	default:
+		return diskOK
+	}
+}
+
+// lastDiskLevel is the level we last logged, so warnings are logged when
+// things change rather than every few seconds
+var lastDiskLevel = diskOK
+
+// checkDiskSpace logs how much space is free, warning when it first drops
+// below DiskWarnFree and raising the alarm below DiskCriticalFree. It
+// returns u with its Level filled in
+func checkDiskSpace(cfg *Config, u diskUsage) diskUsage {
+	u.Level = diskLevel(cfg, u)
+	slog.Debug("Disk space", "path", u.Path, "free_bytes", u.FreeBytes, "free_percent", u.freePercent())
+	if u.Level != lastDiskLevel {
+		switch u.Level {
+		case diskCritical:
+			slog.Error("Disk space critical; transferring without pausing between batches",
+				"path", u.Path, "free_bytes", u.FreeBytes, "free_percent", u.freePercent())
+		case diskWarning:
+			slog.Warn("Disk space low", "path", u.Path, "free_bytes", u.FreeBytes, "free_percent", u.freePercent())
+		default:
+			slog.Info("Disk space back to normal", "path", u.Path, "free_bytes", u.FreeBytes, "free_percent", u.freePercent())
+		}
+		lastDiskLevel = u.Level
+	}
+	return u
+}
+
+// statDisk measures the filesystem holding path. Free space is what's
+// available to us, not counting blocks reserved for root
+func statDisk(path string) (diskUsage, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return diskUsage{}, fmt.Errorf("statfs %s: %w", path, err)
+	}
+	total := st.Blocks * uint64(st.Bsize)
+	free := st.Bavail * uint64(st.Bsize)
+	u := diskUsage{Path: path, TotalBytes: total, FreeBytes: free}
+	if total > 0 {
+		u.UsedPercent = 100 * float64(total-free) / float64(total)
+	}
+	return u, nil
+}
+
+// sameFilesystem reports whether a and b live on the same device, i.e.
+// whether freeing space under one helps the other
+func sameFilesystem(a, b string) bool {
+	var sa, sb unix.Stat_t
+	if unix.Stat(a, &sa) != nil || unix.Stat(b, &sb) != nil {
+		return false
+	}
+	return sa.Dev == sb.Dev
+}
+
+// guardDisk keeps the export filesystem from filling up. Above
+// cfg.DiskHighWater percent it evicts the oldest archived batches until
+// usage is back under cfg.DiskLowWater. Only above cfg.DiskHardCeiling does
+// it start on files that haven't been transferred yet, oldest first, since
+// losing some imagery beats the camera pipeline failing its writes; that's
+// off unless cfg.DiskHardCeiling is set. Every eviction is logged as an
+// error and audited. Returns the usage after any eviction
+func guardDisk(cfg *Config) (diskUsage, error) {
+	u, err := statDisk(cfg.ExportDir)
+	if err != nil || cfg.DiskHighWater <= 0 || u.UsedPercent < cfg.DiskHighWater {
+		return u, err
+	}
+	slog.Warn("Export filesystem past its high-water mark; evicting archived files",
+		"path", u.Path, "used_percent", u.UsedPercent, "high_water", cfg.DiskHighWater, "low_water", cfg.DiskLowWater)
+
+	if cfg.ArchiveDir != "" && sameFilesystem(cfg.ExportDir, cfg.ArchiveDir) {
+		u, err = evictOldest(cfg, cfg.ArchiveDir, archivedFiles(cfg.ArchiveDir), "evicted-archive")
+		if err != nil || u.UsedPercent < cfg.DiskLowWater {
+			return u, err
+		}
+	}
+	if cfg.DiskHardCeiling <= 0 || u.UsedPercent < cfg.DiskHardCeiling {
+		return u, nil
+	}
+	slog.Error("Export filesystem past its hard ceiling; evicting untransferred files",
+		"path", u.Path, "used_percent", u.UsedPercent, "hard_ceiling", cfg.DiskHardCeiling)
+	return evictOldest(cfg, cfg.ExportDir, exportFiles(cfg.ExportDir, newFileFilter(cfg)), "evicted-untransferred")
+}
+
+// evictOldest deletes files from under root, oldest first, until the export
+// filesystem is below cfg.DiskLowWater or they run out
+func evictOldest(cfg *Config, root string, files []evictable, action string) (diskUsage, error) {
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	var evicted []string
+	defer func() { removeEmptyParents(root, evicted) }()
+	u, err := statDisk(cfg.ExportDir)
+	for _, f := range files {
+		if err != nil || u.UsedPercent < cfg.DiskLowWater {
+			break
+		}
+		if err := appendAudit(cfg.auditPath(), action, []sentFile{f.sentFile}); err != nil {
+			return u, fmt.Errorf("audit log: %w", err)
+		}
+		// an error, not a warning, since it's imagery gone for good
+		slog.Error("Evicting file to free disk space", "path", f.Path, "bytes", f.Size,
+			"modified", f.modTime.Format(time.RFC3339), "action", action)
+		if err := os.Remove(f.Path); err != nil {
+			slog.Error("Failed to evict file", "path", f.Path, "error", err)
+			continue
+		}
+		evicted = append(evicted, f.Path)
+		u, err = statDisk(cfg.ExportDir)
+	}
+	return u, err
+}
+
+// evictable is a file guardDisk may remove
+type evictable struct {
+	sentFile
+	modTime time.Time
+}
+
+// archivedFiles lists the files in the archive. Each batch directory is
+// named by when it was archived, which orders them better than mtime,
+// since moving a file keeps the mtime from when it was captured
+func archivedFiles(archiveDir string) []evictable {
+	var files []evictable
+	filepath.WalkDir(archiveDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || d.Name() == batchMarker {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		at := info.ModTime()
+		if rel, err := filepath.Rel(archiveDir, path); err == nil {
+			batch, _, _ := strings.Cut(rel, string(filepath.Separator))
+			if t, err := batchTime(batch); err == nil {
+				at = t
+			}
+		}
+		files = append(files, evictable{sentFile{Path: path, Size: info.Size()}, at})
+		return nil
+	})
+	return files
+}
+
+// exportFiles lists the files waiting in the export dir, leaving out ones
+// filter says aren't ours
+func exportFiles(exportDir string, filter *fileFilter) []evictable {
+	var files []evictable
+	watch.Walk(exportDir, filter, func(path string, d fs.DirEntry) {
+		if !d.Type().IsRegular() {
+			return
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, evictable{sentFile{Path: path, Size: info.Size()}, info.ModTime()})
+		}
+	})
+	return files
+}
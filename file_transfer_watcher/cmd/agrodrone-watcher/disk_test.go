@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// fullDiskConfig is a config under which the temp filesystem, however
+// empty, counts as past the high-water mark
+func fullDiskConfig(t *testing.T) *Config {
+	t.Helper()
+	cfg := testConfig(t)
+	if err := os.MkdirAll(cfg.StateDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	u, err := statDisk(cfg.ExportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.UsedPercent < 0.01 {
+		t.Skipf("%s is too empty to be made to look full", u.Path)
+	}
+	cfg.DiskLowWater, cfg.DiskHighWater = 0.001, 0.002
+	return cfg
+}
+
+func TestGuardDiskLeavesUntransferredFilesByDefault(t *testing.T) {
+	cfg := fullDiskConfig(t)
+	cfg.DeviceID = "drone1"
+	// no hard ceiling is a valid config
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "sub/b.jpg")
+	if _, err := guardDisk(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		if !exists(p) {
+			t.Errorf("%s was evicted with no DiskHardCeiling set", p)
+		}
+	}
+}
+
+func TestGuardDiskEvictsPastTheHardCeiling(t *testing.T) {
+	cfg := fullDiskConfig(t)
+	cfg.DiskHardCeiling = 0.002
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "sub/b.jpg")
+	if _, err := guardDisk(cfg); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(cfg.auditPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range paths {
+		if exists(p) {
+			t.Errorf("%s wasn't evicted", p)
+		}
+		if !strings.Contains(string(b), "evicted-untransferred\t") || !strings.Contains(string(b), p) {
+			t.Errorf("%s isn't in the audit log:\n%s", p, b)
+		}
+	}
+	if exists(cfg.ExportDir + "/sub") {
+		t.Error("sub was left behind empty")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EXIF tags we read: the pointers to the EXIF and GPS IFDs, the capture
+// time, and the GPS position
+const (
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagOffsetTime       = 0x9011 // of DateTimeOriginal
+	tagGPSLatitudeRef   = 1
+	tagGPSLatitude      = 2
+	tagGPSLongitudeRef  = 3
+	tagGPSLongitude     = 4
+	tagGPSAltitudeRef   = 5
+	tagGPSAltitude      = 6
+	tagGPSTimeStamp     = 7
+	tagGPSDateStamp     = 29
+)
+
+// exifTimeFormat is how EXIF writes times, in the camera's local time
+const exifTimeFormat = "2006:01:02 15:04:05"
+
+// imageMeta is where and when a photo was taken, from its EXIF. Anything
+// the file doesn't record is null
+type imageMeta struct {
+	Size      int64
+	Latitude  *float64
+	Longitude *float64
+	Altitude  *float64
+	// Taken is DateTimeOriginal, in the camera's local time
+	Taken *string
+	// takenAt is when it was taken, from DateTimeOriginal and its offset,
+	// else the GPS time, else DateTimeOriginal in our own time zone
+	takenAt time.Time
+}
+
+// readImageMeta reads the EXIF of path if it's a JPEG or TIFF (including
+// DNG). Only the headers and the EXIF itself are read, never the image
+func readImageMeta(path string) (imageMeta, error) {
+	meta := imageMeta{}
+	f, err := os.Open(path)
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return meta, err
+	}
+	meta.Size = info.Size()
+	var base int64
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		var found bool
+		if base, found, err = jpegEXIF(f, meta.Size); err != nil || !found {
+			return meta, err
+		}
+	case ".tif", ".tiff", ".dng":
+	default:
+		return meta, nil
+	}
+	t, ifd0, err := newTIFFReader(f, base)
+	if err != nil {
+		return meta, err
+	}
+	return meta, t.meta(ifd0, &meta)
+}
+
+// jpegEXIF walks the JPEG's segments up to the start of the image data and
+// returns where the TIFF header in its EXIF segment starts, if it has one
+func jpegEXIF(r io.ReaderAt, size int64) (int64, bool, error) {
+	buf := make([]byte, 10)
+	for pos := int64(2); pos+4 <= size; {
+		if _, err := r.ReadAt(buf[:4], pos); err != nil {
+			return 0, false, err
+		}
+		if buf[0] != 0xFF {
+			return 0, false, fmt.Errorf("JPEG bad marker at %d", pos)
+		}
+		switch m := buf[1]; {
+		case m == 0xFF: // fill byte
+			pos++
+			continue
+		case m == 0x01 || (m >= 0xD0 && m <= 0xD7): // no length
+			pos += 2
+			continue
+		case m == 0xDA || m == 0xD9: // image data, or the end
+			return 0, false, nil
+		case m == 0xE1:
+			if _, err := r.ReadAt(buf, pos); err == nil && string(buf[4:10]) == "Exif\x00\x00" {
+				return pos + 10, true, nil
+			}
+		}
+		pos += 2 + int64(binary.BigEndian.Uint16(buf[2:4]))
+	}
+	return 0, false, nil
+}
+
+// tiffReader reads IFDs from a TIFF structure starting at base, which is
+// how EXIF is laid out too
+type tiffReader struct {
+	r     io.ReaderAt
+	base  int64
+	order binary.ByteOrder
+}
+
+// tiffEntry is one IFD entry, with the value (or its offset) still raw
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	raw   []byte
+}
+
+// tiffTypeSizes is the size in bytes of each TIFF field type
+var tiffTypeSizes = map[uint16]int64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// newTIFFReader reads the header at base and returns the first IFD's offset
+func newTIFFReader(r io.ReaderAt, base int64) (*tiffReader, int64, error) {
+	hdr := make([]byte, 8)
+	if _, err := r.ReadAt(hdr, base); err != nil {
+		return nil, 0, fmt.Errorf("TIFF header: %w", err)
+	}
+	t := &tiffReader{r: r, base: base}
+	switch string(hdr[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, 0, errors.New("TIFF bad byte order mark")
+	}
+	if t.order.Uint16(hdr[2:4]) != 42 {
+		return nil, 0, errors.New("TIFF bad magic number")
+	}
+	return t, int64(t.order.Uint32(hdr[4:8])), nil
+}
+
+// ifd reads the entries of the IFD at off
+func (t *tiffReader) ifd(off int64) (map[uint16]tiffEntry, error) {
+	count := make([]byte, 2)
+	if _, err := t.r.ReadAt(count, t.base+off); err != nil {
+		return nil, fmt.Errorf("IFD at %d: %w", off, err)
+	}
+	n := int(t.order.Uint16(count))
+	buf := make([]byte, n*12)
+	if _, err := t.r.ReadAt(buf, t.base+off+2); err != nil {
+		return nil, fmt.Errorf("IFD at %d: %w", off, err)
+	}
+	entries := map[uint16]tiffEntry{}
+	for i := 0; i < n; i++ {
+		e := buf[i*12 : (i+1)*12]
+		entries[t.order.Uint16(e[0:2])] = tiffEntry{typ: t.order.Uint16(e[2:4]), count: t.order.Uint32(e[4:8]), raw: e[8:12]}
+	}
+	return entries, nil
+}
+
+// value returns e's value, which is in the entry itself if it fits in four
+// bytes and at the offset there if not
+func (t *tiffReader) value(e tiffEntry) ([]byte, error) {
+	n := tiffTypeSizes[e.typ] * int64(e.count)
+	if n <= 4 {
+		return e.raw[:n], nil
+	}
+	if n > 1<<16 {
+		return nil, fmt.Errorf("EXIF value of %d bytes", n)
+	}
+	b := make([]byte, n)
+	_, err := t.r.ReadAt(b, t.base+int64(t.order.Uint32(e.raw)))
+	return b, err
+}
+
+// rationals reads e as unsigned rationals
+func (t *tiffReader) rationals(e tiffEntry) ([]float64, error) {
+	if e.typ != 5 {
+		return nil, fmt.Errorf("EXIF type %d, expected RATIONAL", e.typ)
+	}
+	b, err := t.value(e)
+	if err != nil {
+		return nil, err
+	}
+	var vals []float64
+	for i := 0; i+8 <= len(b); i += 8 {
+		num, den := t.order.Uint32(b[i:]), t.order.Uint32(b[i+4:])
+		if den == 0 {
+			return nil, errors.New("EXIF rational with a zero denominator")
+		}
+		vals = append(vals, float64(num)/float64(den))
+	}
+	return vals, nil
+}
+
+// text reads e as an ASCII string
+func (t *tiffReader) text(e tiffEntry) string {
+	b, err := t.value(e)
+	if err != nil || e.typ != 2 {
+		return ""
+	}
+	return strings.TrimRight(string(b), "\x00 ")
+}
+
+// meta fills in m from the IFD at ifd0 and the EXIF and GPS IFDs it points
+// to
+func (t *tiffReader) meta(ifd0 int64, m *imageMeta) error {
+	root, err := t.ifd(ifd0)
+	if err != nil {
+		return err
+	}
+	taken, offset := t.text(root[tagDateTime]), ""
+	if e, ok := root[tagExifIFD]; ok {
+		exif, err := t.ifd(int64(t.order.Uint32(e.raw)))
+		if err != nil {
+			return err
+		}
+		if s := t.text(exif[tagDateTimeOriginal]); s != "" {
+			taken, offset = s, t.text(exif[tagOffsetTime])
+		}
+	}
+	if at, err := time.ParseInLocation(exifTimeFormat, taken, time.Local); err == nil {
+		s := at.Format("2006-01-02T15:04:05")
+		m.Taken = &s
+		m.takenAt = at
+	}
+	// with its offset it's exact; without, the GPS time is better
+	at, err := time.Parse(exifTimeFormat+"-07:00", taken+offset)
+	exact := err == nil
+	if exact {
+		m.takenAt = at
+	}
+
+	e, ok := root[tagGPSIFD]
+	if !ok {
+		return nil
+	}
+	gps, err := t.ifd(int64(t.order.Uint32(e.raw)))
+	if err != nil {
+		return err
+	}
+	if !exact {
+		if at, ok := t.gpsTime(gps); ok {
+			m.takenAt = at
+		}
+	}
+	m.Latitude = t.coordinate(gps[tagGPSLatitude], t.text(gps[tagGPSLatitudeRef]), "S")
+	m.Longitude = t.coordinate(gps[tagGPSLongitude], t.text(gps[tagGPSLongitudeRef]), "W")
+	if alt, err := t.rationals(gps[tagGPSAltitude]); err == nil && len(alt) == 1 {
+		// a reference of 1 is below sea level
+		if ref, _ := t.value(gps[tagGPSAltitudeRef]); len(ref) == 1 && ref[0] == 1 {
+			alt[0] = -alt[0]
+		}
+		m.Altitude = &alt[0]
+	}
+	return nil
+}
+
+// gpsTime is the GPS date and time, which are in UTC
+func (t *tiffReader) gpsTime(gps map[uint16]tiffEntry) (time.Time, bool) {
+	day, err := time.Parse("2006:01:02", t.text(gps[tagGPSDateStamp]))
+	if err != nil {
+		return time.Time{}, false
+	}
+	hms, err := t.rationals(gps[tagGPSTimeStamp])
+	if err != nil || len(hms) != 3 {
+		return time.Time{}, false
+	}
+	secs := hms[0]*3600 + hms[1]*60 + hms[2]
+	return day.Add(time.Duration(secs * float64(time.Second))), true
+}
+
+// captureTime is when the file at path was taken, in UTC: from its EXIF if
+// it has any, else its mtime
+func captureTime(path string, mtime time.Time) time.Time {
+	if meta, err := readImageMeta(path); err == nil && !meta.takenAt.IsZero() {
+		return meta.takenAt.UTC()
+	}
+	return mtime.UTC()
+}
+
+// coordinate converts degrees, minutes and seconds to decimal degrees,
+// negative if ref is neg
+func (t *tiffReader) coordinate(e tiffEntry, ref, neg string) *float64 {
+	dms, err := t.rationals(e)
+	if err != nil || len(dms) != 3 {
+		return nil
+	}
+	deg := dms[0] + dms[1]/60 + dms[2]/3600
+	if ref == neg {
+		deg = -deg
+	}
+	deg = math.Round(deg*1e7) / 1e7
+	return &deg
+}
+
+// batchIndex maps each file sent in a batch, by its path relative to the
+// ingest dir, to where and when it was taken
+type batchIndex struct {
+	Batch string
+	Files map[string]imageMeta
+}
+
+// indexSent reads the EXIF of the files in sent, before they're cleaned up.
+// Files without EXIF, or that aren't images, are there with nulls
+func indexSent(ingestDir string, sent []sentFile) map[string]imageMeta {
+	index := map[string]imageMeta{}
+	for _, f := range sent {
+		meta, err := readImageMeta(f.Path)
+		if err != nil {
+			slog.Debug("Couldn't read EXIF", "file", f.Path, "error", err)
+		}
+		meta.Size = f.Size
+		rel := filepath.ToSlash(f.Remote)
+		if r, err := filepath.Rel(ingestDir, f.Remote); err == nil && !strings.HasPrefix(r, "..") {
+			rel = filepath.ToSlash(r)
+		}
+		index[rel] = meta
+	}
+	return index
+}
+
+// uploadIndex writes the batch's index to StateDir and to
+// batch_index_<batch>.json in the ingest dir
+func uploadIndex(cfg *Config, addr, ingestDir string, idx batchIndex) error {
+	if err := writeFileAtomic(cfg.indexPath(idx.Batch), idx); err != nil {
+		slog.Warn("Failed to save the batch index", "error", err)
+	}
+	return remoteWriteJSON(addr, sshConfig(cfg), path.Join(ingestDir, "batch_index_"+idx.Batch+".json"), idx)
+}
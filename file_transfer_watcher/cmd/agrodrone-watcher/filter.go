@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+)
+
+// fileFilter decides which files in the export dir are ours to send (see
+// watch.Filter)
+type fileFilter = watch.Filter
+
+// stabilityCheck decides whether a file in the export dir is finished (see
+// watch.Stability)
+type stabilityCheck = watch.Stability
+
+// newFileFilter builds the filter from cfg.Ignore and cfg.ExtraIgnore (unless
+// cfg.IncludeAll) and cfg.Include and cfg.Exclude
+func newFileFilter(cfg *Config) *fileFilter {
+	f := &fileFilter{Include: cfg.Include, Exclude: cfg.Exclude, MinSize: int64(cfg.MinFileSize), MaxSize: int64(cfg.MaxFileSize)}
+	if cfg.Sidecars || cfg.HashSidecars {
+		f.Sidecar = isSidecar
+	}
+	if rel, err := filepath.Rel(cfg.ExportDir, cfg.quarantinePath()); err == nil && !strings.HasPrefix(rel, "..") {
+		f.Quarantine = filepath.ToSlash(rel)
+	}
+	if !cfg.IncludeAll {
+		f.Ignore = append(append([]string(nil), cfg.Ignore...), cfg.ExtraIgnore...)
+	}
+	return f
+}
+
+// newStabilityCheck sets up a check for one batch. With cfg.CheckOpenFiles
+// it takes a snapshot of which files are open for writing from /proc
+func newStabilityCheck(cfg *Config) *stabilityCheck {
+	return watch.NewStability(cfg.QuiescePeriod.Duration, cfg.CheckOpenFiles)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/wifi"
+)
+
+// WifiManager is how we drive the WiFi radio
+type WifiManager = wifi.WifiManager
+
+// newWifiManager picks the WiFi backend (see wifi.New), running its
+// command-line tools with runCommand
+func newWifiManager(backend, iface string) (WifiManager, error) {
+	return wifi.New(backend, iface, wifi.RunnerFunc(runCommand))
+}
+
+// accessPoint is one AP seen in a scan
+type accessPoint = wifi.AccessPoint
+
+// acceptSecurity decides whether we're willing to join ap, and why. WPA2,
+// WPA3 and mixed-mode networks are fine; open networks only if allowOpen,
+// since we'd be sending credentials over an unencrypted link
+func acceptSecurity(ap accessPoint, allowOpen bool) (bool, string) {
+	switch {
+	case ap.HasSecurity("WPA2") || ap.HasSecurity("WPA3"):
+		return true, "secured (" + strings.Join(ap.Security, " ") + ")"
+	case len(ap.Security) == 0 && allowOpen:
+		return true, "open network allowed by AllowOpenNetworks"
+	case len(ap.Security) == 0:
+		return false, "open network and AllowOpenNetworks is off"
+	default:
+		return false, "unsupported security (" + strings.Join(ap.Security, " ") + ")"
+	}
+}
+
+// Searches the scan for the highest-priority network in cfg.Networks and
+// attempts to connect to it, falling through to the next one on failure. An
+// AP that doesn't look like the ground station's is skipped for the next
+// one on the same network first. APs weaker than cfg.MinSignal are not
+// connected to, since transfers over them crawl or stall. Networks marked
+// Hidden are connected to blind, up to cfg.HiddenAttempts times, when they
+// aren't in the scan. Returns the network we connected to, or nil and the
+// last error from the WiFi backend, if any
+func findAndConnect(wifi WifiManager, cfg *Config) (*Network, error) {
+	// First, we check for available WiFi access points
+	aps, err := scanCached(wifi, cfg)
+	if err != nil {
+		slog.Error("Scan failed", "error", err)
+		return nil, err
+	}
+
+	var lastErr error
+
+	for i := range cfg.Networks {
+		n := &cfg.Networks[i]
+		ap, ok := findAP(aps, n.SSID, n.BSSID, cfg.AllowOpenNetworks)
+		if !ok {
+			// hidden APs don't show up in the scan, so try them blind
+			if n.Hidden {
+				if why, bad := badBSSIDs[strings.ToLower(n.BSSID)]; n.BSSID != "" && bad {
+					slog.Debug("Not trying hidden network: its BSSID is marked bad", "ssid", n.SSID, "bssid", n.BSSID, "reason", why)
+					continue
+				}
+				slog.Info("Network not in scan; trying hidden path", "ssid", n.SSID)
+				if connectHidden(wifi, n, cfg.HiddenAttempts) && linkReady(wifi, cfg, n) && looksLikeOurs(wifi, cfg, n) {
+					return n, nil
+				}
+			}
+			continue
+		}
+		// an AP that turns out not to be ours is marked bad, and the next
+		// strongest with the same SSID is tried before moving on. It's asked
+		// for by BSSID, so we don't land back on the bad one
+		tried := map[string]bool{}
+		bssid := n.BSSID
+		for {
+			if ap.Signal < cfg.MinSignal {
+				slog.Info("Network visible but signal below minimum; not connecting",
+					"ssid", n.SSID, "signal", ap.Signal, "min_signal", cfg.MinSignal)
+				break
+			}
+			slog.Info("Network found in scan; trying scanned path", "ssid", n.SSID, "bssid", ap.BSSID, "signal", ap.Signal)
+			metrics.wifiAttempt()
+			if err := wifi.Connect(n.SSID, n.PSK, bssid, false); err != nil {
+				slog.Warn("Connection failed", "ssid", n.SSID, "error", err)
+				lastErr = err
+				break
+			}
+			if !linkReady(wifi, cfg, n) {
+				break
+			}
+			if looksLikeOurs(wifi, cfg, n) {
+				return n, nil
+			}
+			tried[strings.ToLower(bssid)] = true
+			if ap, ok = findAP(aps, n.SSID, n.BSSID, cfg.AllowOpenNetworks); !ok || tried[strings.ToLower(ap.BSSID)] {
+				break
+			}
+			bssid = ap.BSSID
+			slog.Info("Trying another AP on the same network", "ssid", n.SSID, "bssid", bssid)
+		}
+	}
+	return nil, lastErr
+}
+
+// linkReady is run right after associating with n. It logs which AP we
+// actually ended up on (with several APs broadcasting the same SSID it may
+// not be the one we asked for), then waits for a DHCP lease and a route to
+// the ground station. If they don't show up within cfg.LeaseTimeout the
+// connection is taken back down
+func linkReady(wifi WifiManager, cfg *Config, n *Network) bool {
+	if ap, ok := wifi.Active(); ok {
+		slog.Info("Associated", "ssid", ap.SSID, "bssid", ap.BSSID, "signal", ap.Signal)
+	}
+	addr, _, err := cfg.target(n)
+	if err == nil {
+		var waited time.Duration
+		waited, err = waitForLease(cfg.WifiInterface, n.Subnet, addr, cfg.LeaseTimeout.Duration)
+		if err == nil {
+			slog.Info("Link ready", "ssid", n.SSID, "duration_ms", waited.Milliseconds())
+			return true
+		}
+	}
+	slog.Warn("Associated but link not ready; disconnecting", "ssid", n.SSID, "error", err)
+	if err := wifi.Disconnect(n.SSID); err != nil {
+		slog.Warn("Failed to disconnect", "ssid", n.SSID, "error", err)
+	}
+	return false
+}
+
+// lastScan is the most recent scan result, reused for ScanCacheTTL since a
+// scan ties up the Pi's single radio for a few seconds
+var lastScan struct {
+	at  time.Time
+	aps []accessPoint
+}
+
+// scanCached returns the last scan if it's younger than cfg.ScanCacheTTL and
+// saw at least one of our networks; otherwise it scans again
+func scanCached(wifi WifiManager, cfg *Config) ([]accessPoint, error) {
+	if time.Since(lastScan.at) < cfg.ScanCacheTTL.Duration && sawAnyNetwork(lastScan.aps, cfg.Networks) {
+		slog.Debug("Reusing scan", "age", time.Since(lastScan.at).Round(time.Second).String())
+		return lastScan.aps, nil
+	}
+	aps, err := wifi.Scan()
+	if err != nil {
+		return nil, err
+	}
+	lastScan.at, lastScan.aps = time.Now(), aps
+	return aps, nil
+}
+
+func sawAnyNetwork(aps []accessPoint, networks []Network) bool {
+	for _, ap := range aps {
+		for _, n := range networks {
+			if ap.SSID == n.SSID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// badBSSIDs are APs that turned out not to be our ground station (e.g. a
+// captive portal with a similar name), keyed by lowercase BSSID with the
+// reason. They're skipped for the rest of the run
+var badBSSIDs = map[string]string{}
+
+// looksLikeOurs checks that the network we just joined really is the ground
+// station's before any credentials go over it: the target must answer on
+// its SSH port and, if HostKeyFingerprint is set, present that host key. If
+// not, the AP is marked bad and we disconnect
+func looksLikeOurs(wifi WifiManager, cfg *Config, n *Network) bool {
+	addr, _, err := cfg.target(n)
+	if err != nil {
+		return false
+	}
+	var why string
+	switch {
+	case !dialOK(&net.Dialer{Timeout: 3 * time.Second}, addr):
+		why = "no SSH server at " + addr
+	case cfg.HostKeyFingerprint != "" && !hostKeyMatches(addr, cfg.HostKeyFingerprint):
+		why = "host key at " + addr + " doesn't match HostKeyFingerprint"
+	default:
+		return true
+	}
+
+	bssid := n.BSSID
+	if ap, ok := wifi.Active(); ok {
+		bssid = ap.BSSID
+	}
+	slog.Warn("Network doesn't look like our ground station; marking it bad", "ssid", n.SSID, "bssid", bssid, "reason", why)
+	if bssid != "" {
+		badBSSIDs[strings.ToLower(bssid)] = n.SSID + ": " + why
+		bad := make(map[string]string, len(badBSSIDs))
+		for k, v := range badBSSIDs {
+			bad[k] = v
+		}
+		status.update(func(s *statusData) { s.BadBSSIDs = bad })
+	}
+	if err := wifi.Disconnect(n.SSID); err != nil {
+		slog.Warn("Failed to disconnect", "ssid", n.SSID, "error", err)
+	}
+	return false
+}
+
+// connectHidden joins a hidden network directly, without it having to appear
+// in a scan, giving up after attempts tries
+func connectHidden(wifi WifiManager, n *Network, attempts int) bool {
+	for i := 1; i <= attempts; i++ {
+		slog.Info("Connecting to hidden network", "ssid", n.SSID, "attempt", i, "attempts", attempts)
+		metrics.wifiAttempt()
+		if err := wifi.Connect(n.SSID, n.PSK, n.BSSID, true); err != nil {
+			slog.Warn("Hidden connection failed", "ssid", n.SSID, "error", err)
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// findAP returns the strongest acceptable AP in aps broadcasting ssid. If
+// bssid is set only that AP is considered
+func findAP(aps []accessPoint, ssid, bssid string, allowOpen bool) (accessPoint, bool) {
+	var best accessPoint
+	found := false
+	for _, ap := range aps {
+		if ap.SSID != ssid {
+			continue
+		}
+		if bssid != "" && !strings.EqualFold(ap.BSSID, bssid) {
+			slog.Debug("Ignoring AP: pinned to another BSSID", "ssid", ap.SSID, "bssid", ap.BSSID, "pinned", bssid)
+			continue
+		}
+		if why, bad := badBSSIDs[strings.ToLower(ap.BSSID)]; bad {
+			slog.Debug("Ignoring AP: marked bad", "ssid", ap.SSID, "bssid", ap.BSSID, "reason", why)
+			continue
+		}
+		ok, why := acceptSecurity(ap, allowOpen)
+		if ok {
+			slog.Debug("Accepting AP", "ssid", ap.SSID, "bssid", ap.BSSID, "signal", ap.Signal, "reason", why)
+		} else {
+			slog.Debug("Rejecting AP", "ssid", ap.SSID, "bssid", ap.BSSID, "signal", ap.Signal, "reason", why)
+			continue
+		}
+		if !found || ap.Signal > best.Signal {
+			best = ap
+			found = true
+		}
+	}
+	return best, found
+}
+
+// activeSignal returns the signal of the link if we're associated with ssid
+func activeSignal(wifi WifiManager, ssid string) (int, bool) {
+	ap, ok := wifi.Active()
+	if !ok || ap.SSID != ssid {
+		return 0, false
+	}
+	return ap.Signal, true
+}
+
+// Checks if we're currently associated with ssid
+func checkIfConnected(wifi WifiManager, ssid string) bool {
+	_, ok := activeSignal(wifi, ssid)
+	return ok
+}
+
+// connectedNetwork returns whichever of networks we're already associated
+// with, or nil
+func connectedNetwork(wifi WifiManager, networks []Network) *Network {
+	for i := range networks {
+		if checkIfConnected(wifi, networks[i].SSID) {
+			return &networks[i]
+		}
+	}
+	return nil
+}
+
+// watchSignal calls cancel if the active link to ssid drops below
+// abortSignal. It returns once ctx is done
+func watchSignal(ctx context.Context, cancel context.CancelFunc, wifi WifiManager, ssid string, abortSignal int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			signal, ok := activeSignal(wifi, ssid)
+			if !ok || signal < abortSignal {
+				slog.Warn("Signal dropped; aborting transfer", "ssid", ssid, "signal", signal, "abort_signal", abortSignal)
+				cancel()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFindAndConnectTriesTheNextAPWhenOneIsntOurs(t *testing.T) {
+	oldBad, oldScan := badBSSIDs, lastScan
+	badBSSIDs = map[string]string{}
+	lastScan.aps = nil
+	t.Cleanup(func() { badBSSIDs, lastScan = oldBad, oldScan })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	t.Cleanup(func() { ln.Close() })
+
+	cfg := testConfig(t)
+	cfg.WifiInterface = "lo"
+	cfg.RemoteHost = addr
+	cfg.Networks = []Network{{SSID: "groundstation", PSK: "field-psk"}, {SSID: "backup", PSK: "backup-psk"}}
+	wifi := &fakeWifi{aps: []accessPoint{
+		// a captive portal that happens to share the name, and is closer
+		{SSID: "groundstation", BSSID: "aa:aa:aa:aa:aa:aa", Signal: 90, Security: []string{"WPA2"}},
+		{SSID: "groundstation", BSSID: "bb:bb:bb:bb:bb:bb", Signal: 60, Security: []string{"WPA2"}},
+		{SSID: "backup", BSSID: "cc:cc:cc:cc:cc:cc", Signal: 80, Security: []string{"WPA2"}},
+	}}
+	// only the real ground station's AP has anything listening on the SSH
+	// port
+	wifi.joined = func(ap accessPoint) {
+		ln.Close()
+		if ap.BSSID == "bb:bb:bb:bb:bb:bb" {
+			if ln, err = net.Listen("tcp", addr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	n, err := findAndConnect(wifi, cfg)
+	if err != nil || n == nil || n.SSID != "groundstation" {
+		t.Fatalf("got %v, %v; want groundstation", n, err)
+	}
+	want := []string{"groundstation ", "groundstation bb:bb:bb:bb:bb:bb"}
+	if len(wifi.connects) != len(want) || wifi.connects[0] != want[0] || wifi.connects[1] != want[1] {
+		t.Errorf("connected %q, want %q", wifi.connects, want)
+	}
+	if _, bad := badBSSIDs["aa:aa:aa:aa:aa:aa"]; !bad || len(badBSSIDs) != 1 {
+		t.Errorf("bad BSSIDs %v, want just the portal", badBSSIDs)
+	}
+}
+
+func TestFindAndConnectMovesOnWhenNoAPIsOurs(t *testing.T) {
+	oldBad, oldScan := badBSSIDs, lastScan
+	badBSSIDs = map[string]string{}
+	lastScan.aps = nil
+	t.Cleanup(func() { badBSSIDs, lastScan = oldBad, oldScan })
+
+	// nothing listening anywhere
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cfg := testConfig(t)
+	cfg.WifiInterface = "lo"
+	cfg.RemoteHost = addr
+	cfg.Networks = []Network{{SSID: "groundstation", PSK: "field-psk"}, {SSID: "backup", PSK: "backup-psk"}}
+	wifi := &fakeWifi{aps: []accessPoint{
+		{SSID: "groundstation", BSSID: "aa:aa:aa:aa:aa:aa", Signal: 90, Security: []string{"WPA2"}},
+		{SSID: "groundstation", BSSID: "bb:bb:bb:bb:bb:bb", Signal: 60, Security: []string{"WPA2"}},
+		{SSID: "backup", BSSID: "cc:cc:cc:cc:cc:cc", Signal: 80, Security: []string{"WPA2"}},
+	}}
+
+	if n, _ := findAndConnect(wifi, cfg); n != nil {
+		t.Fatalf("connected to %s", n.SSID)
+	}
+	// each AP once, the second network's after both of the first's
+	want := []string{"groundstation ", "groundstation bb:bb:bb:bb:bb:bb", "backup "}
+	if len(wifi.connects) != len(want) {
+		t.Fatalf("connected %q, want %q", wifi.connects, want)
+	}
+	for i := range want {
+		if wifi.connects[i] != want[i] {
+			t.Errorf("connected %q, want %q", wifi.connects, want)
+			break
+		}
+	}
+	if len(badBSSIDs) != 3 {
+		t.Errorf("bad BSSIDs %v, want all three", badBSSIDs)
+	}
+}
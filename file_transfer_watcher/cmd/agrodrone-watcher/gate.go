@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// gatePoll is how often the gate is checked again while it's shut
+const gatePoll = 2 * time.Second
+
+// gateStatus is the gate as shown in the status file
+type gateStatus struct {
+	Open   bool
+	Reason string
+	// Since is when it last opened or shut
+	Since time.Time
+}
+
+// landedGate holds off sending until the drone is on the ground: by a flag
+// file the flight stack writes (LandedFile while landed, or FlyingFile while
+// flying) and/or by MAVLink, disarmed and landed. Whatever's configured has
+// to hold for LandedFor before the gate opens. A nil gate is always open
+type landedGate struct {
+	landedFile string
+	flyingFile string
+	mavlink    bool
+	landedFor  time.Duration
+	override   bool
+
+	mu       sync.Mutex
+	metSince time.Time
+	last     gateStatus
+}
+
+var gate *landedGate
+
+// startGate sets up the gate if any of its conditions are configured.
+// override opens it regardless, for the bench
+func startGate(cfg *Config, override bool) {
+	if cfg.LandedFile == "" && cfg.FlyingFile == "" && !cfg.LandedOverMAVLink {
+		return
+	}
+	if override {
+		slog.Warn("Ignoring the landed gate; files are sent even in flight")
+	}
+	gate = &landedGate{
+		landedFile: cfg.LandedFile,
+		flyingFile: cfg.FlyingFile,
+		mavlink:    cfg.LandedOverMAVLink,
+		landedFor:  cfg.LandedFor.Duration,
+		override:   override,
+	}
+}
+
+// check reports whether the gate is open and, if not, why. It's updated in
+// the status file whenever that changes
+func (g *landedGate) check() (bool, string) {
+	if g == nil {
+		return true, ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	reason := g.condition(now)
+	switch {
+	case g.override:
+		reason = ""
+	case reason != "":
+		g.metSince = time.Time{}
+	case g.metSince.IsZero():
+		g.metSince = now
+		fallthrough
+	case now.Sub(g.metSince) < g.landedFor:
+		reason = fmt.Sprintf("on the ground for %s of %s", now.Sub(g.metSince).Round(time.Second), g.landedFor)
+	}
+	open := reason == ""
+	if changed := open != g.last.Open || g.last.Since.IsZero(); changed || reason != g.last.Reason {
+		since := g.last.Since
+		if changed {
+			slog.Info("Landed gate", "open", open, "reason", reason)
+			since = now
+		}
+		g.last = gateStatus{Open: open, Reason: reason, Since: since}
+		s := g.last
+		status.update(func(d *statusData) { d.Gate = &s })
+	}
+	return open, reason
+}
+
+// condition is why the drone doesn't look to be on the ground, or "" if it
+// does
+func (g *landedGate) condition(now time.Time) string {
+	if g.landedFile != "" {
+		if _, err := os.Stat(g.landedFile); err != nil {
+			return "no " + g.landedFile
+		}
+	}
+	if g.flyingFile != "" {
+		if _, err := os.Stat(g.flyingFile); err == nil {
+			return g.flyingFile + " says flying"
+		}
+	}
+	if g.mavlink {
+		return mav.onGround(now)
+	}
+	return ""
+}
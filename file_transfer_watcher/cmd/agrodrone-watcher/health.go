@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+	"golang.org/x/sys/unix"
+)
+
+// healthServer answers /healthz and /status for a watchdog on the ground
+// station, and serves the status page at / for a phone on the hotspot
+type healthServer struct {
+	srv    *http.Server
+	maxAge time.Duration
+}
+
+// serveHealth listens on addr, once per interface in cfg.HealthInterfaces
+// if any are given. Each listener is tied to its interface rather than an
+// address, so it's there as soon as the interface comes up, even if the
+// WiFi is down when we start
+func serveHealth(addr string, cfg *Config, filter *fileFilter) (*healthServer, error) {
+	h := &healthServer{maxAge: cfg.HealthMaxAge.Duration}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/status", h.status)
+	mux.Handle("/", &webUI{cfg: cfg, filter: filter})
+	h.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	var listeners []net.Listener
+	ifaces := cfg.HealthInterfaces
+	if len(ifaces) == 0 {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	for _, iface := range ifaces {
+		lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.BindToDevice(int(fd), iface)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		}}
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listen on %s: %w", iface, err)
+		}
+		listeners = append(listeners, l)
+	}
+	for _, l := range listeners {
+		go func() {
+			if err := h.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				slog.Error("Health listener failed", "addr", l.Addr().String(), "error", err)
+			}
+		}()
+	}
+	beat()
+	return h, nil
+}
+
+// healthz is 200 if the main loop has been round within maxAge, 503 if not
+func (h *healthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	age := time.Since(time.Unix(0, lastBeat.Load()))
+	if age > h.maxAge {
+		http.Error(w, fmt.Sprintf("main loop last ran %s ago\n", age.Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok, main loop last ran %s ago\n", age.Round(time.Second))
+}
+
+// status is the same JSON as the status file
+func (h *healthServer) status(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(redact.Writer{W: w})
+	enc.SetIndent("", "  ")
+	enc.Encode(status.snapshot())
+}
+
+// shutdown stops the server, letting requests in flight finish
+func (h *healthServer) shutdown() {
+	if h == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.srv.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to stop the health server", "error", err)
+	}
+}
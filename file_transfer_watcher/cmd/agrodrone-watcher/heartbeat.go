@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lastBeat is when the main loop last showed it was alive, in unix nanos
+var lastBeat atomic.Int64
+
+// heartbeatFile is a file whose mtime is kept fresh while the main loop is
+// alive, for a watchdog script: it's touched every time round the loop, at
+// least every interval while the loop is waiting, and while transferring
+// only as long as bytes are moving. An empty path touches nothing
+type heartbeatFile struct {
+	path     string
+	interval time.Duration
+	// now and sleep are the clock, swapped out in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mu      sync.Mutex
+	failing bool
+}
+
+var heartbeat = &heartbeatFile{interval: time.Minute, now: time.Now, sleep: time.Sleep}
+
+// touch sets the file's mtime to now, creating it if need be. Failures are
+// logged once until it works again
+func (h *heartbeatFile) touch() {
+	if h.path == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t := h.now()
+	err := os.Chtimes(h.path, t, t)
+	if errors.Is(err, os.ErrNotExist) {
+		var f *os.File
+		if f, err = os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE, 0o644); err == nil {
+			f.Close()
+			err = os.Chtimes(h.path, t, t)
+		}
+	}
+	if err != nil && !h.failing {
+		slog.Warn("Failed to touch the heartbeat file", "file", h.path, "error", err)
+	}
+	h.failing = err != nil
+}
+
+// beat marks the main loop as alive. It's called every time round the loop,
+// for every file sent and for every stretch of a transfer that moved bytes,
+// so a long batch doesn't look like a hang
+func beat() {
+	lastBeat.Store(heartbeat.now().UnixNano())
+	heartbeat.touch()
+}
+
+// sleep is time.Sleep that keeps the heartbeat going: a loop that's waiting
+// on purpose isn't hung
+func sleep(d time.Duration) {
+	for d > 0 {
+		step := min(d, heartbeat.interval)
+		heartbeat.sleep(step)
+		d -= step
+		beat()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when slept on or told to
+type fakeClock struct {
+	t     time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.slept = append(c.slept, d)
+	c.t = c.t.Add(d)
+}
+
+// fakeHeartbeat points the heartbeat at a file in a temp dir, on a fake
+// clock, for the rest of t
+func fakeHeartbeat(t *testing.T) (*fakeClock, string) {
+	t.Helper()
+	clock := &fakeClock{t: time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)}
+	path := filepath.Join(t.TempDir(), "heartbeat")
+	old := heartbeat
+	heartbeat = &heartbeatFile{path: path, interval: time.Minute, now: clock.now, sleep: clock.sleep}
+	t.Cleanup(func() { heartbeat = old })
+	return clock, path
+}
+
+// age is how long ago, by clock, the heartbeat file was touched
+func age(t *testing.T, clock *fakeClock, path string) time.Duration {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clock.t.Sub(info.ModTime())
+}
+
+func TestHeartbeatCreatesTheFile(t *testing.T) {
+	clock, path := fakeHeartbeat(t)
+	beat()
+	if a := age(t, clock, path); a != 0 {
+		t.Errorf("heartbeat is %v old straight after a beat", a)
+	}
+	if lastBeat.Load() != clock.t.UnixNano() {
+		t.Error("lastBeat wasn't updated")
+	}
+}
+
+func TestHeartbeatKeepsGoingWhileSleeping(t *testing.T) {
+	clock, path := fakeHeartbeat(t)
+	beat()
+	// a long backoff is slept in steps of at most the interval, beating
+	// after each
+	sleep(4*time.Minute + 30*time.Second)
+	want := []time.Duration{time.Minute, time.Minute, time.Minute, time.Minute, 30 * time.Second}
+	if len(clock.slept) != len(want) {
+		t.Fatalf("slept %v, want %v", clock.slept, want)
+	}
+	for i := range want {
+		if clock.slept[i] != want[i] {
+			t.Fatalf("slept %v, want %v", clock.slept, want)
+		}
+	}
+	if a := age(t, clock, path); a != 0 {
+		t.Errorf("heartbeat is %v old after sleeping", a)
+	}
+}
+
+func TestHeartbeatLapsesWhenTheTransferStalls(t *testing.T) {
+	clock, path := fakeHeartbeat(t)
+	p := &transferProgress{}
+	p.start(1, 1<<20)
+	beat()
+
+	// bytes moving: the heartbeat keeps up
+	for range 3 {
+		clock.t = clock.t.Add(time.Minute)
+		atomic.AddInt64(&transferredBytes, 1024)
+		p.tick(clock.t)
+		if a := age(t, clock, path); a != 0 {
+			t.Fatalf("heartbeat is %v old while bytes are moving", a)
+		}
+	}
+	// stalled: it goes stale, so a watchdog checking for twice the
+	// interval sees it
+	for range 3 {
+		clock.t = clock.t.Add(time.Minute)
+		p.tick(clock.t)
+	}
+	if a := age(t, clock, path); a <= 2*heartbeat.interval {
+		t.Errorf("heartbeat is only %v old after a 3 minute stall", a)
+	}
+}
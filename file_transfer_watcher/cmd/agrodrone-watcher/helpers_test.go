@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+	"golang.org/x/crypto/ssh"
+)
+
+// testConfig is the default config with its state and export dirs in a
+// temp dir
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	cfg := defaultConfig()
+	dir := t.TempDir()
+	cfg.StateDir = filepath.Join(dir, "state")
+	cfg.ExportDir = filepath.Join(dir, "export")
+	cfg.IngestDir = "/ingest"
+	if err := os.MkdirAll(cfg.ExportDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return &cfg
+}
+
+// writeFiles writes each of names, relative to dir, holding its own name,
+// and returns their paths
+func writeFiles(t *testing.T, dir string, names ...string) []string {
+	t.Helper()
+	var paths []string
+	for _, n := range names {
+		p := filepath.Join(dir, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(n), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// fakeUploader makes dialUploader hand out an in-memory fake, reopened on
+// each dial, for the rest of t
+func fakeUploader(t *testing.T) *transfer.Fake {
+	fake := transfer.NewFake()
+	old := dialUploader
+	dialUploader = func(string, *ssh.ClientConfig) (transfer.Uploader, error) {
+		fake.Mu.Lock()
+		fake.Closed = false
+		fake.Mu.Unlock()
+		return fake, nil
+	}
+	t.Cleanup(func() { dialUploader = old })
+	return fake
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// sshServer starts an SSH server on localhost that accepts any password
+// and runs each command it's given with sh, after passing it through
+// rewrite if that's set. It returns its address
+func sshServer(t *testing.T, rewrite func(cmd string) string) string {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &ssh.ServerConfig{PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) { return nil, nil }}
+	sc.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		l.Close()
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(ctx, c, sc, rewrite)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveSSH(ctx context.Context, c net.Conn, sc *ssh.ServerConfig, rewrite func(string) string) {
+	_, chans, reqs, err := ssh.NewServerConn(c, sc)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		ch, rq, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for r := range rq {
+				if r.Type != "exec" {
+					r.Reply(false, nil)
+					continue
+				}
+				line := string(r.Payload[4 : 4+binary.BigEndian.Uint32(r.Payload)])
+				if rewrite != nil {
+					line = rewrite(line)
+				}
+				cmd := exec.CommandContext(ctx, "sh", "-c", line)
+				cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+				in, _ := cmd.StdinPipe()
+				r.Reply(true, nil)
+				code := 0
+				if err := cmd.Start(); err != nil {
+					code = 127
+				} else {
+					go func() {
+						io.Copy(in, ch)
+						in.Close()
+					}()
+					if err := cmd.Wait(); err != nil {
+						code = 1
+						if exit, ok := err.(*exec.ExitError); ok {
+							code = exit.ExitCode()
+						}
+					}
+				}
+				status := make([]byte, 4)
+				binary.BigEndian.PutUint32(status, uint32(code))
+				ch.SendRequest("exit-status", false, status)
+				ch.Close()
+			}
+		}()
+	}
+}
+
+// fakeWifi is a WifiManager that sees aps and joins whatever it's asked
+// to, recording what it was told. joined, if set, is called on each join
+type fakeWifi struct {
+	aps         []accessPoint
+	active      *accessPoint
+	joined      func(ap accessPoint)
+	connects    []string // "ssid bssid"
+	disconnects []string
+	hotspots    []string
+}
+
+func (f *fakeWifi) Scan() ([]accessPoint, error) { return f.aps, nil }
+
+func (f *fakeWifi) Connect(ssid, psk, bssid string, hidden bool) error {
+	f.connects = append(f.connects, ssid+" "+bssid)
+	for _, ap := range f.aps {
+		if ap.SSID == ssid && (bssid == "" || ap.BSSID == bssid) {
+			f.active = &ap
+			if f.joined != nil {
+				f.joined(ap)
+			}
+			return nil
+		}
+	}
+	if hidden {
+		f.active = &accessPoint{SSID: ssid, BSSID: bssid}
+		return nil
+	}
+	return fmt.Errorf("no network with SSID %q", ssid)
+}
+
+func (f *fakeWifi) Active() (accessPoint, bool) {
+	if f.active == nil {
+		return accessPoint{}, false
+	}
+	return *f.active, true
+}
+
+func (f *fakeWifi) Disconnect(ssid string) error {
+	f.disconnects = append(f.disconnects, ssid)
+	f.active = nil
+	return nil
+}
+
+func (f *fakeWifi) Hotspot(ssid, psk string) error {
+	f.hotspots = append(f.hotspots, ssid)
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	historyBatches = []byte("batches")
+	historyFiles   = []byte("files")
+)
+
+// historyBatch is one batch in the transfer history
+type historyBatch struct {
+	ID         string
+	Start      time.Time
+	End        time.Time
+	RemoteHost string
+	Files      int
+	Sent       int
+	Failed     int
+	Retries    int
+	Bytes      int64
+	// RemoteDir is the ingest dir it went to, with IngestDir's variables
+	// filled in
+	RemoteDir string `json:",omitempty"`
+	// Received and ReceivedBytes are what came back from OutboxDir after it
+	Received      int   `json:",omitempty"`
+	ReceivedBytes int64 `json:",omitempty"`
+
+	AvgBytesPerSec  int64
+	PeakBytesPerSec int64
+	// ClockSkew is how far the ground station's clock was ahead of ours
+	ClockSkew string `json:",omitempty"`
+	// Sessions are the flight sessions the loose files were grouped into
+	Sessions []flightSession `json:",omitempty"`
+	// CountMismatches are the flights that didn't have the number of files
+	// they said they would
+	CountMismatches []flightCount `json:",omitempty"`
+
+	// Outcome is "complete", "partial" or "failed"
+	Outcome string
+	Error   string `json:",omitempty"`
+}
+
+// historyFile is what happened to one file in a batch
+type historyFile struct {
+	Batch    string
+	Path     string
+	Remote   string `json:",omitempty"`
+	Size     int64
+	Duration string `json:",omitempty"`
+	SHA256   string `json:",omitempty"`
+	// Outcome is "sent", "skipped" or "failed"
+	Outcome string
+	Error   string `json:",omitempty"`
+	At      time.Time
+}
+
+// historyKey keys a file's record under its batch, so a batch's files can
+// be read or deleted with a prefix scan
+func historyKey(batch, path string) []byte {
+	return []byte(batch + "\x00" + path)
+}
+
+// updateHistory runs fn against the history database. The database is only
+// held open for the update, so the history subcommands can read it while
+// the watcher runs. Failures are logged and otherwise ignored: the history
+// must never get in the way of a transfer
+func updateHistory(cfg *Config, fn func(tx *bolt.Tx) error) {
+	if cfg.HistoryDays <= 0 {
+		return
+	}
+	err := func() error {
+		if err := os.MkdirAll(cfg.StateDir, 0o755); err != nil {
+			return err
+		}
+		db, err := bolt.Open(cfg.historyPath(), 0o644, &bolt.Options{Timeout: 2 * time.Second})
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.Update(func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{historyBatches, historyFiles} {
+				if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			return fn(tx)
+		})
+	}()
+	if err != nil {
+		slog.Warn("Failed to update transfer history", "error", err)
+	}
+}
+
+// recordFiles adds the outcome of each file in res to batch's history
+func recordFiles(cfg *Config, batch string, res BatchResult) {
+	now := time.Now()
+	var files []historyFile
+	for _, f := range res.Transferred {
+		files = append(files, historyFile{Batch: batch, Path: f.Path, Remote: f.Remote, Size: f.Size,
+			Duration: f.Duration.Round(time.Millisecond).String(), SHA256: f.SHA256, Outcome: "sent", At: now})
+	}
+	for _, p := range res.Skipped {
+		files = append(files, historyFile{Batch: batch, Path: p, Outcome: "skipped", At: now})
+	}
+	for _, fe := range res.Failed {
+		files = append(files, historyFile{Batch: batch, Path: fe.Path, Outcome: "failed", Error: fe.Err.Error(), At: now})
+	}
+	if len(files) == 0 {
+		return
+	}
+	updateHistory(cfg, func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyFiles)
+		for _, f := range files {
+			v, err := json.Marshal(f)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(historyKey(batch, f.Path), []byte(redact.String(string(v)))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recordBatch adds or replaces a batch's summary in the history
+func recordBatch(cfg *Config, h historyBatch) {
+	updateHistory(cfg, func(tx *bolt.Tx) error {
+		v, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(historyBatches).Put([]byte(h.ID), []byte(redact.String(string(v))))
+	})
+}
+
+// pruneHistory drops batches, and their files, older than cfg.HistoryDays
+func pruneHistory(cfg *Config) {
+	cutoff := time.Now().AddDate(0, 0, -cfg.HistoryDays)
+	updateHistory(cfg, func(tx *bolt.Tx) error {
+		var old [][]byte
+		c := tx.Bucket(historyBatches).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var h historyBatch
+			if json.Unmarshal(v, &h) == nil && h.Start.Before(cutoff) {
+				old = append(old, append([]byte(nil), k...))
+			}
+		}
+		files := tx.Bucket(historyFiles)
+		for _, id := range old {
+			if err := tx.Bucket(historyBatches).Delete(id); err != nil {
+				return err
+			}
+			prefix := append(id, 0)
+			fc := files.Cursor()
+			for k, _ := fc.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = fc.Seek(prefix) {
+				if err := files.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		if len(old) > 0 {
+			slog.Info("Pruned transfer history", "batches", len(old))
+		}
+		return nil
+	})
+}
+
+// viewHistory opens the history read-only for the history subcommands
+func viewHistory(cfg *Config, fn func(tx *bolt.Tx) error) error {
+	if _, err := os.Stat(cfg.historyPath()); errors.Is(err, os.ErrNotExist) {
+		return errors.New("no transfer history yet")
+	}
+	db, err := bolt.Open(cfg.historyPath(), 0o644, &bolt.Options{ReadOnly: true, Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(historyBatches) == nil || tx.Bucket(historyFiles) == nil {
+			return errors.New("no transfer history yet")
+		}
+		return fn(tx)
+	})
+}
+
+// historyList prints every batch in the history, newest first
+func historyList(cfg *Config) error {
+	return viewHistory(cfg, func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBatches).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var h historyBatch
+			if err := json.Unmarshal(v, &h); err != nil {
+				continue
+			}
+			fmt.Printf("%s  %-8s  %9s files  %12d bytes  %8s  %s\n", h.ID, h.Outcome, fmt.Sprintf("%d/%d", h.Sent, h.Files), h.Bytes,
+				h.End.Sub(h.Start).Round(time.Second), h.RemoteHost)
+		}
+		return nil
+	})
+}
+
+// historyShow prints a batch and what happened to each of its files
+func historyShow(cfg *Config, id string) error {
+	return viewHistory(cfg, func(tx *bolt.Tx) error {
+		v := tx.Bucket(historyBatches).Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("no batch %q in the history", id)
+		}
+		var h historyBatch
+		if err := json.Unmarshal(v, &h); err != nil {
+			return err
+		}
+		fmt.Printf("Batch %s to %s\n  %s - %s\n  %s: %d/%d files sent, %d failed, %d retried, %d bytes\n  %s/s average, %s/s peak\n",
+			h.ID, h.RemoteHost, h.Start.Format(time.RFC3339), h.End.Format(time.RFC3339), h.Outcome, h.Sent, h.Files,
+			h.Failed, h.Retries, h.Bytes, formatBytes(h.AvgBytesPerSec), formatBytes(h.PeakBytesPerSec))
+		for _, fs := range h.Sessions {
+			fmt.Printf("  %s: %s - %s, %d files, %d bytes\n", fs.Name, fs.Start.Format(time.RFC3339),
+				fs.End.Format(time.RFC3339), fs.Files, fs.Bytes)
+		}
+		if h.RemoteDir != "" {
+			fmt.Printf("  into %s\n", h.RemoteDir)
+		}
+		if h.ClockSkew != "" {
+			fmt.Printf("  ground station clock ahead by %s\n", h.ClockSkew)
+		}
+		for _, c := range h.CountMismatches {
+			fmt.Printf("  %s: %d of %d expected files\n", c.Flight, c.Found, c.Expected)
+		}
+		if h.Error != "" {
+			fmt.Printf("  error: %s\n", h.Error)
+		}
+		prefix := historyKey(id, "")
+		c := tx.Bucket(historyFiles).Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			var f historyFile
+			if err := json.Unmarshal(v, &f); err != nil {
+				continue
+			}
+			line := fmt.Sprintf("  %-7s  %12d  %8s  %s", f.Outcome, f.Size, f.Duration, f.Path)
+			if f.Remote != "" {
+				line += " -> " + f.Remote
+			}
+			if f.Error != "" {
+				line += "  (" + f.Error + ")"
+			}
+			fmt.Println(line)
+		}
+		return nil
+	})
+}
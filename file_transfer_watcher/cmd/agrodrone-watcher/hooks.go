@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+	"golang.org/x/crypto/ssh"
+)
+
+// batchInfo describes a verified batch to the post-transfer hooks
+type batchInfo struct {
+	ID        string
+	Files     int
+	Bytes     int64
+	RemoteDir string
+}
+
+// env is the batch as environment variables, e.g. AGRODRONE_BATCH_ID
+func (b batchInfo) env() []string {
+	return []string{
+		"AGRODRONE_BATCH_ID=" + b.ID,
+		fmt.Sprintf("AGRODRONE_FILES=%d", b.Files),
+		fmt.Sprintf("AGRODRONE_BYTES=%d", b.Bytes),
+		"AGRODRONE_REMOTE_DIR=" + b.RemoteDir,
+	}
+}
+
+// runHooks runs the local PostTransferCommand and the PostTransferRemote
+// command on the ground station for a verified batch, trying each up to
+// cfg.HookAttempts times. Failures are only logged; by now the batch has
+// already been cleaned up, or with CleanupOn ack is waiting on the ground
+// station
+func runHooks(cfg *Config, addr string, b batchInfo) {
+	if len(cfg.PostTransferCommand) > 0 {
+		retryHook("post-transfer command", cfg.HookAttempts, func() error {
+			out, err := runCommandEnv(cfg.HookTimeout.Duration, b.env(), cfg.PostTransferCommand[0], cfg.PostTransferCommand[1:]...)
+			if msg := strings.TrimSpace(string(out)); msg != "" {
+				slog.Info("Post-transfer command output", "output", msg)
+			}
+			return err
+		})
+	}
+	if cfg.PostTransferRemote != "" {
+		retryHook("remote post-transfer command", cfg.HookAttempts, func() error {
+			return runRemote(addr, sshConfig(cfg), b, cfg.PostTransferRemote)
+		})
+	}
+}
+
+// retryHook calls fn until it succeeds or attempts run out
+func retryHook(name string, attempts int, fn func() error) {
+	for i := 1; i <= attempts; i++ {
+		err := fn()
+		if err == nil {
+			slog.Debug("Hook succeeded", "hook", name)
+			return
+		}
+		slog.Warn("Hook failed", "hook", name, "attempt", i, "attempts", attempts, "error", err)
+		if i < attempts {
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// runRemote runs command on the ground station with the batch's variables
+// set. They're put on the command line since sshd usually refuses to pass
+// on environment variables
+func runRemote(addr string, config *ssh.ClientConfig, b batchInfo, command string) error {
+	client, err := transfer.DialSSH(addr, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	var vars []string
+	for _, kv := range b.env() {
+		k, v, _ := strings.Cut(kv, "=")
+		vars = append(vars, k+"="+shellQuote(v))
+	}
+	out, err := session.CombinedOutput(strings.Join(vars, " ") + " sh -c " + shellQuote(command))
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		slog.Info("Remote post-transfer command output", "output", msg)
+	}
+	return err
+}
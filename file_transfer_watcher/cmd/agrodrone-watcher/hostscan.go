@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+	"golang.org/x/crypto/ssh"
+)
+
+// scanForHost looks for the ground station on the /24 that iface is on: it
+// probes every address for an open SSH port, at most rate probes per second,
+// then does an SSH handshake with each responder and returns the host:port
+// of the one whose host key matches fingerprint. No credentials are sent;
+// the handshake is abandoned as soon as the host key has been seen
+func scanForHost(iface string, port int, fingerprint string, rate int) (string, error) {
+	if fingerprint == "" {
+		return "", errors.New("scanning needs HostKeyFingerprint to identify the ground station")
+	}
+	self := interfaceIP(iface)
+	if self == nil {
+		return "", fmt.Errorf("no IPv4 address on %s", iface)
+	}
+	self = self.To4()
+
+	ticker := time.NewTicker(time.Second / time.Duration(max(rate, 1)))
+	defer ticker.Stop()
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		open []string
+	)
+	for i := 1; i < 255; i++ {
+		if byte(i) == self[3] {
+			continue
+		}
+		<-ticker.C
+		ip := net.IPv4(self[0], self[1], self[2], byte(i))
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if dialOK(&net.Dialer{Timeout: 500 * time.Millisecond}, addr) {
+				mu.Lock()
+				open = append(open, addr)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, addr := range open {
+		if hostKeyMatches(addr, fingerprint) {
+			return addr, nil
+		}
+		slog.Debug("SSH open but a different host key", "addr", addr)
+	}
+	return "", fmt.Errorf("no host on %s's subnet presented host key %s (%d with SSH open)",
+		iface, fingerprint, len(open))
+}
+
+// errHostKeySeen aborts a handshake once we've looked at the host key
+var errHostKeySeen = errors.New("host key seen")
+
+// hostKeyMatches does just enough of an SSH handshake with addr to check its
+// host key against fingerprint
+func hostKeyMatches(addr, fingerprint string) bool {
+	matched := false
+	config := &ssh.ClientConfig{
+		User: "probe",
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			matched = ssh.FingerprintSHA256(key) == fingerprint
+			return errHostKeySeen
+		},
+		Timeout: 3 * time.Second,
+	}
+	client, err := transfer.DialSSH(addr, config)
+	if err == nil {
+		_ = client.Close()
+	}
+	return matched
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// Modes the watcher can run in. In client mode (the default) the drone joins
+// the ground station's AP; in hotspot mode the drone is the AP and waits for
+// the ground station to join it
+const (
+	modeClient  = "client"
+	modeHotspot = "hotspot"
+)
+
+// linkPath is how the ground station is reached under cfg: "wifi" when we
+// join one of Networks, "hotspot" when it joins ours, and "unmanaged" when
+// something else looks after the link. A "wifi" link may still turn out to
+// be wired, once we look
+func linkPath(cfg *Config) string {
+	switch {
+	case cfg.Mode == modeHotspot:
+		return "hotspot"
+	case cfg.managesWifi():
+		return "wifi"
+	}
+	return "unmanaged"
+}
+
+// startHotspot brings up the hotspot in hotspot mode, unless HotspotSSID
+// is left empty for something else to do it
+func startHotspot(cfg *Config, wifi WifiManager) error {
+	if cfg.Mode != modeHotspot || cfg.HotspotSSID == "" {
+		return nil
+	}
+	slog.Info("Bringing up hotspot", "ssid", cfg.HotspotSSID)
+	return wifi.Hotspot(cfg.HotspotSSID, cfg.HotspotPSK)
+}
+
+// arpTable is the kernel's ARP table, swapped out in tests
+var arpTable = "/proc/net/arp"
+
+// inARPTable reports whether host has a complete entry in the kernel's ARP
+// table, i.e. it has joined the hotspot and talked to us. Only IPv4 literals
+// can be looked up; anything else is reported as present so the reachability
+// check decides instead
+func inARPTable(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() == nil {
+		return true
+	}
+	f, err := os.Open(arpTable)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	// IP address  HW type  Flags  HW address  Mask  Device
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[0] == ip.String() && fields[2] == "0x2" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the same drone's config, switched from joining the ground station's
+// network to hosting its own
+const clientConfig = `{
+	"RemoteHost": "10.42.0.2",
+	"Networks": [{"SSID": "groundstation", "PSK": "field-psk"}],
+	"HotspotSSID": "agrodrone",
+	"HotspotPSK": "hotspot-psk"
+}`
+
+const hotspotConfig = `{
+	"Mode": "hotspot",
+	"RemoteHost": "10.42.0.2",
+	"Networks": [{"SSID": "groundstation", "PSK": "field-psk"}],
+	"HotspotSSID": "agrodrone",
+	"HotspotPSK": "hotspot-psk"
+}`
+
+func TestSwitchingModes(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name     string
+		config   string
+		path     string
+		hotspots int
+	}{
+		{name: "client", config: clientConfig, path: "wifi"},
+		{name: "hotspot", config: hotspotConfig, path: "hotspot", hotspots: 1},
+		// and back, which leaves the hotspot down
+		{name: "client again", config: clientConfig, path: "wifi"},
+		{name: "client with no networks", config: `{"RemoteHost": "10.42.0.2"}`, path: "unmanaged"},
+		{name: "hotspot run elsewhere", config: `{"Mode": "hotspot", "RemoteHost": "10.42.0.2"}`, path: "hotspot"},
+	} {
+		p := filepath.Join(dir, "config.json")
+		if err := os.WriteFile(p, []byte(tt.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := loadConfig(p)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		wifi := &fakeWifi{}
+		if err := startHotspot(&cfg, wifi); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(wifi.hotspots) != tt.hotspots {
+			t.Errorf("%s: brought up hotspots %v", tt.name, wifi.hotspots)
+		}
+		if got := linkPath(&cfg); got != tt.path {
+			t.Errorf("%s: link path %q, want %q", tt.name, got, tt.path)
+		}
+		// only joining one of Networks touches the WiFi each time round
+		if got := cfg.managesWifi(); got != (tt.path == "wifi") {
+			t.Errorf("%s: managesWifi %v", tt.name, got)
+		}
+	}
+}
+
+func TestInARPTable(t *testing.T) {
+	arp := filepath.Join(t.TempDir(), "arp")
+	old := arpTable
+	arpTable = arp
+	t.Cleanup(func() { arpTable = old })
+
+	// the ground station has an incomplete entry until it answers
+	table := "IP address       HW type     Flags       HW address            Mask     Device\n" +
+		"10.42.0.2        0x1         0x0         00:00:00:00:00:00     *        wlan0\n"
+	if err := os.WriteFile(arp, []byte(table), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if inARPTable("10.42.0.2") {
+		t.Error("an incomplete entry counts as joined")
+	}
+	table += "10.42.0.2        0x1         0x2         dc:a6:32:01:02:03     *        wlan0\n"
+	if err := os.WriteFile(arp, []byte(table), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !inARPTable("10.42.0.2") {
+		t.Error("the ground station hasn't joined once it's answered")
+	}
+	if inARPTable("10.42.0.3") {
+		t.Error("someone else's entry counts")
+	}
+	// a hostname can't be looked up, so it's left to the reachability check
+	if !inARPTable("groundstation.local") {
+		t.Error("a hostname is waited on")
+	}
+}
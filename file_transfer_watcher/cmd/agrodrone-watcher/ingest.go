@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ingestVars are the variables an IngestDir can use
+var ingestVars = []string{"{device}", "{yyyy}", "{mm}", "{dd}", "{batch}", "{session}"}
+
+var ingestVarPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// checkIngestDir catches IngestDir templates that use variables we don't
+// have or could reach outside where they're meant to. Plain dirs are left
+// as they always were
+func checkIngestDir(dir string) error {
+	if !templated(dir) {
+		return nil
+	}
+	for _, v := range ingestVarPattern.FindAllString(dir, -1) {
+		if !slices.Contains(ingestVars, v) {
+			return fmt.Errorf("unknown variable %s; it can use %s", v, strings.Join(ingestVars, ", "))
+		}
+	}
+	if !path.IsAbs(dir) || slices.Contains(strings.Split(dir, "/"), "..") {
+		return fmt.Errorf("must be an absolute path without ..")
+	}
+	return nil
+}
+
+// templated reports whether dir has variables to fill in
+func templated(dir string) bool {
+	return ingestVarPattern.MatchString(dir)
+}
+
+// expandIngest fills in dir's variables for batch and, within it, session:
+// the flight directory or session its files are from, or "" for loose
+// files. Dates are the batch's start in UTC
+func expandIngest(dir, device, batch, session string) string {
+	if !templated(dir) {
+		return dir
+	}
+	start := time.Now()
+	if t, err := batchTime(batch); err == nil {
+		start = t
+	}
+	start = start.UTC()
+	return path.Clean(strings.NewReplacer(
+		"{device}", device,
+		"{yyyy}", start.Format("2006"),
+		"{mm}", start.Format("01"),
+		"{dd}", start.Format("02"),
+		"{batch}", batch,
+		"{session}", session,
+	).Replace(dir))
+}
+
+// unitFiles points the files of u at where they go inside its ingest dir
+// when the template dir names it after the unit ({session}), so the unit's
+// name isn't in their paths twice
+func unitFiles(cfg *Config, u batchUnit, dir string) []batchFile {
+	if u.Name == "" || !strings.Contains(dir, "{session}") {
+		return u.Files
+	}
+	files := slices.Clone(u.Files)
+	for i, f := range files {
+		rel := f.Remote
+		if rel == "" {
+			r, err := filepath.Rel(cfg.ExportDir, f.Path)
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(r)
+		}
+		if r, ok := strings.CutPrefix(rel, u.Name+"/"); ok {
+			files[i].Remote = r
+		}
+	}
+	return files
+}
+
+// commonDir is the deepest directory all of dirs are in
+func commonDir(dirs []string) string {
+	if len(dirs) == 0 {
+		return ""
+	}
+	common := dirs[0]
+	for _, d := range dirs[1:] {
+		for common != "/" && common != "." && d != common && !strings.HasPrefix(d, common+"/") {
+			common = path.Dir(common)
+		}
+	}
+	return common
+}
+
+// unitDir is where u's files go in the batch being sent
+func unitDir(cfg *Config, ingestDir string, u batchUnit) string {
+	return expandIngest(ingestDir, cfg.DeviceID, journal.currentBatch(), u.Name)
+}
+
+// batchDir is the ingest dir every unit in the batch being sent goes in
+func batchDir(cfg *Config, ingestDir string, units []batchUnit) string {
+	if !templated(ingestDir) {
+		return ingestDir
+	}
+	var dirs []string
+	for _, u := range units {
+		dirs = append(dirs, unitDir(cfg, ingestDir, u))
+	}
+	return commonDir(dirs)
+}
+
+// remoteDirs is every directory on the remote that files go in under dir
+func remoteDirs(exportDir, dir string, files []batchFile) []string {
+	seen := map[string]bool{dir: true}
+	dirs := []string{dir}
+	for _, f := range files {
+		rel := f.Remote
+		if rel == "" {
+			r, err := filepath.Rel(exportDir, f.Path)
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(r)
+		}
+		if d := path.Dir(path.Join(dir, rel)); !seen[d] {
+			seen[d] = true
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+// Per-file states recorded in the journal, in the order a file goes
+// through them
+const (
+	stateQueued       = "queued"
+	stateTransferring = "transferring"
+	stateVerified     = "verified"
+	stateFailed       = "failed"
+	stateDeleted      = "deleted"
+	stateArchived     = "archived"
+	// stateOffloaded is a file copied onto a USB drive, but kept here
+	stateOffloaded = "offloaded"
+)
+
+// journalEntry is one state change of one file
+type journalEntry struct {
+	Time  time.Time
+	Batch string
+	Path  string
+	State string
+	Size  int64  `json:",omitempty"`
+	Error string `json:",omitempty"`
+	// Remote is where it's being sent, once it's known
+	Remote string `json:",omitempty"`
+}
+
+// done reports whether the file has left the export dir for good
+func (e journalEntry) done() bool {
+	return e.State == stateDeleted || e.State == stateArchived
+}
+
+// fileJournal is an append-only log of file state changes, one JSON object
+// per line, so after a crash or reboot we know which files already made it
+// across. An empty path records nothing
+type fileJournal struct {
+	mu     sync.Mutex
+	path   string
+	device string // goes in batch IDs
+	batch  string
+}
+
+var journal = &fileJournal{}
+
+// startBatch sets the batch ID that following entries are recorded under,
+// and returns it
+func (j *fileJournal) startBatch() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.batch = newBatchID(j.device)
+	return j.batch
+}
+
+// currentBatch returns the ID of the batch being sent
+func (j *fileJournal) currentBatch() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.batch
+}
+
+// record appends a state change for each of files
+func (j *fileJournal) record(state, errMsg string, files ...sentFile) {
+	j.recordIn(j.currentBatch(), state, errMsg, files...)
+}
+
+// recordIn is record under a batch other than the one being sent
+func (j *fileJournal) recordIn(batch, state, errMsg string, files ...sentFile) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.path == "" || len(files) == 0 {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o755); err != nil {
+		slog.Error("Failed to write journal", "file", j.path, "error", err)
+		return
+	}
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		slog.Error("Failed to write journal", "file", j.path, "error", err)
+		return
+	}
+	defer f.Close()
+	enc := json.NewEncoder(redact.Writer{W: f})
+	now := time.Now()
+	for _, sf := range files {
+		e := journalEntry{Time: now, Batch: batch, Path: sf.Path, State: state, Size: sf.Size, Error: errMsg, Remote: sf.Remote}
+		if err := enc.Encode(e); err != nil {
+			slog.Error("Failed to write journal", "file", j.path, "error", err)
+			return
+		}
+	}
+}
+
+// readJournal returns the latest entry for each file in the journal at
+// path. A line cut short by a crash is skipped
+func readJournal(path string) (map[string]journalEntry, error) {
+	latest := map[string]journalEntry{}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return latest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		latest[e.Path] = e
+	}
+	return latest, sc.Err()
+}
+
+// recoverJournal picks up where the last run left off. Files the remote had
+// already confirmed but that weren't cleaned up yet are cleaned up now
+// rather than sent again; anything mid-transfer is left for
+// reconcileInterrupted once the link is up. With CleanupOn ack they're
+// sent again instead, so the ground station gets to ack them. The journal
+// is then compacted down to the files still in play
+func recoverJournal(cfg *Config) {
+	latest, err := readJournal(journal.path)
+	if err != nil {
+		slog.Error("Failed to read journal", "file", journal.path, "error", err)
+		return
+	}
+	var verified []sentFile
+	var live []journalEntry
+	for _, e := range latest {
+		if e.done() {
+			continue
+		}
+		info, err := os.Stat(e.Path)
+		if err != nil {
+			continue // gone since; nothing to do
+		}
+		if e.State == stateVerified && info.Size() == e.Size && cfg.CleanupOn != cleanupAck {
+			verified = append(verified, sentFile{Path: e.Path, Size: e.Size})
+			continue
+		}
+		live = append(live, e)
+	}
+
+	// rewrite the journal with just what's left before cleaning up, which
+	// appends to it again
+	sort.Slice(live, func(i, j int) bool { return live[i].Time.Before(live[j].Time) })
+	if err := writeJournal(journal.path, live); err != nil {
+		slog.Error("Failed to compact journal", "file", journal.path, "error", err)
+	}
+	if len(verified) > 0 {
+		slog.Info("Recovering files already transferred before the restart", "files", len(verified))
+		if err := cleanupSent(cfg, verified); err != nil {
+			slog.Error("Failed to clean up recovered files", "error", err)
+		}
+	}
+}
+
+// writeJournal replaces the journal at path with entries
+func writeJournal(path string, entries []journalEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(redact.Writer{W: f})
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// printQueue dumps the latest state of every file in the journal that's
+// still in the export dir, oldest first
+func printQueue(cfg *Config) error {
+	latest, err := readJournal(cfg.journalPath())
+	if err != nil {
+		return err
+	}
+	var entries []journalEntry
+	for _, e := range latest {
+		if !e.done() {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	for _, e := range entries {
+		line := fmt.Sprintf("%s  %-12s  %-15s  %10d  %s", e.Time.Format(time.RFC3339), e.State, e.Batch, e.Size, e.Path)
+		if e.Error != "" {
+			line += "  (" + e.Error + ")"
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("%d files\n", len(entries))
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+// journalSocket is where journald takes native protocol messages
+const journalSocket = "/run/systemd/journal/socket"
+
+// journaldAvailable reports whether we're running under systemd with our
+// output going to the journal, and journald is listening
+func journaldAvailable() bool {
+	if os.Getenv("JOURNAL_STREAM") == "" {
+		return false
+	}
+	_, err := os.Stat(journalSocket)
+	return err == nil
+}
+
+// journaldHandler sends log records straight to journald, at the syslog
+// priority matching their level and with their attributes as journal
+// fields (batch_id becomes BATCH_ID=), so `journalctl -p err` and
+// `journalctl BATCH_ID=...` work. A record journald won't take goes to
+// stderr instead
+type journaldHandler struct {
+	conn   *net.UnixConn
+	mu     *sync.Mutex
+	level  slog.Leveler
+	prefix string // from WithGroup
+	attrs  []slog.Attr
+}
+
+func newJournaldHandler(level slog.Leveler) (*journaldHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldHandler{conn: conn, mu: &sync.Mutex{}, level: level}, nil
+}
+
+func (h *journaldHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *journaldHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", r.Message)
+	journalField(&b, "PRIORITY", fmt.Sprint(journalPriority(r.Level, r.Message)))
+	journalField(&b, "SYSLOG_IDENTIFIER", "agrodrone-watcher")
+	for _, a := range h.attrs {
+		journalAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		journalAttr(&b, h.prefix, a)
+		return true
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.conn.Write(b.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", r.Level, redact.String(r.Message))
+	}
+	return nil
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.prefix = h.prefix + name + "_"
+	return &h2
+}
+
+// journalPriority maps a level to a syslog priority. Lines from the log
+// package all come in at info, so their CRITICAL/ERROR/WARNING prefixes are
+// honoured too
+func journalPriority(l slog.Level, msg string) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3
+	case l >= slog.LevelWarn:
+		return 4
+	case l < slog.LevelInfo:
+		return 7
+	case strings.HasPrefix(msg, "CRITICAL:"):
+		return 2
+	case strings.HasPrefix(msg, "ERROR:"):
+		return 3
+	case strings.HasPrefix(msg, "WARNING:"):
+		return 4
+	default:
+		return 6
+	}
+}
+
+// journalAttr adds a as a field, flattening groups into PREFIX_KEY
+func journalAttr(b *bytes.Buffer, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, g := range v.Group() {
+			journalAttr(b, prefix+a.Key+"_", g)
+		}
+		return
+	}
+	journalField(b, prefix+a.Key, v.String())
+}
+
+// journalField writes KEY=value in journald's native protocol. Keys are
+// upper-cased, with anything but letters, digits and _ replaced; values
+// with a newline use the length-prefixed form
+func journalField(b *bytes.Buffer, key, value string) {
+	key = strings.Map(func(r rune) rune {
+		r = unicode.ToUpper(r)
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+	key = strings.TrimLeft(key, "_")
+	if key == "" {
+		return
+	}
+	value = redact.String(value)
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key + "=" + value + "\n")
+		return
+	}
+	b.WriteString(key + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
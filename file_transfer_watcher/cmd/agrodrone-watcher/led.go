@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/warthog618/go-gpiocdev"
+)
+
+// LED patterns, as alternating on and off times starting with on. An empty
+// pattern is solid on
+var (
+	ledSlow   = []time.Duration{time.Second, time.Second}
+	ledFast   = []time.Duration{100 * time.Millisecond, 100 * time.Millisecond}
+	ledSolid  = []time.Duration{}
+	ledDouble = []time.Duration{150 * time.Millisecond, 150 * time.Millisecond, 150 * time.Millisecond, 1050 * time.Millisecond}
+	ledTriple = []time.Duration{150 * time.Millisecond, 150 * time.Millisecond, 150 * time.Millisecond, 150 * time.Millisecond, 150 * time.Millisecond, 1050 * time.Millisecond}
+)
+
+// statusLED shows what the main loop is doing on a GPIO line: a slow blink
+// while idle or looking for the ground station, fast while transferring,
+// solid for LEDSuccessHold after a batch completes and a double blink once
+// it's been failing for LEDErrorAfter. A triple blink for LEDSuccessHold
+// says a USB offload is done and the drive can be pulled. A nil statusLED does nothing, and
+// the GPIO chip is only opened when LEDChip is set
+type statusLED struct {
+	cfg  *Config
+	line *gpiocdev.Line
+	wake chan struct{}
+
+	mu           sync.Mutex
+	current      string
+	succeededAt  time.Time
+	failingSince time.Time
+	offloadedAt  time.Time
+}
+
+var led *statusLED
+
+// errorPhases are the phases the main loop ends a failed cycle in
+var errorPhases = map[string]bool{
+	"wifi-backoff": true,
+	"unreachable":  true,
+	"stalled":      true,
+	"error":        true,
+}
+
+// startLED requests the LED's line and starts driving it. A line that can't
+// be had is logged and the watcher carries on without it
+func startLED(cfg *Config) {
+	if cfg.LEDChip == "" {
+		return
+	}
+	opts := []gpiocdev.LineReqOption{gpiocdev.AsOutput(0), gpiocdev.WithConsumer("file_transfer_watcher")}
+	if cfg.LEDActiveLow {
+		opts = append(opts, gpiocdev.AsActiveLow)
+	}
+	line, err := gpiocdev.RequestLine(cfg.LEDChip, cfg.LEDLine, opts...)
+	if err != nil {
+		slog.Warn("Failed to set up the status LED; carrying on without it", "chip", cfg.LEDChip, "line", cfg.LEDLine, "error", err)
+		return
+	}
+	led = &statusLED{cfg: cfg, line: line, wake: make(chan struct{}, 1)}
+	go led.run()
+}
+
+// phase tells the LED which phase the main loop is in. It's called on
+// every status update, so repeats of the same phase are ignored
+func (l *statusLED) phase(p string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if p == l.current {
+		return
+	}
+	l.current = p
+	switch {
+	case p == "sleeping":
+		l.succeededAt, l.failingSince = time.Now(), time.Time{}
+	case p == "idle":
+		l.failingSince = time.Time{}
+	case errorPhases[p] && l.failingSince.IsZero():
+		l.failingSince = time.Now()
+	}
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// offloaded shows that a USB offload has finished
+func (l *statusLED) offloaded() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.offloadedAt = time.Now()
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pattern is what the LED should be showing now
+func (l *statusLED) pattern() []time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.current == "transferring":
+		return ledFast
+	case time.Since(l.offloadedAt) < l.cfg.LEDSuccessHold.Duration:
+		return ledTriple
+	case !l.failingSince.IsZero() && time.Since(l.failingSince) >= l.cfg.LEDErrorAfter.Duration:
+		return ledDouble
+	case l.current == "sleeping" && time.Since(l.succeededAt) < l.cfg.LEDSuccessHold.Duration:
+		return ledSolid
+	}
+	return ledSlow
+}
+
+// run plays the current pattern, picking it again at the end of each pass
+// or as soon as the phase changes
+func (l *statusLED) run() {
+	for {
+		steps := l.pattern()
+		if len(steps) == 0 {
+			l.set(true)
+			// look again every so often so the hold runs out
+			steps = []time.Duration{time.Second}
+		}
+	pass:
+		for i, d := range steps {
+			if len(steps) > 1 {
+				l.set(i%2 == 0)
+			}
+			select {
+			case <-time.After(d):
+			case <-l.wake:
+				break pass
+			}
+		}
+	}
+}
+
+func (l *statusLED) set(on bool) {
+	v := 0
+	if on {
+		v = 1
+	}
+	if err := l.line.SetValue(v); err != nil {
+		slog.Debug("Failed to set the status LED", "error", err)
+	}
+}
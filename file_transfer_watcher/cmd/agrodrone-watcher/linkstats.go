@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transferredBytes counts every byte handed to the remote across all files,
+// so link samples can be lined up with throughput
+var transferredBytes int64
+
+// linkSample is one reading of `iw dev <iface> station dump`
+type linkSample struct {
+	SignalDBm int
+	TxBitrate float64 // MBit/s
+	TxRetries int64
+	TxFailed  int64
+}
+
+// sampleLink reads the current link quality of iface
+func sampleLink(iface string) (linkSample, error) {
+	out, err := runCommand(5*time.Second, "iw", "dev", iface, "station", "dump")
+	if err != nil {
+		return linkSample{}, fmt.Errorf("iw station dump: %w", err)
+	}
+	return parseStationDump(string(out))
+}
+
+// parseStationDump pulls the fields we care about out of iw's output, e.g.
+//
+//	signal:  	-55 [-57, -58] dBm
+//	tx bitrate:	72.2 MBit/s MCS 7 short GI
+//	tx retries:	12
+//	tx failed:	0
+func parseStationDump(out string) (linkSample, error) {
+	var s linkSample
+	found := false
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		switch key {
+		case "signal":
+			if v, err := strconv.Atoi(fields[0]); err == nil {
+				s.SignalDBm = v
+				found = true
+			}
+		case "tx bitrate":
+			s.TxBitrate, _ = strconv.ParseFloat(fields[0], 64)
+		case "tx retries":
+			s.TxRetries, _ = strconv.ParseInt(fields[0], 10, 64)
+		case "tx failed":
+			s.TxFailed, _ = strconv.ParseInt(fields[0], 10, 64)
+		}
+	}
+	if !found {
+		return s, fmt.Errorf("no station in iw output")
+	}
+	return s, nil
+}
+
+// linkSummary is the min/avg/max signal and retry count over a batch
+type linkSummary struct {
+	Samples      int
+	MinSignalDBm int
+	AvgSignalDBm int
+	MaxSignalDBm int
+	TxBitrate    float64 // last seen, MBit/s
+	TxRetries    int64   // during the batch
+	TxFailed     int64
+}
+
+func (l linkSummary) String() string {
+	if l.Samples == 0 {
+		return "no link samples"
+	}
+	return fmt.Sprintf("signal %d/%d/%d dBm (min/avg/max), tx %.1f MBit/s, %d retries, %d failed",
+		l.MinSignalDBm, l.AvgSignalDBm, l.MaxSignalDBm, l.TxBitrate, l.TxRetries, l.TxFailed)
+}
+
+// linkStats accumulates samples taken while a transfer runs
+type linkStats struct {
+	mu     sync.Mutex
+	sum    int
+	first  linkSample
+	result linkSummary
+}
+
+func (ls *linkStats) add(s linkSample) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	r := &ls.result
+	if r.Samples == 0 {
+		ls.first = s
+		r.MinSignalDBm, r.MaxSignalDBm = s.SignalDBm, s.SignalDBm
+	}
+	r.Samples++
+	ls.sum += s.SignalDBm
+	r.MinSignalDBm = min(r.MinSignalDBm, s.SignalDBm)
+	r.MaxSignalDBm = max(r.MaxSignalDBm, s.SignalDBm)
+	r.AvgSignalDBm = ls.sum / r.Samples
+	r.TxBitrate = s.TxBitrate
+	r.TxRetries = s.TxRetries - ls.first.TxRetries
+	r.TxFailed = s.TxFailed - ls.first.TxFailed
+}
+
+func (ls *linkStats) summary() linkSummary {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.result
+}
+
+// run samples iface every interval until ctx is done, logging each sample
+// next to the throughput since the previous one and keeping the running
+// summary in the status file
+func (ls *linkStats) run(ctx context.Context, iface string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastBytes, lastAt := atomic.LoadInt64(&transferredBytes), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s, err := sampleLink(iface)
+			if err != nil {
+				slog.Debug("Failed to sample the link", "error", err)
+				continue
+			}
+			ls.add(s)
+			n := atomic.LoadInt64(&transferredBytes)
+			mibps := float64(n-lastBytes) / now.Sub(lastAt).Seconds() / 1024 / 1024
+			lastBytes, lastAt = n, now
+			slog.Info("Link", "signal_dbm", s.SignalDBm, "tx_mbit_per_sec", s.TxBitrate, "tx_retries", s.TxRetries,
+				"mib_per_sec", math.Round(mibps*100)/100)
+			summary := ls.summary()
+			status.update(func(st *statusData) { st.Link = &summary })
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// loadPoll is how often the load is checked again while transfers are
+// held for it
+const loadPoll = 5 * time.Second
+
+// ioSample is how long the export dir's device is watched to work out how
+// busy it is
+const ioSample = time.Second
+
+// loadStatus is the load gate as shown in the status file
+type loadStatus struct {
+	Held   bool
+	Reason string `json:",omitempty"`
+	// Since is when it last started or stopped holding, and HeldFor how
+	// long it's been holding
+	Since   time.Time
+	HeldFor string `json:",omitempty"`
+	// Forced is set once it's held for LoadMaxDefer and has given way
+	Forced bool `json:",omitempty"`
+}
+
+// loadGate holds off sending while the capture pipeline is busy: the load
+// average over LoadMax, the export dir's device busier than IOUtilMax
+// percent, or CaptureActiveFile there. After LoadMaxDefer it gives way
+// anyway, so a wedged capture can't keep the data on the drone for good.
+// A nil gate never holds
+type loadGate struct {
+	maxLoad     float64
+	maxUtil     float64
+	captureFile string
+	maxDefer    time.Duration
+	stat        string // the device's stat file in /sys
+
+	mu        sync.Mutex
+	heldSince time.Time
+	last      loadStatus
+}
+
+var load *loadGate
+
+// startLoadGate sets up the gate if any of its limits are configured
+func startLoadGate(cfg *Config) {
+	if cfg.LoadMax <= 0 && cfg.IOUtilMax <= 0 && cfg.CaptureActiveFile == "" {
+		return
+	}
+	load = &loadGate{
+		maxLoad:     cfg.LoadMax,
+		maxUtil:     cfg.IOUtilMax,
+		captureFile: cfg.CaptureActiveFile,
+		maxDefer:    cfg.LoadMaxDefer.Duration,
+	}
+	if cfg.IOUtilMax > 0 {
+		var st unix.Stat_t
+		if err := unix.Stat(cfg.ExportDir, &st); err != nil {
+			slog.Warn("Can't find the export dir's device; not checking how busy it is", "error", err)
+			return
+		}
+		load.stat = fmt.Sprintf("/sys/dev/block/%d:%d/stat", unix.Major(st.Dev), unix.Minor(st.Dev))
+	}
+}
+
+// check reports whether sending can go ahead and, if not, why. It's
+// updated in the status file whenever that changes
+func (g *loadGate) check() (bool, string) {
+	if g == nil {
+		return true, ""
+	}
+	reason := g.condition()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	next := loadStatus{Held: reason != "", Reason: reason, Since: g.last.Since}
+	switch {
+	case reason == "":
+		if !g.heldSince.IsZero() {
+			slog.Info("Load is down; sending", "held_for", now.Sub(g.heldSince).Round(time.Second).String())
+			next.Since = now
+		}
+		g.heldSince = time.Time{}
+	case g.heldSince.IsZero():
+		slog.Info("Holding transfers for the capture pipeline", "reason", reason, "max", g.maxDefer)
+		g.heldSince, next.Since = now, now
+		fallthrough
+	default:
+		held := now.Sub(g.heldSince)
+		next.HeldFor = held.Round(time.Second).String()
+		if held >= g.maxDefer {
+			if !g.last.Forced {
+				slog.Warn("Held for too long; sending anyway", "reason", reason, "held_for", next.HeldFor)
+			}
+			next.Held, next.Forced = false, true
+		}
+	}
+	if next != g.last {
+		g.last = next
+		s := next
+		status.update(func(d *statusData) { d.Load = &s })
+	}
+	return !next.Held, reason
+}
+
+// condition is why the capture pipeline looks busy, or "" if it doesn't
+func (g *loadGate) condition() string {
+	if g.captureFile != "" {
+		if _, err := os.Stat(g.captureFile); err == nil {
+			return g.captureFile + " says capturing"
+		}
+	}
+	if g.maxLoad > 0 {
+		if avg, err := loadAverage(); err != nil {
+			slog.Debug("Failed to read the load average", "error", err)
+		} else if avg > g.maxLoad {
+			return fmt.Sprintf("load average %.2f over %.2f", avg, g.maxLoad)
+		}
+	}
+	if g.stat != "" {
+		if util, err := ioUtil(g.stat, ioSample); err != nil {
+			slog.Debug("Failed to read how busy the export dir's device is", "error", err)
+		} else if util > g.maxUtil {
+			return fmt.Sprintf("export device %.0f%% busy, over %.0f%%", util, g.maxUtil)
+		}
+	}
+	return ""
+}
+
+// loadAverage is the 1 minute load average
+func loadAverage() (float64, error) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// ioUtil is the percentage of the time over d that the device with the
+// stat file at p was busy, as iostat's %util
+func ioUtil(p string, d time.Duration) (float64, error) {
+	before, err := ioTicks(p)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	time.Sleep(d)
+	after, err := ioTicks(p)
+	if err != nil {
+		return 0, err
+	}
+	return float64(after-before) / float64(time.Since(start).Milliseconds()) * 100, nil
+}
+
+// ioTicks is the milliseconds the device has spent doing I/O, the 10th
+// field of its stat file
+func ioTicks(p string) (uint64, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 10 {
+		return 0, fmt.Errorf("%s has %d fields", p, len(fields))
+	}
+	return strconv.ParseUint(fields[9], 10, 64)
+}
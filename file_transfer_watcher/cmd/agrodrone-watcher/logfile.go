@@ -0,0 +1,117 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that's rotated once it reaches maxSize: path
+// becomes path.1 (gzipped to path.1.gz with compress), path.1 becomes
+// path.2 and so on, keeping keep old files. Writes are serialised, so a
+// line is never split across files or lost during a rotation
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	keep     int
+	compress bool
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int, compress bool) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, keep: keep, compress: compress}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// keep logging to the file we have rather than lose the line
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the old files along, dropping the oldest, and starts a new
+// file at path
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	ext := ""
+	if r.compress {
+		ext = ".gz"
+	}
+	if r.keep > 0 {
+		os.Remove(fmt.Sprintf("%s.%d%s", r.path, r.keep, ext))
+		for i := r.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d%s", r.path, i, ext), fmt.Sprintf("%s.%d%s", r.path, i+1, ext))
+		}
+		old := r.path + ".1"
+		if err := os.Rename(r.path, old); err != nil {
+			r.open()
+			return err
+		}
+		if r.compress {
+			if err := gzipFile(old); err != nil {
+				fmt.Fprintf(os.Stderr, "compressing %s: %v\n", old, err)
+			}
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		r.open()
+		return err
+	}
+	return r.open()
+}
+
+// gzipFile compresses path to path.gz and removes path
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sync/atomic"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+// setupLogging picks the log format and level and where logs go. "text" is
+// the log package's usual timestamped lines with any fields appended;
+// "json" is one object per line for log shippers; "journald" sends them
+// straight to the journal (w is unused). "auto" is journald when running
+// under systemd and text otherwise. Anything a library logs with the log
+// package goes the same way, at info level. Secrets registered with
+// redact.Add are masked whichever way logs go, and a copy of every line goes
+// to the syslog server if there is one. Every structured line carries device
+func setupLogging(format string, level slog.Level, w io.Writer, device string) error {
+	w = redact.Writer{W: w}
+	text := w
+	if syslogOut != nil {
+		text = io.MultiWriter(w, syslogOut)
+	}
+	if format == "auto" {
+		format = "text"
+		if journaldAvailable() {
+			format = "journald"
+		}
+	}
+	switch format {
+	case "journald":
+		h, err := newJournaldHandler(level)
+		if err != nil {
+			setupTextLogging(level, text)
+			slog.Warn("journald unavailable, logging to stderr", "error", err)
+			break
+		}
+		slog.SetDefault(slog.New(batchHandler{withSyslog(h, level)}))
+	case "text":
+		setupTextLogging(level, text)
+	case "json":
+		slog.SetDefault(slog.New(batchHandler{withSyslog(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}), level)}))
+	default:
+		return fmt.Errorf("log format must be \"auto\", \"text\", \"json\" or \"journald\", not %q", format)
+	}
+	if device != "" {
+		slog.SetDefault(slog.Default().With("device", device))
+	}
+	return nil
+}
+
+func setupTextLogging(level slog.Level, w io.Writer) {
+	textLogging = true
+	log.SetOutput(w)
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	slog.SetLogLoggerLevel(level)
+}
+
+// logBatch is the ID of the batch being sent, if any
+var logBatch atomic.Value
+
+// textLogging is set when logs are plain text lines, without fields
+var textLogging bool
+
+// setLogBatch tags every log line with the batch id until it's called
+// again with "": as a batch_id field with structured logging, and by
+// prefixing text lines with it
+func setLogBatch(id string) {
+	logBatch.Store(id)
+	switch {
+	case !textLogging:
+	case id == "":
+		log.SetPrefix("")
+	default:
+		log.SetPrefix("[" + id + "] ")
+	}
+}
+
+// batchHandler adds the batch_id field to records while a batch is being
+// sent
+type batchHandler struct {
+	slog.Handler
+}
+
+func (h batchHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, _ := logBatch.Load().(string); id != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String("batch_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h batchHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return batchHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h batchHandler) WithGroup(name string) slog.Handler {
+	return batchHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs msg with args at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path to JSON config file")
+	debug := flag.Bool("debug", false, "enable debug logging")
+	archiveDir := flag.String("archive-dir", "", "move transferred files here instead of deleting them (overrides ArchiveDir)")
+	once := flag.Bool("once", false, "run one cycle, print a JSON summary and exit with a code saying how it went")
+	noHooks := flag.Bool("no-hooks", false, "don't run the post-transfer hooks")
+	ignoreGate := flag.Bool("ignore-gate", false, "send even while the drone isn't known to be landed, for bench testing")
+	ignoreBattery := flag.Bool("ignore-battery", false, "send even when the battery is low, for bench testing")
+	logFormat := flag.String("log-format", "auto", `log format: "text", "json", "journald", or "auto" for journald under systemd and text otherwise`)
+	logFile := flag.String("log-file", "", "also write logs to this file, rotating it")
+	logMaxSize := flag.Int64("log-max-size", 10<<20, "rotate the -log-file at this many bytes")
+	logKeep := flag.Int("log-keep", 5, "how many rotated log files to keep")
+	logCompress := flag.Bool("log-compress", false, "gzip rotated log files")
+	progressFlag := flag.String("progress", progressAuto, `how to show each file's progress: "tty", "log", "none", or "auto" for tty on a terminal and log otherwise`)
+	healthAddr := flag.String("health-addr", "", "serve the status page, /healthz and /status on this address, e.g. :8081")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics at /metrics on this address, e.g. :9090")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fatal("Failed to load config", "error", err)
+	}
+	configSecrets(&cfg)
+	startSyslog(&cfg)
+	level := slog.LevelInfo
+	if cfg.Debug || *debug {
+		level = slog.LevelDebug
+	}
+	var logOut io.Writer = os.Stderr
+	if *logFile != "" {
+		f, err := openRotatingFile(*logFile, *logMaxSize, *logKeep, *logCompress)
+		if err != nil {
+			fatal("Failed to open log file", "file", *logFile, "error", err)
+		}
+		logOut = io.MultiWriter(os.Stderr, f)
+	}
+	if err := setupLogging(*logFormat, level, logOut, cfg.DeviceID); err != nil {
+		fatal("Bad -log-format", "error", err)
+	}
+	if err := setProgressMode(*progressFlag); err != nil {
+		fatal("Bad -progress", "error", err)
+	}
+	if ran, err := runSubcommand(&cfg, flag.Args()); ran {
+		if err != nil {
+			fatal("Command failed", "error", err)
+		}
+		return
+	}
+
+	slog.Info("Starting application")
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr, cfg.DeviceID)
+	}
+	startMQTT(&cfg)
+	startThumbs(&cfg)
+	startLED(&cfg)
+	if err := startMAVLink(cfg.MAVLinkListen); err != nil {
+		fatal("Failed to listen for MAVLink", "error", err)
+	}
+	startGate(&cfg, *ignoreGate)
+	startBattery(&cfg, *ignoreBattery)
+	startLoadGate(&cfg)
+	if *archiveDir != "" {
+		cfg.ArchiveDir = *archiveDir
+	}
+	if *noHooks {
+		cfg.PostTransferCommand, cfg.PostTransferRemote = nil, ""
+	}
+	status.path = cfg.statusPath()
+	heartbeat.path, heartbeat.interval = cfg.HeartbeatFile, cfg.HeartbeatInterval.Duration
+	journal.path, journal.device = cfg.journalPath(), cfg.DeviceID
+	// in pull mode the journal's files are on the drone
+	if cfg.Direction == directionPush {
+		recoverJournal(&cfg)
+	}
+	pruneHistory(&cfg)
+	var wifi WifiManager
+	if cfg.managesWifi() || cfg.HotspotSSID != "" {
+		wifi, err = newWifiManager(cfg.WifiBackend, cfg.WifiInterface)
+		if err != nil {
+			fatal("Failed to set up WiFi", "error", err)
+		}
+	}
+	if err := startHotspot(&cfg, wifi); err != nil {
+		fatal("Failed to start hotspot", "ssid", cfg.HotspotSSID, "error", err)
+	}
+	filter := newFileFilter(&cfg)
+	if *healthAddr != "" {
+		health, err := serveHealth(*healthAddr, &cfg, filter)
+		if err != nil {
+			fatal("Failed to start the health server", "addr", *healthAddr, "error", err)
+		}
+		// stop the server cleanly rather than dropping a watchdog's
+		// request halfway
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-sigs
+			slog.Info("Shutting down", "signal", sig.String())
+			health.shutdown()
+			os.Exit(0)
+		}()
+	}
+	if webhooks, err = newNotifier(&cfg, filter); err != nil {
+		fatal("Failed to set up webhooks", "error", err)
+	}
+	alerts = newIncidentTracker(cfg.AlertFailures, cfg.AlertRecoverAfter, logAlerts{}, statusAlerts{}, mqttAlerts{})
+	if webhooks != nil {
+		alerts.notifiers = append(alerts.notifiers, webhooks)
+	}
+	if cfg.Direction == directionPull {
+		runPull(&cfg, filter, *once)
+		return
+	}
+	startUSB(&cfg, filter)
+	startCards(&cfg)
+	exportDir := cfg.ExportDir
+	watcher := newExportWatcher(&cfg)
+	// the network we're on; kept across iterations so we don't churn between
+	// ground stations unless the current one disappears
+	var current *Network
+	// address found over mDNS or by scanning the subnet, kept for the session
+	// and re-discovered only after a connection failure
+	var discovered string
+	// files interrupted by the last shutdown are sorted out once, the first
+	// time the link is up
+	reconciled := false
+	// with Fleet, this drone's ingest dir, once it's been made on the remote
+	var madeIngest string
+	wifiBackoff := backoff{base: cfg.WifiBackoffBase.Duration, max: cfg.WifiBackoffMax.Duration}
+	for {
+		beat()
+		disk, err := guardDisk(&cfg)
+		if err != nil {
+			slog.Error("Disk check failed", "error", err)
+		} else {
+			disk = checkDiskSpace(&cfg, disk)
+			status.update(func(s *statusData) { s.Disk = &disk })
+		}
+
+		// only bring the link up when there's something to send
+		quarantineStubs(&cfg, filter)
+		files, bytes := exportBacklog(&cfg, filter)
+		metrics.pending(files, bytes)
+		mqtt.queue(files, bytes)
+		status.update(func(s *statusData) { s.PendingFiles, s.PendingBytes = files, bytes })
+		if len(pendingFiles(&cfg, filter)) == 0 {
+			slog.Info("Nothing to do; waiting for files", "phase", "idle")
+			status.update(func(s *statusData) { s.Phase = "idle" })
+			if *once {
+				finishOnce(exitNothing, nil, nil)
+			}
+			watcher.wait(watcher.idle)
+			continue
+		}
+		// let a burst of new files finish arriving, then take the batch as
+		// it stands; anything later waits for the next one
+		var units []batchUnit
+		if cfg.Trigger == triggerMission {
+			units = missionUnits(&cfg, filter, newStabilityCheck(&cfg))
+		} else {
+			settle(&cfg, filter)
+			units = groupSessions(&cfg, splitUnits(exportDir, captureSets(&cfg, buildBatch(&cfg, filter, newStabilityCheck(&cfg)))))
+			units = checkCounts(&cfg, units)
+		}
+		if len(units) == 0 {
+			slog.Debug("Nothing ready to send yet")
+			if *once {
+				finishOnce(exitNothing, nil, nil)
+			}
+			watcher.wait(cfg.QuiescePeriod.Duration + time.Second)
+			continue
+		}
+		// nothing goes while in the air, where it'd only fight the video
+		// downlink for a link that won't last
+		if open, why := gate.check(); !open {
+			slog.Debug("Waiting for the drone to land", "phase", "waiting-for-landing", "reason", why)
+			status.update(func(s *statusData) { s.Phase = "waiting-for-landing" })
+			if *once {
+				finishOnce(exitNothing, nil, errors.New("waiting for the drone to land: "+why))
+			}
+			sleep(gatePoll)
+			continue
+		}
+		if ok, why := battery.allows(); !ok {
+			slog.Debug("Battery too low to send", "phase", "battery-low", "reason", why)
+			status.update(func(s *statusData) { s.Phase = "battery-low" })
+			if *once {
+				finishOnce(exitNothing, nil, errors.New("battery too low: "+why))
+			}
+			sleep(batteryPoll)
+			continue
+		}
+		if ok, why := load.check(); !ok {
+			slog.Debug("Waiting for the capture pipeline", "phase", "load-high", "reason", why)
+			status.update(func(s *statusData) { s.Phase = "load-high" })
+			if *once {
+				finishOnce(exitNothing, nil, errors.New("capture pipeline busy: "+why))
+			}
+			sleep(loadPoll)
+			continue
+		}
+
+		// if the ground station is already reachable (e.g. over Ethernet on
+		// the bench) there's no need to touch the WiFi at all
+		path := linkPath(&cfg)
+		if path == "wifi" {
+			if wired, _, err := cfg.target(nil); err != nil {
+				slog.Error("Bad ground station address; not checking for a wired link", "error", err)
+			} else if via, ok := reachableVia(wired, cfg.PreferredInterfaces, time.Second); ok {
+				path = via
+				current = nil
+			}
+		}
+		// should check if connected first to not spam connection attempts
+		if path == "wifi" && (current == nil || !checkIfConnected(wifi, current.SSID)) {
+			status.update(func(s *statusData) { s.Phase = "connecting"; s.Network = "" })
+			current = connectedNetwork(wifi, cfg.Networks)
+			var wifiErr error
+			if current == nil {
+				current, wifiErr = findAndConnect(wifi, &cfg)
+			}
+			if current != nil {
+				slog.Info("Connected to network", "ssid", current.SSID)
+				wifiBackoff.reset()
+				status.update(func(s *statusData) {
+					s.Network = current.SSID
+					s.WifiBackoff = ""
+					s.WifiBackoffLevel = 0
+				})
+			} else {
+				// if didn't find a network, back off, then skip to the next
+				// iteration to not run the transfer stuff when not connected.
+				// A transient backend error (e.g. NetworkManager busy) is
+				// retried at the base interval without backing off further
+				wait := wifiBackoff.base
+				if !isTransient(wifiErr) {
+					wait = wifiBackoff.next()
+				}
+				slog.Warn("No network found; backing off", "phase", "wifi-backoff",
+					"retry_in", wait.Round(time.Second).String(), "backoff_level", wifiBackoff.level, "error", wifiErr)
+				status.update(func(s *statusData) {
+					if wifiErr != nil {
+						s.LastError = wifiErr.Error()
+					}
+					s.Phase = "wifi-backoff"
+					s.WifiBackoff = wait.Round(time.Second).String()
+					s.WifiBackoffLevel = wifiBackoff.level
+				})
+				alerts.failed(failWifi, cmp.Or(wifiErr, errors.New("no network found")))
+				if *once {
+					finishOnce(exitLinkDown, nil, cmp.Or(wifiErr, errors.New("no network found")))
+				}
+				sleep(wait)
+				continue
+			}
+		}
+		addr, ingestDir, err := cfg.target(current)
+		if err != nil {
+			wait := wifiBackoff.next()
+			slog.Error("Bad ground station address", "retry_in", wait.Round(time.Second).String(), "error", err)
+			status.update(func(s *statusData) { s.LastError = err.Error() })
+			if *once {
+				finishOnce(exitLinkDown, nil, err)
+			}
+			// another network may do better
+			current = nil
+			sleep(wait)
+			continue
+		}
+		if path == "hotspot" {
+			// wait for the ground station to join us before trying SSH
+			if host, _, _ := net.SplitHostPort(addr); !inARPTable(host) {
+				wait := wifiBackoff.next()
+				slog.Info("Waiting for the ground station to join the hotspot", "phase", "waiting-for-ground-station",
+					"remote_host", host, "retry_in", wait.Round(time.Second).String())
+				status.update(func(s *statusData) { s.Phase = "waiting-for-ground-station" })
+				if *once {
+					finishOnce(exitLinkDown, nil, errors.New("ground station hasn't joined the hotspot"))
+				}
+				sleep(wait)
+				continue
+			}
+		}
+		if cfg.DiscoverMDNS && discovered == "" {
+			discovered, err = discoverIngest(cfg.DiscoveryTimeout.Duration)
+			if err != nil {
+				slog.Warn("mDNS discovery failed; using the configured address", "remote_host", addr, "error", err)
+			} else {
+				slog.Info("Discovered ground station", "remote_host", discovered)
+			}
+		}
+		if discovered != "" {
+			addr = discovered
+		}
+		latency, err := checkReachable(addr, 3, 3*time.Second)
+		if err != nil && cfg.ScanSubnet {
+			slog.Warn("Ground station unreachable; scanning the subnet for it", "remote_host", addr, "interface", cfg.ScanInterface)
+			found, scanErr := scanForHost(cfg.ScanInterface, cfg.SSHPort, cfg.HostKeyFingerprint, cfg.ScanRate)
+			if scanErr != nil {
+				slog.Error("Subnet scan failed", "interface", cfg.ScanInterface, "error", scanErr)
+			} else {
+				slog.Info("Ground station moved", "from", addr, "remote_host", found)
+				discovered, addr = found, found
+				latency, err = checkReachable(addr, 3, 3*time.Second)
+			}
+		}
+		if err != nil {
+			discovered = ""
+			wait := wifiBackoff.next()
+			slog.Warn("Associated but host unreachable", "phase", "unreachable", "remote_host", addr,
+				"retry_in", wait.Round(time.Second).String(), "error", err)
+			status.update(func(s *statusData) { s.Phase = "unreachable"; s.LastError = err.Error() })
+			alerts.failed(failConnect, err)
+			if *once {
+				finishOnce(exitLinkDown, nil, err)
+			}
+			sleep(wait)
+			continue
+		}
+		syslogOut.linkUp()
+		checkClock(&cfg, addr)
+		if holdForClock(&cfg) {
+			slog.Warn("Waiting for NTP to set the clock before sending", "phase", "waiting-for-clock")
+			status.update(func(s *statusData) { s.Phase = "waiting-for-clock" })
+			if *once {
+				finishOnce(exitNothing, nil, errors.New("waiting for NTP to set the clock"))
+			}
+			sleep(30 * time.Second)
+			continue
+		}
+		if !reconciled {
+			n, err := reconcileInterrupted(&cfg, addr)
+			if err != nil {
+				slog.Warn("Failed to reconcile interrupted files; trying again next time", "phase", "reconciling", "error", err)
+			}
+			reconciled = err == nil
+			if n > 0 {
+				continue // some of the batch is already across
+			}
+		}
+		if cfg.Fleet && !templated(ingestDir) && madeIngest != ingestDir {
+			if err := remoteMkdir(addr, sshConfig(&cfg), ingestDir); err != nil {
+				slog.Warn("Failed to make this drone's ingest dir", "remote_host", addr, "dir", ingestDir, "error", err)
+			} else {
+				madeIngest = ingestDir
+			}
+		}
+		slog.Info("Transferring", "phase", "transferring", "remote_host", addr, "via", path)
+		status.update(func(s *statusData) { s.Phase = "transferring" })
+		ctx, cancel := context.WithCancel(context.Background())
+		if current != nil && cfg.AbortSignal > 0 {
+			go watchSignal(ctx, cancel, wifi, current.SSID, cfg.AbortSignal, cfg.SignalCheckInterval.Duration)
+		}
+		var link linkStats
+		if current != nil && cfg.LinkStatsInterval.Duration > 0 {
+			go link.run(ctx, cfg.WifiInterface, cfg.LinkStatsInterval.Duration)
+		}
+		// each flight's directory is its own unit of work, oldest first, and
+		// a big backlog goes over in several batches. A mission is always a
+		// batch of its own, whatever its size
+		var batches [][]batchUnit
+		if cfg.Trigger == triggerMission {
+			for _, u := range units {
+				batches = append(batches, []batchUnit{u})
+			}
+		} else {
+			batches = chunkUnits(splitByPriority(units), cfg.MaxFilesPerBatch, int64(cfg.MaxBytesPerBatch))
+		}
+		if len(batches) > 1 {
+			slog.Info("Splitting the backlog", "batches", len(batches))
+		}
+		// a quick look at the whole backlog first, then the real thing
+		if cfg.Previews {
+			if err := sendPreviews(ctx, &cfg, units, ingestDir, addr); err != nil {
+				slog.Warn("Failed to send previews; sending the originals anyway", "error", err)
+			}
+		}
+		start := time.Now()
+		flights, err, cleanupErr := sendBatches(ctx, &cfg, batches, ingestDir, addr)
+		cancel()
+		status.update(func(s *statusData) { s.Flights = flights })
+		if cleanupErr != nil {
+			slog.Error("Cleanup failed", "error", cleanupErr)
+		}
+		// with -once, exit saying how it went rather than going round again
+		finish := func() {
+			if *once {
+				finishOnce(transferExit(flights, err, cleanupErr), flights, cmp.Or(err, cleanupErr))
+			}
+		}
+		if errors.Is(err, errPreempted) {
+			// go straight round again, with the new files first
+			slog.Info("Higher-priority files turned up; starting a new batch with them first", "remote_host", addr)
+			finish()
+			continue
+		}
+		if errors.Is(err, errBatteryLow) {
+			// the rest waits until it's charged
+			slog.Warn("Battery critical; stopped sending at a file boundary", "phase", "battery-low", "remote_host", addr)
+			status.update(func(s *statusData) { s.Phase = "battery-low" })
+			finish()
+			continue
+		}
+		if errors.Is(err, errStalled) {
+			// the link probably dropped; go straight back to checking it
+			slog.Warn("Transfer stalled, rechecking connection", "phase", "stalled", "remote_host", addr, "error", err)
+			status.update(func(s *statusData) { s.Phase = "stalled"; s.LastError = err.Error() })
+			alerts.failed(failTransfer, err)
+			finish()
+			discovered = ""
+			continue
+		}
+		if err != nil {
+			slog.Error("Transfer failed", "phase", "error", "remote_host", addr, "error", err)
+			discovered = ""
+			status.update(func(s *statusData) { s.Phase = "error"; s.LastError = err.Error() })
+			alerts.failed(failTransfer, err)
+			finish()
+			sleep(5 * time.Second)
+			continue
+		}
+		if cleanupErr != nil {
+			// the batch isn't done until the export dir is cleaned up; don't
+			// take the long sleep with files left behind
+			status.update(func(s *statusData) { s.Phase = "error"; s.LastError = cleanupErr.Error() })
+			alerts.failed(failCleanup, cleanupErr)
+			finish()
+			sleep(5 * time.Second)
+			continue
+		}
+		// files written after the walk passed them, or still being written,
+		// wait for the next batch
+		left := len(pendingFiles(&cfg, filter))
+		if left > 0 {
+			slog.Info("Files weren't part of this batch; leaving them for the next one", "files", left, "dir", exportDir)
+		}
+
+		slog.Info("Batch complete", "remote_host", addr, "via", path, "duration_ms", time.Since(start).Milliseconds(),
+			"latency_ms", latency.Milliseconds(), "link", link.summary())
+		wifiBackoff.reset()
+		alerts.succeeded()
+
+		// drop the link to save power, unless more files already showed up
+		// and we'd just have to reconnect
+		if current != nil && cfg.DisconnectAfterBatch {
+			if len(pendingFiles(&cfg, filter)) == 0 {
+				slog.Info("Disconnecting", "ssid", current.SSID)
+				if err := wifi.Disconnect(current.SSID); err != nil {
+					slog.Warn("Failed to disconnect", "ssid", current.SSID, "error", err)
+				}
+				current = nil
+				status.update(func(s *statusData) { s.Network = "" })
+			}
+		}
+		finish()
+
+		// running out of space; keep going while there's anything to send
+		if disk.Level == diskCritical {
+			continue
+		}
+
+		// if files transferred, do a bigger timeout, cut short if new ones
+		// turn up. Files left behind only need to finish being written
+		wait := 5 * time.Minute
+		if left > 0 {
+			wait = cfg.QuiescePeriod.Duration + 5*time.Second
+		}
+		slog.Info("Sleeping for a bit", "phase", "sleeping")
+		status.update(func(s *statusData) { s.Phase = "sleeping"; s.LastError = "" })
+		watcher.wait(wait)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// The little of MAVLink we need to tell whether the drone is on the ground
+// and how its battery is: HEARTBEAT for armed or not, EXTENDED_SYS_STATE for
+// landed or not, SYS_STATUS for the battery
+const (
+	mavlinkV1Magic = 0xFE
+	mavlinkV2Magic = 0xFD
+
+	msgHeartbeat        = 0
+	msgSysStatus        = 1
+	msgExtendedSysState = 245
+
+	mavTypeGCS           = 6
+	mavAutopilotInvalid  = 8 // sent by companion computers and the like
+	mavModeFlagArmed     = 0x80
+	mavLandedOnGround    = 1
+	mavlinkSignatureSize = 13
+)
+
+// mavlinkMessages is the CRC_EXTRA and full payload length of each message
+// we read. MAVLink 2 trims trailing zeros off payloads, so they're padded
+// back out
+var mavlinkMessages = map[uint32]struct {
+	crcExtra byte
+	length   int
+}{
+	msgHeartbeat:        {50, 9},
+	msgSysStatus:        {124, 31},
+	msgExtendedSysState: {130, 2},
+}
+
+// mavlinkStale is how long without a heartbeat from the autopilot before we
+// stop believing what it last said
+const mavlinkStale = 5 * time.Second
+
+// mavlinkState is what the autopilot last told us over MAVLink. A nil state,
+// when MAVLinkListen isn't set, knows nothing
+type mavlinkState struct {
+	mu        sync.Mutex
+	heartbeat time.Time
+	autopilot uint8 // system ID
+	armed     bool
+	landed    uint8 // MAV_LANDED_STATE; 0 until we hear
+	battery   int   // percent, or -1 if the autopilot doesn't know
+}
+
+var mav *mavlinkState
+
+// startMAVLink listens for MAVLink on UDP at addr for as long as the
+// watcher runs
+func startMAVLink(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("listen for MAVLink on %s: %w", addr, err)
+	}
+	slog.Info("Listening for MAVLink", "addr", conn.LocalAddr().String())
+	mav = &mavlinkState{battery: -1}
+	go mav.listen(conn)
+	return nil
+}
+
+func (m *mavlinkState) listen(conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			slog.Warn("Failed to read MAVLink; no longer listening", "error", err)
+			return
+		}
+		for _, msg := range parseMAVLink(buf[:n]) {
+			m.handle(msg, time.Now())
+		}
+	}
+}
+
+// handle takes in one message
+func (m *mavlinkState) handle(msg mavlinkMsg, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch msg.id {
+	case msgHeartbeat:
+		// GCSs and companion computers send heartbeats too, always disarmed
+		typ, autopilot, baseMode := msg.payload[4], msg.payload[5], msg.payload[6]
+		if typ == mavTypeGCS || autopilot == mavAutopilotInvalid {
+			return
+		}
+		m.heartbeat, m.autopilot = now, msg.sysID
+		m.armed = baseMode&mavModeFlagArmed != 0
+	case msgExtendedSysState:
+		if msg.sysID == m.autopilot {
+			m.landed = msg.payload[1]
+		}
+	case msgSysStatus:
+		if msg.sysID == m.autopilot {
+			m.battery = int(int8(msg.payload[30]))
+		}
+	}
+}
+
+// fresh reports whether we've heard from the autopilot lately, and if not
+// why not
+func (m *mavlinkState) fresh(now time.Time) (bool, string) {
+	switch {
+	case m == nil:
+		return false, "not listening for MAVLink"
+	case m.heartbeat.IsZero():
+		return false, "no MAVLink heartbeat from the autopilot yet"
+	case now.Sub(m.heartbeat) > mavlinkStale:
+		return false, fmt.Sprintf("no MAVLink heartbeat from the autopilot for %s", now.Sub(m.heartbeat).Round(time.Second))
+	}
+	return true, ""
+}
+
+// onGround is why the autopilot doesn't say it's disarmed and landed, or ""
+// if it does
+func (m *mavlinkState) onGround(now time.Time) string {
+	if m != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+	if ok, why := m.fresh(now); !ok {
+		return why
+	}
+	switch {
+	case m.armed:
+		return "armed"
+	case m.landed != mavLandedOnGround:
+		return fmt.Sprintf("not landed (MAV_LANDED_STATE %d)", m.landed)
+	}
+	return ""
+}
+
+// batteryPercent is the autopilot's idea of the battery's charge
+func (m *mavlinkState) batteryPercent(now time.Time) (int, error) {
+	if m != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+	if ok, why := m.fresh(now); !ok {
+		return 0, errors.New(why)
+	}
+	if m.battery < 0 {
+		return 0, errors.New("the autopilot doesn't know the battery's charge")
+	}
+	return m.battery, nil
+}
+
+// mavlinkMsg is one message we read, with its payload padded to full length
+type mavlinkMsg struct {
+	sysID   uint8
+	id      uint32
+	payload []byte
+}
+
+// parseMAVLink returns the messages we read in b, a UDP datagram holding
+// any number of MAVLink 1 and 2 frames. Frames with a bad CRC, and
+// messages we don't read, are skipped
+func parseMAVLink(b []byte) []mavlinkMsg {
+	var msgs []mavlinkMsg
+	for len(b) > 0 {
+		var hdr, n int
+		var id uint32
+		switch b[0] {
+		case mavlinkV1Magic:
+			hdr = 6
+			if len(b) < hdr {
+				return msgs
+			}
+			n, id = int(b[1]), uint32(b[5])
+		case mavlinkV2Magic:
+			hdr = 10
+			if len(b) < hdr {
+				return msgs
+			}
+			n, id = int(b[1]), uint32(b[7])|uint32(b[8])<<8|uint32(b[9])<<16
+		default:
+			b = b[1:]
+			continue
+		}
+		size := hdr + n + 2
+		if b[0] == mavlinkV2Magic && b[2]&1 != 0 {
+			size += mavlinkSignatureSize
+		}
+		if len(b) < size {
+			return msgs
+		}
+		frame := b[:size]
+		b = b[size:]
+		m, ok := mavlinkMessages[id]
+		if !ok {
+			continue
+		}
+		crc := mavlinkCRC(frame[1:hdr+n], m.crcExtra)
+		if binary.LittleEndian.Uint16(frame[hdr+n:]) != crc {
+			continue
+		}
+		payload := make([]byte, max(n, m.length))
+		copy(payload, frame[hdr:hdr+n])
+		sysID := frame[3]
+		if frame[0] == mavlinkV2Magic {
+			sysID = frame[5]
+		}
+		msgs = append(msgs, mavlinkMsg{sysID: sysID, id: id, payload: payload})
+	}
+	return msgs
+}
+
+// mavlinkCRC is MAVLink's X.25 CRC of b followed by crcExtra
+func mavlinkCRC(b []byte, crcExtra byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, c := range append(b[:len(b):len(b)], crcExtra) {
+		t := c ^ byte(crc)
+		t ^= t << 4
+		crc = crc>>8 ^ uint16(t)<<8 ^ uint16(t)<<3 ^ uint16(t>>4)
+	}
+	return crc
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ingestService is the mDNS service the ground station advertises for its
+// SSH ingest endpoint
+const ingestService = "_agrodrone-ingest._tcp.local."
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// discoverIngest browses for ingestService on the local network and returns
+// the host:port of the first instance that resolves, or an error once
+// timeout passes. Queries are sent from an ephemeral port, so responders
+// answer us directly by unicast
+func discoverIngest(timeout time.Duration) (string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return "", fmt.Errorf("mdns listen: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+	if err := mdnsQuery(conn, ingestService, dnsmessage.TypePTR); err != nil {
+		return "", err
+	}
+
+	var (
+		target  string
+		port    uint16
+		addrs   = map[string]net.IP{}
+		askedIP bool
+		buf     = make([]byte, 9000)
+	)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return "", fmt.Errorf("no %s found within %v", ingestService, timeout)
+			}
+			return "", fmt.Errorf("mdns read: %w", err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		for _, rr := range append(msg.Answers, msg.Additionals...) {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.SRVResource:
+				if target == "" {
+					target, port = body.Target.String(), body.Port
+				}
+			case *dnsmessage.AResource:
+				name := rr.Header.Name.String()
+				if _, ok := addrs[name]; !ok {
+					addrs[name] = net.IP(body.A[:])
+				}
+			case *dnsmessage.AAAAResource:
+				// prefer IPv6, but link-local addresses would need a zone
+				if ip := net.IP(body.AAAA[:]); !ip.IsLinkLocalUnicast() {
+					addrs[rr.Header.Name.String()] = ip
+				}
+			}
+		}
+		if target == "" {
+			continue
+		}
+		if ip, ok := addrs[target]; ok {
+			return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+		}
+		// the responder didn't include the address; ask for it
+		if !askedIP {
+			askedIP = true
+			for _, t := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA} {
+				if err := mdnsQuery(conn, target, t); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+}
+
+// mdnsQuery sends a single question for name to the mDNS group
+func mdnsQuery(conn *net.UDPConn, name string, qtype dnsmessage.Type) error {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return err
+	}
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: n, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteToUDP(b, mdnsGroup); err != nil {
+		return fmt.Errorf("mdns query: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+)
+
+// metricsRecorder is what the transfer code reports to. By default
+// everything is discarded; -metrics-addr swaps in promMetrics
+type metricsRecorder interface {
+	// transferred counts a file confirmed on the remote
+	transferred(bytes int64)
+	// failed counts a transfer failure, by reason: "connect", "stalled",
+	// "file", "verify" or "transfer"
+	failed(reason string)
+	wifiAttempt()
+	pending(files int, bytes int64)
+	speed(bytesPerSec float64)
+	// batch notes the ID of the batch being sent
+	batch(id string)
+}
+
+var metrics metricsRecorder = noMetrics{}
+
+type noMetrics struct{}
+
+func (noMetrics) transferred(int64)  {}
+func (noMetrics) failed(string)      {}
+func (noMetrics) wifiAttempt()       {}
+func (noMetrics) pending(int, int64) {}
+func (noMetrics) speed(float64)      {}
+func (noMetrics) batch(string)       {}
+
+// promMetrics keeps the metrics for Prometheus to scrape, in its text
+// exposition format
+type promMetrics struct {
+	device       string // the device label on every metric
+	mu           sync.Mutex
+	files        int64
+	bytes        int64
+	failures     map[string]int64
+	wifiAttempts int64
+	pendingFiles int
+	pendingBytes int64
+	lastSuccess  time.Time
+	bytesPerSec  float64
+	batchID      string
+}
+
+func (m *promMetrics) transferred(bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files++
+	m.bytes += bytes
+	m.lastSuccess = time.Now()
+}
+
+func (m *promMetrics) failed(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[reason]++
+}
+
+func (m *promMetrics) wifiAttempt() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wifiAttempts++
+}
+
+func (m *promMetrics) pending(files int, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pendingFiles, m.pendingBytes = files, bytes
+}
+
+func (m *promMetrics) speed(bytesPerSec float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesPerSec = bytesPerSec
+}
+
+func (m *promMetrics) batch(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batchID = id
+}
+
+func (m *promMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, typ, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{device=%q} %v\n", name, help, name, typ, name, m.device, value)
+	}
+	metric("files_transferred_total", "counter", "Files confirmed on the ground station.", m.files)
+	metric("bytes_transferred_total", "counter", "Bytes of the files confirmed on the ground station.", m.bytes)
+	fmt.Fprint(w, "# HELP transfer_failures_total Transfer failures by reason.\n# TYPE transfer_failures_total counter\n")
+	reasons := make([]string, 0, len(m.failures))
+	for r := range m.failures {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	for _, r := range reasons {
+		fmt.Fprintf(w, "transfer_failures_total{device=%q,reason=%q} %d\n", m.device, r, m.failures[r])
+	}
+	metric("wifi_connect_attempts_total", "counter", "Attempts to join a WiFi network.", m.wifiAttempts)
+	metric("export_dir_pending_files", "gauge", "Files waiting in the export dir.", m.pendingFiles)
+	metric("export_dir_pending_bytes", "gauge", "Bytes waiting in the export dir.", m.pendingBytes)
+	var last int64
+	if !m.lastSuccess.IsZero() {
+		last = m.lastSuccess.Unix()
+	}
+	metric("last_successful_transfer_timestamp", "gauge", "Unix time a file was last transferred.", last)
+	metric("current_transfer_speed_bytes", "gauge", "Transfer speed of the file being sent, in bytes per second.", m.bytesPerSec)
+	if m.batchID != "" {
+		fmt.Fprintf(w, "# HELP transfer_batch_info The batch being sent, or the last one.\n# TYPE transfer_batch_info gauge\ntransfer_batch_info{device=%q,batch_id=%q} 1\n", m.device, m.batchID)
+	}
+}
+
+// serveMetrics starts serving promMetrics on addr at /metrics, labelled
+// with device, and makes it the recorder
+func serveMetrics(addr, device string) {
+	m := &promMetrics{device: device, failures: map[string]int64{}}
+	metrics = m
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Metrics listener failed", "addr", addr, "error", err)
+		}
+	}()
+}
+
+// exportBacklog totals up the files waiting to be sent
+func exportBacklog(cfg *Config, filter *fileFilter) (files int, bytes int64) {
+	watch.Walk(cfg.ExportDir, filter, func(path string, d fs.DirEntry) {
+		if _, ok := priorityOf(cfg, path); !ok || !d.Type().IsRegular() {
+			return
+		}
+		if info, err := d.Info(); err == nil {
+			files++
+			bytes += info.Size()
+		}
+	})
+	return files, bytes
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+)
+
+// Trigger values: send whatever is in the export dir, or only what mission
+// manifests list
+const (
+	triggerAll     = "all"
+	triggerMission = "mission"
+)
+
+// missionPattern matches the manifest the flight stack writes when a
+// mission completes
+var missionPattern = regexp.MustCompile(`^mission_.+\.json$`)
+
+// discrepanciesExt replaces a mission manifest's .json for the report of
+// what didn't match it
+const discrepanciesExt = ".discrepancies.json"
+
+// missionManifest is mission_<id>.json: every file the mission produced,
+// relative to the manifest's directory, with the size and optionally the
+// SHA256 it should have
+type missionManifest struct {
+	Files []missionFile
+}
+
+type missionFile struct {
+	Path   string
+	Size   *int64
+	SHA256 string `json:",omitempty"`
+}
+
+// missionDiscrepancy is a file listed in a manifest that isn't as it says
+type missionDiscrepancy struct {
+	Path    string
+	Problem string
+}
+
+// missionReport is sent as mission_<id>.discrepancies.json, just before
+// the manifest, when a mission goes without some of its files
+type missionReport struct {
+	Manifest      string
+	Discrepancies []missionDiscrepancy
+}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// isMissionManifest reports whether name is a mission manifest
+func isMissionManifest(name string) bool {
+	return missionPattern.MatchString(name) && !strings.HasSuffix(name, discrepanciesExt)
+}
+
+// readMissionManifest reads the manifest at p, saying what's wrong with it
+// if it isn't one
+func readMissionManifest(p string) (missionManifest, error) {
+	var m missionManifest
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return m, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return m, fmt.Errorf("not a mission manifest: %w", err)
+	}
+	if len(m.Files) == 0 {
+		return m, errors.New("Files is missing or empty")
+	}
+	seen := map[string]bool{}
+	for i, f := range m.Files {
+		switch {
+		case f.Path == "":
+			return m, fmt.Errorf("Files[%d] has no Path", i)
+		case path.IsAbs(f.Path) || slices.Contains(strings.Split(f.Path, "/"), ".."):
+			return m, fmt.Errorf("Files[%d] Path %q must be relative to the manifest, without ..", i, f.Path)
+		case seen[path.Clean(f.Path)]:
+			return m, fmt.Errorf("Files[%d] Path %q is listed twice", i, f.Path)
+		case f.Size == nil:
+			return m, fmt.Errorf("Files[%d] (%s) has no Size", i, f.Path)
+		case *f.Size < 0:
+			return m, fmt.Errorf("Files[%d] (%s) Size can't be negative", i, f.Path)
+		case f.SHA256 != "" && !sha256Pattern.MatchString(f.SHA256):
+			return m, fmt.Errorf("Files[%d] (%s) SHA256 must be 64 lowercase hex digits", i, f.Path)
+		}
+		seen[path.Clean(f.Path)] = true
+	}
+	return m, nil
+}
+
+// missionUnits looks for mission manifests in the export dir and returns a
+// unit for each one that's ready, oldest first: every file it lists, once
+// they're all there, finished and as it says, then the manifest itself.
+// Once a manifest is MissionTimeout old it goes with whatever files are
+// right, and a report of the rest. Manifests that can't be read are
+// quarantined
+func missionUnits(cfg *Config, filter *fileFilter, stable *stabilityCheck) []batchUnit {
+	var manifests []batchFile
+	watch.Walk(cfg.ExportDir, filter, func(p string, d fs.DirEntry) {
+		if !d.Type().IsRegular() || !isMissionManifest(d.Name()) {
+			return
+		}
+		info, err := d.Info()
+		if err != nil {
+			return
+		}
+		if ok, why := stable.Ready(p, info); !ok {
+			slog.Debug("Skipping mission manifest for now", "file", p, "reason", why)
+			return
+		}
+		manifests = append(manifests, batchFile{Path: p, Size: info.Size(), ModTime: info.ModTime()})
+	})
+	sort.SliceStable(manifests, func(i, j int) bool { return manifests[i].ModTime.Before(manifests[j].ModTime) })
+
+	var units []batchUnit
+	for _, m := range manifests {
+		if u, ok := missionUnit(cfg, m, stable); ok {
+			units = append(units, u)
+		}
+	}
+	return units
+}
+
+// missionUnit is the unit for the manifest m, if it's ready to go
+func missionUnit(cfg *Config, m batchFile, stable *stabilityCheck) (batchUnit, bool) {
+	man, err := readMissionManifest(m.Path)
+	if err != nil {
+		why := "bad mission manifest: " + err.Error()
+		slog.Warn("Bad mission manifest", "file", m.Path, "reason", why)
+		if err := quarantineFile(cfg, m.Path, why); err != nil {
+			slog.Error("Failed to quarantine file", "file", m.Path, "error", err)
+			return batchUnit{}, false
+		}
+		noteQuarantined(m.Path, why)
+		return batchUnit{}, false
+	}
+	name := strings.TrimSuffix(filepath.Base(m.Path), ".json")
+	dir := filepath.Dir(m.Path)
+	var files []batchFile
+	var problems []missionDiscrepancy
+	for _, f := range man.Files {
+		bf, problem := checkMissionFile(filepath.Join(dir, filepath.FromSlash(f.Path)), f, stable)
+		if problem != "" {
+			problems = append(problems, missionDiscrepancy{Path: f.Path, Problem: problem})
+			continue
+		}
+		files = append(files, bf)
+	}
+	if len(problems) > 0 {
+		if age := time.Since(m.ModTime); age < cfg.MissionTimeout.Duration {
+			slog.Debug("Waiting for mission", "mission", name, "ready", len(files), "files", len(man.Files), "file", problems[0].Path, "problem", problems[0].Problem)
+			return batchUnit{}, false
+		}
+		for _, d := range problems {
+			slog.Warn("Mission file not ready; sending the mission without it", "mission", name, "file", d.Path, "problem", d.Problem)
+		}
+		report := strings.TrimSuffix(m.Path, ".json") + discrepanciesExt
+		if err := writeFileAtomic(report, missionReport{Manifest: filepath.Base(m.Path), Discrepancies: problems}); err != nil {
+			slog.Error("Failed to write mission discrepancies", "file", report, "error", err)
+		} else if info, err := os.Stat(report); err == nil {
+			files = append(files, batchFile{Path: report, Size: info.Size(), ModTime: info.ModTime()})
+		}
+	}
+	// the manifest goes last, so once it's there the mission is
+	files = append(files, m)
+	return batchUnit{Name: name, Files: files}, true
+}
+
+// checkMissionFile checks the file at p against what the manifest says
+// about it, f, returning it to send or what's wrong with it
+func checkMissionFile(p string, f missionFile, stable *stabilityCheck) (batchFile, string) {
+	info, err := os.Stat(p)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return batchFile{}, "missing"
+	case err != nil:
+		return batchFile{}, err.Error()
+	case !info.Mode().IsRegular():
+		return batchFile{}, "not a regular file"
+	}
+	if ok, why := stable.Ready(p, info); !ok {
+		return batchFile{}, "not finished: " + why
+	}
+	if info.Size() != *f.Size {
+		return batchFile{}, fmt.Sprintf("%d bytes, not %d", info.Size(), *f.Size)
+	}
+	if f.SHA256 != "" {
+		sum, err := missionSum(p, info)
+		if err != nil {
+			return batchFile{}, err.Error()
+		}
+		if sum != f.SHA256 {
+			return batchFile{}, "SHA256 is " + sum + ", not " + f.SHA256
+		}
+	}
+	return batchFile{Path: p, Size: info.Size(), ModTime: info.ModTime()}, ""
+}
+
+// cachedSum is a file's SHA256 as of its size and mtime
+type cachedSum struct {
+	size  int64
+	mtime time.Time
+	sum   string
+}
+
+// missionSums saves hashing a mission's files again each time round while
+// it waits for the rest
+var missionSums = map[string]cachedSum{}
+
+// missionSum is the SHA256 of the file at p
+func missionSum(p string, info os.FileInfo) (string, error) {
+	if c, ok := missionSums[p]; ok && c.size == info.Size() && c.mtime.Equal(info.ModTime()) {
+		return c.sum, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum, err := hashFile(f)
+	if err != nil {
+		return "", err
+	}
+	missionSums[p] = cachedSum{size: info.Size(), mtime: info.ModTime(), sum: sum}
+	return sum, nil
+}
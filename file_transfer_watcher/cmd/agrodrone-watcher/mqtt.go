@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+// mqttKeepAlive is how often we ping the broker when there's nothing to
+// publish
+const mqttKeepAlive = 60 * time.Second
+
+// mqttPublisher publishes the watcher's status to an MQTT broker as
+// retained JSON messages, from its own goroutine so a slow or missing
+// broker never holds up a transfer. Only the latest message per topic is
+// kept while the broker is away, and all of them are published again on
+// reconnecting. A nil publisher does nothing
+type mqttPublisher struct {
+	cfg    *Config
+	prefix string // <MQTTTopicPrefix>/<device ID>/watcher/
+
+	mu       sync.Mutex
+	latest   map[string][]byte // topic -> payload not yet published
+	all      map[string][]byte // topic -> last payload, for reconnects
+	live     map[string][]byte // full topic -> payload not yet published, not retained
+	state    string
+	wake     chan struct{}
+	loggedUp *bool // nil until the first connection attempt
+}
+
+var mqtt *mqttPublisher
+
+// startMQTT connects to cfg.MQTTBroker in the background, if set
+func startMQTT(cfg *Config) {
+	if cfg.MQTTBroker == "" {
+		return
+	}
+	mqtt = &mqttPublisher{
+		cfg:    cfg,
+		prefix: cfg.MQTTTopicPrefix + "/" + cfg.DeviceID + "/watcher/",
+		latest: map[string][]byte{},
+		all:    map[string][]byte{},
+		live:   map[string][]byte{},
+		wake:   make(chan struct{}, 1),
+	}
+	go mqtt.run()
+}
+
+// publish queues v as JSON on topic (relative to the prefix), replacing
+// anything not yet sent there. It never blocks
+func (m *mqttPublisher) publish(topic string, v any) {
+	if m == nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	b = []byte(redact.String(string(b)))
+	m.mu.Lock()
+	m.latest[m.prefix+topic] = b
+	m.all[m.prefix+topic] = b
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stream queues payload on topic, as is and not retained, replacing
+// anything not yet sent there. Unlike publish, topic is the whole topic,
+// and what's queued while the broker is away isn't sent again on
+// reconnecting
+func (m *mqttPublisher) stream(topic string, payload []byte) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.live[topic] = payload
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// phase publishes the state the watcher's phase falls under, if that
+// changed: idle, connecting, transferring or error
+func (m *mqttPublisher) phase(phase string) {
+	if m == nil {
+		return
+	}
+	state := "idle"
+	switch phase {
+	case "connecting", "wifi-backoff", "waiting-for-ground-station", "unreachable":
+		state = "connecting"
+	case "settling", "transferring":
+		state = "transferring"
+	case "error", "stalled":
+		state = "error"
+	}
+	m.mu.Lock()
+	changed := state != m.state
+	m.state = state
+	m.mu.Unlock()
+	if changed {
+		m.publish("state", map[string]any{"state": state, "phase": phase, "at": time.Now()})
+	}
+}
+
+// queue publishes the backlog in the export dir
+func (m *mqttPublisher) queue(files int, bytes int64) {
+	m.publish("queue", map[string]any{"files": files, "bytes": bytes, "at": time.Now()})
+}
+
+// run keeps a connection to the broker and publishes whatever's queued,
+// reconnecting with a pause whenever it drops
+func (m *mqttPublisher) run() {
+	for {
+		err := m.session()
+		m.connected(false, err)
+		time.Sleep(30 * time.Second)
+		// everything goes again on the next connection, but what's streamed
+		// is only worth seeing live
+		m.mu.Lock()
+		for t, b := range m.all {
+			m.latest[t] = b
+		}
+		clear(m.live)
+		m.mu.Unlock()
+	}
+}
+
+// connected logs the broker connection coming up or going down, but only
+// when that changes
+func (m *mqttPublisher) connected(up bool, err error) {
+	m.mu.Lock()
+	changed := m.loggedUp == nil || *m.loggedUp != up
+	m.loggedUp = &up
+	m.mu.Unlock()
+	switch {
+	case !changed:
+	case up:
+		slog.Info("Connected to MQTT broker", "broker", m.cfg.MQTTBroker)
+	default:
+		slog.Warn("MQTT broker unreachable; status won't be published until it's back", "broker", m.cfg.MQTTBroker, "error", err)
+	}
+}
+
+// session connects, then publishes until the connection fails
+func (m *mqttPublisher) session() error {
+	conn, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := mqttConnect(conn, m.cfg); err != nil {
+		return err
+	}
+	m.connected(true, nil)
+
+	// the broker only sends ping responses, which tell us it's still there
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, conn)
+		readErr <- errors.Join(errors.New("connection closed"), err)
+	}()
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		m.mu.Lock()
+		topics := make([]string, 0, len(m.latest))
+		for t := range m.latest {
+			topics = append(topics, t)
+		}
+		sort.Strings(topics)
+		pending := make([][]byte, len(topics))
+		for i, t := range topics {
+			pending[i] = mqttPublish(t, m.latest[t], true)
+			delete(m.latest, t)
+		}
+		for t, b := range m.live {
+			pending = append(pending, mqttPublish(t, b, false))
+			delete(m.live, t)
+		}
+		m.mu.Unlock()
+		for _, p := range pending {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write(p); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-m.wake:
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := conn.Write([]byte{0xc0, 0}); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		}
+	}
+}
+
+// dial connects to the broker: tcp://host:1883 or tls://host:8883, with
+// MQTTCAFile to trust a private CA
+func (m *mqttPublisher) dial() (net.Conn, error) {
+	u, err := url.Parse(m.cfg.MQTTBroker)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return d.Dial("tcp", u.Host)
+	case "tls", "ssl", "mqtts":
+		conf := &tls.Config{ServerName: u.Hostname()}
+		if m.cfg.MQTTCAFile != "" {
+			pem, err := os.ReadFile(m.cfg.MQTTCAFile)
+			if err != nil {
+				return nil, err
+			}
+			conf.RootCAs = x509.NewCertPool()
+			if !conf.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", m.cfg.MQTTCAFile)
+			}
+		}
+		return tls.DialWithDialer(d, "tcp", u.Host, conf)
+	default:
+		return nil, fmt.Errorf("MQTTBroker scheme must be tcp or tls, not %q", u.Scheme)
+	}
+}
+
+// mqttConnect sends an MQTT 3.1.1 CONNECT and waits for the CONNACK
+func mqttConnect(conn net.Conn, cfg *Config) error {
+	flags := byte(0x02) // clean session
+	var payload []byte
+	payload = mqttString(payload, "agrodrone-watcher-"+cfg.DeviceID)
+	if cfg.MQTTUsername != "" {
+		flags |= 0x80
+		payload = mqttString(payload, cfg.MQTTUsername)
+		if cfg.MQTTPassword != "" {
+			flags |= 0x40
+			payload = mqttString(payload, cfg.MQTTPassword)
+		}
+	}
+	body := mqttString(nil, "MQTT")
+	body = append(body, 4, flags, byte(mqttKeepAlive/time.Second>>8), byte(mqttKeepAlive/time.Second))
+	body = append(body, payload...)
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(mqttPacket(0x10, body)); err != nil {
+		return err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("waiting for CONNACK: %w", err)
+	}
+	if ack[0] != 0x20 {
+		return fmt.Errorf("expected CONNACK, got packet type %#x", ack[0])
+	}
+	if ack[3] != 0 {
+		return fmt.Errorf("broker refused the connection (code %d)", ack[3])
+	}
+	return nil
+}
+
+// mqttPublish is a QoS 0 PUBLISH of payload to topic, retained or not
+func mqttPublish(topic string, payload []byte, retain bool) []byte {
+	header := byte(0x30)
+	if retain {
+		header |= 1
+	}
+	return mqttPacket(header, append(mqttString(nil, topic), payload...))
+}
+
+// mqttPacket prefixes body with the fixed header
+func mqttPacket(header byte, body []byte) []byte {
+	p := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+// mqttString appends s with its 2-byte length
+func mqttString(b []byte, s string) []byte {
+	return append(append(b, byte(len(s)>>8), byte(len(s))), s...)
+}
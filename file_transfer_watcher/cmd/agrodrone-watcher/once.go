@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+// Exit codes with -once. 1 is a bad config or setup, as always, and 2 bad
+// flags
+const (
+	exitOK       = 0 // everything in the batch went across
+	exitNothing  = 3 // nothing waiting to be sent
+	exitLinkDown = 4 // no network, or the ground station can't be reached
+	exitPartial  = 5 // some files went across and some didn't
+	exitFailed   = 6 // the transfer failed with nothing sent
+	exitCleanup  = 7 // everything went across but cleaning up failed
+)
+
+// onceSummary is the line printed to stdout when -once finishes, counted
+// from what each unit's transfer actually did
+type onceSummary struct {
+	Outcome     string
+	ExitCode    int
+	Attempted   int
+	Transferred int
+	Failed      int
+	Skipped     int
+	Invalid     int
+	Bytes       int64
+	Error       string `json:",omitempty"`
+}
+
+var onceOutcomes = map[int]string{
+	exitOK:       "ok",
+	exitNothing:  "nothing-to-do",
+	exitLinkDown: "link-down",
+	exitPartial:  "partial",
+	exitFailed:   "failed",
+	exitCleanup:  "cleanup-failed",
+}
+
+// transferExit works out the exit code for a cycle that got as far as
+// transferring
+func transferExit(results []unitResult, err, cleanupErr error) int {
+	s := summarize(0, results, nil)
+	switch {
+	case err != nil && s.Transferred > 0:
+		return exitPartial
+	case errors.Is(err, errStalled):
+		return exitLinkDown
+	case err != nil:
+		return exitFailed
+	case s.Transferred+s.Invalid < s.Attempted:
+		if s.Transferred == 0 {
+			return exitFailed
+		}
+		return exitPartial
+	case cleanupErr != nil:
+		return exitCleanup
+	}
+	return exitOK
+}
+
+func summarize(code int, results []unitResult, err error) onceSummary {
+	s := onceSummary{Outcome: onceOutcomes[code], ExitCode: code}
+	for _, u := range results {
+		s.Attempted += u.Files
+		s.Transferred += u.Sent
+		s.Failed += u.Failed
+		s.Skipped += u.Skipped
+		s.Invalid += u.Invalid
+		s.Bytes += u.Bytes
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// onceOut and onceExit are where finishOnce prints and exits, swapped out
+// in tests
+var (
+	onceOut  io.Writer = os.Stdout
+	onceExit           = os.Exit
+)
+
+// finishOnce prints the summary as JSON and exits with code
+func finishOnce(code int, results []unitResult, err error) {
+	b, _ := json.Marshal(summarize(code, results, err))
+	fmt.Fprintln(onceOut, redact.String(string(b)))
+	onceExit(code)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestFinishOnce(t *testing.T) {
+	oldOut, oldExit := onceOut, onceExit
+	t.Cleanup(func() { onceOut, onceExit = oldOut, oldExit })
+	var out bytes.Buffer
+	var exited []int
+	onceOut = &out
+	onceExit = func(code int) { exited = append(exited, code) }
+
+	for _, tt := range []struct {
+		name string
+		// transfer is whether the cycle got as far as transferring, where
+		// the code is worked out from results as main does; otherwise it's
+		// code
+		transfer        bool
+		code            int
+		results         []unitResult
+		err, cleanupErr error
+		want            int
+		outcome         string
+		transferred     int
+	}{
+		{name: "nothing to send", code: exitNothing, want: exitNothing, outcome: "nothing-to-do"},
+		{
+			name: "connect failure", code: exitLinkDown, err: errors.New("dial tcp 192.168.4.1:22: connection refused"),
+			want: exitLinkDown, outcome: "link-down",
+		},
+		{
+			name: "sent", transfer: true,
+			results: []unitResult{{Files: 2, Sent: 2, Bytes: 20}, {Files: 1, Sent: 1, Bytes: 10}},
+			want:    exitOK, outcome: "ok", transferred: 3,
+		},
+		{
+			name: "partial failure", transfer: true,
+			results: []unitResult{{Files: 2, Sent: 2, Bytes: 20}, {Files: 1, Failed: 1}},
+			want:    exitPartial, outcome: "partial", transferred: 2,
+		},
+		{
+			name: "link lost part way", transfer: true,
+			results: []unitResult{{Files: 3, Sent: 1, Skipped: 2, Bytes: 10}}, err: errors.New("connection lost"),
+			want: exitPartial, outcome: "partial", transferred: 1,
+		},
+		{
+			name: "everything failed", transfer: true,
+			results: []unitResult{{Files: 2, Failed: 2}},
+			want:    exitFailed, outcome: "failed",
+		},
+		{
+			name: "stalled before anything went", transfer: true,
+			results: []unitResult{{Files: 2, Skipped: 2}}, err: errStalled,
+			want: exitLinkDown, outcome: "link-down",
+		},
+		{
+			name: "cleanup failed", transfer: true,
+			results: []unitResult{{Files: 1, Sent: 1, Bytes: 10}}, cleanupErr: errors.New("remove a.jpg: read-only file system"),
+			want: exitCleanup, outcome: "cleanup-failed", transferred: 1,
+		},
+	} {
+		out.Reset()
+		exited = nil
+		code, err := tt.code, tt.err
+		if tt.transfer {
+			code, err = transferExit(tt.results, tt.err, tt.cleanupErr), cmp.Or(tt.err, tt.cleanupErr)
+		}
+		finishOnce(code, tt.results, err)
+
+		if len(exited) != 1 || exited[0] != tt.want {
+			t.Errorf("%s: exited %v, want %d", tt.name, exited, tt.want)
+		}
+		var s onceSummary
+		if err := json.Unmarshal(out.Bytes(), &s); err != nil {
+			t.Fatalf("%s: summary %q: %v", tt.name, out.String(), err)
+		}
+		if s.ExitCode != tt.want || s.Outcome != tt.outcome || s.Transferred != tt.transferred {
+			t.Errorf("%s: summary %+v", tt.name, s)
+		}
+		if (s.Error != "") != (err != nil) {
+			t.Errorf("%s: summary error %q for %v", tt.name, s.Error, err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	scp "github.com/bramvdbogaerde/go-scp"
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+	"golang.org/x/crypto/ssh"
+)
+
+// InboxConflict values, for a file changed both here and in the outbox
+const (
+	conflictRemoteWins = "remote-wins"
+	conflictKeepBoth   = "keep-both"
+)
+
+// inboxEntry is what was last fetched from the outbox to a path in the
+// inbox
+type inboxEntry struct {
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+}
+
+// outboxResult is what a sync brought back from the outbox
+type outboxResult struct {
+	Files int
+	Bytes int64
+}
+
+func loadInbox(cfg *Config) map[string]inboxEntry {
+	inbox := map[string]inboxEntry{}
+	b, err := os.ReadFile(cfg.inboxPath())
+	if err == nil {
+		err = json.Unmarshal(b, &inbox)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("Failed to read what was fetched from the outbox", "file", cfg.inboxPath(), "error", err)
+	}
+	return inbox
+}
+
+func saveInbox(cfg *Config, inbox map[string]inboxEntry) {
+	if err := writeFileAtomic(cfg.inboxPath(), inbox); err != nil {
+		slog.Error("Failed to write what was fetched from the outbox", "file", cfg.inboxPath(), "error", err)
+	}
+}
+
+// syncOutbox fetches the files in OutboxDir on the ground station that are
+// new, or have changed by size or mtime, since they were last fetched into
+// InboxDir, all over one connection. Each is checked against its SHA256
+// there before it replaces anything, and with OutboxDelete only then
+// deleted there
+func syncOutbox(ctx context.Context, cfg *Config, addr string) (res outboxResult, err error) {
+	client := scp.NewClient(addr, sshConfig(cfg))
+	if err := client.Connect(); err != nil {
+		return res, fmt.Errorf("connect: %w", err)
+	}
+	defer client.Close()
+	listed, _, err := listRemoteFiles(client.SSHClient(), cfg.OutboxDir)
+	if err != nil {
+		return res, fmt.Errorf("list %s: %w", cfg.OutboxDir, err)
+	}
+	lg := slog.With("remote_host", addr)
+	inbox := loadInbox(cfg)
+	defer saveInbox(cfg, inbox)
+	// whatever's still being written into the outbox, or left half done
+	ignore := &fileFilter{Ignore: watch.DefaultIgnore}
+	var errs []error
+	for _, f := range listed {
+		rel := strings.TrimPrefix(f.Path, strings.TrimSuffix(cfg.OutboxDir, "/")+"/")
+		if skip, _ := ignore.Skip(rel, false); skip {
+			continue
+		}
+		if prev, ok := inbox[rel]; !ok || prev.Size != f.Size || !prev.ModTime.Equal(f.ModTime) {
+			e, err := fetchOutboxFile(ctx, cfg, &client, f, rel, prev, lg)
+			if ctx.Err() != nil || errors.Is(err, errStalled) {
+				return res, err
+			}
+			if err != nil {
+				lg.Error("Failed to fetch from the outbox", "file", f.Path, "error", err)
+				errs = append(errs, err)
+				continue
+			}
+			inbox[rel] = e
+			res.Files++
+			res.Bytes += f.Size
+		}
+		if cfg.OutboxDelete {
+			if err := removeRemote(client.SSHClient(), f.Path); err != nil {
+				errs = append(errs, fmt.Errorf("delete %s: %w", f.Path, err))
+			}
+		}
+	}
+	return res, errors.Join(errs...)
+}
+
+// fetchOutboxFile fetches f into the inbox at rel. prev is what was last
+// fetched there, to tell an update to a file nobody's touched here from a
+// conflict with a change made here
+func fetchOutboxFile(ctx context.Context, cfg *Config, client *scp.Client, f batchFile, rel string, prev inboxEntry, lg *slog.Logger) (inboxEntry, error) {
+	dst := filepath.Join(cfg.InboxDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return inboxEntry{}, err
+	}
+	tmp := dst + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return inboxEntry{}, err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	n, sum, err := fetchFile(ctx, client, f.Path, out, cfg.StallTimeout.Duration, lg)
+	if err != nil {
+		return inboxEntry{}, fmt.Errorf("copy %q -> %q: %w", f.Path, dst, err)
+	}
+	if n != f.Size {
+		return inboxEntry{}, fmt.Errorf("%s changed while being fetched", f.Path)
+	}
+	theirs, err := remoteSum(client.SSHClient(), f.Path)
+	if err != nil {
+		return inboxEntry{}, fmt.Errorf("hash %s there: %w", f.Path, err)
+	}
+	if theirs != sum {
+		return inboxEntry{}, fmt.Errorf("%s has SHA256 %s there but %s here", f.Path, theirs, sum)
+	}
+	if err := out.Sync(); err != nil {
+		return inboxEntry{}, err
+	}
+	if err := out.Close(); err != nil {
+		return inboxEntry{}, err
+	}
+	if err := os.Chtimes(tmp, f.ModTime, f.ModTime); err != nil {
+		lg.Warn("Failed to keep the file's mtime", "file", dst, "error", err)
+	}
+
+	mine, err := sumFile(dst)
+	switch {
+	case errors.Is(err, fs.ErrNotExist), err == nil && (mine == sum || mine == prev.SHA256):
+		// new, the same, or not changed here since it was last fetched
+	case err != nil:
+		return inboxEntry{}, err
+	case cfg.InboxConflict == conflictKeepBoth:
+		mine := dst
+		dst = uniqueName(dst, map[string]bool{}, func(p string) bool {
+			_, err := os.Stat(p)
+			return err == nil
+		})
+		lg.Warn("Changed here and in the outbox; keeping both", "file", mine, "outbox_copy", dst)
+	default:
+		lg.Warn("Changed here and in the outbox; the outbox's copy wins", "file", dst)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return inboxEntry{}, err
+	}
+	lg.Info("Fetched from the outbox", "file", f.Path, "to", dst, "bytes", n)
+	return inboxEntry{Size: f.Size, ModTime: f.ModTime, SHA256: sum}, nil
+}
+
+// sumFile is the SHA256 of the file at p
+func sumFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashFile(f)
+}
+
+// removeRemote deletes the file at p on the remote
+func removeRemote(client *ssh.Client, p string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if out, err := session.CombinedOutput("rm -f -- " + shellQuote(p)); err != nil {
+		return errors.New(strings.TrimSpace(string(out)) + ": " + err.Error())
+	}
+	return nil
+}
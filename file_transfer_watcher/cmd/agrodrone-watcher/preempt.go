@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+)
+
+// errPreempted means a batch was cut short at a file boundary because
+// files of a higher priority turned up, to be sent first in a new one
+var errPreempted = errors.New("preempted by higher-priority files")
+
+// preemptInterval is how often the export dir is checked for new files
+// mid-batch
+const preemptInterval = 5 * time.Second
+
+// preemptCheck spots files of a higher priority than the one about to be
+// sent turning up while a batch is going, e.g. a flight log copied over
+// during a long run of raw TIFFs. A nil check never preempts
+type preemptCheck struct {
+	cfg    *Config
+	filter *fileFilter
+	// known are the files already in the backlog
+	known map[string]bool
+	last  time.Time
+	// best is the highest priority (lowest index) of the new files found
+	// by the last walk, or -1 if there weren't any
+	best int
+}
+
+// newPreemptCheck returns a check for files not in batches, or nil with
+// fewer than two priority groups, when nothing could ever go first
+func newPreemptCheck(cfg *Config, batches [][]batchUnit) *preemptCheck {
+	if len(cfg.Priorities) < 2 {
+		return nil
+	}
+	p := &preemptCheck{cfg: cfg, filter: newFileFilter(cfg), known: map[string]bool{}, last: time.Now(), best: -1}
+	for _, b := range batches {
+		p.add(b)
+	}
+	return p
+}
+
+// add notes the files in units as part of the backlog, e.g. once renamed
+func (p *preemptCheck) add(units []batchUnit) {
+	if p == nil {
+		return
+	}
+	for _, u := range units {
+		for _, f := range u.Files {
+			p.known[f.Path] = true
+		}
+	}
+}
+
+// due reports whether a new file should go before next. The export dir is
+// walked at most every preemptInterval, and only files that are ready to
+// send count
+func (p *preemptCheck) due(next batchFile) bool {
+	if p == nil {
+		return false
+	}
+	if time.Since(p.last) >= preemptInterval {
+		p.last = time.Now()
+		p.best = p.scan()
+	}
+	return p.best >= 0 && p.best < next.Priority
+}
+
+func (p *preemptCheck) scan() int {
+	best := -1
+	stable := newStabilityCheck(p.cfg)
+	watch.Walk(p.cfg.ExportDir, p.filter, func(path string, d fs.DirEntry) {
+		if p.known[path] || !d.Type().IsRegular() {
+			return
+		}
+		prio, ok := priorityOf(p.cfg, path)
+		if !ok || (best >= 0 && prio >= best) {
+			return
+		}
+		if info, err := d.Info(); err == nil {
+			if ready, _ := stable.Ready(path, info); ready {
+				best = prio
+			}
+		}
+	})
+	return best
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+)
+
+// previewDir is where previews go on the remote, relative to the ingest dir
+const previewDir = "previews"
+
+// previewable reports whether a preview can be made of path
+func previewable(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".tif", ".tiff":
+		return true
+	}
+	return false
+}
+
+// previewName is where the preview of f goes, relative to the preview dir
+// here and to previews/ on the remote. JPEGs keep their name; anything else
+// gets .jpg added
+func previewName(exportDir string, f batchFile) (string, error) {
+	rel := f.Remote
+	if rel == "" {
+		r, err := filepath.Rel(exportDir, f.Path)
+		if err != nil {
+			return "", err
+		}
+		rel = filepath.ToSlash(r)
+	}
+	switch strings.ToLower(path.Ext(rel)) {
+	case ".jpg", ".jpeg":
+		return rel, nil
+	}
+	return rel + ".jpg", nil
+}
+
+// scaledImage is src scaled down to fit in maxDim by maxDim, or as it is if
+// it's already smaller
+func scaledImage(src string, maxDim int) (image.Image, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", src, err)
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if scale := float64(maxDim) / float64(max(w, h)); scale < 1 {
+		w, h = max(int(float64(w)*scale), 1), max(int(float64(h)*scale), 1)
+		small := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.BiLinear.Scale(small, small.Bounds(), img, b, draw.Src, nil)
+		img = small
+	}
+	return img, nil
+}
+
+// makePreview writes a JPEG of src scaled down to fit in maxDim by maxDim to
+// dst. Images already smaller are only re-encoded
+func makePreview(src, dst string, maxDim, quality int) error {
+	img, err := scaledImage(src, maxDim)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: quality}); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// sentPreviews remembers which originals have had their preview sent, by
+// path with their mtime, so a preview isn't sent again while its original
+// waits
+type sentPreviews map[string]int64
+
+func loadSentPreviews(cfg *Config) sentPreviews {
+	sent := sentPreviews{}
+	b, err := os.ReadFile(cfg.sentPreviewsPath())
+	if err == nil {
+		err = json.Unmarshal(b, &sent)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("Failed to read which previews were sent", "error", err)
+	}
+	return sent
+}
+
+// sendPreviews makes a preview of every JPEG and TIFF in units that hasn't
+// had one sent yet and sends them all, ahead of the originals, to
+// previews/ in the ingest dir. Previews are made by cfg.PreviewWorkers
+// workers at a time, to leave the CPU for everything else. They're made in
+// StateDir and deleted once sent, and never go through dedup, renaming or
+// the manifest
+func sendPreviews(ctx context.Context, cfg *Config, units []batchUnit, ingestDir, addr string) error {
+	dir := cfg.previewPath()
+	// previews aren't in a batch, so {batch} and {session} are left empty
+	mkdir := templated(ingestDir)
+	ingestDir = expandIngest(ingestDir, cfg.DeviceID, "", "")
+	sent := loadSentPreviews(cfg)
+	pending := sentPreviews{}
+	var todo []batchFile
+	for _, u := range units {
+		for _, f := range u.Files {
+			if !previewable(f.Path) {
+				continue
+			}
+			pending[f.Path] = f.ModTime.UnixNano()
+			if sent[f.Path] != f.ModTime.UnixNano() {
+				todo = append(todo, f)
+			}
+		}
+	}
+	// forget originals that have gone since
+	defer func() {
+		for p := range sent {
+			if _, ok := pending[p]; !ok {
+				delete(sent, p)
+			}
+		}
+		if err := writeFileAtomic(cfg.sentPreviewsPath(), sent); err != nil {
+			slog.Error("Failed to record which previews were sent", "error", err)
+		}
+	}()
+	if len(todo) == 0 {
+		return nil
+	}
+
+	slog.Info("Making previews", "files", len(todo), "workers", cfg.PreviewWorkers)
+	previews := make([]batchFile, len(todo))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range cfg.PreviewWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f := todo[i]
+				name, err := previewName(cfg.ExportDir, f)
+				if err == nil {
+					err = makePreview(f.Path, filepath.Join(dir, filepath.FromSlash(name)), cfg.PreviewMaxDim, cfg.PreviewQuality)
+				}
+				if err != nil {
+					slog.Warn("Failed to make a preview", "file", f.Path, "error", err)
+					continue
+				}
+				p := filepath.Join(dir, filepath.FromSlash(name))
+				if info, err := os.Stat(p); err == nil {
+					previews[i] = batchFile{Path: p, Size: info.Size(), ModTime: info.ModTime(), Remote: path.Join(previewDir, name)}
+				}
+			}
+		}()
+	}
+feed:
+	for i := range todo {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var files []batchFile
+	var bytes int64
+	for _, p := range previews {
+		if p.Path != "" {
+			files = append(files, p)
+			bytes += p.Size
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	slog.Info("Sending previews", "files", len(files), "bytes", bytes)
+	if mkdir {
+		if err := remoteMkdir(addr, sshConfig(cfg), remoteDirs(dir, ingestDir, files)...); err != nil {
+			slog.Warn("Failed to make the remote dirs", "remote_host", addr, "dir", ingestDir, "error", err)
+		}
+	}
+	progress.start(len(files), bytes)
+	res, err := scpDir(ctx, dir, files, ingestDir, addr, sshConfig(cfg), cfg.StallTimeout.Duration, nil, nil, nil, nil)
+	byPreview := map[string]batchFile{}
+	for i, p := range previews {
+		byPreview[p.Path] = todo[i]
+	}
+	for _, s := range res.Transferred {
+		sent[byPreview[s.Path].Path] = byPreview[s.Path].ModTime.UnixNano()
+	}
+	var removed []string
+	for _, p := range files {
+		if os.Remove(p.Path) == nil {
+			removed = append(removed, p.Path)
+		}
+	}
+	removeEmptyParents(dir, removed)
+	slog.Info("Previews sent", "files", len(res.Transferred), "of", len(files), "bytes", res.Bytes)
+	return err
+}
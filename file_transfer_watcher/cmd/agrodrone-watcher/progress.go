@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressStatus is how far through the snapshot being sent we are, as
+// kept in the status file
+type progressStatus struct {
+	File      int
+	Files     int
+	BytesSent int64
+	Bytes     int64
+	Percent   float64
+	// BytesPerSec is the rate over the last speedWindow, AvgBytesPerSec
+	// since the start
+	BytesPerSec    int64
+	AvgBytesPerSec int64
+	ETA            string `json:",omitempty"`
+}
+
+// transferProgress tracks progress across every file in a snapshot, which
+// may go over in several batches. Bytes are counted as they go over the
+// wire, from transferredBytes, plus the files that didn't need sending
+type transferProgress struct {
+	mu         sync.Mutex
+	file       int
+	files      int
+	bytes      int64
+	base       int64 // transferredBytes when we started
+	skipped    int64
+	started    time.Time
+	speed      rateWindow
+	lastLogged time.Time
+	lastSent   int64 // BytesSent at the last tick
+}
+
+var progress = &transferProgress{}
+
+// progressLogInterval is how often progress is logged; the status file is
+// updated more often
+const progressLogInterval = 30 * time.Second
+
+// start resets the counters for a snapshot of files totalling bytes
+func (p *transferProgress) start(files int, bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.file, p.files, p.bytes, p.skipped, p.lastSent = 0, files, bytes, 0, 0
+	p.base = atomic.LoadInt64(&transferredBytes)
+	p.started, p.lastLogged = now, now
+	p.speed = rateWindow{window: speedWindow}
+	p.speed.add(now, 0)
+}
+
+// nextFile notes that another file is being sent
+func (p *transferProgress) nextFile() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.file++
+}
+
+// skip counts size bytes as done without them going over the wire, e.g.
+// for a duplicate
+func (p *transferProgress) skip(size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.skipped += size
+}
+
+// sample returns where we're at. The ETA goes by the rate over the last
+// speedWindow, so it follows the link as it is now rather than since the
+// start
+func (p *transferProgress) sample(now time.Time) progressStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sent := atomic.LoadInt64(&transferredBytes) - p.base
+	p.speed.add(now, sent)
+	rate := p.speed.rate(now)
+
+	s := progressStatus{File: p.file, Files: p.files, BytesSent: min(sent+p.skipped, p.bytes), Bytes: p.bytes, BytesPerSec: int64(rate)}
+	if d := now.Sub(p.started).Seconds(); d > 0 {
+		s.AvgBytesPerSec = int64(float64(sent) / d)
+	}
+	if p.bytes > 0 {
+		s.Percent = float64(int(float64(s.BytesSent)/float64(p.bytes)*1000)) / 10
+	}
+	if rate > 0 {
+		eta := time.Duration(float64(p.bytes-s.BytesSent) / rate * float64(time.Second))
+		s.ETA = eta.Round(time.Second).String()
+	}
+	return s
+}
+
+func (s progressStatus) String() string {
+	line := fmt.Sprintf("file %d/%d, %s/%s (%.0f%%), %s/s", s.File, s.Files,
+		formatBytes(s.BytesSent), formatBytes(s.Bytes), s.Percent, formatBytes(s.BytesPerSec))
+	if s.ETA != "" {
+		line += ", ETA " + s.ETA
+	}
+	return line
+}
+
+// run keeps the status file's progress up to date every interval, logging
+// it every progressLogInterval, until ctx is done. The heartbeat goes on
+// only while bytes are moving, so a stalled transfer lets it lapse
+func (p *transferProgress) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			status.update(func(st *statusData) { st.Progress = nil })
+			return
+		case now := <-ticker.C:
+			p.tick(now)
+		}
+	}
+}
+
+// tick is one go of run's ticker at now
+func (p *transferProgress) tick(now time.Time) {
+	s := p.sample(now)
+	status.update(func(st *statusData) { st.Progress = &s })
+	p.mu.Lock()
+	moved := s.BytesSent > p.lastSent
+	if moved {
+		p.lastSent = s.BytesSent
+	}
+	logIt := now.Sub(p.lastLogged) >= progressLogInterval
+	if logIt {
+		p.lastLogged = now
+	}
+	p.mu.Unlock()
+	if moved {
+		beat()
+	}
+	if logIt {
+		slog.Info("Progress: "+s.String(), "bytes", s.BytesSent, "percent", s.Percent)
+	}
+}
+
+// formatBytes renders n like "3.1 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// speedWindow is how far back the current speed looks: short enough to
+// show a stall or a recovery within seconds, long enough to smooth out
+// TCP's bursts
+const speedWindow = 10 * time.Second
+
+// rateSamples is how many samples a rateWindow holds. Samples closer
+// together than a hundredth of the window are merged, so it never fills
+const rateSamples = 128
+
+type byteSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// rateWindow works out the rate a byte counter is going up at over the
+// last window, from samples of it kept in a ring buffer
+type rateWindow struct {
+	window  time.Duration
+	samples [rateSamples]byteSample
+	head    int // the oldest sample
+	n       int
+}
+
+func (w *rateWindow) at(i int) *byteSample {
+	return &w.samples[(w.head+i)%rateSamples]
+}
+
+// add records the counter's value at a point in time, which must not be
+// before the last one
+func (w *rateWindow) add(at time.Time, bytes int64) {
+	switch {
+	case w.n >= 2 && at.Sub(w.at(w.n-2).at) < w.window/100:
+		*w.at(w.n - 1) = byteSample{at, bytes}
+	case w.n == rateSamples:
+		*w.at(0) = byteSample{at, bytes}
+		w.head = (w.head + 1) % rateSamples
+	default:
+		w.n++
+		*w.at(w.n - 1) = byteSample{at, bytes}
+	}
+	// keep just one sample from before the window, to measure from
+	for w.n > 2 && at.Sub(w.at(1).at) >= w.window {
+		w.head = (w.head + 1) % rateSamples
+		w.n--
+	}
+}
+
+// covered reports whether the samples go back a whole window from now
+func (w *rateWindow) covered(now time.Time) bool {
+	return w.n > 0 && now.Sub(w.at(0).at) >= w.window
+}
+
+// rate is bytes per second over the last window up to now, or since the
+// first sample if that's more recent. Nothing added for a whole window
+// means a rate of zero
+func (w *rateWindow) rate(now time.Time) float64 {
+	if w.n == 0 {
+		return 0
+	}
+	from := now.Add(-w.window)
+	i := 0
+	for i+1 < w.n && !w.at(i+1).at.After(from) {
+		i++
+	}
+	base := *w.at(i)
+	if base.at.After(from) {
+		from = base.at
+	} else if i+1 < w.n {
+		// the counter as it was at from, taking it to have gone up evenly
+		// to the next sample, so bytes from a long gap between samples
+		// aren't all put down to the window
+		next := w.at(i + 1)
+		base.bytes += int64(float64(next.bytes-base.bytes) * float64(from.Sub(base.at)) / float64(next.at.Sub(base.at)))
+	}
+	span := now.Sub(from).Seconds()
+	if span <= 0 {
+		return 0
+	}
+	return float64(w.at(w.n-1).bytes-base.bytes) / span
+}
+
+// peakWindow is the stretch throughput is averaged over to find the peak
+const peakWindow = 5 * time.Second
+
+// peakMeter finds the highest throughput over any peakWindow of a byte
+// counter sampled regularly, rather than the average since the start
+type peakMeter struct {
+	speed rateWindow
+	peak  float64
+}
+
+// add records the counter's value at a point in time
+func (m *peakMeter) add(at time.Time, bytes int64) {
+	m.speed.add(at, bytes)
+	if m.speed.covered(at) {
+		m.peak = max(m.peak, m.speed.rate(at))
+	}
+}
+
+// measurePeak samples transferredBytes every second until stop is closed,
+// then returns the peak throughput. If the transfer didn't last a whole
+// window that's the average over however long it did last
+func measurePeak(stop <-chan struct{}) <-chan float64 {
+	result := make(chan float64, 1)
+	go func() {
+		m := peakMeter{speed: rateWindow{window: peakWindow}}
+		start, startBytes := time.Now(), atomic.LoadInt64(&transferredBytes)
+		m.add(start, startBytes)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				m.add(now, atomic.LoadInt64(&transferredBytes))
+			case <-stop:
+				peak := m.peak
+				if d := time.Since(start).Seconds(); peak == 0 && d > 0 {
+					peak = float64(atomic.LoadInt64(&transferredBytes)-startBytes) / d
+				}
+				result <- peak
+				return
+			}
+		}
+	}()
+	return result
+}
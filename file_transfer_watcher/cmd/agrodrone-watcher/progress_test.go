@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateWindow(t *testing.T) {
+	t0 := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(s float64) time.Time { return t0.Add(time.Duration(s * float64(time.Second))) }
+	type sample struct {
+		at    float64 // seconds from t0
+		bytes int64
+	}
+	for _, tt := range []struct {
+		name    string
+		samples []sample
+		now     float64
+		want    float64
+		covered bool
+	}{
+		{name: "nothing yet", now: 5},
+		{name: "just started", samples: []sample{{0, 0}, {2, 2048}}, now: 2, want: 1024},
+		{
+			name:    "steady",
+			samples: []sample{{0, 0}, {5, 5120}, {10, 10240}, {15, 15360}, {20, 20480}},
+			now:     20, want: 1024, covered: true,
+		},
+		{
+			name:    "stalled half the window",
+			samples: []sample{{0, 0}, {10, 10240}, {15, 15360}, {20, 15360}},
+			now:     20, want: 512, covered: true,
+		},
+		{
+			name:    "stalled the whole window",
+			samples: []sample{{0, 0}, {10, 10240}, {15, 10240}, {20, 10240}},
+			now:     25, want: 0, covered: true,
+		},
+		{
+			name:    "stalled with nothing sampled since",
+			samples: []sample{{0, 0}, {10, 10240}},
+			now:     30, want: 0, covered: true,
+		},
+		{
+			// e.g. suspended: what came over the hour is spread across it
+			name:    "long gap",
+			samples: []sample{{0, 0}, {3600, 3600 * 1024}},
+			now:     3600, want: 1024, covered: true,
+		},
+		{
+			name:    "picking up after a gap",
+			samples: []sample{{0, 0}, {10, 10240}, {100, 10240}, {101, 11264}},
+			now:     101, want: 102.4, covered: true,
+		},
+	} {
+		w := rateWindow{window: 10 * time.Second}
+		for _, s := range tt.samples {
+			w.add(at(s.at), s.bytes)
+		}
+		if got := w.rate(at(tt.now)); got < tt.want-0.01 || got > tt.want+0.01 {
+			t.Errorf("%s: rate %.2f, want %.2f", tt.name, got, tt.want)
+		}
+		if got := w.covered(at(tt.now)); got != tt.covered {
+			t.Errorf("%s: covered %v, want %v", tt.name, got, tt.covered)
+		}
+	}
+}
+
+func TestRateWindowNeverFills(t *testing.T) {
+	w := rateWindow{window: 10 * time.Second}
+	t0 := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	// a sample every 10ms for a minute, at 1 KiB/s
+	for i := range 6000 {
+		w.add(t0.Add(time.Duration(i)*10*time.Millisecond), int64(i)*10240/1000)
+		if w.n > rateSamples {
+			t.Fatalf("%d samples after %d adds", w.n, i+1)
+		}
+	}
+	now := t0.Add(59990 * time.Millisecond)
+	if got := w.rate(now); got < 1000 || got > 1050 {
+		t.Errorf("rate %.0f, want about 1024", got)
+	}
+	if oldest := now.Sub(w.at(0).at); oldest < w.window || oldest > w.window+w.window/50 {
+		t.Errorf("oldest sample is %v back, want just over the window", oldest)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	scp "github.com/bramvdbogaerde/go-scp"
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+	"golang.org/x/crypto/ssh"
+)
+
+// Direction values: send to RemoteHost, or fetch from it
+const (
+	directionPush = "push"
+	directionPull = "pull"
+)
+
+// runPull is the main loop in pull mode, on the ground station: whenever
+// the drone at RemoteHost answers, the finished files in its ExportDir are
+// fetched into IngestDir and then deleted, or archived, on the drone
+func runPull(cfg *Config, filter *fileFilter, once bool) {
+	addr, _, err := cfg.target(nil)
+	if err != nil {
+		fatal("Bad drone address", "error", err)
+	}
+	for {
+		beat()
+		if _, err := checkReachable(addr, 3, 3*time.Second); err != nil {
+			slog.Info("Drone isn't reachable; waiting for it", "phase", "waiting-for-drone", "remote_host", addr)
+			status.update(func(s *statusData) { s.Phase = "waiting-for-drone" })
+			if once {
+				finishOnce(exitLinkDown, nil, err)
+			}
+			sleep(cfg.PollInterval.Duration)
+			continue
+		}
+		status.update(func(s *statusData) { s.Phase = "transferring" })
+		results, err, cleanupErr := pullBatch(context.Background(), cfg, filter, addr)
+		status.update(func(s *statusData) { s.Flights = results })
+		if results == nil && err == nil {
+			slog.Debug("Nothing on the drone to fetch", "remote_host", addr)
+			if once {
+				finishOnce(exitNothing, nil, nil)
+			}
+			status.update(func(s *statusData) { s.Phase = "idle" })
+			sleep(cfg.PollInterval.Duration)
+			continue
+		}
+		if once {
+			finishOnce(transferExit(results, err, cleanupErr), results, cmp.Or(err, cleanupErr))
+		}
+		switch {
+		case err != nil:
+			slog.Error("Fetch failed", "phase", "error", "remote_host", addr, "error", err)
+			status.update(func(s *statusData) { s.Phase = "error"; s.LastError = err.Error() })
+			alerts.failed(failTransfer, err)
+		case cleanupErr != nil:
+			slog.Error("Cleanup on the drone failed", "phase", "error", "remote_host", addr, "error", cleanupErr)
+			status.update(func(s *statusData) { s.Phase = "error"; s.LastError = cleanupErr.Error() })
+			alerts.failed(failCleanup, cleanupErr)
+		default:
+			status.update(func(s *statusData) { s.Phase = "sleeping"; s.LastError = "" })
+			alerts.succeeded()
+		}
+		sleep(5 * time.Second)
+	}
+}
+
+// pullBatch fetches one batch of what's ready on the drone and cleans it
+// up there, recording it like a batch sent. It returns nil results if
+// there was nothing to fetch
+func pullBatch(ctx context.Context, cfg *Config, filter *fileFilter, addr string) (results []unitResult, err, cleanupErr error) {
+	files, err := droneBatch(cfg, filter, addr)
+	if err != nil || len(files) == 0 {
+		return nil, err, nil
+	}
+	var bytes int64
+	for _, f := range files {
+		bytes += f.Size
+	}
+	progress.start(len(files), bytes)
+
+	id := journal.startBatch()
+	setLogBatch(id)
+	defer setLogBatch("")
+	metrics.batch(id)
+	h := historyBatch{ID: id, Start: time.Now(), RemoteHost: addr, RemoteDir: cfg.IngestDir, Files: len(files)}
+	for _, f := range files {
+		journal.record(stateQueued, "", sentFile{Path: f.Path, Size: f.Size})
+	}
+	res, err := pullFiles(ctx, cfg, addr, files)
+	recordFiles(cfg, id, res)
+	journal.record(stateVerified, "", res.Transferred...)
+	for _, fe := range res.Failed {
+		journal.record(stateFailed, fe.Err.Error(), sentFile{Path: fe.Path})
+	}
+	cleanupErr = cleanupDrone(cfg, addr, id, res.Transferred)
+
+	r := unitResult{
+		Name:      cfg.ExportDir,
+		Files:     len(files),
+		Sent:      len(res.Transferred),
+		Skipped:   len(res.Skipped),
+		Failed:    len(res.Failed),
+		Bytes:     res.Bytes,
+		Duration:  res.Duration.Round(time.Second).String(),
+		RemoteDir: cfg.IngestDir,
+
+		AvgBytesPerSec:  res.avgBytesPerSec(),
+		PeakBytesPerSec: res.PeakBytesPerSec,
+	}
+	switch {
+	case r.Sent == r.Files:
+		r.Status = "complete"
+	case r.Sent > 0:
+		r.Status = "partial"
+	default:
+		r.Status = "failed"
+	}
+	h.End, h.Sent, h.Failed, h.Bytes = time.Now(), r.Sent, r.Failed, r.Bytes
+	h.AvgBytesPerSec, h.PeakBytesPerSec = r.AvgBytesPerSec, r.PeakBytesPerSec
+	h.Outcome = r.Status
+	if err != nil {
+		h.Error = err.Error()
+	}
+	slog.Info("Batch summary", "remote_host", addr, "dir", cfg.IngestDir, "files", h.Sent, "of", h.Files, "bytes", h.Bytes,
+		"duration_ms", h.End.Sub(h.Start).Milliseconds(), "avg_bytes_per_sec", h.AvgBytesPerSec,
+		"peak_bytes_per_sec", h.PeakBytesPerSec, "failures", h.Failed)
+	recordBatch(cfg, h)
+	mqtt.publish("last_batch", h)
+	status.update(func(s *statusData) { s.LastBatch = &h })
+	webhooks.batch(h)
+	return []unitResult{r}, err, cleanupErr
+}
+
+// droneBatch lists the drone's ExportDir and picks the files to fetch:
+// those the filter lets through and that haven't changed for QuiescePeriod
+// by the drone's clock, in Order, up to MaxFilesPerBatch and
+// MaxBytesPerBatch
+func droneBatch(cfg *Config, filter *fileFilter, addr string) ([]batchFile, error) {
+	client, err := transfer.DialSSH(addr, sshConfig(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer client.Close()
+	listed, now, err := listRemoteFiles(client, cfg.ExportDir)
+	if err != nil {
+		return nil, fmt.Errorf("list %s on the drone: %w", cfg.ExportDir, err)
+	}
+	var files []batchFile
+	for _, f := range listed {
+		rel := strings.TrimPrefix(f.Path, strings.TrimSuffix(cfg.ExportDir, "/")+"/")
+		if skip, why := filter.Skip(rel, false); skip {
+			slog.Debug("Skipping file on the drone", "file", rel, "reason", why)
+			continue
+		}
+		if skip, why := filter.SkipSize(f.Size); skip {
+			slog.Debug("Skipping file on the drone", "file", rel, "reason", why)
+			continue
+		}
+		if age := now.Sub(f.ModTime); age < cfg.QuiescePeriod.Duration {
+			slog.Debug("Skipping file on the drone for now", "file", rel, "modified_ago", age.Round(time.Second).String())
+			continue
+		}
+		files = append(files, f)
+	}
+	sort.SliceStable(files, func(i, j int) bool { return orderFunc(cfg.Order)(files[i], files[j]) })
+
+	var n int
+	var size int64
+	for i, f := range files {
+		if (cfg.MaxFilesPerBatch > 0 && n == cfg.MaxFilesPerBatch) ||
+			(cfg.MaxBytesPerBatch > 0 && n > 0 && size+f.Size > int64(cfg.MaxBytesPerBatch)) {
+			slog.Info("Leaving the rest of the drone's backlog for the next batch", "files", len(files)-i)
+			return files[:i], nil
+		}
+		n, size = n+1, size+f.Size
+	}
+	return files, nil
+}
+
+// listRemoteFiles lists the files under dir on the remote, and the time
+// there, so how long since they changed goes by the clock that wrote them
+func listRemoteFiles(client *ssh.Client, dir string) ([]batchFile, time.Time, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer session.Close()
+	// size and mtime first, since the path runs to the end of the line
+	out, err := session.Output("date +%s && find " + shellQuote(dir) + ` -type f -printf '%s %T@ %p\n'`)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	if !sc.Scan() {
+		return nil, time.Time{}, errors.New("no output")
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(sc.Text()), 10, 64)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("bad time %q", sc.Text())
+	}
+	var files []batchFile
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		mtime, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		sec, frac := math.Modf(mtime)
+		files = append(files, batchFile{Path: fields[2], Size: size, ModTime: time.Unix(int64(sec), int64(frac*1e9))})
+	}
+	return files, time.Unix(secs, 0), sc.Err()
+}
+
+// pullFiles fetches files from the drone at addr, in order, into
+// IngestDir, keeping their paths under ExportDir. Like scpDir, a file that
+// fails on its own doesn't stop the rest, and if one makes no progress for
+// StallTimeout the connection is torn down and errStalled returned
+func pullFiles(ctx context.Context, cfg *Config, addr string, files []batchFile) (res BatchResult, err error) {
+	stopPeak := make(chan struct{})
+	peak := measurePeak(stopPeak)
+	defer func(start time.Time) {
+		res.Duration = time.Since(start)
+		close(stopPeak)
+		res.PeakBytesPerSec = int64(<-peak)
+	}(time.Now())
+
+	client := scp.NewClient(addr, sshConfig(cfg))
+	if err := client.Connect(); err != nil {
+		metrics.failed("connect")
+		return res, fmt.Errorf("connect: %w", err)
+	}
+	defer metrics.speed(0)
+	defer client.Close()
+	lg := slog.With("remote_host", addr)
+
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		progress.nextFile()
+		err := pullFile(ctx, cfg, &client, f, &res, lg)
+		var fe *fileError
+		if errors.As(err, &fe) {
+			lg.Error("Failed to fetch file, carrying on", "file", fe.Path, "error", fe.Err)
+			res.Failed = append(res.Failed, fe)
+			metrics.failed("file")
+			continue
+		}
+		if errors.Is(err, errStalled) {
+			metrics.failed("stalled")
+		} else if err != nil {
+			metrics.failed("transfer")
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// pullFile fetches f under a temporary name and only moves it into place
+// once it's all here, and with VerifyRemote has the same SHA256 as on the
+// drone
+func pullFile(ctx context.Context, cfg *Config, client *scp.Client, f batchFile, res *BatchResult, lg *slog.Logger) error {
+	rel := strings.TrimPrefix(f.Path, strings.TrimSuffix(cfg.ExportDir, "/")+"/")
+	dst := filepath.Join(cfg.IngestDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return &fileError{Path: f.Path, Err: err}
+	}
+	tmp := dst + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return &fileError{Path: f.Path, Err: err}
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	journal.record(stateTransferring, "", sentFile{Path: f.Path, Size: f.Size, Remote: dst})
+	start := time.Now()
+	total, sum, err := fetchFile(ctx, client, f.Path, out, cfg.StallTimeout.Duration, lg)
+	if errors.Is(err, errStalled) {
+		return fmt.Errorf("copy %q -> %q: %w after %v without progress", f.Path, dst, errStalled, cfg.StallTimeout.Duration)
+	}
+	if err != nil && ctx.Err() == nil {
+		return &fileError{Path: f.Path, Err: fmt.Errorf("copy %q -> %q: %w", f.Path, dst, err)}
+	}
+	if err != nil {
+		return fmt.Errorf("copy %q -> %q: %w", f.Path, dst, err)
+	}
+	// a file that changed size since it was listed is still being written
+	if total != f.Size {
+		lg.Warn("File changed size on the drone while being fetched; leaving it for the next batch", "file", f.Path, "bytes", total, "size", f.Size)
+		res.Skipped = append(res.Skipped, f.Path)
+		return nil
+	}
+	if cfg.VerifyRemote {
+		theirs, err := remoteSum(client.SSHClient(), f.Path)
+		if err != nil {
+			return &fileError{Path: f.Path, Err: fmt.Errorf("hash on the drone: %w", err)}
+		}
+		if theirs != sum {
+			return &fileError{Path: f.Path, Err: fmt.Errorf("SHA256 is %s here but %s on the drone", sum, theirs)}
+		}
+	}
+	if err := out.Sync(); err != nil {
+		return &fileError{Path: f.Path, Err: err}
+	}
+	if err := out.Close(); err != nil {
+		return &fileError{Path: f.Path, Err: err}
+	}
+	if err := os.Chtimes(tmp, f.ModTime, f.ModTime); err != nil {
+		lg.Warn("Failed to keep the file's mtime", "file", dst, "error", err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return &fileError{Path: f.Path, Err: err}
+	}
+	took := time.Since(start)
+	lg.Info("Fetched", "file", f.Path, "to", dst, "bytes", f.Size, "duration_ms", took.Milliseconds(),
+		"mib_per_sec", math.Round(float64(f.Size)/took.Seconds()/1024/1024*100)/100)
+	res.transferred(sentFile{Path: f.Path, Size: f.Size, Remote: dst, Duration: took, SHA256: sum})
+	beat()
+	return nil
+}
+
+// fetchFile copies the file at remote to out, with watchedCopy's progress
+// and stall detection, and returns how many bytes came and their SHA256
+func fetchFile(ctx context.Context, client *scp.Client, remote string, out io.Writer, stallTimeout time.Duration, lg *slog.Logger) (int64, string, error) {
+	h := sha256.New()
+	n, err := watchedCopy(ctx, remote, stallTimeout, lg, client.Close, func(ctx context.Context, passThru scp.PassThru) error {
+		return client.CopyFromRemotePassThru(ctx, io.MultiWriter(out, h), remote, passThru)
+	})
+	return n, hex.EncodeToString(h.Sum(nil)), err
+}
+
+// remoteSum is the SHA256 of the file at p on the remote
+func remoteSum(client *ssh.Client, p string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	out, err := session.Output("sha256sum -- " + shellQuote(p))
+	if err != nil {
+		return "", err
+	}
+	sum, _, _ := strings.Cut(string(out), " ")
+	return sum, nil
+}
+
+// cleanupDrone deletes the files in sent from the drone once they're
+// safely here, or with ArchiveDir moves them there, on the drone, under the
+// batch's ID. Directories left empty go too. As with cleanupSent, what's
+// about to go is appended to the audit log first
+func cleanupDrone(cfg *Config, addr, batch string, sent []sentFile) error {
+	if len(sent) == 0 {
+		return nil
+	}
+	action, state := "deleted", stateDeleted
+	if cfg.ArchiveDir != "" {
+		action, state = "archived", stateArchived
+	}
+	if err := appendAudit(cfg.auditPath(), action, sent); err != nil {
+		return fmt.Errorf("audit log, not cleaning up anything: %w", err)
+	}
+	exportDir := strings.TrimSuffix(cfg.ExportDir, "/")
+	var script strings.Builder
+	script.WriteString("status=0\n")
+	dirs := map[string]bool{}
+	for _, f := range sent {
+		if cfg.ArchiveDir == "" {
+			fmt.Fprintf(&script, "rm -f -- %s || status=1\n", shellQuote(f.Path))
+		} else {
+			dst := path.Join(cfg.ArchiveDir, batch, strings.TrimPrefix(f.Path, exportDir+"/"))
+			fmt.Fprintf(&script, "{ mkdir -p -- %s && mv -f -- %s %s; } || status=1\n", shellQuote(path.Dir(dst)), shellQuote(f.Path), shellQuote(dst))
+		}
+		for d := path.Dir(f.Path); d != exportDir && strings.HasPrefix(d, exportDir+"/"); d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+	// deepest first, so a parent is empty by the time it's tried
+	var empty []string
+	for d := range dirs {
+		empty = append(empty, d)
+	}
+	sort.Slice(empty, func(i, j int) bool { return len(empty[i]) > len(empty[j]) })
+	for _, d := range empty {
+		fmt.Fprintf(&script, "rmdir -- %s 2>/dev/null\n", shellQuote(d))
+	}
+	script.WriteString("exit $status\n")
+
+	slog.Info("Cleaning up on the drone", "action", action, "files", len(sent))
+	client, err := transfer.DialSSH(addr, sshConfig(cfg))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = strings.NewReader(script.String())
+	if out, err := session.CombinedOutput("sh -s"); err != nil {
+		return fmt.Errorf("clean up on the drone: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	journal.record(state, "", sent...)
+	return nil
+}
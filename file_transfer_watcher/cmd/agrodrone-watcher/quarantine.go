@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// staleFailures is how many failures a file older than MaxFileAge needs
+// before it's quarantined, so one bad link doesn't condemn old files
+const staleFailures = 3
+
+// quarantineNote is the suffix of the note left next to a quarantined file
+// saying why it's there, and quarantineReason of the machine-readable one
+// left for files that failed validation
+const (
+	quarantineNote   = ".quarantine.txt"
+	quarantineReason = ".quarantine.json"
+)
+
+// invalidNote is what goes in a quarantineReason note
+type invalidNote struct {
+	Time   time.Time
+	Reason string
+	Detail string
+}
+
+// fileFailure is how often a file has failed to transfer in a row
+type fileFailure struct {
+	Count       int
+	FirstFailed time.Time
+	LastError   string
+}
+
+// loadFailures reads the per-file failure counts. They're kept on disk, and
+// reread every time, so they survive restarts and retry-quarantine can
+// reset them while the watcher runs
+func loadFailures(cfg *Config) map[string]fileFailure {
+	failures := map[string]fileFailure{}
+	b, err := os.ReadFile(cfg.failuresPath())
+	if err == nil {
+		err = json.Unmarshal(b, &failures)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("Failed to read failure counts", "file", cfg.failuresPath(), "error", err)
+	}
+	return failures
+}
+
+func saveFailures(cfg *Config, failures map[string]fileFailure) {
+	if err := writeFileAtomic(cfg.failuresPath(), failures); err != nil {
+		slog.Error("Failed to write failure counts", "file", cfg.failuresPath(), "error", err)
+	}
+}
+
+// clearFailures forgets the failures of paths that have now gone through
+func clearFailures(cfg *Config, sent []sentFile) {
+	failures := loadFailures(cfg)
+	changed := false
+	for _, f := range sent {
+		if _, ok := failures[f.Path]; ok {
+			delete(failures, f.Path)
+			changed = true
+		}
+	}
+	if changed {
+		saveFailures(cfg, failures)
+	}
+}
+
+// recordFailure notes that path failed to transfer with err, and
+// quarantines it if it keeps failing: after cfg.QuarantineAfter failures in
+// a row, or staleFailures once it's older than cfg.MaxFileAge. That way one
+// file the remote will never take stops holding up everything else. With
+// QuarantineDelete stale files are deleted instead
+func recordFailure(cfg *Config, path string, err error) {
+	failures := loadFailures(cfg)
+	f := failures[path]
+	if f.Count == 0 {
+		f.FirstFailed = time.Now()
+	}
+	f.Count++
+	f.LastError = err.Error()
+	failures[path] = f
+	defer saveFailures(cfg, failures)
+
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return
+	}
+	age := time.Since(info.ModTime())
+	stale := cfg.MaxFileAge.Duration > 0 && age > cfg.MaxFileAge.Duration && f.Count >= staleFailures
+	if !stale && (cfg.QuarantineAfter <= 0 || f.Count < cfg.QuarantineAfter) {
+		return
+	}
+
+	why := fmt.Sprintf("failed %d times in a row, last with: %v", f.Count, err)
+	if stale {
+		why = fmt.Sprintf("%v old and %s", age.Round(time.Hour), why)
+	}
+	if stale && cfg.QuarantineDelete {
+		slog.Warn("Deleting file that keeps failing", "file", path, "reason", why)
+		if err := appendAudit(cfg.auditPath(), "quarantine-deleted", []sentFile{{Path: path, Size: info.Size()}}); err != nil {
+			slog.Error("Not deleting file, audit log failed", "file", path, "error", err)
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			slog.Error("Failed to delete file", "file", path, "error", err)
+			return
+		}
+	} else {
+		slog.Warn("Quarantining file that keeps failing", "file", path, "reason", why)
+		if err := quarantineFile(cfg, path, why); err != nil {
+			slog.Error("Failed to quarantine file", "file", path, "error", err)
+			return
+		}
+	}
+	delete(failures, path)
+	noteQuarantined(path, why)
+}
+
+// quarantineFile moves path out of the export dir into the quarantine dir,
+// keeping its relative path, with a note next to it saying why
+func quarantineFile(cfg *Config, path, why string) error {
+	dst := quarantineDest(cfg, path)
+	slog.Info("Moving file to quarantine", "file", path, "to", dst)
+	if err := moveFile(path, dst); err != nil {
+		return err
+	}
+	note := fmt.Sprintf("%s\n%s\n", time.Now().Format(time.RFC3339), why)
+	if err := os.WriteFile(dst+quarantineNote, []byte(note), 0o644); err != nil {
+		slog.Error("Failed to write quarantine note", "file", dst, "error", err)
+	}
+	return nil
+}
+
+// quarantineDest is where path goes in the quarantine dir
+func quarantineDest(cfg *Config, path string) string {
+	rel, err := filepath.Rel(cfg.ExportDir, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	return filepath.Join(cfg.quarantinePath(), rel)
+}
+
+// noteInvalid leaves the reason path, already quarantined, failed
+// validation next to it for tooling to pick up
+func noteInvalid(cfg *Config, path string, err error) {
+	note := invalidNote{Time: time.Now().UTC(), Reason: invalidReason(err), Detail: err.Error()}
+	if err := writeFileAtomic(quarantineDest(cfg, path)+quarantineReason, note); err != nil {
+		slog.Error("Failed to write quarantine reason", "file", path, "error", err)
+	}
+}
+
+// noteQuarantined lists path in the status file's Quarantined with why
+func noteQuarantined(path, why string) {
+	status.update(func(s *statusData) {
+		// copied, since snapshots share the old map
+		q := make(map[string]string, len(s.Quarantined)+1)
+		for k, v := range s.Quarantined {
+			q[k] = v
+		}
+		q[path] = why
+		s.Quarantined = q
+	})
+}
+
+// retryQuarantine moves everything in the quarantine dir back into the
+// export dir, drops the notes and resets the failure counts, for once
+// whatever was wrong has been fixed
+func retryQuarantine(cfg *Config) error {
+	root := cfg.quarantinePath()
+	var errs []error
+	var removed []string
+	moved := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == root {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if strings.HasSuffix(path, quarantineNote) || strings.HasSuffix(path, quarantineReason) {
+			if err := os.Remove(path); err != nil {
+				errs = append(errs, err)
+				return nil
+			}
+			removed = append(removed, path)
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(cfg.ExportDir, rel)
+		fmt.Printf("%s -> %s\n", path, dst)
+		if err := moveFile(path, dst); err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		removed = append(removed, path)
+		moved++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	removeEmptyParents(root, removed)
+	saveFailures(cfg, map[string]fileFailure{})
+	fmt.Printf("%d files back in the queue\n", moved)
+	return errors.Join(errs...)
+}
+
+// quarantineStubs moves files smaller than cfg.MinFileSize to the
+// quarantine dir, since they're most likely stubs left by a crashed camera.
+// Files still being written are left alone
+func quarantineStubs(cfg *Config, filter *fileFilter) {
+	if cfg.MinFileSize == 0 || !cfg.QuarantineSmall {
+		return
+	}
+	stable := newStabilityCheck(cfg)
+	// the same filter, except for the lower bound we're looking for
+	var stubs *fileFilter
+	if filter != nil {
+		f := *filter
+		f.MinSize = 0
+		stubs = &f
+	}
+	var moved []string
+	for _, f := range exportFiles(cfg.ExportDir, stubs) {
+		info, err := os.Stat(f.Path)
+		if err != nil || uint64(info.Size()) >= uint64(cfg.MinFileSize) {
+			continue
+		}
+		if ok, _ := stable.Ready(f.Path, info); !ok {
+			continue
+		}
+		why := fmt.Sprintf("%d bytes, below MinFileSize %d; likely corrupt", info.Size(), cfg.MinFileSize)
+		slog.Warn("Quarantining stub file", "file", f.Path, "reason", why)
+		if err := quarantineFile(cfg, f.Path, why); err != nil {
+			slog.Error("Failed to quarantine file", "file", f.Path, "error", err)
+			continue
+		}
+		noteQuarantined(f.Path, why)
+		moved = append(moved, f.Path)
+	}
+	removeEmptyParents(cfg.ExportDir, moved)
+}
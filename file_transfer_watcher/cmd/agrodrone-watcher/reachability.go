@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hostAddr turns a configured host into host:port. It accepts a hostname or
+// IPv4 address, a bare IPv6 literal (fd00::1), or a bracketed one with or
+// without a port ([fd00::1], [fd00::1]:2222, host:2222); defaultPort is used
+// when none is given
+func hostAddr(host string, defaultPort int) (string, error) {
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		if _, err := strconv.Atoi(p); err != nil {
+			return "", fmt.Errorf("bad port in %q", host)
+		}
+		return net.JoinHostPort(h, p), nil
+	}
+	h := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if h == "" {
+		return "", fmt.Errorf("empty host %q", host)
+	}
+	return net.JoinHostPort(h, strconv.Itoa(defaultPort)), nil
+}
+
+// reachableVia checks whether addr accepts a TCP connection, trying each
+// interface in ifaces in order (e.g. eth0 before wlan0). It returns the name
+// of the interface that worked, or "default route" when ifaces is empty and
+// a plain dial succeeded
+func reachableVia(addr string, ifaces []string, timeout time.Duration) (string, bool) {
+	if len(ifaces) == 0 {
+		if dialOK(&net.Dialer{Timeout: timeout}, addr) {
+			return "default route", true
+		}
+		return "", false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	ips, err := resolveDualStack(host)
+	if err != nil {
+		return "", false
+	}
+	for _, name := range ifaces {
+		// bind to the interface's address of the same family as the target,
+		// trying IPv6 targets before IPv4
+		for _, ip := range ips {
+			local := interfaceAddr(name, ip.To4() == nil)
+			if local == nil {
+				continue
+			}
+			d := &net.Dialer{Timeout: timeout, LocalAddr: &net.TCPAddr{IP: local}}
+			if dialOK(d, net.JoinHostPort(ip.String(), port)) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// resolveDualStack resolves host, IPv6 addresses first
+func resolveDualStack(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ips, func(i, j int) bool { return ips[i].To4() == nil && ips[j].To4() != nil })
+	return ips, nil
+}
+
+// checkReachable dials addr up to attempts times, pausing briefly between
+// tries, and returns how long the successful dial took. This is much cheaper
+// than finding out via a failed SSH handshake that DHCP hasn't finished or
+// sshd isn't up yet. Hostnames with both IPv6 and IPv4 addresses are dialed
+// Happy Eyeballs style, IPv6 first
+func checkReachable(addr string, attempts int, timeout time.Duration) (time.Duration, error) {
+	var err error
+	for i := 1; i <= attempts; i++ {
+		start := time.Now()
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+		if err == nil {
+			latency := time.Since(start)
+			_ = conn.Close()
+			return latency, nil
+		}
+		if i < attempts {
+			time.Sleep(time.Second)
+		}
+	}
+	return 0, err
+}
+
+// waitForLease polls until iface has an IPv4 address (inside subnet, if
+// given as a CIDR) and there's a route to addr, returning how long that took
+func waitForLease(iface, subnet, addr string, timeout time.Duration) (time.Duration, error) {
+	var want *net.IPNet
+	if subnet != "" {
+		_, n, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return 0, fmt.Errorf("bad subnet %q: %w", subnet, err)
+		}
+		want = n
+	}
+	start := time.Now()
+	for {
+		ip := interfaceIP(iface)
+		switch {
+		case ip == nil:
+		case want != nil && !want.Contains(ip):
+			slog.Debug("Waiting for an address in the subnet", "interface", iface, "ip", ip, "want", want)
+		case routable(addr):
+			return time.Since(start), nil
+		}
+		if time.Since(start) >= timeout {
+			if ip == nil {
+				return 0, fmt.Errorf("no address on %s after %v", iface, timeout)
+			}
+			return 0, fmt.Errorf("no usable address or route to %s after %v (have %s)", addr, timeout, ip)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// routable reports whether the kernel has a route to addr. Connecting a UDP
+// socket does the route lookup without sending anything
+func routable(addr string) bool {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+func dialOK(d *net.Dialer, addr string) bool {
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// interfaceIP returns the first IPv4 address of the named interface, or nil
+// if it doesn't exist or has no address (e.g. the cable is unplugged)
+func interfaceIP(name string) net.IP {
+	return interfaceAddr(name, false)
+}
+
+// interfaceAddr returns the first IPv4 or (non link-local) IPv6 address of
+// the named interface, or nil
+func interfaceAddr(name string, v6 bool) net.IP {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if (ipnet.IP.To4() == nil) == v6 {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
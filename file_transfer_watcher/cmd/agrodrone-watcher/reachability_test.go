@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestHostAddr(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"fd00::1", "[fd00::1]:22", true},
+		{"[fd00::1]", "[fd00::1]:22", true},
+		{"[fd00::1]:2222", "[fd00::1]:2222", true},
+		{"groundstation.local", "groundstation.local:22", true},
+		{"groundstation.local:2222", "groundstation.local:2222", true},
+		{"192.168.4.1", "192.168.4.1:22", true},
+		{"192.168.4.1:2222", "192.168.4.1:2222", true},
+		{"192.168.4.1:ssh", "", false},
+		{"", "", false},
+		{"[]", "", false},
+	} {
+		got, err := hostAddr(tt.in, 22)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("hostAddr(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
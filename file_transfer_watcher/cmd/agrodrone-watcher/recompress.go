@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// JPEG markers
+const (
+	jpegSOI  = 0xD8
+	jpegSOS  = 0xDA
+	jpegAPP1 = 0xE1 // EXIF and XMP
+	jpegAPP2 = 0xE2 // ICC profile
+)
+
+// recompressible reports whether f is a JPEG big enough to recompress
+func recompressible(cfg *Config, f batchFile) bool {
+	switch strings.ToLower(filepath.Ext(f.Path)) {
+	case ".jpg", ".jpeg":
+		return cfg.RecompressOver > 0 && f.Size > int64(cfg.RecompressOver)
+	}
+	return false
+}
+
+// recompressFiles re-encodes the JPEGs in files over RecompressOver into
+// the recompress dir, cfg.RecompressWorkers at a time, and points each one
+// that came out smaller at its copy (Source) so that's what's sent. Any
+// that can't be decoded, or don't shrink, are sent as they are
+func recompressFiles(ctx context.Context, cfg *Config, files []batchFile) []batchFile {
+	var todo []int
+	for i, f := range files {
+		if recompressible(cfg, f) {
+			todo = append(todo, i)
+		}
+	}
+	if len(todo) == 0 {
+		return files
+	}
+	out := append([]batchFile(nil), files...)
+	slog.Info("Recompressing JPEGs", "files", len(todo), "quality", cfg.RecompressQuality, "workers", cfg.RecompressWorkers)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range cfg.RecompressWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f := files[i]
+				rel, err := filepath.Rel(cfg.ExportDir, f.Path)
+				if err != nil {
+					rel = filepath.Base(f.Path)
+				}
+				dst := filepath.Join(cfg.recompressPath(), rel)
+				n, err := recompressJPEG(f.Path, dst, cfg.RecompressQuality)
+				switch {
+				case err != nil:
+					slog.Warn("Failed to recompress; sending the original", "file", f.Path, "error", err)
+				case n >= f.Size:
+					slog.Info("Recompressing didn't make it smaller; sending the original", "file", f.Path, "bytes", f.Size)
+					os.Remove(dst)
+				default:
+					slog.Debug("Recompressed", "file", f.Path, "from_bytes", f.Size, "bytes", n)
+					out[i].Source, out[i].Size = dst, n
+				}
+			}
+		}()
+	}
+feed:
+	for _, i := range todo {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return out
+}
+
+// recompressJPEG decodes the JPEG src and writes it to dst at quality, with
+// src's EXIF, XMP and ICC profile. It returns how big dst is
+func recompressJPEG(src, dst string, quality int) (int64, error) {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return 0, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return 0, fmt.Errorf("decode %s: %w", src, err)
+	}
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, img, &jpeg.Options{Quality: quality}); err != nil {
+		return 0, fmt.Errorf("encode %s: %w", src, err)
+	}
+	// the metadata goes straight after the new SOI
+	var buf bytes.Buffer
+	buf.Write(enc.Bytes()[:2])
+	for _, seg := range jpegMetadata(b) {
+		buf.Write(seg)
+	}
+	buf.Write(enc.Bytes()[2:])
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return 0, err
+	}
+	tmp := dst + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return int64(buf.Len()), nil
+}
+
+// jpegMetadata returns the APP1 and APP2 segments, markers and all, from
+// the header of the JPEG b
+func jpegMetadata(b []byte) [][]byte {
+	if len(b) < 2 || b[0] != 0xFF || b[1] != jpegSOI {
+		return nil
+	}
+	var segs [][]byte
+	for i := 2; i+4 <= len(b) && b[i] == 0xFF; {
+		marker := b[i+1]
+		if marker == jpegSOS {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			break
+		}
+		if marker == jpegAPP1 || marker == jpegAPP2 {
+			segs = append(segs, b[i:i+2+n])
+		}
+		i += 2 + n
+	}
+	return segs
+}
+
+// sentRecompressed deals with the originals of the recompressed files among
+// sent before they're cleaned up: with ArchiveDir, and unless
+// RecompressKeepOriginal, each is replaced by the copy that was sent, so
+// that's what's archived. The rest of the recompress dir is emptied
+func sentRecompressed(cfg *Config, files []batchFile, sent []sentFile) {
+	if cfg.ArchiveDir != "" && !cfg.RecompressKeepOriginal {
+		source := map[string]string{}
+		for _, f := range files {
+			if f.Source != "" {
+				source[f.Path] = f.Source
+			}
+		}
+		for _, s := range sent {
+			if src, ok := source[s.Path]; ok {
+				if err := moveFile(src, s.Path); err != nil {
+					slog.Warn("Failed to replace the original with its recompressed copy; archiving the original", "file", s.Path, "error", err)
+				}
+			}
+		}
+	}
+	if err := os.RemoveAll(cfg.recompressPath()); err != nil {
+		slog.Warn("Failed to empty the recompress dir", "error", err)
+	}
+}
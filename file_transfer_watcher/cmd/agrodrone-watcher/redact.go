@@ -0,0 +1,12 @@
+package main
+
+import "github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+
+// configSecrets registers the secrets in cfg to be masked wherever they'd
+// be logged or written out
+func configSecrets(cfg *Config) {
+	redact.Add(cfg.RemotePassword, cfg.HotspotPSK, cfg.MQTTPassword, cfg.WebhookURL)
+	for _, n := range cfg.Networks {
+		redact.Add(n.PSK)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHFailureKeepsPasswordOut(t *testing.T) {
+	cfg := testConfig(t)
+	testSSHConfig(cfg)
+	cfg.RemotePassword = "gr0und-stati0n-pw"
+	configSecrets(cfg)
+
+	// some sshd and PAM setups echo what was tried back in the error
+	old := dialUploader
+	dialUploader = func(addr string, _ *ssh.ClientConfig) (transfer.Uploader, error) {
+		return nil, fmt.Errorf("ssh: handshake failed with %s: password %q rejected", addr, cfg.RemotePassword)
+	}
+	t.Cleanup(func() { dialUploader = old })
+
+	var logs bytes.Buffer
+	oldLog := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(oldLog) })
+	if err := setupLogging("json", slog.LevelDebug, &logs, ""); err != nil {
+		t.Fatal(err)
+	}
+	oldStatus := status
+	status = &statusFile{path: filepath.Join(t.TempDir(), "status.json")}
+	t.Cleanup(func() { status = oldStatus })
+	oldOut, oldExit := onceOut, onceExit
+	t.Cleanup(func() { onceOut, onceExit = oldOut, oldExit })
+	var summary bytes.Buffer
+	onceOut, onceExit = &summary, func(int) {}
+
+	writeFiles(t, cfg.ExportDir, "a.jpg")
+	units := splitUnits(cfg.ExportDir, batchOf(t, []string{filepath.Join(cfg.ExportDir, "a.jpg")}))
+	results, err, cleanupErr := sendBatches(context.Background(), cfg, [][]batchUnit{units}, cfg.IngestDir, "drone:22")
+	if err == nil {
+		t.Fatal("want the connect error")
+	}
+	// as the main loop reports it
+	slog.Error("Transfer failed", "phase", "error", "remote_host", "drone:22", "error", err)
+	status.update(func(s *statusData) { s.Phase = "error"; s.LastError = err.Error() })
+	finishOnce(transferExit(results, err, cleanupErr), results, err)
+
+	statusFile, err := os.ReadFile(status.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history bytes.Buffer
+	if err := viewHistory(cfg, func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBatches).ForEach(func(_, v []byte) error {
+			history.Write(v)
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for what, out := range map[string]string{
+		"logs":        logs.String(),
+		"status file": string(statusFile),
+		"history":     history.String(),
+		"summary":     summary.String(),
+	} {
+		if strings.Contains(out, cfg.RemotePassword) {
+			t.Errorf("the %s have the password:\n%s", what, out)
+		}
+		if !strings.Contains(out, redact.Marker) {
+			t.Errorf("the %s don't show the error, masked:\n%s", what, out)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+	"golang.org/x/crypto/ssh"
+)
+
+// verifyRemote lists the remote directories that sent went to and checks
+// each file is there at its full size. Only those directories are listed,
+// not their subdirectories, so it stays cheap however big the ingest dir
+// gets. Files that aren't there as expected come back in missing
+func verifyRemote(addr string, config *ssh.ClientConfig, sent []sentFile) (ok, missing []sentFile, err error) {
+	var remote []string
+	for _, f := range sent {
+		if f.Remote != "" {
+			remote = append(remote, f.Remote)
+		}
+	}
+	if len(remote) == 0 {
+		return sent, nil, nil
+	}
+	sizes, err := remoteSizes(addr, config, remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, f := range sent {
+		if f.Remote == "" {
+			ok = append(ok, f)
+			continue
+		}
+		switch n, found := sizes[f.Remote]; {
+		case !found:
+			slog.Error("File isn't on the remote; keeping it", "file", f.Path, "remote", f.Remote)
+			missing = append(missing, f)
+		case n != f.Size:
+			slog.Error("File is the wrong size on the remote; keeping it", "file", f.Path, "remote", f.Remote, "remote_bytes", n, "bytes", f.Size)
+			missing = append(missing, f)
+		default:
+			ok = append(ok, f)
+		}
+	}
+	return ok, missing, nil
+}
+
+// remoteSizes lists the remote directories the files at paths are in, and
+// returns the size of every file in them by path
+func remoteSizes(addr string, config *ssh.ClientConfig, paths []string) (map[string]int64, error) {
+	dirs := map[string]bool{}
+	for _, p := range paths {
+		dirs[path.Dir(p)] = true
+	}
+	var args []string
+	for d := range dirs {
+		args = append(args, shellQuote(d))
+	}
+	sort.Strings(args)
+
+	client, err := transfer.DialSSH(addr, config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	// size first, since the path runs to the end of the line
+	cmd := "find " + strings.Join(args, " ") + ` -maxdepth 1 -type f -printf '%s %p\n'`
+	out, err := session.Output(cmd)
+	// find exits non-zero if one of the directories is missing, which the
+	// caller's comparison catches anyway
+	var exit *ssh.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		return nil, err
+	}
+
+	sizes := map[string]int64{}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		size, p, found := strings.Cut(sc.Text(), " ")
+		n, err := strconv.ParseInt(size, 10, 64)
+		if !found || err != nil {
+			continue
+		}
+		sizes[p] = n
+	}
+	return sizes, nil
+}
+
+// remoteMkdir makes dirs on the remote, and any parents they need
+func remoteMkdir(addr string, config *ssh.ClientConfig, dirs ...string) error {
+	up, err := dialUploader(addr, config)
+	if err != nil {
+		return err
+	}
+	defer up.Close()
+	return up.Mkdir(dirs...)
+}
+
+// remoteWriteJSON writes v as indented JSON to dst on the remote, under a
+// temporary name first so nothing picks up half of it
+func remoteWriteJSON(addr string, config *ssh.ClientConfig, dst string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	client, err := transfer.DialSSH(addr, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = bytes.NewReader(append(b, '\n'))
+	cmd := "cat > " + shellQuote(dst+".part") + " && mv -- " + shellQuote(dst+".part") + " " + shellQuote(dst)
+	if out, err := session.CombinedOutput(cmd); err != nil {
+		return errors.New(strings.TrimSpace(string(out)) + ": " + err.Error())
+	}
+	return nil
+}
+
+// remoteRead returns the file at p on the remote, or nil if there isn't one
+func remoteRead(addr string, config *ssh.ClientConfig, p string) ([]byte, error) {
+	client, err := transfer.DialSSH(addr, config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	out, err := session.Output("if [ -e " + shellQuote(p) + " ]; then cat -- " + shellQuote(p) + "; fi")
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
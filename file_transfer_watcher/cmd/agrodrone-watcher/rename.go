@@ -0,0 +1,170 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// renameTimeFormat is {batch_ts} in RenameTemplate, always in UTC
+const renameTimeFormat = "20060102T150405Z"
+
+// renameFiles applies cfg.RenameTemplate to the name of each file in units,
+// keeping the directory it's in (on the remote, for a flight session), or
+// cfg.RemoteNameTemplate to its whole remote path. Names that collide after
+// templating get _1, _2 and so on, in batch order. With RenameLocal the
+// files are renamed in the export dir; otherwise only the name on the
+// remote changes. It returns the mapping for the manifest
+func renameFiles(cfg *Config, units []batchUnit) []manifestEntry {
+	if cfg.RenameTemplate == "" && cfg.RemoteNameTemplate == "" {
+		return nil
+	}
+	ts := time.Now().UTC().Format(renameTimeFormat)
+	// RemoteNameTemplate never touches local files
+	renameLocal := cfg.RenameLocal && cfg.RemoteNameTemplate == ""
+	taken := map[string]bool{}
+	var entries []manifestEntry
+	for i := range units {
+		for j := range units[i].Files {
+			f := &units[i].Files[j]
+			rel, err := filepath.Rel(cfg.ExportDir, f.Path)
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			remote := cmp.Or(f.Remote, rel)
+			dir, name := path.Split(remote)
+			if cfg.RemoteNameTemplate != "" {
+				dir, name = path.Split(remoteName(cfg, *f, remote))
+			} else {
+				name = strings.NewReplacer(
+					"{device_id}", cfg.DeviceID,
+					"{batch_ts}", ts,
+					"{orig_name}", name,
+				).Replace(cfg.RenameTemplate)
+			}
+			// where the renamed file would go locally
+			local := func(p string) string { return path.Join(path.Dir(rel), path.Base(p)) }
+			target := uniqueName(dir+name, taken, func(p string) bool {
+				// renaming locally mustn't clobber a file that's already there
+				if !renameLocal {
+					return false
+				}
+				_, err := os.Lstat(filepath.Join(cfg.ExportDir, filepath.FromSlash(local(p))))
+				return err == nil
+			})
+			entry := manifestEntry{Local: rel, Remote: target, Size: f.Size, Priority: priorityName(cfg, *f), Capture: f.Capture}
+			entries = append(entries, entry)
+			if target == remote {
+				continue
+			}
+			if !renameLocal {
+				f.Remote = target
+				continue
+			}
+			dst := filepath.Join(cfg.ExportDir, filepath.FromSlash(local(target)))
+			if err := os.Rename(f.Path, dst); err != nil {
+				slog.Error("Failed to rename file; sending it as is", "file", f.Path, "target", target, "error", err)
+				entries[len(entries)-1].Remote = remote
+				continue
+			}
+			f.Path = dst
+			if f.Remote != "" {
+				f.Remote = target
+			}
+		}
+	}
+	return entries
+}
+
+// captureTimeFormat is {capture_ts} in RemoteNameTemplate, always in UTC.
+// Unlike {batch_ts} it has milliseconds, which mtimes and GPS times have
+const captureTimeFormat = "20060102T150405.000Z"
+
+// remoteName applies cfg.RemoteNameTemplate to f, which would otherwise go
+// to remote, for its path relative to the ingest dir. The capture time is
+// from its EXIF, else its mtime, and always in UTC so that names sort and a
+// change of daylight saving can't make two the same
+func remoteName(cfg *Config, f batchFile, remote string) string {
+	at := captureTime(f.Path, f.ModTime)
+	return path.Clean(strings.NewReplacer(
+		"{device}", cfg.DeviceID,
+		"{date}", at.Format(time.DateOnly),
+		"{capture_ts}", at.Format(captureTimeFormat),
+		"{dir}", path.Dir(remote),
+		"{orig}", path.Base(remote),
+	).Replace(cfg.RemoteNameTemplate))
+}
+
+// writeManifest records the renames, flight sessions and file counts in a
+// batch, if there are any
+func writeManifest(cfg *Config, batchID string, entries []manifestEntry, sessions []flightSession, counts []flightCount) {
+	if len(entries) == 0 && len(sessions) == 0 && len(counts) == 0 {
+		return
+	}
+	m := batchManifest{Batch: batchID, DeviceID: cfg.DeviceID, Files: entries, Sessions: sessions, Counts: counts}
+	if err := writeFileAtomic(cfg.manifestPath(batchID), m); err != nil {
+		slog.Error("Failed to write manifest", "batch", batchID, "error", err)
+	}
+}
+
+// uniqueName returns p, or p with _1, _2... before its extension, whichever
+// is first not in taken or reported by exists. The name is then taken
+func uniqueName(p string, taken map[string]bool, exists func(string) bool) string {
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	name := p
+	for n := 1; taken[name] || exists(name); n++ {
+		name = fmt.Sprintf("%s_%d%s", base, n, ext)
+	}
+	taken[name] = true
+	return name
+}
+
+// batchManifest records what was sent in a batch and under what name, and
+// which flight sessions its loose files made up
+type batchManifest struct {
+	Batch    string
+	DeviceID string          `json:",omitempty"`
+	Files    []manifestEntry `json:",omitempty"`
+	Sessions []flightSession `json:",omitempty"`
+	// Counts are how many files each flight that says was expected to have
+	// and went with
+	Counts []flightCount `json:",omitempty"`
+}
+
+// manifestEntry maps a file's original path, relative to ExportDir, to its
+// path relative to the ingest dir
+type manifestEntry struct {
+	Local  string
+	Remote string
+	Size   int64
+	// Priority is the name of the file's priority group, if there are any
+	Priority string `json:",omitempty"`
+	// Capture is the capture set it belongs to, with CapturePattern
+	Capture string `json:",omitempty"`
+	// SHA256 is its hash, where it's been worked out
+	SHA256 string `json:",omitempty"`
+}
+
+// manifestEntries lists the files in units as they are, for a manifest
+// without renames
+func manifestEntries(cfg *Config, units []batchUnit) []manifestEntry {
+	var entries []manifestEntry
+	for _, u := range units {
+		for _, f := range u.Files {
+			rel, err := filepath.Rel(cfg.ExportDir, f.Path)
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			entries = append(entries, manifestEntry{Local: rel, Remote: cmp.Or(f.Remote, rel), Size: f.Size, Priority: priorityName(cfg, f), Capture: f.Capture})
+		}
+	}
+	return entries
+}
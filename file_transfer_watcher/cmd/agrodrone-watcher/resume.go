@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// interruptedFile is a file the journal last saw mid-transfer, say because
+// the drone was switched off, and what the remote has of it now
+type interruptedFile struct {
+	entry  journalEntry
+	remote int64 // -1 if it isn't there
+}
+
+// reconcileInterrupted is the first thing done once the link is up: every
+// file the journal last saw being sent, and that's still here unchanged, is
+// looked up on the remote. If all of it got there (with its sidecars, if
+// they're on) it's marked verified and cleaned up instead of being sent
+// again; if only part did, or none, it's sent again from the start with the
+// next batch, as scp can't resume. With CleanupOn ack nothing is cleaned
+// up here: files that made it go with the next batch too, so the ground
+// station gets to ack them. It returns how many files were cleaned up, so
+// the caller can rebuild its batch, and an error if the remote couldn't be
+// checked and it should be tried again
+func reconcileInterrupted(cfg *Config, addr string) (int, error) {
+	latest, err := readJournal(journal.path)
+	if err != nil {
+		slog.Warn("Failed to read journal", "phase", "reconciling", "error", err)
+		return 0, nil
+	}
+	var files []interruptedFile
+	var remote []string
+	for _, e := range latest {
+		if e.State != stateTransferring || e.Remote == "" {
+			continue
+		}
+		if info, err := os.Stat(e.Path); err != nil || info.Size() != e.Size {
+			continue // gone or changed since; nothing to reconcile
+		}
+		files = append(files, interruptedFile{entry: e, remote: -1})
+		remote = append(remote, e.Remote)
+	}
+	if len(files) == 0 {
+		return 0, nil
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].entry.Time.Before(files[j].entry.Time) })
+
+	start := time.Now()
+	slog.Info("Reconciling files interrupted mid-transfer", "phase", "reconciling", "files", len(files))
+	status.update(func(s *statusData) { s.Phase = "reconciling" })
+	sizes, err := remoteSizes(addr, sshConfig(cfg), remote)
+	if err != nil {
+		return 0, fmt.Errorf("list the remote: %w", err)
+	}
+	for i := range files {
+		if n, ok := sizes[files[i].entry.Remote]; ok {
+			files[i].remote = n
+		}
+	}
+
+	var done []sentFile
+	var restart int
+	for _, f := range files {
+		e := f.entry
+		switch {
+		case f.remote == e.Size && hasSidecars(cfg, sizes, e.Remote):
+			slog.Info("Interrupted file made it across; not sending it again", "phase", "reconciling",
+				"file", e.Path, "remote", e.Remote, "bytes", e.Size)
+			done = append(done, sentFile{Path: e.Path, Size: e.Size, Remote: e.Remote})
+		case f.remote >= 0:
+			slog.Info("Interrupted file only partly made it across; sending it again", "phase", "reconciling",
+				"file", e.Path, "remote", e.Remote, "bytes", f.remote, "size", e.Size)
+			restart++
+		default:
+			slog.Info("Interrupted file isn't on the remote; sending it again", "phase", "reconciling",
+				"file", e.Path, "remote", e.Remote)
+			restart++
+		}
+	}
+	if len(done) > 0 {
+		journal.record(stateVerified, "", done...)
+		clearFailures(cfg, done)
+		if cfg.CleanupOn == cleanupAck {
+			restart += len(done)
+			done = nil
+		} else if err := cleanupSent(cfg, done); err != nil {
+			slog.Warn("Failed to clean up", "phase", "reconciling", "error", err)
+		}
+	}
+	slog.Info("Reconciled interrupted files", "phase", "reconciling", "complete", len(done), "resend", restart,
+		"duration_ms", time.Since(start).Milliseconds())
+	return len(done), nil
+}
+
+// hasSidecars reports whether the sidecars that go with remote, if they're
+// on, are there too
+func hasSidecars(cfg *Config, sizes map[string]int64, remote string) bool {
+	if _, ok := sizes[remote+sidecarExt]; cfg.Sidecars && !ok {
+		return false
+	}
+	if _, ok := sizes[remote+hashExt]; cfg.HashSidecars && !ok {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestResumeAfterInterruptedBatch(t *testing.T) {
+	cfg := testConfig(t)
+	testSSHConfig(cfg)
+	old := journal
+	journal = &fileJournal{path: cfg.journalPath()}
+	t.Cleanup(func() { journal = old })
+
+	// rewrite is swapped between the runs before and after the restart
+	var mu sync.Mutex
+	var rewrite func(string) string
+	addr := sshServer(t, func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if rewrite == nil {
+			return cmd
+		}
+		return rewrite(cmd)
+	})
+	ingest := t.TempDir()
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "b.jpg", "c.jpg", "d.jpg", "v.jpg")
+	// an earlier batch got v.jpg verified but not yet cleaned up
+	journal.record(stateVerified, "", sentFile{Path: paths[4], Size: 5, Remote: ingest + "/v.jpg"})
+
+	// the drone is switched off once c.jpg has started, leaving part of it
+	// on the remote
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mu.Lock()
+	rewrite = func(cmd string) string {
+		if strings.HasPrefix(cmd, "scp") && strings.Contains(cmd, "c.jpg") {
+			if err := os.WriteFile(filepath.Join(ingest, "c.jpg"), []byte("c."), 0o644); err != nil {
+				t.Error(err)
+			}
+			cancel()
+			return "sleep 30"
+		}
+		return cmd
+	}
+	mu.Unlock()
+	_, err := scpDir(ctx, cfg.ExportDir, batchOf(t, paths[:4]), ingest, addr, sshConfig(cfg), cfg.StallTimeout.Duration, nil, nil, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+
+	// restart
+	journal = &fileJournal{path: cfg.journalPath()}
+	recoverJournal(cfg)
+	if exists(paths[4]) {
+		t.Error("v.jpg was verified before the restart but is still here")
+	}
+	var sent []string
+	mu.Lock()
+	rewrite = func(cmd string) string {
+		if strings.HasPrefix(cmd, "scp") {
+			sent = append(sent, filepath.Base(strings.Trim(strings.Fields(cmd)[2], `"`)))
+		}
+		return cmd
+	}
+	mu.Unlock()
+	n, err := reconcileInterrupted(cfg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("cleaned up %d files, want a.jpg and b.jpg", n)
+	}
+	for i, want := range []bool{false, false, true, true} {
+		if exists(paths[i]) != want {
+			t.Errorf("%s still here: %v, want %v", filepath.Base(paths[i]), !want, want)
+		}
+	}
+
+	// the next batch sends what's left, with c.jpg from the start
+	res, err := scpDir(context.Background(), cfg.ExportDir, batchOf(t, paths[2:4]), ingest, addr, sshConfig(cfg), cfg.StallTimeout.Duration, nil, nil, nil, nil)
+	if err != nil || len(res.Transferred) != 2 {
+		t.Fatalf("got %v with %+v", err, res)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(sent, " ") != "c.jpg d.jpg" {
+		t.Errorf("sent %v after the restart, want just c.jpg and d.jpg", sent)
+	}
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+		if b, err := os.ReadFile(filepath.Join(ingest, name)); err != nil || string(b) != name {
+			t.Errorf("%s on the remote holds %q, %v", name, b, err)
+		}
+	}
+}
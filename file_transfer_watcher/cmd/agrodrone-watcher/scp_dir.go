@@ -0,0 +1,466 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	scp "github.com/bramvdbogaerde/go-scp"
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// errStalled is returned by scpDir when no bytes moved for the stall window,
+// which usually means the link is gone
+var errStalled = errors.New("transfer stalled")
+
+// fileError is a transfer failure pinned on one local file, as opposed to
+// the connection as a whole
+type fileError = transfer.FileError
+
+// sentFile is a local file the remote confirmed receiving in full
+type sentFile struct {
+	Path string
+	Size int64
+	// Remote is where it is on the remote, if known
+	Remote string
+	// Duration is how long it took to send, and SHA256 its hash if it was
+	// worked out for deduplication
+	Duration time.Duration
+	SHA256   string
+}
+
+// BatchResult is how each of the files given to scpDir went
+type BatchResult struct {
+	// Transferred were copied completely (or their content had already
+	// been sent), so are safe to clean up
+	Transferred []sentFile
+	// Skipped disappeared or changed size before they could be sent; what's
+	// still there goes in the next batch
+	Skipped []string
+	// Failed couldn't be read or were rejected by the remote, and are tried
+	// again next batch
+	Failed []*fileError
+	// Bytes is the size of the Transferred files
+	Bytes    int64
+	Duration time.Duration
+	// PeakBytesPerSec is the best throughput over any few seconds
+	PeakBytesPerSec int64
+	// Retries is how many of the files had failed in an earlier batch
+	Retries int
+}
+
+// avgBytesPerSec is the throughput over the whole transfer
+func (r BatchResult) avgBytesPerSec() int64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return int64(float64(r.Bytes) / r.Duration.Seconds())
+}
+
+// transferred adds f to the files confirmed sent
+func (r *BatchResult) transferred(f sentFile) {
+	r.Transferred = append(r.Transferred, f)
+	r.Bytes += f.Size
+	metrics.transferred(f.Size)
+	thumbs.sent(f.Path)
+}
+
+// dialUploader connects to the remote at addr (host:port) to send files
+// there. Tests swap in a fake
+var dialUploader = func(addr string, config *ssh.ClientConfig) (transfer.Uploader, error) {
+	return transfer.DialSCP(addr, config)
+}
+
+// scpDir copies files, in order, from exportDir to ingestDir on the remote
+// host at addr (host:port) and shows a live transfer-speed indicator.
+// Cancelling ctx aborts the copy. If a file makes no progress for
+// stallTimeout the connection is torn down and errStalled returned.
+//
+// A file that can't be read or that the remote rejects doesn't stop the
+// rest. With a dedup index, files whose content was already sent aren't
+// sent again. The result says what happened to each file even when it fails
+// part way, so only the files that made it get cleaned up. With a sidecar
+// writer each file's sidecar follows it, and the file only counts as sent
+// once its sidecar is across too. With a segmenter big files go in pieces
+// and only count as sent once they're joined back together on the remote.
+// If preempt finds files that should go first, the rest are skipped and
+// errPreempted returned
+func scpDir(ctx context.Context, exportDir string, files []batchFile, ingestDir, addr string, config *ssh.ClientConfig, stallTimeout time.Duration, dedup *dedupIndex, sidecars *sidecarWriter, segments *segmenter, preempt *preemptCheck) (res BatchResult, err error) {
+	stopPeak := make(chan struct{})
+	peak := measurePeak(stopPeak)
+	defer func(start time.Time) {
+		res.Duration = time.Since(start)
+		close(stopPeak)
+		res.PeakBytesPerSec = int64(<-peak)
+	}(time.Now())
+
+	up, err := dialUploader(addr, config)
+	if err != nil {
+		metrics.failed("connect")
+		return res, fmt.Errorf("connect: %w", err)
+	}
+	defer metrics.speed(0)
+	defer up.Close()
+	// sidecars, segments and copies on the remote need a shell there
+	shell, _ := up.(*transfer.SCP)
+	if shell == nil && (sidecars != nil || segments != nil || dedup != nil && dedup.remoteCopy) {
+		return res, errors.New("sidecars, segments and remote copies need the scp uploader")
+	}
+	lg := slog.With("remote_host", addr)
+
+	todo := make([]transfer.File, len(files))
+	for i, f := range files {
+		relativePath, _ := filepath.Rel(exportDir, f.Path) // keep sub-folder structure
+		if f.Remote != "" {
+			relativePath = f.Remote
+		}
+		todo[i] = transfer.File{Local: f.Path, Remote: filepath.Join(ingestDir, relativePath), Size: f.Size}
+	}
+
+	// seq is the file's place in the unit, to tell its log lines apart from
+	// another attempt at the same file
+	seq := 0
+	// remoteErr puts a failure on the remote side down to the file, unless
+	// it was the connection that went, which stops the batch instead
+	remoteErr := func(path string, err error) error {
+		if err = transfer.ConnLost(shell.SSH(), err); errors.Is(err, transfer.ErrConnLost) {
+			metrics.failed("connection")
+			return err
+		}
+		return &fileError{Path: path, Err: err}
+	}
+	send := func(ctx context.Context, i int, t transfer.File) (bool, error) {
+		seq++
+		lg := lg.With("seq", seq)
+		progress.nextFile()
+		f := files[i]
+		path, remotePath := t.Local, t.Remote
+
+		// a recompressed copy is sent under the original's name
+		src := cmp.Or(f.Source, path)
+		info, err := os.Stat(src)
+		if errors.Is(err, fs.ErrNotExist) {
+			lg.Warn("File disappeared before it could be sent", "file", path)
+			progress.skip(f.Size)
+			return false, nil
+		}
+		if err != nil {
+			return false, &fileError{Path: path, Err: fmt.Errorf("stat local %q: %w", path, err)}
+		}
+
+		// the hash is worked out on the way, unless the file might be a
+		// duplicate, which isn't sent at all; only something the same size
+		// as a file already sent can be one
+		var sum string
+		if dedup != nil && dedup.mayHave(info.Size()) {
+			if sum, err = hashPath(src); err != nil {
+				return false, &fileError{Path: path, Err: fmt.Errorf("hash local %q: %w", path, err)}
+			}
+			if prev, ok := dedup.lookup(sum); ok {
+				if !dedup.remoteCopy {
+					// it counts as sent, to where the earlier copy went
+					lg.Info("Duplicate of a file already sent; not sending it", "file", path, "duplicate_of", prev.RemotePath)
+					progress.skip(info.Size())
+					res.transferred(sentFile{Path: path, Size: info.Size(), Remote: prev.RemotePath, SHA256: sum})
+					return true, nil
+				}
+				if err := remoteCopy(shell.SSH(), prev.RemotePath, remotePath); err == nil {
+					lg.Info("Duplicate of a file already sent; copied it on the remote", "file", path, "duplicate_of", prev.RemotePath)
+					if err := sidecars.send(ctx, shell.Client(), exportDir, path, info, sum, remotePath); err != nil {
+						return false, remoteErr(path, fmt.Errorf("sidecar for %q: %w", path, err))
+					}
+					progress.skip(info.Size())
+					res.transferred(sentFile{Path: path, Size: info.Size(), Remote: remotePath, SHA256: sum})
+					return true, nil
+				}
+				// probably processed and moved away already
+				lg.Warn("Duplicate of a file already sent, but the remote copy failed; sending it", "file", path, "duplicate_of", prev.RemotePath)
+			}
+		}
+
+		perm := fmt.Sprintf("%04o", info.Mode().Perm())
+		want := info.Size()
+		var plan *segmentPlan
+		if segments.applies(path, info.Size()) {
+			localFile, err := os.Open(src)
+			if err != nil {
+				return false, &fileError{Path: path, Err: fmt.Errorf("open local %q: %w", path, err)}
+			}
+			defer localFile.Close()
+			if plan, err = segments.plan(shell.SSH(), localFile, info.Size(), remotePath); err != nil {
+				return false, remoteErr(path, fmt.Errorf("segment %q: %w", path, err))
+			}
+			sum, want = plan.SHA256, plan.pending()
+			lg.Info("Sending in segments", "file", path, "segments", len(plan.Segments), "bytes", want)
+		}
+
+		journal.record(stateTransferring, "", sentFile{Path: path, Size: info.Size(), Remote: remotePath})
+
+		var hasher hash.Hash
+		start := time.Now()
+		abort := func() { up.Close() }
+		total, err := watchedCopy(ctx, path, stallTimeout, lg, abort, func(ctx context.Context, passThru scp.PassThru) error {
+			if sum == "" && (sidecars != nil || dedup != nil) {
+				hasher = sha256.New()
+				passThru = teePassThru(passThru, hasher)
+			}
+			if plan != nil {
+				return plan.copy(ctx, shell.Client(), perm, passThru)
+			}
+			return up.Upload(ctx, src, remotePath, transfer.Options{Perm: perm, PassThru: passThru})
+		})
+		if errors.Is(err, errStalled) {
+			metrics.failed("stalled")
+			return false, fmt.Errorf("copy %q -> %q: %w after %v without progress", path, remotePath, errStalled, stallTimeout)
+		}
+		if err != nil && ctx.Err() == nil {
+			return false, remoteErr(path, fmt.Errorf("copy %q -> %q: %w", path, remotePath, err))
+		}
+		if err != nil {
+			metrics.failed("transfer")
+			return false, fmt.Errorf("copy %q -> %q: %w", path, remotePath, err)
+		}
+		// a file that changed size under us isn't the file we sent
+		if total != want {
+			lg.Warn("File changed size while being sent; leaving it for the next batch", "file", path, "bytes", total, "size", want)
+			return false, nil
+		}
+		if plan != nil {
+			if err := plan.join(shell.SSH()); err != nil {
+				return false, remoteErr(path, err)
+			}
+		}
+		if hasher != nil {
+			sum = hex.EncodeToString(hasher.Sum(nil))
+		}
+		if err := sidecars.send(ctx, shell.Client(), exportDir, path, info, sum, remotePath); err != nil {
+			return false, remoteErr(path, fmt.Errorf("sidecar for %q: %w", path, err))
+		}
+		took := time.Since(start)
+		lg.Info("Sent", "file", path, "bytes", info.Size(), "duration_ms", took.Milliseconds(),
+			"mib_per_sec", math.Round(float64(info.Size())/took.Seconds()/1024/1024*100)/100)
+		res.transferred(sentFile{Path: path, Size: info.Size(), Remote: remotePath, Duration: took, SHA256: sum})
+		beat()
+		if dedup != nil {
+			dedup.add(sum, remotePath, info.Size())
+		}
+		return true, nil
+	}
+	b := transfer.Batch{
+		Uploader: up,
+		Send:     send,
+		Before: func(i int, _ transfer.File) error {
+			if battery.critical() {
+				return errBatteryLow
+			}
+			// a capture set isn't split by preempting in the middle of it
+			f := files[i]
+			if (i == 0 || f.Capture == "" || f.Capture != files[i-1].Capture) && preempt.due(f) {
+				return errPreempted
+			}
+			return nil
+		},
+	}
+	// what was sent is counted as it goes, by res.transferred
+	out, err := b.Run(ctx, todo)
+	for _, f := range out.Skipped {
+		res.Skipped = append(res.Skipped, f.Local)
+	}
+	res.Failed = out.Failed
+	for range out.Failed {
+		metrics.failed("file")
+	}
+	return res, err
+}
+
+// watchStall calls onStall if counter's rate over the last window has
+// been zero. It returns once ctx is done or after calling onStall
+func watchStall(ctx context.Context, counter *int64, window time.Duration, onStall func()) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	speed := rateWindow{window: window}
+	speed.add(time.Now(), atomic.LoadInt64(counter))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			speed.add(now, atomic.LoadInt64(counter))
+			if speed.covered(now) && speed.rate(now) == 0 {
+				onStall()
+				return
+			}
+		}
+	}
+}
+
+// watchedCopy runs copy, which moves one file called name in either
+// direction, reading it through the passThru it's given. That shows its
+// progress, and if no bytes move for stallTimeout abort is called to tear
+// the connection down and errStalled returned. It returns how many bytes
+// moved
+func watchedCopy(ctx context.Context, name string, stallTimeout time.Duration, lg *slog.Logger, abort func(), copy func(context.Context, scp.PassThru) error) (int64, error) {
+	// PassThru allows you to pass in a function that gets called whenever more
+	// of the file is read by the scp funciton. This allows you to add things
+	// like progress tickers
+	var total int64
+	var progressReader *speedReader
+	passThru := func(r io.Reader, size int64) io.Reader {
+		progressReader = newSpeedReader(r, name, size, &total, lg)
+		return progressReader
+	}
+
+	// Watch for stalls; when the link drops mid-file the copy would
+	// otherwise hang until TCP gives up many minutes later
+	fileCtx, cancelFile := context.WithCancel(ctx)
+	defer cancelFile()
+	var stalled atomic.Bool
+	go watchStall(fileCtx, &total, stallTimeout, func() {
+		stalled.Store(true)
+		cancelFile()
+		abort()
+	})
+
+	err := copy(fileCtx, passThru)
+	if progressReader != nil {
+		progressReader.finish()
+	}
+	if stalled.Load() {
+		return atomic.LoadInt64(&total), errStalled
+	}
+	return atomic.LoadInt64(&total), err
+}
+
+// teePassThru is passThru, also writing everything read through it to w
+func teePassThru(passThru scp.PassThru, w io.Writer) scp.PassThru {
+	return func(r io.Reader, size int64) io.Reader {
+		return passThru(io.TeeReader(r, w), size)
+	}
+}
+
+// Progress display modes, for -progress
+const (
+	progressAuto = "auto" // tty on a terminal, log otherwise
+	progressTTY  = "tty"  // a live line redrawn in place on stdout
+	progressLog  = "log"  // a debug log line every 10s or 10% of the file
+	progressNone = "none"
+)
+
+// progressMode is how speedReader shows each file's progress
+var progressMode = progressLog
+
+// setProgressMode sets progressMode, working out "auto" from whether stdout
+// is a terminal
+func setProgressMode(mode string) error {
+	switch mode {
+	case progressAuto:
+		progressMode = progressLog
+		if _, err := unix.IoctlGetTermios(int(os.Stdout.Fd()), unix.TCGETS); err == nil {
+			progressMode = progressTTY
+		}
+	case progressTTY, progressLog, progressNone:
+		progressMode = mode
+	default:
+		return fmt.Errorf("-progress must be %q, %q, %q or %q, not %q", progressAuto, progressTTY, progressLog, progressNone, mode)
+	}
+	return nil
+}
+
+// speedReader counts the bytes read through it and shows the file's
+// progress as progressMode says, with the speed over the last speedWindow
+// and since the start of the file
+type speedReader struct {
+	r         io.Reader
+	name      string // the file being read, for the display
+	size      int64
+	start     time.Time
+	speed     rateWindow
+	counter   *int64 // points to the same int64 we gave to PassThru
+	lastPrint time.Time
+	lastStep  int64 // tenths of the file logged so far
+	printed   bool  // a live line is on the terminal
+	log       *slog.Logger
+	now       func() time.Time // the clock, swapped out in tests
+}
+
+// newSpeedReader wraps r, the file called name of size bytes, counting
+// what's read into counter
+func newSpeedReader(r io.Reader, name string, size int64, counter *int64, log *slog.Logger) *speedReader {
+	s := &speedReader{counter: counter, log: log, now: time.Now}
+	s.reset(r, name, size)
+	return s
+}
+
+// reset points s at another file, starting the count again from zero
+func (s *speedReader) reset(r io.Reader, name string, size int64) {
+	s.r, s.name, s.size = r, name, size
+	s.start = s.now()
+	s.lastPrint = s.start
+	s.lastStep, s.printed = 0, false
+	s.speed = rateWindow{window: speedWindow}
+	s.speed.add(s.start, 0)
+	atomic.StoreInt64(s.counter, 0)
+}
+
+func (s *speedReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	atomic.AddInt64(s.counter, int64(n))
+	atomic.AddInt64(&transferredBytes, int64(n))
+
+	now := s.now()
+	sent := atomic.LoadInt64(s.counter)
+	elapsed := now.Sub(s.start).Seconds()
+	if elapsed <= 0 {
+		return n, err
+	}
+	s.speed.add(now, sent)
+	bps := s.speed.rate(now)
+	avg := float64(sent) / elapsed
+	switch progressMode {
+	case progressTTY:
+		if now.Sub(s.lastPrint) >= 100*time.Millisecond {
+			fmt.Printf("\r%s → remote  %d bytes  %.2f MiB/s (avg %.2f)  ", s.name, sent, bps/1024/1024, avg/1024/1024)
+			s.lastPrint, s.printed = now, true
+			metrics.speed(bps)
+		}
+	case progressLog:
+		var step int64
+		if s.size > 0 {
+			step = sent * 10 / s.size
+		}
+		if sent < s.size && (now.Sub(s.lastPrint) >= 10*time.Second || step > s.lastStep) {
+			s.log.Debug("Progress", "file", s.name, "bytes", sent, "size", s.size, "bytes_per_sec", int64(bps), "avg_bytes_per_sec", int64(avg))
+			s.lastPrint, s.lastStep = now, step
+			metrics.speed(bps)
+		}
+	default:
+		if now.Sub(s.lastPrint) >= 10*time.Second {
+			s.lastPrint = now
+			metrics.speed(bps)
+		}
+	}
+	return n, err
+}
+
+// finish ends the live line, if there is one, so the next output starts
+// on a line of its own
+func (s *speedReader) finish() {
+	if s.printed {
+		fmt.Println()
+		s.printed = false
+	}
+}
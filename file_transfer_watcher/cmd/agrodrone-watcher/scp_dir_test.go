@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+	"golang.org/x/crypto/ssh"
+)
+
+// batchOf is paths as a batch, with their sizes as written by writeFiles
+func batchOf(t *testing.T, paths []string) []batchFile {
+	t.Helper()
+	var files []batchFile
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, batchFile{Path: p, Size: info.Size()})
+	}
+	return files
+}
+
+func TestScpDirMixedOutcomes(t *testing.T) {
+	cfg := testConfig(t)
+	fake := fakeUploader(t)
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "bad.jpg", "gone.jpg", "sub/d.jpg")
+	files := batchOf(t, paths)
+	fake.Fail[paths[1]] = []error{errors.New("permission denied")}
+	os.Remove(paths[2])
+
+	res, err := scpDir(context.Background(), cfg.ExportDir, files, "/ingest", "drone:22", sshConfig(cfg), time.Minute, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []string
+	for _, f := range res.Transferred {
+		sent = append(sent, f.Remote)
+	}
+	if strings.Join(sent, " ") != "/ingest/a.jpg /ingest/sub/d.jpg" {
+		t.Errorf("transferred %v", sent)
+	}
+	if res.Bytes != files[0].Size+files[3].Size {
+		t.Errorf("got %d bytes, want %d", res.Bytes, files[0].Size+files[3].Size)
+	}
+	if len(res.Skipped) != 1 || res.Skipped[0] != paths[2] {
+		t.Errorf("skipped %v, want the file that disappeared", res.Skipped)
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Path != paths[1] || !strings.Contains(res.Failed[0].Error(), "permission denied") {
+		t.Errorf("failed %v, want bad.jpg with its error", res.Failed)
+	}
+}
+
+// cancelAfter is an Uploader that cancels the batch once n files are up,
+// as when the main loop is told to stop
+type cancelAfter struct {
+	*transfer.Fake
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfter) Upload(ctx context.Context, localPath, remotePath string, opts transfer.Options) error {
+	err := c.Fake.Upload(ctx, localPath, remotePath, opts)
+	if c.n--; c.n == 0 {
+		c.cancel()
+	}
+	return err
+}
+
+func TestScpDirCancelledPartWay(t *testing.T) {
+	cfg := testConfig(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := &cancelAfter{Fake: transfer.NewFake(), n: 1, cancel: cancel}
+	old := dialUploader
+	dialUploader = func(string, *ssh.ClientConfig) (transfer.Uploader, error) { return up, nil }
+	t.Cleanup(func() { dialUploader = old })
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "b.jpg", "c.jpg")
+
+	res, err := scpDir(ctx, cfg.ExportDir, batchOf(t, paths), "/ingest", "drone:22", sshConfig(cfg), time.Minute, nil, nil, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if len(res.Transferred) != 1 || res.Transferred[0].Path != paths[0] {
+		t.Errorf("transferred %v, want just a.jpg", res.Transferred)
+	}
+	// the rest never went, which isn't their fault
+	if len(res.Failed) != 0 {
+		t.Errorf("failed %v", res.Failed)
+	}
+}
+
+func TestSpeedReaderCountsBytes(t *testing.T) {
+	old := progressMode
+	t.Cleanup(func() { progressMode = old })
+	lg := slog.New(slog.NewTextHandler(io.Discard, nil))
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	for _, mode := range []string{progressTTY, progressLog, progressNone} {
+		for _, size := range []int64{int64(len(data)), 0, int64(len(data)) * 2} {
+			progressMode = mode
+			var counter int64
+			before := atomic.LoadInt64(&transferredBytes)
+			// a byte at a time, so every branch gets a look in
+			r := newSpeedReader(iotest.OneByteReader(bytes.NewReader(data)), "a.jpg", size, &counter, lg)
+			got, err := io.ReadAll(r)
+			r.finish()
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s, size %d: read %d bytes, %v", mode, size, len(got), err)
+			}
+			if counter != int64(len(data)) {
+				t.Errorf("%s, size %d: counted %d bytes, want %d", mode, size, counter, len(data))
+			}
+			if n := atomic.LoadInt64(&transferredBytes) - before; n != int64(len(data)) {
+				t.Errorf("%s, size %d: added %d to the total, want %d", mode, size, n, len(data))
+			}
+		}
+	}
+}
+
+func TestSpeedReaderReset(t *testing.T) {
+	var counter int64
+	lg := slog.New(slog.NewTextHandler(io.Discard, nil))
+	r := newSpeedReader(bytes.NewReader([]byte("first")), "a.jpg", 5, &counter, lg)
+	io.ReadAll(r)
+	r.reset(bytes.NewReader([]byte("second!")), "b.jpg", 7)
+	if counter != 0 {
+		t.Fatalf("reset left the count at %d", counter)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "second!" || counter != 7 {
+		t.Errorf("read %q, counted %d", got, counter)
+	}
+}
+
+// pacedReader reads n bytes at chunk bytes a read, moving clock on by per
+// each time, so they come at a set rate
+type pacedReader struct {
+	clock *fakeClock
+	chunk int
+	per   time.Duration
+	n     int64
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	n := min(len(p), r.chunk, int(r.n))
+	r.n -= int64(n)
+	r.clock.t = r.clock.t.Add(r.per)
+	return n, nil
+}
+
+func TestSpeedReaderRates(t *testing.T) {
+	old := progressMode
+	t.Cleanup(func() { progressMode = old })
+	progressMode = progressLog
+	var logs bytes.Buffer
+	lg := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	const mib = 1 << 20
+	clock := &fakeClock{t: time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)}
+	// 20 MiB at 1 MiB/s, then 80 MiB at 4 MiB/s
+	src := io.MultiReader(
+		&pacedReader{clock: clock, chunk: 64 << 10, per: time.Second / 16, n: 20 * mib},
+		&pacedReader{clock: clock, chunk: 64 << 10, per: time.Second / 64, n: 80 * mib},
+	)
+	var counter int64
+	r := newSpeedReader(nil, "a.tif", 100*mib, &counter, lg)
+	r.now = clock.now
+	r.reset(src, "a.tif", 100*mib)
+
+	// sampled every second, as measurePeak does
+	peak := peakMeter{speed: rateWindow{window: peakWindow}}
+	peak.add(clock.t, 0)
+	next := clock.t.Add(time.Second)
+	buf := make([]byte, 64<<10)
+	for {
+		_, err := r.Read(buf)
+		if !clock.t.Before(next) {
+			peak.add(clock.t, counter)
+			next = next.Add(time.Second)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if counter != 100*mib {
+		t.Fatalf("counted %d bytes", counter)
+	}
+
+	near := func(got, want float64) bool { return got > want*0.98 && got < want*1.02 }
+	type progressLine struct {
+		Bytes int64   `json:"bytes"`
+		BPS   float64 `json:"bytes_per_sec"`
+		Avg   float64 `json:"avg_bytes_per_sec"`
+	}
+	lines := map[int64]progressLine{}
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var l progressLine
+		if err := dec.Decode(&l); err != nil {
+			t.Fatal(err)
+		}
+		lines[l.Bytes] = l
+	}
+	for _, tt := range []struct {
+		bytes     int64
+		rate, avg float64
+	}{
+		// 10s in, all of it at 1 MiB/s
+		{10 * mib, 1 * mib, 1 * mib},
+		// 37.5s in, the last 10s of it at 4 MiB/s
+		{90 * mib, 4 * mib, 90 * mib / 37.5},
+	} {
+		l, ok := lines[tt.bytes]
+		if !ok {
+			t.Errorf("no progress logged at %d bytes", tt.bytes)
+			continue
+		}
+		if !near(l.BPS, tt.rate) || !near(l.Avg, tt.avg) {
+			t.Errorf("at %d bytes got %.0f B/s (avg %.0f), want %.0f (avg %.0f)", tt.bytes, l.BPS, l.Avg, tt.rate, tt.avg)
+		}
+	}
+	// the peak is the fast stretch, not the 2.5 MiB/s average
+	if !near(peak.peak, 4*mib) {
+		t.Errorf("peak %.0f B/s, want %d", peak.peak, 4*mib)
+	}
+}
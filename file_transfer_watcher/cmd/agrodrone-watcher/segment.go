@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	scp "github.com/bramvdbogaerde/go-scp"
+	"golang.org/x/crypto/ssh"
+)
+
+// segmentsExt is added to a segmented file's remote name for its reassembly
+// manifest, and segmentExt (with the segment's number) for each segment
+const (
+	segmentsExt = ".segments.json"
+	segmentExt  = ".seg%04d"
+)
+
+// segmenter sends big files (videos, mostly) in SegmentSize pieces that are
+// joined back together on the remote, so a link that drops part way only
+// costs the piece it was on. A nil segmenter sends everything whole
+type segmenter struct {
+	over int64
+	size int64
+	exts []string
+}
+
+func newSegmenter(cfg *Config) *segmenter {
+	if cfg.SegmentOver == 0 {
+		return nil
+	}
+	return &segmenter{over: int64(cfg.SegmentOver), size: int64(cfg.SegmentSize), exts: cfg.SegmentExtensions}
+}
+
+// applies reports whether the file at path, of size bytes, is sent in
+// segments
+func (s *segmenter) applies(p string, size int64) bool {
+	if s == nil || size <= s.over {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(p))
+	for _, e := range s.exts {
+		if strings.ToLower(e) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// segment is one piece of a segmented file
+type segment struct {
+	Name   string // on the remote, next to where the file goes
+	Offset int64
+	Size   int64
+	SHA256 string
+	sent   bool // already on the remote intact
+}
+
+// segmentManifest is sent ahead of the segments as <name>.segments.json,
+// so they can be put back together by hand if joining them fails
+type segmentManifest struct {
+	Name     string
+	Size     int64
+	SHA256   string
+	Segments []segment
+}
+
+// segmentPlan is how one file is sent in segments
+type segmentPlan struct {
+	file   *os.File
+	remote string // where the whole file goes
+	segmentManifest
+}
+
+// plan works out f's segments and their hashes, and which the remote
+// already has intact from an earlier attempt
+func (s *segmenter) plan(client *ssh.Client, f *os.File, size int64, remotePath string) (*segmentPlan, error) {
+	p := &segmentPlan{file: f, remote: remotePath}
+	p.Name, p.Size = path.Base(remotePath), size
+	whole := sha256.New()
+	for off, i := int64(0), 0; off < size; off, i = off+s.size, i+1 {
+		n := min(s.size, size-off)
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(whole, h), io.NewSectionReader(f, off, n)); err != nil {
+			return nil, err
+		}
+		p.Segments = append(p.Segments, segment{
+			Name:   p.Name + fmt.Sprintf(segmentExt, i),
+			Offset: off,
+			Size:   n,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+	p.SHA256 = hex.EncodeToString(whole.Sum(nil))
+
+	have, err := p.remoteSums(client)
+	if err != nil {
+		return nil, err
+	}
+	for i := range p.Segments {
+		p.Segments[i].sent = have[p.Segments[i].Name] == p.Segments[i].SHA256
+	}
+	return p, nil
+}
+
+// dir is the remote directory the file and its segments go in
+func (p *segmentPlan) dir() string {
+	return path.Dir(p.remote)
+}
+
+// remoteSums hashes whatever segments are already on the remote
+func (p *segmentPlan) remoteSums(client *ssh.Client) (map[string]string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	cmd := "cd " + shellQuote(p.dir()) + " 2>/dev/null && sha256sum --" + p.names() + " 2>/dev/null"
+	out, err := session.Output(cmd)
+	// missing segments, or a missing dir, just aren't in the output
+	var exit *ssh.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		return nil, err
+	}
+	sums := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if sum, name, ok := strings.Cut(sc.Text(), "  "); ok {
+			sums[name] = sum
+		}
+	}
+	return sums, nil
+}
+
+// names is every segment's name, shell quoted and each after a space
+func (p *segmentPlan) names() string {
+	var b strings.Builder
+	for _, seg := range p.Segments {
+		b.WriteString(" " + shellQuote(seg.Name))
+	}
+	return b.String()
+}
+
+// pending is how many bytes of segments the remote doesn't have yet
+func (p *segmentPlan) pending() int64 {
+	var n int64
+	for _, seg := range p.Segments {
+		if !seg.sent {
+			n += seg.Size
+		}
+	}
+	return n
+}
+
+// copy sends the manifest, then every segment the remote doesn't have yet.
+// They're read through passThru as one stream, so progress and stall
+// detection see the file as a whole
+func (p *segmentPlan) copy(ctx context.Context, client *scp.Client, perm string, passThru func(io.Reader, int64) io.Reader) error {
+	b, err := json.MarshalIndent(p.segmentManifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := client.CopyFile(ctx, bytes.NewReader(b), p.remote+segmentsExt, "0644"); err != nil {
+		return fmt.Errorf("manifest: %w", err)
+	}
+	var pending []io.Reader
+	for _, seg := range p.Segments {
+		if !seg.sent {
+			pending = append(pending, io.NewSectionReader(p.file, seg.Offset, seg.Size))
+		}
+	}
+	r := passThru(io.MultiReader(pending...), p.pending())
+	for _, seg := range p.Segments {
+		if seg.sent {
+			continue
+		}
+		err := client.CopyPassThru(ctx, io.LimitReader(r, seg.Size), path.Join(p.dir(), seg.Name), perm, seg.Size, nil)
+		if err != nil {
+			return fmt.Errorf("segment %s: %w", seg.Name, err)
+		}
+	}
+	return nil
+}
+
+// join checks every segment on the remote against its hash, puts them
+// back together, checks the whole file's hash and only then moves it into
+// place and removes the segments. A segment that fails its check is sent
+// again on the next attempt
+func (p *segmentPlan) join(client *ssh.Client) error {
+	var sums, rm strings.Builder
+	for _, seg := range p.Segments {
+		fmt.Fprintf(&sums, "%s  %s\n", seg.SHA256, seg.Name)
+	}
+	tmp := shellQuote(p.Name + ".joining")
+	name := shellQuote(p.Name)
+	rm.WriteString(p.names() + " " + shellQuote(p.Name+segmentsExt))
+	cmd := "cd " + shellQuote(p.dir()) +
+		" && printf '%s' " + shellQuote(sums.String()) + " | sha256sum -c --quiet -" +
+		" && cat --" + p.names() + " > " + tmp +
+		" && printf '%s' " + shellQuote(p.SHA256+"  "+p.Name+".joining\n") + " | sha256sum -c --quiet -" +
+		" && mv -f -- " + tmp + " " + name +
+		" && rm -f --" + rm.String() +
+		" || { rm -f -- " + tmp + "; exit 1; }"
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if out, err := session.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("join segments on the remote: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
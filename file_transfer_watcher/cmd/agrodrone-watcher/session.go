@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// flightSession is a run of loose files with no gap of more than
+// SessionGap between one and the next, taken to be one flight
+type flightSession struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+	Files int
+	Bytes int64
+}
+
+// sessionName is the directory a session starting at start goes in
+func sessionName(start time.Time) string {
+	return "flight_" + start.UTC().Format(renameTimeFormat)
+}
+
+// groupSessions splits the loose files in units into flight sessions by
+// their mtimes, each a unit of its own sent to flight_<start>/ on the
+// remote. Files in directories are left as they are. Files close enough
+// after the last session sent join it, so a flight split across batches
+// stays in one directory. Units come back oldest first, as from splitUnits
+func groupSessions(cfg *Config, units []batchUnit) []batchUnit {
+	gap := cfg.SessionGap.Duration
+	if gap <= 0 {
+		return units
+	}
+	var loose []batchFile
+	var grouped []batchUnit
+	for _, u := range units {
+		if u.Name == "" {
+			loose = append(loose, u.Files...)
+		} else {
+			grouped = append(grouped, u)
+		}
+	}
+	if len(loose) == 0 {
+		return units
+	}
+	sort.SliceStable(loose, func(i, j int) bool { return loose[i].ModTime.Before(loose[j].ModTime) })
+
+	cur := loadSession(cfg)
+	var sessions []batchUnit
+	for _, f := range loose {
+		if cur == nil || f.ModTime.Before(cur.Start) || f.ModTime.Sub(cur.End) > gap {
+			cur = &flightSession{Name: sessionName(f.ModTime), Start: f.ModTime}
+			sessions = append(sessions, batchUnit{Name: cur.Name, Session: true})
+		} else if len(sessions) == 0 {
+			sessions = append(sessions, batchUnit{Name: cur.Name, Session: true})
+		}
+		cur.End = f.ModTime
+		rel, err := filepath.Rel(cfg.ExportDir, f.Path)
+		if err != nil {
+			continue
+		}
+		f.Remote = path.Join(cur.Name, filepath.ToSlash(rel))
+		sessions[len(sessions)-1].Files = append(sessions[len(sessions)-1].Files, f)
+	}
+
+	units = append(grouped, sessions...)
+	sort.SliceStable(units, func(i, j int) bool { return oldestFile(units[i]).Before(oldestFile(units[j])) })
+	return units
+}
+
+func oldestFile(u batchUnit) time.Time {
+	var oldest time.Time
+	for i, f := range u.Files {
+		if i == 0 || f.ModTime.Before(oldest) {
+			oldest = f.ModTime
+		}
+	}
+	return oldest
+}
+
+// unitSessions sums up the flight sessions in a batch
+func unitSessions(units []batchUnit) []flightSession {
+	var sessions []flightSession
+	for _, u := range units {
+		if !u.Session || len(u.Files) == 0 {
+			continue
+		}
+		s := flightSession{Name: u.Name, Files: len(u.Files)}
+		for i, f := range u.Files {
+			if i == 0 || f.ModTime.Before(s.Start) {
+				s.Start = f.ModTime
+			}
+			if f.ModTime.After(s.End) {
+				s.End = f.ModTime
+			}
+			s.Bytes += f.Size
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// loadSession returns the last session sent, or nil if there isn't one
+func loadSession(cfg *Config) *flightSession {
+	b, err := os.ReadFile(cfg.sessionPath())
+	var s flightSession
+	if err == nil {
+		err = json.Unmarshal(b, &s)
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Failed to read the last flight session", "error", err)
+		}
+		return nil
+	}
+	return &s
+}
+
+// rememberSession records s as the last session sent, unless a later one
+// already is
+func rememberSession(cfg *Config, s flightSession) {
+	if last := loadSession(cfg); last != nil && last.End.After(s.End) {
+		return
+	}
+	if err := writeFileAtomic(cfg.sessionPath(), s); err != nil {
+		slog.Error("Failed to record the last flight session", "error", err)
+	}
+}
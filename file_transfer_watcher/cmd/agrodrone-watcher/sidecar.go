@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	scp "github.com/bramvdbogaerde/go-scp"
+)
+
+// sidecarSchema is bumped whenever fields in sidecarMeta change meaning or
+// go away, so tooling on the ground can tell versions apart. New fields
+// don't bump it
+const sidecarSchema = 1
+
+// sidecarExt is added to a file's name for its sidecar, and hashExt for its
+// sha256sum line
+const (
+	sidecarExt = ".meta.json"
+	hashExt    = ".sha256"
+)
+
+// sidecarMeta is the provenance of a file sent, written next to it as
+// <name>.meta.json and sent straight after it
+type sidecarMeta struct {
+	Schema        int
+	DeviceID      string `json:",omitempty"`
+	Batch         string
+	Source        string // relative to the export dir
+	Size          int64
+	SHA256        string
+	CapturedAt    time.Time // the file's mtime
+	TransferredAt time.Time
+}
+
+// sidecarWriter writes and sends the sidecars for each file in a batch: the
+// provenance with meta, the .sha256 with hash. A nil writer does nothing
+type sidecarWriter struct {
+	deviceID string
+	batch    string
+	meta     bool
+	hash     bool
+}
+
+func newSidecarWriter(cfg *Config) *sidecarWriter {
+	if !cfg.Sidecars && !cfg.HashSidecars {
+		return nil
+	}
+	return &sidecarWriter{deviceID: cfg.DeviceID, batch: journal.currentBatch(), meta: cfg.Sidecars, hash: cfg.HashSidecars}
+}
+
+// isSidecar reports whether path is a sidecar rather than a file of ours
+func isSidecar(path string) bool {
+	return strings.HasSuffix(path, sidecarExt) || strings.HasSuffix(path, hashExt)
+}
+
+// sidecarsOf returns the sidecars path has locally
+func sidecarsOf(path string) []string {
+	var found []string
+	for _, ext := range []string{sidecarExt, hashExt} {
+		if _, err := os.Lstat(path + ext); err == nil {
+			found = append(found, path+ext)
+		}
+	}
+	return found
+}
+
+// send writes the sidecars for the file at path (already sent to
+// remotePath) next to it, then sends them next to the remote copy, the
+// .sha256 last so its presence means everything else is there. The local
+// sidecars are cleaned up along with their file
+func (w *sidecarWriter) send(ctx context.Context, client *scp.Client, exportDir, path string, info os.FileInfo, sum, remotePath string) error {
+	if w == nil {
+		return nil
+	}
+	if w.meta {
+		rel, _ := filepath.Rel(exportDir, path)
+		b, err := json.MarshalIndent(sidecarMeta{
+			Schema:        sidecarSchema,
+			DeviceID:      w.deviceID,
+			Batch:         w.batch,
+			Source:        filepath.ToSlash(rel),
+			Size:          info.Size(),
+			SHA256:        sum,
+			CapturedAt:    info.ModTime().UTC(),
+			TransferredAt: time.Now().UTC(),
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeSidecar(ctx, client, path+sidecarExt, remotePath+sidecarExt, b); err != nil {
+			return err
+		}
+	}
+	if w.hash {
+		// as sha256sum writes it, so sha256sum -c works in the remote dir
+		line := sum + "  " + filepath.Base(remotePath) + "\n"
+		return writeSidecar(ctx, client, path+hashExt, remotePath+hashExt, []byte(line))
+	}
+	return nil
+}
+
+func writeSidecar(ctx context.Context, client *scp.Client, local, remote string, b []byte) error {
+	if err := os.WriteFile(local, b, 0o644); err != nil {
+		return err
+	}
+	return client.CopyFile(ctx, bytes.NewReader(b), remote, "0644")
+}
+
+// removeSidecars deletes path's sidecars, if it has any
+func removeSidecars(path string) error {
+	var errs []error
+	for _, ext := range []string{sidecarExt, hashExt} {
+		if err := os.Remove(path + ext); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
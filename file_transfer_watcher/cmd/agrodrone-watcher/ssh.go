@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshConfig builds the client config for the ground station. When
+// HostKeyFingerprint is set the host key must match it; otherwise any host
+// key is accepted. Connecting gives up after StallTimeout, so a link that
+// drops mid-handshake doesn't hang until TCP gives up
+func sshConfig(cfg *Config) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User: cfg.RemoteUser,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(cfg.RemotePassword),
+		},
+		HostKeyCallback: hostKeyCallback(cfg.HostKeyFingerprint),
+		Timeout:         cfg.StallTimeout.Duration,
+	}
+}
+
+// hostKeyCallback checks the host key against a pinned SHA256 fingerprint in
+// the `ssh-keygen -lf` form ("SHA256:...")
+func hostKeyCallback(fingerprint string) ssh.HostKeyCallback {
+	if fingerprint == "" {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+		if got := ssh.FingerprintSHA256(key); got != fingerprint {
+			return fmt.Errorf("host key for %s is %s, expected %s", hostname, got, fingerprint)
+		}
+		return nil
+	}
+}
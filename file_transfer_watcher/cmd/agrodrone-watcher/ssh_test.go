@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/transfer"
+)
+
+// testSSHConfig is cfg's SSH config with a short stall window, for the
+// in-process server
+func testSSHConfig(cfg *Config) {
+	cfg.RemoteUser, cfg.RemotePassword = "drone", "x"
+	cfg.StallTimeout = Duration{2 * time.Second}
+}
+
+func TestSSHConnectTimesOut(t *testing.T) {
+	cfg := testConfig(t)
+	testSSHConfig(cfg)
+	// accepts the connection but never says anything
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	start := time.Now()
+	_, err = dialUploader(l.Addr().String(), sshConfig(cfg))
+	if err == nil {
+		t.Fatal("connected to a server that never answered")
+	}
+	if d := time.Since(start); d > cfg.StallTimeout.Duration+2*time.Second {
+		t.Errorf("took %v to give up, with a %v timeout", d, cfg.StallTimeout.Duration)
+	}
+}
+
+func TestScpDirAbortsWhenTheRemoteStopsReading(t *testing.T) {
+	cfg := testConfig(t)
+	testSSHConfig(cfg)
+	// the remote's scp never reads or answers, as when the link drops
+	addr := sshServer(t, func(cmd string) string {
+		if strings.HasPrefix(cmd, "scp") {
+			return "sleep 30"
+		}
+		return cmd
+	})
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "b.jpg")
+	files := []batchFile{{Path: paths[0], Size: 5}, {Path: paths[1], Size: 5}}
+
+	start := time.Now()
+	res, err := scpDir(context.Background(), cfg.ExportDir, files, t.TempDir(), addr, sshConfig(cfg), cfg.StallTimeout.Duration, nil, nil, nil, nil)
+	if !errors.Is(err, errStalled) {
+		t.Fatalf("got %v, want errStalled", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("took %v to notice the stall", d)
+	}
+	if len(res.Transferred) != 0 {
+		t.Errorf("transferred %v of a stalled copy", res.Transferred)
+	}
+	if len(res.Failed) != 0 {
+		t.Errorf("a stall was put down to the file: %v", res.Failed)
+	}
+}
+
+func TestScpDirSendsOverSSH(t *testing.T) {
+	cfg := testConfig(t)
+	testSSHConfig(cfg)
+	addr := sshServer(t, nil)
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "sub/b.jpg")
+	files := []batchFile{{Path: paths[0], Size: 5}, {Path: paths[1], Size: 9}}
+	ingest := t.TempDir()
+	if err := remoteMkdir(addr, sshConfig(cfg), ingest+"/sub"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := scpDir(context.Background(), cfg.ExportDir, files, ingest, addr, sshConfig(cfg), cfg.StallTimeout.Duration, nil, nil, nil, nil)
+	if err != nil || len(res.Transferred) != 2 || res.Bytes != 14 {
+		t.Fatalf("got %v with %+v", err, res)
+	}
+	for _, p := range []string{"a.jpg", "sub/b.jpg"} {
+		if !exists(ingest + "/" + p) {
+			t.Errorf("%s isn't on the remote", p)
+		}
+	}
+}
+
+// cuttable forwards connections to addr until cut is called, which drops
+// them all, as when the link goes. It returns the address to dial
+func cuttable(t *testing.T, addr string) (string, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	cut := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	t.Cleanup(func() {
+		l.Close()
+		cut()
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", addr)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			mu.Lock()
+			conns = append(conns, c, up)
+			mu.Unlock()
+			go io.Copy(up, c)
+			go io.Copy(c, up)
+		}
+	}()
+	return l.Addr().String(), cut
+}
+
+func TestScpDirStopsWhenTheLinkDrops(t *testing.T) {
+	cfg := testConfig(t)
+	testSSHConfig(cfg)
+	var cut func()
+	addr := sshServer(t, func(cmd string) string {
+		if strings.HasPrefix(cmd, "scp") && strings.Contains(cmd, "b.jpg") {
+			cut()
+			return "sleep 30"
+		}
+		return cmd
+	})
+	addr, cut = cuttable(t, addr)
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "b.jpg", "c.jpg")
+	ingest := t.TempDir()
+
+	res, err := scpDir(context.Background(), cfg.ExportDir, batchOf(t, paths), ingest, addr, sshConfig(cfg), cfg.StallTimeout.Duration, nil, nil, nil, nil)
+	if !errors.Is(err, transfer.ErrConnLost) {
+		t.Fatalf("got %v, want ErrConnLost", err)
+	}
+	if len(res.Transferred) != 1 || res.Transferred[0].Path != paths[0] {
+		t.Errorf("transferred %v, want just a.jpg", res.Transferred)
+	}
+	if len(res.Failed) != 0 {
+		t.Errorf("the dropped link was put down to files: %v", res.Failed)
+	}
+}
+
+func TestScpDirPutsARefusedPathOnTheFile(t *testing.T) {
+	cfg := testConfig(t)
+	testSSHConfig(cfg)
+	addr := sshServer(t, nil)
+	paths := writeFiles(t, cfg.ExportDir, "a.jpg", "sub/b.jpg", "c.jpg")
+	ingest := t.TempDir()
+
+	// sub doesn't exist on the remote, so scp refuses b.jpg but the
+	// connection is fine
+	res, err := scpDir(context.Background(), cfg.ExportDir, batchOf(t, paths), ingest, addr, sshConfig(cfg), cfg.StallTimeout.Duration, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Transferred) != 2 || len(res.Failed) != 1 || res.Failed[0].Path != paths[1] {
+		t.Errorf("transferred %v, failed %v; want b.jpg alone failed", res.Transferred, res.Failed)
+	}
+	if errors.Is(res.Failed[0], transfer.ErrConnLost) {
+		t.Errorf("a refused path was taken for the link: %v", res.Failed[0])
+	}
+}
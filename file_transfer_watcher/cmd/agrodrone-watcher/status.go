@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+// statusData is what gets written to the status file so operators can see
+// what the watcher is doing without reading its logs
+type statusData struct {
+	UpdatedAt time.Time
+	Phase     string
+	Network   string `json:",omitempty"`
+	// WifiBackoff is how long we're waiting before the next WiFi attempt,
+	// and WifiBackoffLevel how many failed attempts in a row led there
+	WifiBackoff      string `json:",omitempty"`
+	WifiBackoffLevel int
+	LastError        string `json:",omitempty"`
+	// Incident is set while every cycle has been failing for a while
+	Incident *incident `json:",omitempty"`
+	// Link is the WiFi link quality over the current or last batch
+	Link *linkSummary `json:",omitempty"`
+	// BadBSSIDs are APs we've stopped trying because they turned out not to
+	// be the ground station
+	BadBSSIDs map[string]string `json:",omitempty"`
+	// Quarantined are files that kept failing to transfer and were moved out
+	// of the export dir (or deleted), keyed by path with the last error
+	Quarantined map[string]string `json:",omitempty"`
+	// Flights is how each flight directory (and the loose files) in the
+	// last batch went
+	Flights []unitResult `json:",omitempty"`
+	// Backlog is how far through the current (or last) backlog we are, when
+	// it's split into several batches
+	Backlog *backlogProgress `json:",omitempty"`
+	// Progress is how far through the files being sent we are, while
+	// transferring
+	Progress *progressStatus `json:",omitempty"`
+	// PendingFiles and PendingBytes are what's waiting in the export dir,
+	// as of the last cycle
+	PendingFiles int
+	PendingBytes int64
+	// LastBatch is the last batch sent
+	LastBatch *historyBatch `json:",omitempty"`
+	// ClockSkew is how far the ground station's clock is ahead of ours, as
+	// of the last time we connected
+	ClockSkew string `json:",omitempty"`
+	// Disk is how full the export filesystem is, checked every cycle
+	Disk *diskUsage `json:",omitempty"`
+	// Gate is whether sending is held off until the drone lands, if it's
+	// configured
+	Gate *gateStatus `json:",omitempty"`
+	// Load is whether sending is held off for the capture pipeline, if
+	// any of its limits are configured
+	Load *loadStatus `json:",omitempty"`
+	// Battery is the battery's charge as last read, if BatterySource is set
+	Battery *batteryStatus `json:",omitempty"`
+}
+
+// statusFile holds the current status and rewrites the file on every update.
+// An empty path keeps the status in memory only
+type statusFile struct {
+	mu   sync.Mutex
+	path string
+	data statusData
+}
+
+var status = &statusFile{}
+
+// update applies fn to the status and writes it out
+func (s *statusFile) update(fn func(*statusData)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.data)
+	s.data.UpdatedAt = time.Now()
+	mqtt.phase(s.data.Phase)
+	led.phase(s.data.Phase)
+	if s.path == "" {
+		return
+	}
+	if err := writeFileAtomic(s.path, s.data); err != nil {
+		slog.Error("Failed to write status file", "file", s.path, "error", err)
+	}
+}
+
+// snapshot returns a copy of the current status
+func (s *statusFile) snapshot() statusData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data
+}
+
+// writeFileAtomic writes v as JSON to path via a temp file and rename, so
+// readers never see a half-written file
+func writeFileAtomic(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = []byte(redact.String(string(b)))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runSubcommand runs the one-off command given after the flags, if any,
+// instead of the watcher itself. It reports whether there was one
+func runSubcommand(cfg *Config, args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch {
+	case len(args) == 3 && args[0] == "filters" && args[1] == "test":
+		return true, filtersTest(cfg, args[2])
+	case len(args) == 1 && args[0] == "retry-quarantine":
+		return true, retryQuarantine(cfg)
+	case len(args) == 1 && args[0] == "queue":
+		return true, printQueue(cfg)
+	case len(args) == 2 && args[0] == "history" && args[1] == "list":
+		return true, historyList(cfg)
+	case len(args) == 3 && args[0] == "history" && args[1] == "show":
+		return true, historyShow(cfg, args[2])
+	default:
+		return true, fmt.Errorf("unknown command %q; usage: filters test <path> | retry-quarantine | queue | history list | history show <batch>", strings.Join(args, " "))
+	}
+}
+
+// filtersTest prints whether path would be sent, and which rule decided it.
+// path is relative to the export dir, or absolute inside it
+func filtersTest(cfg *Config, path string) error {
+	rel := path
+	if filepath.IsAbs(path) {
+		var err error
+		rel, err = filepath.Rel(cfg.ExportDir, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("%s isn't inside the export dir %s", path, cfg.ExportDir)
+		}
+	}
+	isDir := false
+	if info, err := os.Stat(filepath.Join(cfg.ExportDir, rel)); err == nil {
+		isDir = info.IsDir()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	filter := newFileFilter(cfg)
+	skip, why := filter.Skip(rel, isDir)
+	// a parent directory being filtered out takes its whole tree with it
+	for dir := filepath.Dir(rel); !skip && dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if s, w := filter.Skip(dir, true); s {
+			skip, why = true, "in "+dir+", "+w
+		}
+	}
+	if skip {
+		fmt.Printf("%s: skipped (%s)\n", rel, why)
+	} else {
+		fmt.Printf("%s: sent (%s)\n", rel, why)
+	}
+	return nil
+}
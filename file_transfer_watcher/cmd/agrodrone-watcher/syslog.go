@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+// Syslog severities and the facility we log as, from RFC 5424
+const (
+	syslogDaemon  = 3
+	syslogError   = 3
+	syslogWarning = 4
+	syslogInfo    = 6
+	syslogDebug   = 7
+)
+
+const syslogTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// syslogForwarder sends a copy of every log line to a syslog server, e.g.
+// on the ground station, as RFC 5424 messages. Lines wait in a ring while
+// the server can't be reached, dropping the oldest once it's full, and go
+// when the link comes up. Writing never waits on the network
+type syslogForwarder struct {
+	network  string // "udp" or "tcp"
+	addr     string
+	hostname string
+
+	mu      sync.Mutex
+	ring    []syslogRecord
+	head, n int
+	dropped int
+	conn    net.Conn
+	wake    chan struct{}
+}
+
+type syslogRecord struct {
+	at  time.Time
+	sev int
+	msg string
+}
+
+// syslogOut is nil unless SyslogAddr is set
+var syslogOut *syslogForwarder
+
+// startSyslog starts forwarding logs to cfg.SyslogAddr, if set. It's called
+// before logging is set up, so setupLogging can send logs its way
+func startSyslog(cfg *Config) {
+	if cfg.SyslogAddr == "" {
+		return
+	}
+	u, _ := url.Parse(cfg.SyslogAddr)
+	syslogOut = &syslogForwarder{
+		network:  u.Scheme,
+		addr:     u.Host,
+		hostname: syslogName(cfg.DeviceID),
+		ring:     make([]syslogRecord, cfg.SyslogBuffer),
+		wake:     make(chan struct{}, 1),
+	}
+	go syslogOut.run()
+}
+
+// Write queues one log line. Secrets are masked here, since the line comes
+// straight from the handler
+func (f *syslogForwarder) Write(p []byte) (int, error) {
+	sev, msg := lineSeverity(strings.TrimRight(redact.String(string(p)), "\n"))
+	f.mu.Lock()
+	f.push(syslogRecord{at: time.Now(), sev: sev, msg: msg})
+	up := f.conn != nil
+	f.mu.Unlock()
+	if up {
+		f.kick()
+	}
+	return len(p), nil
+}
+
+// push adds r to the end of the ring, dropping the oldest if it's full
+func (f *syslogForwarder) push(r syslogRecord) {
+	if f.n == len(f.ring) {
+		f.head = (f.head + 1) % len(f.ring)
+		f.n--
+		f.dropped++
+	}
+	f.ring[(f.head+f.n)%len(f.ring)] = r
+	f.n++
+}
+
+// linkUp sends whatever's waiting now the link is up, rather than at the
+// next retry
+func (f *syslogForwarder) linkUp() {
+	if f == nil {
+		return
+	}
+	f.kick()
+}
+
+func (f *syslogForwarder) kick() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends what's waiting whenever it's woken, and every minute in case
+// the link came up without anyone saying so
+func (f *syslogForwarder) run() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.wake:
+		case <-t.C:
+		}
+		f.flush()
+	}
+}
+
+// flush connects if need be and sends the ring, oldest first, until it's
+// empty or a write fails. A failed record goes back to the front
+func (f *syslogForwarder) flush() {
+	f.mu.Lock()
+	conn := f.conn
+	f.mu.Unlock()
+	if conn == nil {
+		c, err := net.DialTimeout(f.network, f.addr, 5*time.Second)
+		if err != nil {
+			return
+		}
+		conn = c
+		f.mu.Lock()
+		f.conn = conn
+		f.mu.Unlock()
+	}
+	for {
+		f.mu.Lock()
+		var r syslogRecord
+		dropped := f.dropped
+		switch {
+		case dropped > 0:
+			r = syslogRecord{at: time.Now(), sev: syslogWarning,
+				msg: fmt.Sprintf("%d log lines dropped while the syslog server couldn't be reached", dropped)}
+			f.dropped = 0
+		case f.n > 0:
+			r = f.ring[f.head]
+			f.head = (f.head + 1) % len(f.ring)
+			f.n--
+		default:
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(f.format(r)); err != nil {
+			conn.Close()
+			f.mu.Lock()
+			f.conn = nil
+			switch {
+			case dropped > 0:
+				f.dropped += dropped
+			case f.n < len(f.ring):
+				f.head = (f.head - 1 + len(f.ring)) % len(f.ring)
+				f.ring[f.head] = r
+				f.n++
+			default:
+				f.dropped++
+			}
+			f.mu.Unlock()
+			return
+		}
+	}
+}
+
+// format builds the RFC 5424 message for r, with the octet count in front
+// over TCP (RFC 6587) and as a datagram of its own over UDP
+func (f *syslogForwarder) format(r syslogRecord) []byte {
+	msg := fmt.Sprintf("<%d>1 %s %s agrodrone-watcher %d - - %s",
+		syslogDaemon*8+r.sev, r.at.Format(syslogTime), f.hostname, os.Getpid(), r.msg)
+	if f.network == "tcp" {
+		return fmt.Appendf(nil, "%d %s", len(msg), msg)
+	}
+	return []byte(msg)
+}
+
+// syslogName makes s fit the HOSTNAME field: printable ASCII with no spaces
+func syslogName(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '-'
+		}
+		return r
+	}, s)
+}
+
+// lineSeverity picks the level out of a log line, either from the log
+// package ("2025/04/12 10:15:00 [batch] WARN msg") or slog's text handler
+// ("level=WARN msg=..."), and returns the line without the timestamp, which
+// the syslog header already has. Lines from the log package are info
+func lineSeverity(line string) (int, string) {
+	if len(line) >= 20 && line[4] == '/' && line[13] == ':' {
+		line = line[20:]
+	}
+	prefix, rest := "", line
+	if strings.HasPrefix(rest, "[") {
+		if i := strings.Index(rest, "] "); i >= 0 {
+			prefix, rest = rest[:i+2], rest[i+2:]
+		}
+	}
+	level, msg, _ := strings.Cut(rest, " ")
+	sev := map[string]int{"DEBUG": syslogDebug, "INFO": syslogInfo, "WARN": syslogWarning, "ERROR": syslogError}
+	if s, ok := sev[strings.TrimPrefix(level, "level=")]; ok {
+		return s, prefix + msg
+	}
+	return syslogInfo, line
+}
+
+// withSyslog adds forwarding to h, for the structured log formats. Text
+// logs are forwarded from the writer instead
+func withSyslog(h slog.Handler, level slog.Level) slog.Handler {
+	if syslogOut == nil {
+		return h
+	}
+	fwd := slog.NewTextHandler(syslogOut, &slog.HandlerOptions{Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}})
+	return teeHandler{h, fwd}
+}
+
+// teeHandler sends each record to both of its handlers
+type teeHandler [2]slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return t[0].Enabled(ctx, l) || t[1].Enabled(ctx, l)
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			if e := h.Handle(ctx, r); err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return teeHandler{t[0].WithAttrs(attrs), t[1].WithAttrs(attrs)}
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	return teeHandler{t[0].WithGroup(name), t[1].WithGroup(name)}
+}
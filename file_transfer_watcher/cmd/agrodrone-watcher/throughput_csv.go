@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// throughputHeader is the first row of every throughput CSV
+var throughputHeader = []string{"time_utc", "kind", "batch_id", "file", "ssid", "signal_start_dbm", "signal_end_dbm",
+	"files", "bytes", "duration_s", "avg_mib_s", "peak_mib_s", "retries", "failures"}
+
+// throughputMu keeps our own appends from interleaving; the file is also
+// locked, for anything else writing to it
+var throughputMu sync.Mutex
+
+// throughputPath is the month's CSV for t, e.g. throughput-2026-10.csv for
+// throughput.csv
+func throughputPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + t.UTC().Format("-2006-01") + ext
+}
+
+// linkSignal is the WiFi signal in dBm, or "" if we're not on WiFi or it
+// can't be read
+func linkSignal(cfg *Config) string {
+	if cfg.ThroughputCSV == "" || cfg.WifiInterface == "" || status.snapshot().Network == "" {
+		return ""
+	}
+	s, err := sampleLink(cfg.WifiInterface)
+	if err != nil {
+		slog.Debug("Couldn't read the signal for the throughput CSV", "error", err)
+		return ""
+	}
+	return strconv.Itoa(s.SignalDBm)
+}
+
+// csvBatch appends a row for h to the throughput CSV
+func csvBatch(cfg *Config, h historyBatch, signalStart, signalEnd string) {
+	if cfg.ThroughputCSV == "" {
+		return
+	}
+	appendThroughput(cfg, h.End, [][]string{{
+		h.End.UTC().Format(time.RFC3339), "batch", h.ID, "", status.snapshot().Network, signalStart, signalEnd,
+		strconv.Itoa(h.Sent), strconv.FormatInt(h.Bytes, 10), seconds(h.End.Sub(h.Start)),
+		mibPerSec(float64(h.AvgBytesPerSec)), mibPerSec(float64(h.PeakBytesPerSec)),
+		strconv.Itoa(h.Retries), strconv.Itoa(h.Failed),
+	}})
+}
+
+// csvFiles appends a row for each file sent in res, with
+// ThroughputCSVFiles
+func csvFiles(cfg *Config, batch string, res BatchResult) {
+	if cfg.ThroughputCSV == "" || !cfg.ThroughputCSVFiles || len(res.Transferred) == 0 {
+		return
+	}
+	now := time.Now()
+	ssid := status.snapshot().Network
+	var rows [][]string
+	for _, f := range res.Transferred {
+		var avg float64
+		if f.Duration > 0 {
+			avg = float64(f.Size) / f.Duration.Seconds()
+		}
+		rows = append(rows, []string{
+			now.UTC().Format(time.RFC3339), "file", batch, f.Path, ssid, "", "",
+			"1", strconv.FormatInt(f.Size, 10), seconds(f.Duration), mibPerSec(avg), "", "", "",
+		})
+	}
+	appendThroughput(cfg, now, rows)
+}
+
+// appendThroughput appends rows to the CSV for the month of t, starting it
+// with the header if it's new. Failures are only logged
+func appendThroughput(cfg *Config, t time.Time, rows [][]string) {
+	throughputMu.Lock()
+	defer throughputMu.Unlock()
+	path := throughputPath(cfg.ThroughputCSV, t)
+	err := func() error {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			return fmt.Errorf("lock: %w", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		w := csv.NewWriter(f)
+		if info.Size() == 0 {
+			w.Write(throughputHeader)
+		}
+		w.WriteAll(rows)
+		return w.Error()
+	}()
+	if err != nil {
+		slog.Warn("Failed to write the throughput CSV", "file", path, "error", err)
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 1, 64)
+}
+
+func mibPerSec(bytesPerSec float64) string {
+	return strconv.FormatFloat(bytesPerSec/1024/1024, 'f', 2, 64)
+}
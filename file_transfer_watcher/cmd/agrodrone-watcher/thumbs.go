@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// thumbQualities are the JPEG qualities a thumbnail is tried at, best
+// first, until it fits in MQTTPreviewMaxBytes
+var thumbQualities = []int{75, 60, 45, 30, 15}
+
+// thumbStreamer publishes thumbnails of images as they're sent, at most
+// MQTTPreviewsPerMinute a minute, from its own goroutine so it never holds
+// up a transfer. Only the latest image sent is waiting at any time; any
+// sent before it since the last thumbnail are skipped. A nil streamer does
+// nothing
+type thumbStreamer struct {
+	cfg   *Config
+	topic string
+
+	mu   sync.Mutex
+	next string
+	wake chan struct{}
+}
+
+var thumbs *thumbStreamer
+
+// startThumbs starts streaming thumbnails, if MQTT and
+// MQTTPreviewsPerMinute are both set
+func startThumbs(cfg *Config) {
+	if mqtt == nil || cfg.MQTTPreviewsPerMinute <= 0 {
+		return
+	}
+	thumbs = &thumbStreamer{
+		cfg:   cfg,
+		topic: cfg.MQTTTopicPrefix + "/" + cfg.DeviceID + "/preview",
+		wake:  make(chan struct{}, 1),
+	}
+	go thumbs.run()
+}
+
+// sent offers the file at p, which has just been sent, for a thumbnail
+func (t *thumbStreamer) sent(p string) {
+	if t == nil || !previewable(p) {
+		return
+	}
+	t.mu.Lock()
+	t.next = p
+	t.mu.Unlock()
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *thumbStreamer) run() {
+	interval := time.Minute / time.Duration(t.cfg.MQTTPreviewsPerMinute)
+	for range t.wake {
+		t.mu.Lock()
+		p := t.next
+		t.next = ""
+		t.mu.Unlock()
+		if p == "" {
+			continue
+		}
+		b, err := thumbnail(p, t.cfg.MQTTPreviewMaxDim, int(t.cfg.MQTTPreviewMaxBytes))
+		if err != nil {
+			// it may have been cleaned up already
+			slog.Debug("No thumbnail", "file", p, "error", err)
+			continue
+		}
+		if b == nil {
+			slog.Debug("No thumbnail: too big even at the lowest quality", "file", p)
+			continue
+		}
+		mqtt.stream(t.topic, b)
+		time.Sleep(interval)
+	}
+}
+
+// thumbnail is a JPEG of the image at p fitting in maxDim by maxDim, at
+// the best of thumbQualities that's no bigger than maxBytes, or nil if
+// none is
+func thumbnail(p string, maxDim, maxBytes int) ([]byte, error) {
+	img, err := scaledImage(p, maxDim)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, q := range thumbQualities {
+		buf.Reset()
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: q}); err != nil {
+			return nil, err
+		}
+		if buf.Len() <= maxBytes {
+			return buf.Bytes(), nil
+		}
+	}
+	return nil, nil
+}
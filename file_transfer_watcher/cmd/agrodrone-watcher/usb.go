@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// usbLabelDir is where udev links filesystems by their label, with spaces
+// and other odd characters escaped as \x20 and so on
+const usbLabelDir = "/dev/disk/by-label"
+
+// usbAutomountWait is how long to wait for the automounter to mount a
+// drive when there's no USBMountDir
+const usbAutomountWait = 30 * time.Second
+
+// usbOffload is what an offload put on a USB drive, as published over MQTT
+type usbOffload struct {
+	Batch  string
+	Time   time.Time
+	Files  int
+	Bytes  int64
+	Failed int
+}
+
+// startUSB watches for a drive labelled USBLabel and offloads ExportDir
+// onto it each time one is plugged in
+func startUSB(cfg *Config, filter *fileFilter) {
+	if cfg.USBLabel == "" {
+		return
+	}
+	dev := filepath.Join(usbLabelDir, cfg.USBLabel)
+	go func() {
+		// only once per time it's plugged in
+		present := false
+		for {
+			_, err := os.Stat(dev)
+			switch {
+			case err != nil:
+				present = false
+			case !present:
+				present = true
+				if err := offloadUSB(cfg, filter, dev); err != nil {
+					slog.Error("USB offload failed", "label", cfg.USBLabel, "error", err)
+				}
+			}
+			time.Sleep(cfg.USBPollInterval.Duration)
+		}
+	}()
+}
+
+// offloadUSB copies what's ready in ExportDir onto the drive at dev, then
+// unmounts it so it can be pulled
+func offloadUSB(cfg *Config, filter *fileFilter, dev string) error {
+	dev, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return err
+	}
+	mnt, err := mountUSB(cfg, dev)
+	if err != nil {
+		return err
+	}
+	slog.Info("USB drive plugged in; offloading", "device", dev, "mount", mnt)
+	res, err := copyToUSB(cfg, filter, mnt)
+	// flushed whether or not it all went, so what did is safe to pull
+	syscall.Sync()
+	if out, uerr := runCommand(time.Minute, "umount", mnt); uerr != nil {
+		err = errors.Join(err, fmt.Errorf("unmount %s: %s", mnt, strings.TrimSpace(string(out))))
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("USB offload done; the drive can be pulled", "batch", res.Batch, "files", res.Files, "bytes", res.Bytes, "failed", res.Failed)
+	led.offloaded()
+	mqtt.publish("usb_offload", res)
+	return nil
+}
+
+// mountUSB returns where dev is mounted, mounting it at USBMountDir if
+// it's set and it isn't already, or else waiting for the automounter
+func mountUSB(cfg *Config, dev string) (string, error) {
+	deadline := time.Now().Add(usbAutomountWait)
+	for {
+		if mnt, err := mountPoint(dev); err != nil || mnt != "" {
+			return mnt, err
+		}
+		if cfg.USBMountDir != "" {
+			if err := os.MkdirAll(cfg.USBMountDir, 0o755); err != nil {
+				return "", err
+			}
+			if out, err := runCommand(time.Minute, "mount", dev, cfg.USBMountDir); err != nil {
+				return "", fmt.Errorf("mount %s: %s", dev, strings.TrimSpace(string(out)))
+			}
+			return cfg.USBMountDir, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("%s wasn't mounted within %s; set USBMountDir to mount it ourselves", dev, usbAutomountWait)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// mountPoint is where dev is mounted, or empty if it isn't
+func mountPoint(dev string) (string, error) {
+	mounts, err := readMounts()
+	for _, m := range mounts {
+		if m.Device == dev {
+			return m.Dir, nil
+		}
+	}
+	return "", err
+}
+
+// mount is a line of /proc/mounts, with symlinks in Device resolved
+type mount struct {
+	Device string
+	Dir    string
+}
+
+// readMounts lists the devices mounted and where, from /proc/mounts
+func readMounts() ([]mount, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []mount
+	// spaces and the like are octal escaped, e.g. \040
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		dev, err := filepath.EvalSymlinks(fields[0])
+		if err != nil {
+			continue
+		}
+		mounts = append(mounts, mount{Device: dev, Dir: unescape.Replace(fields[1])})
+	}
+	return mounts, sc.Err()
+}
+
+// copyToUSB copies the files in ExportDir that are ready into a new batch
+// dir under mnt, with a manifest, and cleans them up here with USBDelete.
+// A file that fails is left for the network; a full drive stops the lot
+func copyToUSB(cfg *Config, filter *fileFilter, mnt string) (usbOffload, error) {
+	res := usbOffload{Batch: newBatchID(cfg.DeviceID), Time: time.Now()}
+	files := buildBatch(cfg, filter, newStabilityCheck(cfg))
+	if len(files) == 0 {
+		slog.Info("Nothing to offload onto the USB drive")
+		return res, nil
+	}
+	dir := filepath.Join(mnt, res.Batch)
+	var sent []sentFile
+	var entries []manifestEntry
+	var errs []error
+	for _, f := range files {
+		rel, err := filepath.Rel(cfg.ExportDir, f.Path)
+		if err != nil {
+			continue
+		}
+		dst := filepath.Join(dir, rel)
+		sum, err := copyVerified(f.Path, dst)
+		if err != nil {
+			slog.Error("Failed to offload onto the USB drive", "file", f.Path, "error", err)
+			res.Failed++
+			if errors.Is(err, syscall.ENOSPC) {
+				errs = append(errs, fmt.Errorf("USB drive full after %d files", res.Files))
+				break
+			}
+			errs = append(errs, err)
+			continue
+		}
+		sf := sentFile{Path: f.Path, Size: f.Size, Remote: dst, SHA256: sum}
+		journal.recordIn(res.Batch, stateOffloaded, "", sf)
+		sent = append(sent, sf)
+		entries = append(entries, manifestEntry{Local: filepath.ToSlash(rel), Remote: filepath.ToSlash(rel), Size: f.Size, SHA256: sum})
+		res.Files++
+		res.Bytes += f.Size
+	}
+	if len(entries) > 0 {
+		m := batchManifest{Batch: res.Batch, DeviceID: cfg.DeviceID, Files: entries}
+		if err := writeFileAtomic(filepath.Join(dir, "manifest.json"), m); err != nil {
+			errs = append(errs, fmt.Errorf("manifest: %w", err))
+		}
+		writeManifest(cfg, res.Batch, entries, nil, nil)
+	}
+	if cfg.USBDelete && len(sent) > 0 {
+		if err := cleanupSent(cfg, sent); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return res, errors.Join(errs...)
+}
+
+// copyVerified copies src to dst, then reads dst back from the drive
+// rather than the page cache and checks it has the same SHA256. It returns
+// the hash
+func copyVerified(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	tmp := dst + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), in); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err := out.Sync(); err != nil {
+		return "", err
+	}
+	// drop what's cached so it's the drive's copy that's checked
+	if err := unix.Fadvise(int(out.Fd()), 0, 0, unix.FADV_DONTNEED); err != nil {
+		slog.Debug("Failed to drop the cached copy", "file", dst, "error", err)
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	got, err := hashFile(out)
+	if err != nil {
+		return "", err
+	}
+	if got != sum {
+		return "", fmt.Errorf("%s has SHA256 %s on the drive but %s here", dst, got, sum)
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if info, err := in.Stat(); err == nil {
+		os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	return sum, os.Rename(tmp, dst)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Reasons a file fails validation, which don't change so that tooling can
+// act on them
+const (
+	reasonCorrupt       = "corrupt"
+	reasonTIFFStructure = "tiff-structure"
+	reasonTIFFData      = "tiff-data-out-of-bounds"
+	reasonNoGeoKeys     = "geotiff-missing-geokeys"
+	reasonBadGeoKeys    = "geotiff-bad-geokeys"
+)
+
+// invalidError is a validation failure with its reason
+type invalidError struct {
+	Reason string
+	Err    error
+}
+
+func (e *invalidError) Error() string { return e.Err.Error() }
+func (e *invalidError) Unwrap() error { return e.Err }
+
+func invalid(reason, format string, args ...any) error {
+	return &invalidError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// invalidReason is why err failed validation: its reason if it has one, or
+// reasonCorrupt
+func invalidReason(err error) string {
+	var ie *invalidError
+	if errors.As(err, &ie) {
+		return ie.Reason
+	}
+	return reasonCorrupt
+}
+
+// pngChunksChecked is how many PNG chunks have their CRC checked; enough to
+// cover the header and the start of the image data without reading it all
+const pngChunksChecked = 8
+
+// validateImage checks that path, if it's a JPEG, TIFF (including DNG) or
+// PNG, isn't obviously truncated or corrupt. With geo, TIFFs (not DNGs)
+// must be GeoTIFFs. Other files always pass. Only the parts being checked
+// are read, so it's cheap on big files
+func validateImage(path string, geo bool) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	var check func(*os.File, int64) error
+	switch ext {
+	case ".jpg", ".jpeg":
+		check = validateJPEG
+	case ".tif", ".tiff":
+		check = func(f *os.File, size int64) error { return validateTIFF(f, size, geo) }
+	case ".dng":
+		check = func(f *os.File, size int64) error { return validateTIFF(f, size, false) }
+	case ".png":
+		check = validatePNG
+	default:
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return check(f, info.Size())
+}
+
+// validateJPEG checks for the start-of-image marker at the start and the
+// end-of-image marker at the end, which a truncated file won't have
+func validateJPEG(f *os.File, size int64) error {
+	if size < 4 {
+		return errors.New("JPEG too short")
+	}
+	buf := make([]byte, 2)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	if buf[0] != 0xFF || buf[1] != 0xD8 {
+		return errors.New("JPEG missing SOI marker")
+	}
+	// some cameras pad after EOI, so look in the last few bytes
+	tail := make([]byte, min(size, 32))
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return err
+	}
+	if !bytes.Contains(tail, []byte{0xFF, 0xD9}) {
+		return errors.New("JPEG missing EOI marker; probably truncated")
+	}
+	return nil
+}
+
+// TIFF tags validateTIFF looks at: where the image data is, as strips or
+// tiles, and the GeoTIFF keys
+const (
+	tagStripOffsets      = 273
+	tagStripByteCounts   = 279
+	tagTileOffsets       = 324
+	tagTileByteCounts    = 325
+	tagGeoKeyDirectory   = 34735
+	tagGeoDoubleParams   = 34736
+	tagGeoASCIIParams    = 34737
+	tiffMaxIFDs          = 64
+	tiffMaxDataLocations = 1 << 20
+)
+
+// validateTIFF checks the byte-order header, then walks the chain of IFDs
+// (up to tiffMaxIFDs) checking that every entry's value and every strip or
+// tile of image data is inside the file, and that a GeoKey directory, if
+// there is one, is consistent. With geo there has to be one. Only the
+// header, the IFDs and their values are read, never the image data
+func validateTIFF(f *os.File, size int64, geo bool) error {
+	t, ifd, err := newTIFFReader(f, 0)
+	if err != nil {
+		return &invalidError{Reason: reasonTIFFStructure, Err: err}
+	}
+	if ifd < 8 || ifd+2 > size {
+		return invalid(reasonTIFFStructure, "TIFF first IFD at %d is outside the file", ifd)
+	}
+	seen := map[int64]bool{}
+	for i := 0; ifd != 0 && i < tiffMaxIFDs; i++ {
+		if seen[ifd] {
+			return invalid(reasonTIFFStructure, "TIFF IFD %d loops back to %d", i, ifd)
+		}
+		seen[ifd] = true
+		if ifd+2 > size {
+			return invalid(reasonTIFFStructure, "TIFF IFD %d at %d is outside the file", i, ifd)
+		}
+		count := make([]byte, 2)
+		if _, err := f.ReadAt(count, ifd); err != nil {
+			return invalid(reasonTIFFStructure, "TIFF IFD %d: %v", i, err)
+		}
+		n := int64(t.order.Uint16(count))
+		if n == 0 {
+			return invalid(reasonTIFFStructure, "TIFF IFD %d has no entries", i)
+		}
+		// 12 bytes per entry plus the offset of the next IFD
+		if ifd+2+n*12+4 > size {
+			return invalid(reasonTIFFStructure, "TIFF IFD %d (%d entries) runs past the end of the file", i, n)
+		}
+		entries, err := t.ifd(ifd)
+		if err != nil {
+			return invalid(reasonTIFFStructure, "TIFF IFD %d: %v", i, err)
+		}
+		for tag, e := range entries {
+			if n := tiffTypeSizes[e.typ] * int64(e.count); n > 4 && int64(t.order.Uint32(e.raw))+n > size {
+				return invalid(reasonTIFFStructure, "TIFF IFD %d tag %d's value runs past the end of the file", i, tag)
+			}
+		}
+		if err := t.checkImageData(entries, i, size); err != nil {
+			return err
+		}
+		if i == 0 {
+			_, ok := entries[tagGeoKeyDirectory]
+			if geo && !ok {
+				return invalid(reasonNoGeoKeys, "GeoTIFF has no GeoKeyDirectoryTag (%d)", tagGeoKeyDirectory)
+			}
+			if ok {
+				if err := t.checkGeoKeys(entries, size); err != nil {
+					return err
+				}
+			}
+		}
+		next := make([]byte, 4)
+		if _, err := f.ReadAt(next, ifd+2+n*12); err != nil {
+			return invalid(reasonTIFFStructure, "TIFF IFD %d: %v", i, err)
+		}
+		ifd = int64(t.order.Uint32(next))
+	}
+	return nil
+}
+
+// locations reads e as SHORTs or LONGs, as offsets and byte counts are
+func (t *tiffReader) locations(e tiffEntry) ([]int64, error) {
+	if e.typ != 3 && e.typ != 4 {
+		return nil, fmt.Errorf("type %d, expected SHORT or LONG", e.typ)
+	}
+	if e.count > tiffMaxDataLocations {
+		return nil, fmt.Errorf("%d values", e.count)
+	}
+	w := tiffTypeSizes[e.typ]
+	b := e.raw[:min(w*int64(e.count), 4)]
+	if n := w * int64(e.count); n > 4 {
+		b = make([]byte, n)
+		if _, err := t.r.ReadAt(b, int64(t.order.Uint32(e.raw))); err != nil {
+			return nil, err
+		}
+	}
+	vals := make([]int64, e.count)
+	for i := range vals {
+		if w == 2 {
+			vals[i] = int64(t.order.Uint16(b[i*2:]))
+		} else {
+			vals[i] = int64(t.order.Uint32(b[i*4:]))
+		}
+	}
+	return vals, nil
+}
+
+// checkImageData checks the strips or tiles an IFD declares are all inside
+// the file
+func (t *tiffReader) checkImageData(entries map[uint16]tiffEntry, ifd int, size int64) error {
+	kind, offTag, countTag := "strip", uint16(tagStripOffsets), uint16(tagStripByteCounts)
+	if _, ok := entries[tagTileOffsets]; ok {
+		kind, offTag, countTag = "tile", tagTileOffsets, tagTileByteCounts
+	}
+	offE, ok1 := entries[offTag]
+	countE, ok2 := entries[countTag]
+	if !ok1 || !ok2 {
+		return invalid(reasonTIFFStructure, "TIFF IFD %d has no %s offsets and byte counts", ifd, kind)
+	}
+	offsets, err := t.locations(offE)
+	if err != nil {
+		return invalid(reasonTIFFStructure, "TIFF IFD %d %s offsets: %v", ifd, kind, err)
+	}
+	counts, err := t.locations(countE)
+	if err != nil {
+		return invalid(reasonTIFFStructure, "TIFF IFD %d %s byte counts: %v", ifd, kind, err)
+	}
+	if len(offsets) != len(counts) {
+		return invalid(reasonTIFFStructure, "TIFF IFD %d has %d %s offsets but %d byte counts", ifd, len(offsets), kind, len(counts))
+	}
+	for i := range offsets {
+		if offsets[i]+counts[i] > size {
+			return invalid(reasonTIFFData, "TIFF IFD %d %s %d (%d bytes at %d) runs past the end of the file at %d; probably truncated",
+				ifd, kind, i, counts[i], offsets[i], size)
+		}
+	}
+	return nil
+}
+
+// checkGeoKeys checks the GeoKey directory is consistent: a version 1
+// header, the number of keys it declares, keys in order, and each key's
+// value where it says, inline or in one of the GeoTIFF params tags
+func (t *tiffReader) checkGeoKeys(entries map[uint16]tiffEntry, size int64) error {
+	e := entries[tagGeoKeyDirectory]
+	if e.typ != 3 {
+		return invalid(reasonBadGeoKeys, "GeoKey directory is type %d, not SHORT", e.typ)
+	}
+	dir, err := t.locations(e)
+	if err != nil {
+		return invalid(reasonBadGeoKeys, "GeoKey directory: %v", err)
+	}
+	if len(dir) < 4 {
+		return invalid(reasonBadGeoKeys, "GeoKey directory has %d values, too short for its header", len(dir))
+	}
+	if dir[0] != 1 {
+		return invalid(reasonBadGeoKeys, "GeoKey directory version %d, expected 1", dir[0])
+	}
+	n := dir[3]
+	if int64(len(dir)) != 4+4*n {
+		return invalid(reasonBadGeoKeys, "GeoKey directory declares %d keys but has %d values", n, len(dir))
+	}
+	// how many values each params tag has, if it's there at all
+	params := map[int64]int64{tagGeoKeyDirectory: int64(len(dir))}
+	for _, tag := range []uint16{tagGeoDoubleParams, tagGeoASCIIParams} {
+		if p, ok := entries[tag]; ok {
+			params[int64(tag)] = int64(p.count)
+		}
+	}
+	prev := int64(-1)
+	for k := int64(0); k < n; k++ {
+		id, loc, count, val := dir[4+4*k], dir[5+4*k], dir[6+4*k], dir[7+4*k]
+		if id <= prev {
+			return invalid(reasonBadGeoKeys, "GeoKey %d after %d; keys must be in ascending order", id, prev)
+		}
+		prev = id
+		if loc == 0 {
+			if count != 1 {
+				return invalid(reasonBadGeoKeys, "GeoKey %d is inline but has %d values", id, count)
+			}
+			continue
+		}
+		have, ok := params[loc]
+		if !ok {
+			return invalid(reasonBadGeoKeys, "GeoKey %d's value is in tag %d, which isn't there", id, loc)
+		}
+		if val+count > have {
+			return invalid(reasonBadGeoKeys, "GeoKey %d's value (%d at %d) is past the end of tag %d", id, count, val, loc)
+		}
+	}
+	return nil
+}
+
+// validatePNG checks the signature and the CRCs of the first few chunks
+func validatePNG(f *os.File, size int64) error {
+	r := bufio.NewReader(f)
+	sig := make([]byte, 8)
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return fmt.Errorf("PNG signature: %w", err)
+	}
+	if string(sig) != "\x89PNG\r\n\x1a\n" {
+		return errors.New("PNG bad signature")
+	}
+	hdr := make([]byte, 8)
+	for i := 0; i < pngChunksChecked; i++ {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return fmt.Errorf("PNG chunk %d: %w", i, err)
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[:4]))
+		kind := string(hdr[4:])
+		if length > size {
+			return fmt.Errorf("PNG %s chunk claims %d bytes, file is %d", kind, length, size)
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(hdr[4:])
+		if _, err := io.CopyN(crc, r, length); err != nil {
+			return fmt.Errorf("PNG %s chunk: %w", kind, err)
+		}
+		want := make([]byte, 4)
+		if _, err := io.ReadFull(r, want); err != nil {
+			return fmt.Errorf("PNG %s chunk CRC: %w", kind, err)
+		}
+		if crc.Sum32() != binary.BigEndian.Uint32(want) {
+			return fmt.Errorf("PNG %s chunk CRC mismatch", kind)
+		}
+		if kind == "IEND" {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+)
+
+// Ways of noticing new files in the export dir
+const (
+	watchFsnotify = watch.Fsnotify
+	watchPoll     = watch.Poll
+)
+
+// exportWatcher wakes the main loop when files show up in the export dir
+type exportWatcher struct {
+	*watch.Watcher
+	idle time.Duration
+}
+
+// newExportWatcher sets up watching cfg.ExportDir as cfg.Watch says
+func newExportWatcher(cfg *Config) *exportWatcher {
+	w := watch.New(watch.Options{
+		Dir:        cfg.ExportDir,
+		Mode:       cfg.Watch,
+		Debounce:   cfg.WatchDebounce.Duration,
+		Idle:       cfg.PollInterval.Duration,
+		SafetyPoll: cfg.WatchSafetyPoll.Duration,
+	})
+	return &exportWatcher{Watcher: w, idle: w.Idle}
+}
+
+// wait returns once something changes in the export dir or after d,
+// whichever is first, keeping the heartbeat going meanwhile
+func (w *exportWatcher) wait(d time.Duration) {
+	w.Wait(d, heartbeat.interval, beat)
+}
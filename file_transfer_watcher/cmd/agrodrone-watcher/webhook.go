@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+// webhookEvent is what's sent to WebhookURL, as JSON or through
+// WebhookTemplate
+type webhookEvent struct {
+	// Event is "failing", "recovered" or "batch"
+	Event    string
+	DeviceID string
+	Error    string `json:",omitempty"`
+	// Incident is the incident that's started or ended, for "failing" and
+	// "recovered"
+	Incident     *incident `json:",omitempty"`
+	PendingFiles int
+	PendingBytes int64
+	Batch        *historyBatch `json:",omitempty"`
+	At           time.Time
+}
+
+// notifier posts to a webhook when an incident starts and ends, and with
+// cfg.WebhookOnBatch after every batch. Posting happens in the background;
+// a nil notifier does nothing
+type notifier struct {
+	cfg    *Config
+	filter *fileFilter
+	tmpl   *template.Template
+	device string
+	events chan webhookEvent
+}
+
+var webhooks *notifier
+
+// newNotifier returns nil if cfg.WebhookURL isn't set
+func newNotifier(cfg *Config, filter *fileFilter) (*notifier, error) {
+	if cfg.WebhookURL == "" {
+		return nil, nil
+	}
+	n := &notifier{cfg: cfg, filter: filter, device: cfg.DeviceID, events: make(chan webhookEvent, 16)}
+	if cfg.WebhookTemplate != "" {
+		t, err := template.New("webhook").Funcs(template.FuncMap{
+			// json quotes a value for use inside a JSON template
+			"json": func(v any) (string, error) {
+				b, err := json.Marshal(v)
+				return string(b), err
+			},
+		}).Parse(cfg.WebhookTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("WebhookTemplate: %w", err)
+		}
+		n.tmpl = t
+	}
+	go n.send()
+	return n, nil
+}
+
+// alert posts an incident starting or ending
+func (n *notifier) alert(inc incident) {
+	if n == nil {
+		return
+	}
+	if inc.RecoveredAt == nil {
+		n.post(webhookEvent{Event: "failing", Error: inc.Error, Incident: &inc})
+		return
+	}
+	n.post(webhookEvent{Event: "recovered", Incident: &inc})
+}
+
+// batch posts a completed batch, with WebhookOnBatch
+func (n *notifier) batch(h historyBatch) {
+	if n == nil || !n.cfg.WebhookOnBatch {
+		return
+	}
+	n.post(webhookEvent{Event: "batch", Error: h.Error, Batch: &h})
+}
+
+// post fills in the rest of e and queues it for sending. Events go out in
+// order; if too many are already waiting this one is dropped
+func (n *notifier) post(e webhookEvent) {
+	e.DeviceID, e.At = n.device, time.Now()
+	select {
+	case n.events <- e:
+	default:
+		slog.Warn("Too many webhooks waiting; dropping one", "event", e.Event)
+	}
+}
+
+// send delivers queued events one at a time, retrying each a few times
+func (n *notifier) send() {
+	client := &http.Client{Timeout: n.cfg.WebhookTimeout.Duration}
+	for e := range n.events {
+		e.PendingFiles, e.PendingBytes = exportBacklog(n.cfg, n.filter)
+		body, err := n.render(e)
+		if err != nil {
+			slog.Warn("Failed to build webhook body", "event", e.Event, "error", err)
+			continue
+		}
+		for attempt := 1; attempt <= 3; attempt++ {
+			err = postJSON(client, n.cfg.WebhookURL, body)
+			if err == nil {
+				slog.Info("Sent webhook", "event", e.Event)
+				break
+			}
+			slog.Warn("Webhook failed", "event", e.Event, "attempt", attempt, "error", err)
+			if attempt < 3 {
+				time.Sleep(time.Duration(attempt) * 10 * time.Second)
+			}
+		}
+	}
+}
+
+func (n *notifier) render(e webhookEvent) ([]byte, error) {
+	if n.tmpl == nil {
+		b, err := json.Marshal(e)
+		return []byte(redact.String(string(b))), err
+	}
+	var b bytes.Buffer
+	err := n.tmpl.Execute(&b, e)
+	return []byte(redact.String(b.String())), err
+}
+
+func postJSON(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/watch"
+)
+
+//go:embed web/index.html
+var webFiles embed.FS
+
+var pageTemplate = template.Must(template.New("index.html").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"time":  func(t time.Time) string { return t.Local().Format("Jan 2 15:04") },
+	"took":  func(h historyBatch) string { return h.End.Sub(h.Start).Round(time.Second).String() },
+}).ParseFS(webFiles, "web/index.html"))
+
+// flightBacklog is what's waiting to be sent from one flight's directory
+type flightBacklog struct {
+	Name  string
+	Files int
+	Bytes int64
+}
+
+// pageData is what the status page shows
+type pageData struct {
+	Status    statusData
+	SignalDBm int
+	HasSignal bool
+	Pending   []flightBacklog
+	Batches   []historyBatch
+}
+
+// webUI serves the status page, for a phone on the hotspot
+type webUI struct {
+	cfg    *Config
+	filter *fileFilter
+}
+
+func (u *webUI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	d := pageData{Status: status.snapshot(), Pending: pendingByFlight(u.cfg, u.filter)}
+	if d.Status.Network != "" && u.cfg.WifiInterface != "" {
+		if s, err := sampleLink(u.cfg.WifiInterface); err == nil {
+			d.SignalDBm, d.HasSignal = s.SignalDBm, true
+		}
+	}
+	d.Batches, _ = recentBatches(u.cfg, 20)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, d); err != nil {
+		slog.Warn("Failed to render the status page", "error", err)
+	}
+}
+
+// pendingByFlight totals up the files waiting in each flight's directory,
+// oldest flight first
+func pendingByFlight(cfg *Config, filter *fileFilter) []flightBacklog {
+	var files []batchFile
+	watch.Walk(cfg.ExportDir, filter, func(path string, d fs.DirEntry) {
+		if _, ok := priorityOf(cfg, path); !ok || !d.Type().IsRegular() {
+			return
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, batchFile{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+		}
+	})
+	var flights []flightBacklog
+	for _, u := range groupSessions(cfg, splitUnits(cfg.ExportDir, files)) {
+		f := flightBacklog{Name: u.String(), Files: len(u.Files)}
+		for _, bf := range u.Files {
+			f.Bytes += bf.Size
+		}
+		flights = append(flights, f)
+	}
+	return flights
+}
+
+// recentBatches returns the last n batches in the history, newest first
+func recentBatches(cfg *Config, n int) ([]historyBatch, error) {
+	var batches []historyBatch
+	err := viewHistory(cfg, func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBatches).Cursor()
+		for k, v := c.Last(); k != nil && len(batches) < n; k, v = c.Prev() {
+			var h historyBatch
+			if json.Unmarshal(v, &h) == nil {
+				batches = append(batches, h)
+			}
+		}
+		return nil
+	})
+	return batches, err
+}
@@ -0,0 +1,16 @@
+module github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher
+
+go 1.24.0
+
+require (
+	github.com/bmatcuk/doublestar/v4 v4.10.2
+	github.com/bramvdbogaerde/go-scp v1.5.0
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/godbus/dbus/v5 v5.2.2
+	github.com/warthog618/go-gpiocdev v0.9.1
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.45.0
+	golang.org/x/image v0.32.0
+	golang.org/x/net v0.47.0
+	golang.org/x/sys v0.38.0
+)
@@ -0,0 +1,71 @@
+// Package redact masks secrets, like WiFi PSKs and passwords, in anything
+// headed for a log, an error or a file someone else reads. Commands that
+// take them on their argv, and the errors those commands produce, can echo
+// them back
+package redact
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Marker is what each secret is replaced with
+const Marker = "[REDACTED]"
+
+var secrets struct {
+	mu       sync.RWMutex
+	replacer *strings.Replacer
+	values   []string
+}
+
+// Add registers values to be masked by String, along with their quoted and
+// JSON-escaped forms, which is how they show up in some errors and in JSON
+func Add(values ...string) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	added := false
+	for _, v := range values {
+		if v == "" || slices.Contains(secrets.values, v) {
+			continue
+		}
+		j, _ := json.Marshal(v)
+		secrets.values = append(secrets.values, v, strconv.Quote(v), string(j[1:len(j)-1]))
+		added = true
+	}
+	if !added {
+		return
+	}
+	var pairs []string
+	for _, v := range secrets.values {
+		pairs = append(pairs, v, Marker)
+	}
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+// String masks every registered secret in s
+func String(s string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	if secrets.replacer == nil {
+		return s
+	}
+	return secrets.replacer.Replace(s)
+}
+
+// Writer masks secrets in everything written through it to W. Each log
+// line or JSON value is a single write, so a secret is never split across
+// two
+type Writer struct {
+	W io.Writer
+}
+
+func (r Writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.W, String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,41 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	const secret = `pa"ss\word`
+	Add(secret, "")
+	Add(secret) // again, which changes nothing
+	j, _ := json.Marshal(map[string]string{"error": "auth failed for " + secret})
+	for _, s := range []string{
+		"password " + secret,
+		fmt.Sprintf("bad value %q", secret),
+		string(j),
+	} {
+		got := String(s)
+		if strings.Contains(got, `ss\word`) || strings.Contains(got, `ss\\word`) || !strings.Contains(got, Marker) {
+			t.Errorf("String(%s) = %s", s, got)
+		}
+	}
+	if got := String("nothing to hide"); got != "nothing to hide" {
+		t.Errorf("String changed %q", got)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	Add("hunter22")
+	var b bytes.Buffer
+	n, err := Writer{&b}.Write([]byte("psk hunter22\n"))
+	if err != nil || n != len("psk hunter22\n") {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	if b.String() != "psk "+Marker+"\n" {
+		t.Errorf("wrote %q", b.String())
+	}
+}
@@ -0,0 +1,98 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+)
+
+// Fake is an in-memory Uploader for tests. Its fields can be set before
+// use and read afterwards; lock Mu around them meanwhile
+type Fake struct {
+	Mu sync.Mutex
+	// Files is what's on the "remote", by path
+	Files map[string][]byte
+	Dirs  map[string]bool
+	// Fail makes uploading the local file with that path fail with the
+	// error, once for each entry in the slice and then succeed
+	Fail map[string][]error
+	// Drop, if positive, is how many more uploads go through before the
+	// connection goes; every upload after that fails with ErrConnLost
+	Drop int
+	// Uploads lists the local paths uploaded, in order, including failures
+	Uploads []string
+	Closed  bool
+}
+
+// NewFake returns an empty Fake
+func NewFake() *Fake {
+	return &Fake{Files: map[string][]byte{}, Dirs: map[string]bool{}, Fail: map[string][]error{}}
+}
+
+func (f *Fake) Upload(ctx context.Context, localPath, remotePath string, opts Options) error {
+	f.Mu.Lock()
+	f.Uploads = append(f.Uploads, localPath)
+	if f.Drop > 0 {
+		if f.Drop--; f.Drop == 0 {
+			f.Closed = true
+		}
+	} else if f.Closed {
+		f.Mu.Unlock()
+		return fmt.Errorf("upload %s: %w", localPath, ErrConnLost)
+	}
+	if errs := f.Fail[localPath]; len(errs) > 0 {
+		f.Fail[localPath] = errs[1:]
+		f.Mu.Unlock()
+		return errs[0]
+	}
+	f.Mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	if opts.PassThru != nil {
+		if b, err = io.ReadAll(opts.PassThru(bytes.NewReader(b), int64(len(b)))); err != nil {
+			return err
+		}
+	}
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	f.Files[remotePath] = b
+	return nil
+}
+
+func (f *Fake) Mkdir(dirs ...string) error {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	for _, d := range dirs {
+		for ; d != "." && d != "/" && d != ""; d = path.Dir(d) {
+			f.Dirs[d] = true
+		}
+	}
+	return nil
+}
+
+func (f *Fake) Stat(remotePath string) (int64, error) {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	b, ok := f.Files[remotePath]
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", remotePath, fs.ErrNotExist)
+	}
+	return int64(len(b)), nil
+}
+
+func (f *Fake) Close() error {
+	f.Mu.Lock()
+	defer f.Mu.Unlock()
+	f.Closed = true
+	return nil
+}
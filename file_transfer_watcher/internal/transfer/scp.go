@@ -0,0 +1,191 @@
+package transfer
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	scp "github.com/bramvdbogaerde/go-scp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SCP uploads over scp on one SSH connection
+type SCP struct {
+	client scp.Client
+}
+
+// DialSCP connects to addr (host:port)
+func DialSCP(addr string, config *ssh.ClientConfig) (*SCP, error) {
+	client, err := DialSSH(addr, config)
+	if err != nil {
+		return nil, err
+	}
+	c, err := scp.NewClientBySSH(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &SCP{client: c}, nil
+}
+
+// DialSSH is ssh.Dial, except config.Timeout bounds the handshake too and
+// not just the TCP connect, so a remote that accepts and then says nothing
+// can't hang us
+func DialSSH(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// Client is the scp client, for what the Uploader doesn't cover, or nil
+// for a nil SCP
+func (s *SCP) Client() *scp.Client {
+	if s == nil {
+		return nil
+	}
+	return &s.client
+}
+
+// SSH is the SSH connection underneath, for running commands on the
+// remote, or nil for a nil SCP
+func (s *SCP) SSH() *ssh.Client {
+	if s == nil {
+		return nil
+	}
+	return s.client.SSHClient()
+}
+
+func (s *SCP) Upload(ctx context.Context, localPath, remotePath string, opts Options) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = s.client.CopyFromFilePassThru(ctx, *f, remotePath, cmp.Or(opts.Perm, "0644"), opts.PassThru)
+	if ctx.Err() != nil {
+		return err
+	}
+	return ConnLost(s.SSH(), err)
+}
+
+// keepaliveTimeout is how long ConnLost waits for the remote to answer
+const keepaliveTimeout = 5 * time.Second
+
+// ConnLost wraps err in ErrConnLost if it's the connection c that went
+// rather than anything about the file: the transport or the session
+// failing, or c no longer answering a keepalive. Anything else, like the
+// remote's scp refusing the path, is returned as it is. A nil c is only
+// judged by the error
+func ConnLost(c *ssh.Client, err error) error {
+	if err == nil || errors.Is(err, ErrConnLost) {
+		return err
+	}
+	if transportError(err) || c != nil && !alive(c) {
+		return fmt.Errorf("%w: %w", ErrConnLost, err)
+	}
+	return err
+}
+
+// transportError reports whether err comes from the SSH connection or
+// session underneath rather than the remote command
+func transportError(err error) bool {
+	var exitMissing *ssh.ExitMissingError
+	var openChannel *ssh.OpenChannelError
+	var netErr *net.OpError
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.As(err, &exitMissing), errors.As(err, &openChannel), errors.As(err, &netErr):
+		return true
+	}
+	// go-scp flattens a failed NewSession into a string
+	return strings.HasPrefix(err.Error(), "Error creating ssh session")
+}
+
+// alive reports whether c still answers a keepalive request
+func alive(c *ssh.Client) bool {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(keepaliveTimeout):
+		return false
+	}
+}
+
+func (s *SCP) Mkdir(dirs ...string) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	cmd := "mkdir -p --"
+	for _, d := range dirs {
+		cmd += " " + quote(d)
+	}
+	_, err := s.run(cmd)
+	return err
+}
+
+// statMissing is the exit status Stat's command gives for a missing file
+const statMissing = 3
+
+func (s *SCP) Stat(remotePath string) (int64, error) {
+	p := quote(remotePath)
+	out, err := s.run(fmt.Sprintf("[ -f %s ] || exit %d; stat -c %%s -- %s", p, statMissing, p))
+	var exit *ssh.ExitError
+	if errors.As(err, &exit) && exit.ExitStatus() == statMissing {
+		return 0, fmt.Errorf("%s: %w", remotePath, fs.ErrNotExist)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+func (s *SCP) Close() error {
+	s.client.Close()
+	return nil
+}
+
+// run runs cmd on the remote, returning its output, which also goes in
+// the error if it fails
+func (s *SCP) run(cmd string) ([]byte, error) {
+	session, err := s.SSH().NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	out, err := session.CombinedOutput(cmd)
+	if err != nil && len(out) > 0 {
+		return out, fmt.Errorf("%s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return out, err
+}
+
+// quote quotes s for the remote's shell
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,158 @@
+// Package transfer sends files to the ground station through an Uploader,
+// one batch at a time
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+)
+
+// Options says how a file is uploaded
+type Options struct {
+	// Perm is the remote file's mode, e.g. "0644"
+	Perm string
+	// PassThru wraps the local file as it's read, e.g. to count progress
+	// or hash it on the way
+	PassThru func(r io.Reader, size int64) io.Reader
+}
+
+// Uploader puts files on the remote
+type Uploader interface {
+	// Upload copies the file at localPath to remotePath. A localPath that
+	// doesn't exist gives an error matching fs.ErrNotExist
+	Upload(ctx context.Context, localPath, remotePath string, opts Options) error
+	// Mkdir makes dirs on the remote, and any parents they need
+	Mkdir(dirs ...string) error
+	// Stat is the size of the file at remotePath, or an error matching
+	// fs.ErrNotExist if there isn't one
+	Stat(remotePath string) (int64, error)
+	Close() error
+}
+
+// ErrConnLost marks an upload that failed because the connection went
+// (reset, closed, the remote's sshd restarting), not because of anything
+// about the file. It stops the batch rather than counting against the file
+var ErrConnLost = errors.New("connection lost")
+
+// FileError is a transfer failure pinned on one local file, as opposed to
+// the connection as a whole
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string { return e.Err.Error() }
+
+func (e *FileError) Unwrap() error { return e.Err }
+
+// File is one file of a batch
+type File struct {
+	Local  string
+	Remote string
+	Size   int64
+}
+
+// Result is how each of the files given to a batch went
+type Result struct {
+	// Sent made it across, or were already there with SkipExisting
+	Sent []File
+	// Skipped disappeared or changed before they could be sent, or were
+	// after whatever stopped the batch
+	Skipped []File
+	// Failed were tried Attempts times and failed each time
+	Failed []*FileError
+	// Bytes is the size of the Sent files
+	Bytes int64
+	// Retried is how many files took more than one attempt
+	Retried int
+}
+
+// Batch sends files in order through an Uploader. A file that fails on its
+// own (a *FileError) doesn't stop the rest; any other error does
+type Batch struct {
+	Uploader Uploader
+	Options  Options
+	// Attempts is how many times a failing file is tried; 0 means once
+	Attempts int
+	// SkipExisting counts a file as sent, without sending it, when the
+	// remote already has one of the same size there
+	SkipExisting bool
+	// Before, if set, is called before each file. An error stops the
+	// batch there, with that file and the rest skipped
+	Before func(i int, f File) error
+	// Send, if set, sends the i'th file in place of Uploader.Upload,
+	// reporting whether it went (false meaning skipped)
+	Send func(ctx context.Context, i int, f File) (bool, error)
+}
+
+// Run sends files. The result says what happened to each one even when an
+// error stops the batch part way
+func (b *Batch) Run(ctx context.Context, files []File) (Result, error) {
+	var res Result
+	for i, f := range files {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		if b.Before != nil {
+			if err := b.Before(i, f); err != nil {
+				res.Skipped = append(res.Skipped, files[i:]...)
+				return res, err
+			}
+		}
+		if b.SkipExisting {
+			if n, err := b.Uploader.Stat(f.Remote); err == nil && n == f.Size {
+				slog.Info("Already on the remote; not sending it", "file", f.Local, "remote", f.Remote)
+				res.Sent = append(res.Sent, f)
+				res.Bytes += f.Size
+				continue
+			}
+		}
+		sent, err := b.send(ctx, i, f)
+		for try := 1; try < b.Attempts && isFileError(err) && ctx.Err() == nil; try++ {
+			slog.Warn("Failed to send file, trying again", "file", f.Local, "attempt", try, "error", err)
+			if try == 1 {
+				res.Retried++
+			}
+			sent, err = b.send(ctx, i, f)
+		}
+		var fe *FileError
+		switch {
+		case errors.As(err, &fe):
+			slog.Error("Failed to send file, carrying on", "file", fe.Path, "error", fe.Err)
+			res.Failed = append(res.Failed, fe)
+		case err != nil:
+			return res, err
+		case sent:
+			res.Sent = append(res.Sent, f)
+			res.Bytes += f.Size
+		default:
+			res.Skipped = append(res.Skipped, f)
+		}
+	}
+	return res, nil
+}
+
+// send sends one file with Send, or failing that Upload, where a file that
+// went missing is skipped and any other error is put down to the file
+// unless ctx is done or the connection went
+func (b *Batch) send(ctx context.Context, i int, f File) (bool, error) {
+	if b.Send != nil {
+		return b.Send(ctx, i, f)
+	}
+	err := b.Uploader.Upload(ctx, f.Local, f.Remote, b.Options)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return false, nil
+	case err != nil && ctx.Err() == nil && !errors.Is(err, ErrConnLost):
+		return false, &FileError{Path: f.Local, Err: err}
+	}
+	return err == nil, err
+}
+
+func isFileError(err error) bool {
+	var fe *FileError
+	return errors.As(err, &fe)
+}
@@ -0,0 +1,198 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// batchOf writes files named names in a temp dir, each holding its name,
+// and lists them for sending to /ingest
+func batchOf(t *testing.T, names ...string) []File {
+	t.Helper()
+	dir := t.TempDir()
+	var files []File
+	for _, n := range names {
+		p := filepath.Join(dir, n)
+		if err := os.WriteFile(p, []byte(n), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, File{Local: p, Remote: "/ingest/" + n, Size: int64(len(n))})
+	}
+	return files
+}
+
+func locals(files []File) []string {
+	var l []string
+	for _, f := range files {
+		l = append(l, f.Local)
+	}
+	return l
+}
+
+func TestBatchSendsInOrder(t *testing.T) {
+	files := batchOf(t, "c.log", "a.jpg", "b.dng")
+	fake := NewFake()
+	res, err := (&Batch{Uploader: fake}).Run(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(fake.Uploads, locals(files)) {
+		t.Errorf("uploaded %q, want %q", fake.Uploads, locals(files))
+	}
+	if len(res.Sent) != 3 || res.Bytes != 15 {
+		t.Errorf("sent %d files, %d bytes", len(res.Sent), res.Bytes)
+	}
+	if string(fake.Files["/ingest/a.jpg"]) != "a.jpg" {
+		t.Errorf("remote a.jpg is %q", fake.Files["/ingest/a.jpg"])
+	}
+}
+
+func TestBatchPartialFailure(t *testing.T) {
+	files := batchOf(t, "a", "b", "c", "d")
+	os.Remove(files[3].Local)
+	fake := NewFake()
+	fake.Fail[files[1].Local] = []error{errors.New("permission denied")}
+	res, err := (&Batch{Uploader: fake}).Run(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := locals(res.Sent); !slices.Equal(got, []string{files[0].Local, files[2].Local}) {
+		t.Errorf("sent %q", got)
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Path != files[1].Local {
+		t.Errorf("failed %v", res.Failed)
+	}
+	if got := locals(res.Skipped); !slices.Equal(got, []string{files[3].Local}) {
+		t.Errorf("skipped %q; a missing file should be skipped", got)
+	}
+}
+
+func TestBatchRetries(t *testing.T) {
+	files := batchOf(t, "a", "b")
+	fake := NewFake()
+	fake.Fail[files[0].Local] = []error{errors.New("one"), errors.New("two")}
+	fake.Fail[files[1].Local] = []error{errors.New("one"), errors.New("two"), errors.New("three")}
+	res, err := (&Batch{Uploader: fake, Attempts: 3}).Run(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Sent) != 1 || res.Sent[0].Local != files[0].Local {
+		t.Errorf("sent %q", locals(res.Sent))
+	}
+	if len(res.Failed) != 1 || res.Failed[0].Err.Error() != "three" {
+		t.Errorf("failed %v", res.Failed)
+	}
+	if res.Retried != 2 || len(fake.Uploads) != 6 {
+		t.Errorf("retried %d files in %d uploads", res.Retried, len(fake.Uploads))
+	}
+}
+
+func TestBatchSkipExisting(t *testing.T) {
+	files := batchOf(t, "a", "bb")
+	fake := NewFake()
+	fake.Files["/ingest/a"] = []byte("a")
+	// a different size isn't the same file
+	fake.Files["/ingest/bb"] = []byte("b")
+	res, err := (&Batch{Uploader: fake, SkipExisting: true}).Run(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(fake.Uploads, []string{files[1].Local}) {
+		t.Errorf("uploaded %q", fake.Uploads)
+	}
+	if len(res.Sent) != 2 {
+		t.Errorf("sent %q", locals(res.Sent))
+	}
+}
+
+func TestBatchStops(t *testing.T) {
+	files := batchOf(t, "a", "b", "c")
+	stop := errors.New("battery low")
+	fake := NewFake()
+	b := Batch{Uploader: fake, Before: func(i int, _ File) error {
+		if i == 1 {
+			return stop
+		}
+		return nil
+	}}
+	res, err := b.Run(context.Background(), files)
+	if !errors.Is(err, stop) {
+		t.Fatalf("got %v", err)
+	}
+	if len(res.Sent) != 1 || len(res.Skipped) != 2 {
+		t.Errorf("sent %q, skipped %q", locals(res.Sent), locals(res.Skipped))
+	}
+
+	// a connection error from Send stops it too, keeping what was sent
+	conn := errors.New("connection lost")
+	b = Batch{Uploader: fake, Send: func(_ context.Context, i int, _ File) (bool, error) {
+		if i == 2 {
+			return false, conn
+		}
+		return true, nil
+	}}
+	res, err = b.Run(context.Background(), files)
+	if !errors.Is(err, conn) || len(res.Sent) != 2 || len(res.Failed) != 0 {
+		t.Errorf("got %v with %d sent, %d failed", err, len(res.Sent), len(res.Failed))
+	}
+}
+
+func TestBatchStopsWhenTheConnectionGoes(t *testing.T) {
+	files := batchOf(t, "a", "b", "c")
+	fake := NewFake()
+	fake.Drop = 1
+	res, err := (&Batch{Uploader: fake, Attempts: 3}).Run(context.Background(), files)
+	if !errors.Is(err, ErrConnLost) {
+		t.Fatalf("got %v, want ErrConnLost", err)
+	}
+	if len(res.Sent) != 1 || len(res.Failed) != 0 || res.Retried != 0 {
+		t.Errorf("sent %q, failed %v, retried %d; want a sent and nothing put down to b", locals(res.Sent), res.Failed, res.Retried)
+	}
+	// nothing after b was tried on the dead connection
+	if !slices.Equal(fake.Uploads, locals(files[:2])) {
+		t.Errorf("uploaded %q", fake.Uploads)
+	}
+}
+
+func TestConnLost(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "reset", err: fmt.Errorf("write: %w", syscall.ECONNRESET), want: true},
+		{name: "eof", err: io.EOF, want: true},
+		{name: "session gone", err: &ssh.ExitMissingError{}, want: true},
+		{name: "no session", err: errors.New("Error creating ssh session in copy to remote: EOF"), want: true},
+		{name: "remote refused the path", err: errors.New("scp: /ingest/a.jpg: Permission denied")},
+		{name: "remote exit", err: &ssh.ExitError{}},
+		{name: "local read", err: &fs.PathError{Op: "read", Path: "a.jpg", Err: syscall.EIO}},
+	}
+	for _, tt := range tests {
+		if got := errors.Is(ConnLost(nil, tt.err), ErrConnLost); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if ConnLost(nil, nil) != nil {
+		t.Error("no error became one")
+	}
+}
+
+func TestBatchCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err := (&Batch{Uploader: NewFake()}).Run(ctx, batchOf(t, "a"))
+	if !errors.Is(err, context.Canceled) || len(res.Sent) != 0 {
+		t.Errorf("got %v with %d sent", err, len(res.Sent))
+	}
+}
@@ -0,0 +1,124 @@
+package watch
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// DefaultIgnore are files that never belong in a batch: dotfiles (which
+// includes the ._* AppleDouble files a Mac leaves behind), temp and swap
+// files, partial downloads, and the filesystem's lost+found
+var DefaultIgnore = []string{".*", "*.tmp", "*.partial", "*.swp", "lost+found"}
+
+// Filter decides which files in a directory are ours to send. Files it
+// filters out are never transferred, and so never deleted either. A nil
+// filter lets everything through
+type Filter struct {
+	// Ignore patterns match any single path element
+	Ignore []string
+	// Include and Exclude patterns match the whole relative path
+	Include []string
+	Exclude []string
+	// MinSize and MaxSize bound the size of files sent; zero is no limit
+	MinSize, MaxSize int64
+	// Quarantine is the quarantine dir relative to the directory, if it's
+	// inside it; it's always left alone
+	Quarantine string
+	// Sidecar, if set, picks out files that are only ever sent along with
+	// their file, never by themselves
+	Sidecar func(rel string) bool
+}
+
+// Skip reports whether rel, a path relative to the directory, is filtered
+// out, and why. Ignore patterns match any single path element, so
+// "lost+found" or ".*" also cover everything inside such a directory.
+// Include and exclude patterns match the whole relative path, with "**"
+// spanning directories. Excludes always win; if there are includes, a file
+// has to match one of them. Directories are never skipped for not matching
+// an include, since files inside them might
+func (f *Filter) Skip(rel string, isDir bool) (bool, string) {
+	if f == nil {
+		return false, ""
+	}
+	rel = filepath.ToSlash(rel)
+	if f.Quarantine != "" && (rel == f.Quarantine || strings.HasPrefix(rel, f.Quarantine+"/")) {
+		return true, "quarantined"
+	}
+	if f.Sidecar != nil && !isDir && f.Sidecar(rel) {
+		return true, "sidecar"
+	}
+	for _, elem := range strings.Split(rel, "/") {
+		for _, pattern := range f.Ignore {
+			if ok, _ := filepath.Match(pattern, elem); ok {
+				return true, "ignored by " + pattern
+			}
+		}
+	}
+	for _, pattern := range f.Exclude {
+		if doublestar.MatchUnvalidated(pattern, rel) {
+			return true, "excluded by " + pattern
+		}
+	}
+	if len(f.Include) == 0 {
+		return false, "no include patterns"
+	}
+	if isDir {
+		return false, "directory"
+	}
+	for _, pattern := range f.Include {
+		if doublestar.MatchUnvalidated(pattern, rel) {
+			return false, "included by " + pattern
+		}
+	}
+	return true, "matches no include pattern"
+}
+
+// SkipSize reports whether a file of size bytes is outside MinSize and
+// MaxSize, and why
+func (f *Filter) SkipSize(size int64) (bool, string) {
+	switch {
+	case f == nil:
+		return false, ""
+	case f.MinSize > 0 && size < f.MinSize:
+		return true, fmt.Sprintf("%d bytes is below MinFileSize %d", size, f.MinSize)
+	case f.MaxSize > 0 && size > f.MaxSize:
+		return true, fmt.Sprintf("%d bytes is over MaxFileSize %d; offload it over USB instead", size, f.MaxSize)
+	default:
+		return false, ""
+	}
+}
+
+// Walk calls fn for everything under dir the filter lets through,
+// including by size, not descending into filtered-out directories.
+// Unreadable entries are skipped
+func Walk(dir string, filter *Filter, fn func(path string, d fs.DirEntry)) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != dir {
+			rel, _ := filepath.Rel(dir, path)
+			if skip, _ := filter.Skip(rel, d.IsDir()); skip {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if skip, _ := filter.SkipSize(info.Size()); skip {
+				return nil
+			}
+		}
+		fn(path, d)
+		return nil
+	})
+}
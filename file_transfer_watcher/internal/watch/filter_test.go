@@ -0,0 +1,118 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterSkip(t *testing.T) {
+	f := &Filter{
+		Ignore:     DefaultIgnore,
+		Include:    []string{"**/*.jpg", "**/*.tif"},
+		Exclude:    []string{"calib/**"},
+		Quarantine: "quarantine",
+		Sidecar:    func(rel string) bool { return strings.HasSuffix(rel, ".meta.json") },
+	}
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{rel: "flight1/a.jpg"},
+		{rel: "flight1/b.tif"},
+		{rel: "flight1/a.txt", want: true},
+		{rel: "flight1/._a.jpg", want: true},
+		{rel: "flight1/a.jpg.partial", want: true},
+		{rel: ".cache/a.jpg", want: true},
+		{rel: "lost+found", isDir: true, want: true},
+		{rel: "calib/a.jpg", want: true},
+		{rel: "quarantine/a.jpg", want: true},
+		{rel: "flight1/a.jpg.meta.json", want: true},
+		// a directory might hold files an include matches
+		{rel: "flight1", isDir: true},
+	}
+	for _, tt := range tests {
+		if got, why := f.Skip(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("Skip(%q) = %v (%s), want %v", tt.rel, got, why, tt.want)
+		}
+	}
+	var none *Filter
+	if skip, _ := none.Skip(".hidden", false); skip {
+		t.Error("a nil filter skipped something")
+	}
+}
+
+func TestFilterSkipSize(t *testing.T) {
+	f := &Filter{MinSize: 10, MaxSize: 100}
+	for size, want := range map[int64]bool{0: true, 9: true, 10: false, 100: false, 101: true} {
+		if got, why := f.SkipSize(size); got != want {
+			t.Errorf("SkipSize(%d) = %v (%s), want %v", size, got, why, want)
+		}
+	}
+}
+
+func TestWalkSkipsFilteredDirs(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"flight1/a.jpg", "flight1/tiny.jpg", ".trash/b.jpg", "c.tmp"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		data := []byte("0123456789")
+		if strings.Contains(p, "tiny") {
+			data = data[:1]
+		}
+		if err := os.WriteFile(filepath.Join(dir, p), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	Walk(dir, &Filter{Ignore: DefaultIgnore, MinSize: 2}, func(path string, d os.DirEntry) {
+		if !d.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+	})
+	if strings.Join(got, " ") != "flight1/a.jpg" {
+		t.Errorf("walked %v", got)
+	}
+}
+
+func TestStabilityWaitsOutQuiesce(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "a.tif")
+	if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := NewStability(time.Hour, false).Ready(p, info); ok {
+		t.Error("a file just written is ready with an hour's quiesce")
+	}
+	if ok, why := NewStability(0, false).Ready(p, info); !ok {
+		t.Errorf("not ready with no quiesce: %s", why)
+	}
+}
+
+func TestStabilitySeesFilesOpenForWrite(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "a.tif")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewStability(0, true)
+	if len(c.openForWrite) == 0 {
+		t.Skip("/proc isn't readable here")
+	}
+	if ok, why := c.Ready(p, info); ok || why != "open for writing" {
+		t.Errorf("got %v, %q for a file we have open", ok, why)
+	}
+}
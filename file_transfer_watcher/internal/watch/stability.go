@@ -0,0 +1,87 @@
+package watch
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stability decides whether a file is finished, so a TIFF the camera
+// pipeline is still writing isn't sent half done
+type Stability struct {
+	quiesce time.Duration
+	// openForWrite holds the files some process had open for writing when
+	// the check was set up; nil if we didn't look
+	openForWrite map[string]bool
+}
+
+// NewStability sets up a check for one batch: files must have been left
+// alone for quiesce. With checkOpen it also takes a snapshot of which files
+// are open for writing from /proc
+func NewStability(quiesce time.Duration, checkOpen bool) *Stability {
+	c := &Stability{quiesce: quiesce}
+	if checkOpen {
+		c.openForWrite = filesOpenForWrite()
+	}
+	return c
+}
+
+// Ready reports whether path is done being written: nobody has it open for
+// writing and it hasn't changed for the quiescence period. If not, the
+// reason is returned
+func (c *Stability) Ready(path string, info os.FileInfo) (bool, string) {
+	// /proc has the real absolute path
+	if real, err := filepath.Abs(path); err == nil && len(c.openForWrite) > 0 {
+		if r, err := filepath.EvalSymlinks(real); err == nil {
+			real = r
+		}
+		if c.openForWrite[real] {
+			return false, "open for writing"
+		}
+	}
+	if age := time.Since(info.ModTime()); age < c.quiesce {
+		return false, "modified " + age.Round(time.Millisecond).String() + " ago"
+	}
+	return true, ""
+}
+
+// filesOpenForWrite lists every file some process has open for writing, by
+// going through /proc/*/fd. Processes we can't inspect are skipped, so run
+// as the same user as the camera pipeline (or root) for this to see it
+func filesOpenForWrite() map[string]bool {
+	open := map[string]bool{}
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/[0-9]*")
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(target, "/") {
+			continue // sockets, pipes and the like
+		}
+		// fdinfo/N has the open flags in octal
+		if writeFlags(strings.Replace(fd, "/fd/", "/fdinfo/", 1)) {
+			open[target] = true
+		}
+	}
+	return open
+}
+
+// writeFlags reports whether the fdinfo file at path shows O_WRONLY or O_RDWR
+func writeFlags(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		v, ok := strings.CutPrefix(sc.Text(), "flags:")
+		if !ok {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimSpace(v), 8, 64)
+		return err == nil && flags&uint64(os.O_WRONLY|os.O_RDWR) != 0
+	}
+	return false
+}
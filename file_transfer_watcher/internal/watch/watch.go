@@ -0,0 +1,154 @@
+// Package watch notices new files in a directory tree, with inotify via
+// fsnotify or by polling, and decides which of them are ours to send and
+// finished being written
+package watch
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Ways of noticing new files
+const (
+	Fsnotify = "fsnotify"
+	Poll     = "poll"
+)
+
+// Options says what to watch and how
+type Options struct {
+	Dir  string
+	Mode string // Fsnotify or Poll
+	// Debounce is how long writes must stop before a wake-up
+	Debounce time.Duration
+	// Idle is how long to wait with nothing to do when polling, and
+	// SafetyPoll how long with fsnotify in case an event went missing
+	Idle       time.Duration
+	SafetyPoll time.Duration
+}
+
+// Watcher wakes its owner when files show up in a directory tree. With
+// fsnotify it reacts as soon as a burst of writes settles; polling (or if
+// inotify isn't available) it just sleeps
+type Watcher struct {
+	fs       *fsnotify.Watcher // nil when polling
+	changed  chan struct{}
+	debounce time.Duration
+	// Idle is how long to wait with nothing to do before looking again
+	Idle time.Duration
+}
+
+// New sets up watching o.Dir as o.Mode says, falling back to polling if
+// inotify can't be used there (e.g. NFS)
+func New(o Options) *Watcher {
+	w := &Watcher{
+		changed:  make(chan struct{}, 1),
+		debounce: o.Debounce,
+		Idle:     o.Idle,
+	}
+	if o.Mode != Fsnotify {
+		return w
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watchTree(fw, o.Dir)
+		if err != nil {
+			fw.Close()
+		}
+	}
+	if err != nil {
+		slog.Warn("Can't watch the export dir; polling instead", "dir", o.Dir, "interval", w.Idle, "error", err)
+		return w
+	}
+	w.fs = fw
+	w.Idle = o.SafetyPoll
+	go w.run()
+	return w
+}
+
+// watchTree adds watches on root and every directory under it, since
+// inotify watches aren't recursive
+func watchTree(fw *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return fw.Add(path)
+	})
+}
+
+// run turns fsnotify events into a wake-up once they've stopped for the
+// debounce window, so a file being written doesn't wake us for every chunk
+func (w *Watcher) run() {
+	var settle *time.Timer
+	for {
+		select {
+		case ev, ok := <-w.fs.Events:
+			if !ok {
+				return
+			}
+			if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+				continue
+			}
+			if info, err := os.Stat(ev.Name); err == nil && info.IsDir() && ev.Has(fsnotify.Create) {
+				// anything written into it before the watch was added is
+				// caught by the walk
+				if err := watchTree(w.fs, ev.Name); err != nil {
+					slog.Error("Failed to watch a new directory", "dir", ev.Name, "error", err)
+				}
+			}
+			slog.Debug("export dir changed", "event", ev.String())
+			if settle == nil {
+				settle = time.AfterFunc(w.debounce, w.notify)
+			} else {
+				settle.Reset(w.debounce)
+			}
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return
+			}
+			// e.g. the event queue overflowed; have a look to be safe
+			slog.Warn("fsnotify error", "error", err)
+			w.notify()
+		}
+	}
+}
+
+func (w *Watcher) notify() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Wait returns once something changes or after d, whichever is first,
+// calling tick every interval meanwhile. When polling it always sleeps
+// for d
+func (w *Watcher) Wait(d, interval time.Duration, tick func()) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.changed:
+			return
+		case <-t.C:
+			return
+		case <-ticker.C:
+			tick()
+		}
+	}
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	if w.fs == nil {
+		return nil
+	}
+	return w.fs.Close()
+}
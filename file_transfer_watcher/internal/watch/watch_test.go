@@ -0,0 +1,55 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFsnotifyWakesOnNewFile(t *testing.T) {
+	dir := t.TempDir()
+	w := New(Options{Dir: dir, Mode: Fsnotify, Debounce: 10 * time.Millisecond, Idle: time.Hour, SafetyPoll: time.Hour})
+	defer w.Close()
+	if w.fs == nil {
+		t.Skip("inotify isn't available here")
+	}
+	sub := filepath.Join(dir, "flight1")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// let the new directory's watch be added before writing into it
+	w.Wait(time.Second, time.Hour, func() {})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.WriteFile(filepath.Join(sub, "a.jpg"), []byte("x"), 0o644)
+	}()
+	start := time.Now()
+	w.Wait(5*time.Second, time.Hour, func() {})
+	if d := time.Since(start); d >= 5*time.Second {
+		t.Fatalf("not woken by a file in a new subdirectory")
+	}
+}
+
+func TestPollSleepsAndTicks(t *testing.T) {
+	w := New(Options{Dir: t.TempDir(), Mode: Poll, Idle: time.Minute})
+	if w.fs != nil || w.Idle != time.Minute {
+		t.Fatalf("polling watcher has fs %v, idle %v", w.fs, w.Idle)
+	}
+	ticks := 0
+	start := time.Now()
+	w.Wait(55*time.Millisecond, 10*time.Millisecond, func() { ticks++ })
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("returned early")
+	}
+	if ticks < 3 {
+		t.Fatalf("ticked %d times", ticks)
+	}
+}
+
+func TestMissingDirFallsBackToPolling(t *testing.T) {
+	w := New(Options{Dir: filepath.Join(t.TempDir(), "gone"), Mode: Fsnotify, Idle: time.Minute, SafetyPoll: time.Hour})
+	if w.fs != nil || w.Idle != time.Minute {
+		t.Fatalf("got fs %v, idle %v; want polling every minute", w.fs, w.Idle)
+	}
+}
@@ -0,0 +1,427 @@
+package wifi
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// NetworkManager D-Bus names, see
+// https://networkmanager.dev/docs/api/latest/spec.html
+const (
+	nmDest          = "org.freedesktop.NetworkManager"
+	nmPath          = "/org/freedesktop/NetworkManager"
+	nmDeviceIface   = nmDest + ".Device"
+	nmWirelessIface = nmDest + ".Device.Wireless"
+	nmAPIface       = nmDest + ".AccessPoint"
+	nmSettingsPath  = "/org/freedesktop/NetworkManager/Settings"
+	nmSettingsIface = nmDest + ".Settings"
+	nmConnIface     = nmDest + ".Settings.Connection"
+
+	nmDeviceTypeWifi       = 2
+	nmDeviceStateActivated = 100
+	nmDeviceStateFailed    = 120
+
+	// NM_802_11_AP_SEC_* key management flags in WpaFlags/RsnFlags
+	nmAPSecKeyMgmtPSK   = 0x100
+	nmAPSecKeyMgmt8021X = 0x200
+	nmAPSecKeyMgmtSAE   = 0x400
+
+	nmScanTimeout    = 10 * time.Second
+	nmConnectTimeout = 30 * time.Second
+)
+
+// dbusManager talks to NetworkManager over the system D-Bus. The wireless
+// device's state is tracked from StateChanged signals, so checking whether
+// we're connected doesn't need a round trip
+type dbusManager struct {
+	conn   *dbus.Conn
+	device dbus.ObjectPath
+
+	mu    sync.Mutex
+	state uint32
+	// changed is closed and replaced every time state changes
+	changed chan struct{}
+}
+
+func newDBusManager() (*dbusManager, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("connect system bus: %w", err)
+	}
+	device, err := findWifiDevice(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	m := &dbusManager{conn: conn, device: device, changed: make(chan struct{})}
+
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(device),
+		dbus.WithMatchInterface(nmDeviceIface),
+		dbus.WithMatchMember("StateChanged"),
+	); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("subscribe to StateChanged: %w", err)
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+
+	v, err := m.deviceObj().GetProperty(nmDeviceIface + ".State")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read device state: %w", err)
+	}
+	state, _ := v.Value().(uint32)
+	m.setState(state)
+	go m.watchState(signals)
+	return m, nil
+}
+
+// findWifiDevice returns the first WiFi device NetworkManager manages
+func findWifiDevice(conn *dbus.Conn) (dbus.ObjectPath, error) {
+	var devices []dbus.ObjectPath
+	if err := conn.Object(nmDest, nmPath).Call(nmDest+".GetDevices", 0).Store(&devices); err != nil {
+		return "", fmt.Errorf("list devices: %w", err)
+	}
+	for _, d := range devices {
+		v, err := conn.Object(nmDest, d).GetProperty(nmDeviceIface + ".DeviceType")
+		if err != nil {
+			continue
+		}
+		if t, ok := v.Value().(uint32); ok && t == nmDeviceTypeWifi {
+			return d, nil
+		}
+	}
+	return "", errors.New("no WiFi device managed by NetworkManager")
+}
+
+func (m *dbusManager) deviceObj() dbus.BusObject {
+	return m.conn.Object(nmDest, m.device)
+}
+
+func (m *dbusManager) watchState(signals chan *dbus.Signal) {
+	for sig := range signals {
+		if sig.Path != m.device || sig.Name != nmDeviceIface+".StateChanged" || len(sig.Body) == 0 {
+			continue
+		}
+		if state, ok := sig.Body[0].(uint32); ok {
+			slog.Debug("WiFi device state changed", "state", state)
+			m.setState(state)
+		}
+	}
+}
+
+func (m *dbusManager) setState(state uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = state
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *dbusManager) currentState() (uint32, chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state, m.changed
+}
+
+// waitActivated blocks until the device is activated, fails, or timeout
+// passes. before is the changed channel from currentState taken before
+// asking for the activation: only states after a transition from then
+// count, so what was left over (still activated on the old network, or
+// failed from the last try) isn't taken for the outcome
+func (m *dbusManager) waitActivated(before chan struct{}, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	changed := before
+	for {
+		select {
+		case <-changed:
+		case <-deadline:
+			state, _ := m.currentState()
+			return fmt.Errorf("not activated after %v (state %d)", timeout, state)
+		}
+		state, next := m.currentState()
+		switch state {
+		case nmDeviceStateActivated:
+			return nil
+		case nmDeviceStateFailed:
+			return errors.New("activation failed")
+		}
+		changed = next
+	}
+}
+
+// Scan asks NetworkManager for a fresh scan and returns every AP it knows of
+func (m *dbusManager) Scan() ([]AccessPoint, error) {
+	dev := m.deviceObj()
+	before, _ := dev.GetProperty(nmWirelessIface + ".LastScan")
+	// a rejected request (e.g. already scanning) still leaves us with the
+	// previous results, so it isn't fatal
+	if call := dev.Call(nmWirelessIface+".RequestScan", 0, map[string]dbus.Variant{}); call.Err != nil {
+		slog.Debug("RequestScan failed", "error", call.Err)
+	} else {
+		deadline := time.Now().Add(nmScanTimeout)
+		for time.Now().Before(deadline) {
+			time.Sleep(500 * time.Millisecond)
+			after, err := dev.GetProperty(nmWirelessIface + ".LastScan")
+			if err != nil || after.Value() != before.Value() {
+				break
+			}
+		}
+	}
+
+	var paths []dbus.ObjectPath
+	if err := dev.Call(nmWirelessIface+".GetAllAccessPoints", 0).Store(&paths); err != nil {
+		return nil, fmt.Errorf("list access points: %w", err)
+	}
+	aps := make([]AccessPoint, 0, len(paths))
+	for _, p := range paths {
+		ap, err := m.readAP(p)
+		if err != nil {
+			// APs can vanish between listing and reading
+			slog.Debug("Failed to read AP", "path", p, "error", err)
+			continue
+		}
+		aps = append(aps, ap)
+	}
+	return aps, nil
+}
+
+// readAP reads an AccessPoint object's properties
+func (m *dbusManager) readAP(path dbus.ObjectPath) (AccessPoint, error) {
+	var props map[string]dbus.Variant
+	err := m.conn.Object(nmDest, path).
+		Call("org.freedesktop.DBus.Properties.GetAll", 0, nmAPIface).
+		Store(&props)
+	if err != nil {
+		return AccessPoint{}, err
+	}
+	ssid, _ := props["Ssid"].Value().([]byte)
+	strength, _ := props["Strength"].Value().(byte)
+	bssid, _ := props["HwAddress"].Value().(string)
+	wpa, _ := props["WpaFlags"].Value().(uint32)
+	rsn, _ := props["RsnFlags"].Value().(uint32)
+	return AccessPoint{
+		SSID:     string(ssid),
+		BSSID:    bssid,
+		Signal:   int(strength),
+		Security: apSecurity(wpa, rsn),
+	}, nil
+}
+
+// apSecurity turns the WpaFlags/RsnFlags bitmasks into the same names nmcli
+// prints in its SECURITY column
+func apSecurity(wpa, rsn uint32) []string {
+	var sec []string
+	if wpa != 0 {
+		sec = append(sec, "WPA1")
+	}
+	if rsn&(nmAPSecKeyMgmtPSK|nmAPSecKeyMgmt8021X) != 0 {
+		sec = append(sec, "WPA2")
+	}
+	if rsn&nmAPSecKeyMgmtSAE != 0 {
+		sec = append(sec, "WPA3")
+	}
+	if (wpa|rsn)&nmAPSecKeyMgmt8021X != 0 {
+		sec = append(sec, "802.1X")
+	}
+	return sec
+}
+
+// Connect activates the saved connection profile for ssid, or adds one and
+// activates it, then waits for the device to come up
+func (m *dbusManager) Connect(ssid, psk, bssid string, hidden bool) error {
+	profile, err := m.findProfile(ssid)
+	if err != nil {
+		return err
+	}
+	// with a pinned BSSID, point NetworkManager at that specific AP
+	specific := dbus.ObjectPath("/")
+	if bssid != "" {
+		specific = m.findAPPath(bssid)
+	}
+	_, before := m.currentState()
+	if profile != "" {
+		slog.Info("Activating existing connection profile", "ssid", ssid)
+		call := m.conn.Object(nmDest, nmPath).Call(nmDest+".ActivateConnection", 0,
+			profile, m.device, specific)
+		if call.Err != nil {
+			return fmt.Errorf("activate %s: %w", ssid, call.Err)
+		}
+	} else {
+		slog.Info("Adding connection profile", "ssid", ssid)
+		settings := map[string]map[string]dbus.Variant{
+			"connection": {
+				"id":   dbus.MakeVariant(ssid),
+				"type": dbus.MakeVariant("802-11-wireless"),
+			},
+			"802-11-wireless": {
+				"ssid":   dbus.MakeVariant([]byte(ssid)),
+				"hidden": dbus.MakeVariant(hidden),
+			},
+		}
+		if bssid != "" {
+			mac, err := net.ParseMAC(bssid)
+			if err != nil {
+				return fmt.Errorf("bad BSSID %q: %w", bssid, err)
+			}
+			settings["802-11-wireless"]["bssid"] = dbus.MakeVariant([]byte(mac))
+		}
+		if psk != "" {
+			settings["802-11-wireless-security"] = map[string]dbus.Variant{
+				"key-mgmt": dbus.MakeVariant("wpa-psk"),
+				"psk":      dbus.MakeVariant(psk),
+			}
+		}
+		call := m.conn.Object(nmDest, nmPath).Call(nmDest+".AddAndActivateConnection", 0,
+			settings, m.device, specific)
+		if call.Err != nil {
+			return fmt.Errorf("add connection for %s: %w", ssid, call.Err)
+		}
+	}
+	if err := m.waitActivated(before, nmConnectTimeout); err != nil {
+		return fmt.Errorf("connect %s: %w", ssid, err)
+	}
+	return nil
+}
+
+// findProfile returns the saved connection profile for ssid, or "" if there
+// isn't one
+func (m *dbusManager) findProfile(ssid string) (dbus.ObjectPath, error) {
+	return m.findConnection(func(settings map[string]map[string]dbus.Variant) bool {
+		b, _ := settings["802-11-wireless"]["ssid"].Value().([]byte)
+		return settings["802-11-wireless"] != nil && string(b) == ssid
+	})
+}
+
+// findProfileID returns the saved connection profile called id, or "" if
+// there isn't one
+func (m *dbusManager) findProfileID(id string) (dbus.ObjectPath, error) {
+	return m.findConnection(func(settings map[string]map[string]dbus.Variant) bool {
+		s, _ := settings["connection"]["id"].Value().(string)
+		return s == id
+	})
+}
+
+// findConnection returns the first saved connection profile whose settings
+// match, or "" if none do
+func (m *dbusManager) findConnection(match func(map[string]map[string]dbus.Variant) bool) (dbus.ObjectPath, error) {
+	var conns []dbus.ObjectPath
+	err := m.conn.Object(nmDest, nmSettingsPath).Call(nmSettingsIface+".ListConnections", 0).Store(&conns)
+	if err != nil {
+		return "", fmt.Errorf("list connections: %w", err)
+	}
+	for _, c := range conns {
+		var settings map[string]map[string]dbus.Variant
+		if err := m.conn.Object(nmDest, c).Call(nmConnIface+".GetSettings", 0).Store(&settings); err != nil {
+			continue
+		}
+		if match(settings) {
+			return c, nil
+		}
+	}
+	return "", nil
+}
+
+// findAPPath returns the AccessPoint object for bssid, or "/" to let
+// NetworkManager choose if it isn't currently visible
+func (m *dbusManager) findAPPath(bssid string) dbus.ObjectPath {
+	var paths []dbus.ObjectPath
+	if err := m.deviceObj().Call(nmWirelessIface+".GetAllAccessPoints", 0).Store(&paths); err != nil {
+		return "/"
+	}
+	for _, p := range paths {
+		if ap, err := m.readAP(p); err == nil && strings.EqualFold(ap.BSSID, bssid) {
+			return p
+		}
+	}
+	return "/"
+}
+
+// Active returns the active AP if the device is activated. While the device
+// is down this is answered from the signal-tracked state without touching
+// the bus
+func (m *dbusManager) Active() (AccessPoint, bool) {
+	if state, _ := m.currentState(); state != nmDeviceStateActivated {
+		return AccessPoint{}, false
+	}
+	v, err := m.deviceObj().GetProperty(nmWirelessIface + ".ActiveAccessPoint")
+	if err != nil {
+		return AccessPoint{}, false
+	}
+	path, ok := v.Value().(dbus.ObjectPath)
+	if !ok || path == "/" {
+		return AccessPoint{}, false
+	}
+	ap, err := m.readAP(path)
+	if err != nil {
+		return AccessPoint{}, false
+	}
+	return ap, true
+}
+
+// Disconnect disconnects the WiFi device. NetworkManager won't autoconnect it
+// again until we ask it to
+func (m *dbusManager) Disconnect(_ string) error {
+	if call := m.deviceObj().Call(nmDeviceIface+".Disconnect", 0); call.Err != nil {
+		return fmt.Errorf("disconnect: %w", call.Err)
+	}
+	return nil
+}
+
+// hotspotID is the connection profile the hotspot is kept in
+const hotspotID = "agrodrone-hotspot"
+
+// Hotspot brings up an access point connection, reusing the profile from
+// last time (updated to ssid and psk) so they don't pile up. The "shared"
+// IPv4 method makes NetworkManager hand out DHCP leases to clients
+func (m *dbusManager) Hotspot(ssid, psk string) error {
+	settings := map[string]map[string]dbus.Variant{
+		"connection": {
+			"id":   dbus.MakeVariant(hotspotID),
+			"type": dbus.MakeVariant("802-11-wireless"),
+		},
+		"802-11-wireless": {
+			"ssid": dbus.MakeVariant([]byte(ssid)),
+			"mode": dbus.MakeVariant("ap"),
+		},
+		"ipv4": {
+			"method": dbus.MakeVariant("shared"),
+		},
+	}
+	if psk != "" {
+		settings["802-11-wireless-security"] = map[string]dbus.Variant{
+			"key-mgmt": dbus.MakeVariant("wpa-psk"),
+			"psk":      dbus.MakeVariant(psk),
+		}
+	}
+	profile, err := m.findProfileID(hotspotID)
+	if err != nil {
+		return err
+	}
+	_, before := m.currentState()
+	if profile != "" {
+		if call := m.conn.Object(nmDest, profile).Call(nmConnIface+".Update", 0, settings); call.Err != nil {
+			return fmt.Errorf("update hotspot: %w", call.Err)
+		}
+		call := m.conn.Object(nmDest, nmPath).Call(nmDest+".ActivateConnection", 0,
+			profile, m.device, dbus.ObjectPath("/"))
+		if call.Err != nil {
+			return fmt.Errorf("activate hotspot: %w", call.Err)
+		}
+	} else {
+		call := m.conn.Object(nmDest, nmPath).Call(nmDest+".AddAndActivateConnection", 0,
+			settings, m.device, dbus.ObjectPath("/"))
+		if call.Err != nil {
+			return fmt.Errorf("add hotspot: %w", call.Err)
+		}
+	}
+	return m.waitActivated(before, nmConnectTimeout)
+}
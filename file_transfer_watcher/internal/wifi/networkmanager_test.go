@@ -0,0 +1,50 @@
+package wifi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWaitActivatedNeedsATransition(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    uint32
+		to      []uint32
+		wantErr bool
+	}{
+		// still up on the old network when the new activation is asked for
+		{name: "left activated", from: nmDeviceStateActivated, to: []uint32{30, 70, nmDeviceStateActivated}},
+		{name: "left activated, then fails", from: nmDeviceStateActivated, to: []uint32{30, nmDeviceStateFailed}, wantErr: true},
+		// failed from the last try
+		{name: "left failed", from: nmDeviceStateFailed, to: []uint32{40, 50, nmDeviceStateActivated}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &dbusManager{changed: make(chan struct{})}
+			m.setState(tt.from)
+			_, before := m.currentState()
+			done := make(chan error, 1)
+			go func() { done <- m.waitActivated(before, 5*time.Second) }()
+			select {
+			case err := <-done:
+				t.Fatalf("returned %v before any transition", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			for _, s := range tt.to {
+				m.setState(s)
+			}
+			if err := <-done; (err != nil) != tt.wantErr {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestWaitActivatedTimesOut(t *testing.T) {
+	m := &dbusManager{changed: make(chan struct{})}
+	m.setState(nmDeviceStateActivated)
+	_, before := m.currentState()
+	if err := m.waitActivated(before, 20*time.Millisecond); err == nil {
+		t.Error("activated with no transition")
+	}
+}
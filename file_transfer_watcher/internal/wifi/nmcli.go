@@ -0,0 +1,284 @@
+package wifi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+// Nmcli drives NetworkManager by shelling out to nmcli through Runner
+type Nmcli struct {
+	Runner CommandRunner
+}
+
+// NewNmcli returns an Nmcli running nmcli with r
+func NewNmcli(r CommandRunner) *Nmcli {
+	return &Nmcli{Runner: r}
+}
+
+// How long each kind of nmcli command may run before it's killed
+const (
+	ScanTimeout    = 15 * time.Second
+	ConnectTimeout = 30 * time.Second
+	ShowTimeout    = 5 * time.Second
+)
+
+// attempts is how many times a transient nmcli failure is tried, and
+// retryDelay how long to wait in between
+var (
+	attempts   = 3
+	retryDelay = 2 * time.Second
+)
+
+// splitTerse splits a line of nmcli terse output on unescaped colons and
+// unescapes `\:` and `\\` sequences inside each field
+func splitTerse(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case c == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(c)
+		}
+	}
+	return append(fields, field.String())
+}
+
+// scanFields are the columns we ask nmcli for; parseScan expects them after
+// any leading columns it's told to skip
+const scanFields = "SSID,BSSID,SIGNAL,SECURITY"
+
+// parseScan parses the terse SSID,BSSID,SIGNAL,SECURITY listing from nmcli.
+// Lines that don't have the expected number of fields are skipped
+func parseScan(out string) []AccessPoint {
+	var aps []AccessPoint
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if ap, ok := parseScanFields(splitTerse(scanner.Text())); ok {
+			aps = append(aps, ap)
+		}
+	}
+	return aps
+}
+
+// parseScanFields parses one SSID,BSSID,SIGNAL,SECURITY row
+func parseScanFields(fields []string) (AccessPoint, bool) {
+	if len(fields) != 4 {
+		return AccessPoint{}, false
+	}
+	signal, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return AccessPoint{}, false
+	}
+	security := strings.Fields(fields[3])
+	// open networks have nothing, or "--" in the older nmclis
+	if len(security) == 0 || len(security) == 1 && security[0] == "--" {
+		security = nil
+	}
+	return AccessPoint{
+		SSID:     fields[0],
+		BSSID:    fields[1],
+		Signal:   signal,
+		Security: security,
+	}, true
+}
+
+// Scan rescans and returns the access points nmcli can currently see, one
+// per BSSID, so an SSID broadcast by several APs is there several times. A
+// rejected rescan (usually because NetworkManager is mid-scan already) is
+// ignored, since the listing still returns the last results
+func (n *Nmcli) Scan() ([]AccessPoint, error) {
+	// no point retrying: the scan that's in the way is what we want anyway
+	if _, err := n.Runner.Run(ScanTimeout, "nmcli", "dev", "wifi", "rescan"); err != nil {
+		slog.Debug("nmcli rescan failed", "error", err)
+	}
+	out, err := n.nmcli(ScanTimeout, "-t", "-f", scanFields, "dev", "wifi", "list", "--rescan", "no")
+	if err != nil {
+		return nil, err
+	}
+	return parseScan(string(out)), nil
+}
+
+// Connect joins ssid, creating a new connection profile if one isn't
+// already registered, restricted to the AP bssid if it's set. A hidden
+// network is joined without needing to appear in a scan
+func (n *Nmcli) Connect(ssid, psk, bssid string, hidden bool) error {
+	// "id" so an SSID that happens to look like a UUID or a D-Bus path
+	// isn't taken for one
+	_, err := n.nmcli(ShowTimeout, "con", "show", "id", ssid)
+	args := connectArgs(ssid, psk, bssid, hidden, err == nil)
+	slog.Info("Connecting with nmcli", "args", masked(args))
+	_, err = n.nmcli(ConnectTimeout, args...)
+	return scrub(err, psk)
+}
+
+// scrub masks secret, and anything else registered with redact, wherever
+// it shows up in err, since nmcli and the runner may echo the argv or the
+// property that was rejected
+func scrub(err error, secret string) error {
+	if err == nil {
+		return err
+	}
+	redact.Add(secret)
+	if redact.String(err.Error()) == err.Error() {
+		return err
+	}
+	kind, msg := Unknown, err.Error()
+	var ne *Error
+	if errors.As(err, &ne) {
+		kind, msg = ne.Kind, ne.Err.Error()
+	}
+	return &Error{Kind: kind, Err: errors.New(redact.String(msg))}
+}
+
+// connectArgs is the nmcli argv that connects to ssid. The password is
+// only passed for a new profile or a hidden network, since an existing
+// profile has it already
+func connectArgs(ssid, psk, bssid string, hidden, exists bool) []string {
+	args := []string{"device", "wifi", "connect", ssid}
+	if (!exists || hidden) && psk != "" {
+		// if it doesn't yet exist, the new connection needs the password
+		args = append(args, "password", psk)
+	}
+	if bssid != "" {
+		args = append(args, "bssid", bssid)
+	}
+	if hidden {
+		args = append(args, "hidden", "yes")
+	}
+	return args
+}
+
+// Active returns the AP we're currently associated with
+func (n *Nmcli) Active() (AccessPoint, bool) {
+	out, err := n.nmcli(ShowTimeout, "-t", "-f", "ACTIVE,"+scanFields, "dev", "wifi", "list", "--rescan", "no")
+	if err != nil {
+		return AccessPoint{}, false
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		fields := splitTerse(scanner.Text())
+		if len(fields) == 0 || fields[0] != "yes" {
+			continue
+		}
+		return parseScanFields(fields[1:])
+	}
+	return AccessPoint{}, false
+}
+
+// Disconnect takes down the connection profile for ssid
+func (n *Nmcli) Disconnect(ssid string) error {
+	_, err := n.nmcli(ConnectTimeout, "connection", "down", "id", ssid)
+	return err
+}
+
+// Hotspot brings up a NetworkManager hotspot, which also runs DHCP for the
+// clients
+func (n *Nmcli) Hotspot(ssid, psk string) error {
+	args := []string{"device", "wifi", "hotspot", "con-name", "agrodrone-hotspot", "ssid", ssid}
+	if psk != "" {
+		args = append(args, "password", psk)
+	}
+	_, err := n.nmcli(ConnectTimeout, args...)
+	return scrub(err, psk)
+}
+
+// ErrorKind classifies an nmcli failure by what's worth doing about it
+type ErrorKind int
+
+const (
+	Unknown   ErrorKind = iota
+	Transient           // busy, mid-scan or timed out; try again shortly
+	Permanent           // retrying won't help until someone fixes something
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case Transient:
+		return "transient"
+	case Permanent:
+		return "permanent"
+	default:
+		return "unknown"
+	}
+}
+
+// Error is a failed nmcli command along with its classification
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("nmcli (%s): %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Transient reports whether the failure is worth retrying soon
+func (e *Error) Transient() bool { return e.Kind == Transient }
+
+// classify sorts an nmcli failure by the message it printed to stderr
+func classify(err error) ErrorKind {
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return Transient
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"busy", "scanning not allowed", "timeout", "timed out"} {
+		if strings.Contains(msg, s) {
+			return Transient
+		}
+	}
+	for _, s := range []string{"no wi-fi device", "secrets were required", "not authorized", "insufficient privileges"} {
+		if strings.Contains(msg, s) {
+			return Permanent
+		}
+	}
+	return Unknown
+}
+
+// nmcli runs nmcli with args and returns its stdout. A hung nmcli is killed
+// after timeout. Transient failures are retried up to attempts times;
+// anything else fails straight away. Errors are *Error and include whatever
+// nmcli wrote to stderr, e.g. "Secrets were required"
+func (n *Nmcli) nmcli(timeout time.Duration, args ...string) ([]byte, error) {
+	slog.Debug("Running nmcli", "args", masked(args))
+	for attempt := 1; ; attempt++ {
+		out, err := n.Runner.Run(timeout, "nmcli", args...)
+		if err == nil {
+			return out, nil
+		}
+		kind := classify(err)
+		if kind != Transient || attempt == attempts {
+			return out, &Error{Kind: kind, Err: err}
+		}
+		slog.Debug("nmcli failed; retrying", "command", args[0], "attempt", attempt, "attempts", attempts, "error", err)
+		time.Sleep(retryDelay)
+	}
+}
+
+// masked is args joined up for logging, with any password masked
+func masked(args []string) string {
+	args = slices.Clone(args)
+	for i := 1; i < len(args); i++ {
+		if args[i-1] == "password" {
+			args[i] = redact.Marker
+		}
+	}
+	return strings.Join(args, " ")
+}
@@ -0,0 +1,451 @@
+package wifi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/siarapatel/EC463_Team_17_AgroDrone/file_transfer_watcher/internal/redact"
+)
+
+func init() {
+	retryDelay = 0
+}
+
+// reply is what a fake nmcli run gives back: stdout, and with a non-zero
+// exit, stderr in the error as runCommand puts it
+type reply struct {
+	stdout string
+	stderr string
+	exit   int
+}
+
+// testdata reads a captured nmcli output
+func testdata(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// fakeRunner answers each nmcli run with the replies for the first prefix
+// its args start with, in turn, the last one repeating. Anything without a
+// prefix succeeds with no output
+type fakeRunner struct {
+	prefixes []string
+	replies  map[string][]reply
+	calls    [][]string
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{replies: map[string][]reply{}}
+}
+
+// on sets the replies to runs whose args start with prefix
+func (f *fakeRunner) on(prefix string, r ...reply) *fakeRunner {
+	f.prefixes = append(f.prefixes, prefix)
+	f.replies[prefix] = r
+	return f
+}
+
+func (f *fakeRunner) Run(_ time.Duration, name string, args ...string) ([]byte, error) {
+	f.calls = append(f.calls, args)
+	cmd := strings.Join(args, " ")
+	for _, p := range f.prefixes {
+		if !strings.HasPrefix(cmd, p) {
+			continue
+		}
+		r := f.replies[p][0]
+		if len(f.replies[p]) > 1 {
+			f.replies[p] = f.replies[p][1:]
+		}
+		if r.exit != 0 {
+			return []byte(r.stdout), fmt.Errorf("exit status %d: %s", r.exit, strings.TrimSpace(r.stderr))
+		}
+		return []byte(r.stdout), nil
+	}
+	return nil, nil
+}
+
+// ran lists the commands run that start with prefix
+func (f *fakeRunner) ran(prefix string) [][]string {
+	var calls [][]string
+	for _, c := range f.calls {
+		if strings.HasPrefix(strings.Join(c, " "), prefix) {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+const listCmd = "-t -f SSID,BSSID,SIGNAL,SECURITY dev wifi list"
+
+// captured is what's in testdata/scan.txt
+var captured = []AccessPoint{
+	{SSID: "pi4", BSSID: "DC:A6:32:01:02:03", Signal: 82, Security: []string{"WPA2"}},
+	// the same SSID from another AP is listed again
+	{SSID: "pi4", BSSID: "DC:A6:32:0A:0B:0C", Signal: 47, Security: []string{"WPA2"}},
+	{SSID: "pi4-guest", BSSID: "E4:5F:01:AA:BB:CC", Signal: 90, Security: []string{"WPA1", "WPA2"}},
+	{SSID: "café:outdoor 5G", BSSID: "F0:9F:C2:11:22:33", Signal: 61, Security: []string{"WPA2", "802.1X"}},
+	{SSID: "", BSSID: "F0:9F:C2:44:55:66", Signal: 30, Security: []string{"WPA2"}},
+	{SSID: "BU Guest (unencrypted)", BSSID: "00:1A:1E:00:00:01", Signal: 55},
+	{SSID: `lab\net`, BSSID: "00:1A:1E:00:00:02", Signal: 20, Security: []string{"WPA3"}},
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []reply
+		rescan  reply
+		want    []AccessPoint
+		kind    ErrorKind // of the error, if one is wanted
+		wantErr bool
+		runs    int
+	}{
+		{
+			name:    "captured",
+			replies: []reply{{stdout: testdata(t, "scan.txt")}},
+			want:    captured,
+			runs:    1,
+		},
+		{
+			name:    "empty",
+			replies: []reply{{stdout: testdata(t, "scan_empty.txt")}},
+			runs:    1,
+		},
+		{
+			name:    "rescan refused",
+			rescan:  reply{stderr: testdata(t, "rescan_busy.stderr"), exit: 1},
+			replies: []reply{{stdout: testdata(t, "scan.txt")}},
+			want:    captured,
+			runs:    1,
+		},
+		{
+			name:    "no device",
+			replies: []reply{{stderr: testdata(t, "no_wifi_device.stderr"), exit: 10}},
+			wantErr: true,
+			kind:    Permanent,
+			runs:    1,
+		},
+		{
+			name:    "busy then fine",
+			replies: []reply{{stderr: testdata(t, "device_busy.stderr"), exit: 1}, {stdout: testdata(t, "scan_empty.txt")}},
+			runs:    2,
+		},
+		{
+			name:    "busy throughout",
+			replies: []reply{{stderr: testdata(t, "device_busy.stderr"), exit: 1}},
+			wantErr: true,
+			kind:    Transient,
+			runs:    attempts,
+		},
+		{
+			name:    "unknown failure",
+			replies: []reply{{stderr: "Error: NetworkManager is not running.", exit: 8}},
+			wantErr: true,
+			kind:    Unknown,
+			runs:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRunner().on("dev wifi rescan", tt.rescan).on(listCmd, tt.replies...)
+			aps, err := NewNmcli(r).Scan()
+			if got := len(r.ran(listCmd)); got != tt.runs {
+				t.Errorf("listed %d times, want %d", got, tt.runs)
+			}
+			if tt.wantErr {
+				var ne *Error
+				if !errors.As(err, &ne) || ne.Kind != tt.kind {
+					t.Fatalf("got %v, want a %s error", err, tt.kind)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(aps, tt.want) {
+				t.Errorf("got\n%+v\nwant\n%+v", aps, tt.want)
+			}
+		})
+	}
+}
+
+func TestActive(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply reply
+		want  AccessPoint
+		ok    bool
+	}{
+		{name: "associated", reply: reply{stdout: testdata(t, "active.txt")},
+			want: AccessPoint{SSID: "pi4", BSSID: "DC:A6:32:01:02:03", Signal: 82, Security: []string{"WPA2"}}, ok: true},
+		{name: "not associated", reply: reply{stdout: testdata(t, "active_none.txt")}},
+		{name: "empty scan", reply: reply{stdout: testdata(t, "scan_empty.txt")}},
+		{name: "no device", reply: reply{stderr: testdata(t, "no_wifi_device.stderr"), exit: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRunner().on("-t -f ACTIVE,SSID", tt.reply)
+			ap, ok := NewNmcli(r).Active()
+			if ok != tt.ok || !reflect.DeepEqual(ap, tt.want) {
+				t.Errorf("got %+v, %v, want %+v, %v", ap, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestConnectArgv(t *testing.T) {
+	missing := reply{stderr: testdata(t, "con_show_missing.stderr"), exit: 10}
+	ok := reply{stdout: testdata(t, "connect_ok.txt")}
+	tests := []struct {
+		name   string
+		ssid   string
+		psk    string
+		bssid  string
+		hidden bool
+		show   reply
+		want   []string
+	}{
+		{
+			name: "new profile",
+			ssid: "pi4", psk: "hunter22", show: missing,
+			want: []string{"device", "wifi", "connect", "pi4", "password", "hunter22"},
+		},
+		{
+			name: "existing profile",
+			ssid: "pi4", psk: "hunter22", show: ok,
+			want: []string{"device", "wifi", "connect", "pi4"},
+		},
+		{
+			name: "open network",
+			ssid: "BU Guest (unencrypted)", show: missing,
+			want: []string{"device", "wifi", "connect", "BU Guest (unencrypted)"},
+		},
+		{
+			name: "pinned to an AP",
+			ssid: "pi4", psk: "hunter22", bssid: "DC:A6:32:01:02:03", show: ok,
+			want: []string{"device", "wifi", "connect", "pi4", "bssid", "DC:A6:32:01:02:03"},
+		},
+		{
+			name: "hidden with a profile",
+			ssid: "pi4", psk: "hunter22", hidden: true, show: ok,
+			want: []string{"device", "wifi", "connect", "pi4", "password", "hunter22", "hidden", "yes"},
+		},
+		{
+			name: "hidden and pinned, new profile",
+			ssid: "café:outdoor 5G", psk: "p:ss", bssid: "F0:9F:C2:11:22:33", hidden: true, show: missing,
+			want: []string{"device", "wifi", "connect", "café:outdoor 5G", "password", "p:ss", "bssid", "F0:9F:C2:11:22:33", "hidden", "yes"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRunner().on("con show", tt.show).on("device wifi connect", ok)
+			if err := NewNmcli(r).Connect(tt.ssid, tt.psk, tt.bssid, tt.hidden); err != nil {
+				t.Fatal(err)
+			}
+			want := [][]string{{"con", "show", "id", tt.ssid}, tt.want}
+			if !reflect.DeepEqual(r.calls, want) {
+				t.Errorf("ran\n%q\nwant\n%q", r.calls, want)
+			}
+		})
+	}
+}
+
+func TestConnectFailure(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply []reply
+		kind  ErrorKind
+		runs  int
+	}{
+		{name: "wrong password", reply: []reply{{stderr: testdata(t, "connect_secrets.stderr"), exit: 4}}, kind: Permanent, runs: 1},
+		{name: "busy", reply: []reply{{stderr: testdata(t, "device_busy.stderr"), exit: 1}}, kind: Transient, runs: attempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRunner().on("con show", reply{}).on("device wifi connect", tt.reply...)
+			err := NewNmcli(r).Connect("pi4", "hunter22", "", false)
+			var ne *Error
+			if !errors.As(err, &ne) || ne.Kind != tt.kind {
+				t.Fatalf("got %v, want a %s error", err, tt.kind)
+			}
+			if got := len(r.ran("device wifi connect")); got != tt.runs {
+				t.Errorf("tried %d times, want %d", got, tt.runs)
+			}
+		})
+	}
+}
+
+// timeoutError is what a runner gives for a command it had to kill
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "nmcli timed out after 5s" }
+func (timeoutError) Timeout() bool { return true }
+
+func TestTimeoutIsTransient(t *testing.T) {
+	if k := classify(fmt.Errorf("run: %w", timeoutError{})); k != Transient {
+		t.Errorf("got %s", k)
+	}
+}
+
+// Nmcli is all the WifiManager main needs from the package
+var _ WifiManager = (*Nmcli)(nil)
+
+func TestSplitTerse(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{`pi4:82`, []string{"pi4", "82"}},
+		{`café\:outdoor 5G:61`, []string{"café:outdoor 5G", "61"}},
+		{`DC\:A6\:32\:01\:02\:03`, []string{"DC:A6:32:01:02:03"}},
+		{`lab\\net:20`, []string{`lab\net`, "20"}},
+		{`a\\:b`, []string{`a\`, "b"}},
+		{`::`, []string{"", "", ""}},
+		{``, []string{""}},
+		// a lone backslash at the end has nothing to escape
+		{`trailing\`, []string{`trailing\`}},
+	}
+	for _, tt := range tests {
+		if got := splitTerse(tt.line); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitTerse(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseScanFields(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want AccessPoint
+		ok   bool
+	}{
+		{
+			name: "secured",
+			line: `pi4:DC\:A6\:32\:01\:02\:03:82:WPA2`,
+			want: AccessPoint{SSID: "pi4", BSSID: "DC:A6:32:01:02:03", Signal: 82, Security: []string{"WPA2"}},
+			ok:   true,
+		},
+		{
+			name: "WPA2 in the name",
+			line: `WPA2 lab:00\:11\:22\:33\:44\:55:40:--`,
+			want: AccessPoint{SSID: "WPA2 lab", BSSID: "00:11:22:33:44:55", Signal: 40},
+			ok:   true,
+		},
+		{
+			name: "open as --",
+			line: `pi4-open:00\:11\:22\:33\:44\:55:40:--`,
+			want: AccessPoint{SSID: "pi4-open", BSSID: "00:11:22:33:44:55", Signal: 40},
+			ok:   true,
+		},
+		{
+			name: "mixed mode",
+			line: `pi4:00\:11\:22\:33\:44\:55:40:WPA1 WPA2 802.1X`,
+			want: AccessPoint{SSID: "pi4", BSSID: "00:11:22:33:44:55", Signal: 40, Security: []string{"WPA1", "WPA2", "802.1X"}},
+			ok:   true,
+		},
+		{
+			name: "escaped colons and backslashes",
+			line: `a\:b\\c:00\:11\:22\:33\:44\:55:7:WPA3`,
+			want: AccessPoint{SSID: `a:b\c`, BSSID: "00:11:22:33:44:55", Signal: 7, Security: []string{"WPA3"}},
+			ok:   true,
+		},
+		{name: "short row", line: `pi4:82:WPA2`},
+		{name: "unescaped colon in the SSID", line: `café:outdoor:00\:11\:22\:33\:44\:55:61:WPA2`},
+		{name: "non-numeric signal", line: `pi4:00\:11\:22\:33\:44\:55:strong:WPA2`},
+		{name: "empty signal", line: `pi4:00\:11\:22\:33\:44\:55::WPA2`},
+		{name: "blank line", line: ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ap, ok := parseScanFields(splitTerse(tt.line))
+			if ok != tt.ok || !reflect.DeepEqual(ap, tt.want) {
+				t.Errorf("got %+v, %v; want %+v, %v", ap, ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+	// and a listing skips the rows it can't use
+	aps := parseScan("pi4:82:WPA2\n" + `pi4:00\:11\:22\:33\:44\:55:40:WPA2` + "\n\n")
+	if len(aps) != 1 || aps[0].Signal != 40 {
+		t.Errorf("parseScan got %+v", aps)
+	}
+}
+
+// joinTerse is the inverse of splitTerse, escaping as nmcli -t does
+func joinTerse(fields []string) string {
+	esc := strings.NewReplacer(`\`, `\\`, `:`, `\:`)
+	for i, f := range fields {
+		fields[i] = esc.Replace(f)
+	}
+	return strings.Join(fields, ":")
+}
+
+func FuzzSplitTerse(f *testing.F) {
+	for _, s := range []string{`pi4:82:WPA2`, `café\:outdoor 5G:61`, `a\\:b`, `trailing\`, `::`, ``, `\\\:`} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		fields := splitTerse(line)
+		if len(fields) == 0 {
+			t.Fatalf("splitTerse(%q) gave no fields", line)
+		}
+		joined := joinTerse(slices.Clone(fields))
+		if again := splitTerse(joined); !slices.Equal(again, fields) {
+			t.Fatalf("splitTerse(%q) = %q, but that escaped again as %q splits to %q", line, fields, joined, again)
+		}
+		// whatever the line, parsing it mustn't panic
+		parseScanFields(fields)
+	})
+}
+
+func TestConnectKeepsPSKOutOfLogsAndErrors(t *testing.T) {
+	var logs bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	const psk = "hunter22-secret"
+	r := newFakeRunner().
+		on("con show", reply{stderr: testdata(t, "con_show_missing.stderr"), exit: 10}).
+		// some nmcli versions echo the rejected value back
+		on("device wifi connect", reply{stderr: "Error: 802-11-wireless-security.psk: '" + psk + "' is not a valid PSK", exit: 2})
+	err := NewNmcli(r).Connect("pi4", psk, "", false)
+	if err == nil {
+		t.Fatal("want an error")
+	}
+	// nmcli itself still gets it
+	want := []string{"device", "wifi", "connect", "pi4", "password", psk}
+	if calls := r.ran("device wifi connect"); len(calls) != 1 || !reflect.DeepEqual(calls[0], want) {
+		t.Errorf("ran %q, want %q", calls, want)
+	}
+	if strings.Contains(err.Error(), psk) {
+		t.Errorf("the error has the PSK: %v", err)
+	}
+	if !strings.Contains(err.Error(), "is not a valid PSK") {
+		t.Errorf("the error lost nmcli's stderr: %v", err)
+	}
+	if strings.Contains(logs.String(), psk) {
+		t.Errorf("the logs have the PSK:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "password "+redact.Marker) {
+		t.Errorf("the logs don't show the masked command:\n%s", logs.String())
+	}
+
+	logs.Reset()
+	r = newFakeRunner().on("device wifi hotspot", reply{stderr: "Error: '" + psk + "' rejected", exit: 4})
+	if err := NewNmcli(r).Hotspot("agrodrone", psk); err == nil || strings.Contains(err.Error()+logs.String(), psk) {
+		t.Errorf("hotspot leaked the PSK: %v\n%s", err, logs.String())
+	}
+}
@@ -0,0 +1,89 @@
+// Package wifi finds and joins the ground station's WiFi
+package wifi
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"time"
+)
+
+// AccessPoint is one AP seen in a scan
+type AccessPoint struct {
+	SSID     string
+	BSSID    string
+	Signal   int      // 0-100
+	Security []string // e.g. ["WPA1", "WPA2"], empty for open networks
+}
+
+// HasSecurity reports whether the AP advertises the given security protocol
+func (ap AccessPoint) HasSecurity(proto string) bool {
+	return slices.Contains(ap.Security, proto)
+}
+
+// WifiManager is how we drive the WiFi radio. NetworkManager over D-Bus is
+// the default, with nmcli kept as a fallback for systems where the D-Bus
+// policy blocks us, and wpa_supplicant for systems without NetworkManager
+type WifiManager interface {
+	// Scan returns the access points currently visible
+	Scan() ([]AccessPoint, error)
+	// Connect joins ssid, creating a connection profile if there isn't one.
+	// A non-empty bssid restricts it to that AP. Hidden networks are joined
+	// without needing to appear in a scan
+	Connect(ssid, psk, bssid string, hidden bool) error
+	// Active returns the AP we're currently associated with, if any
+	Active() (AccessPoint, bool)
+	// Disconnect takes down the connection to ssid
+	Disconnect(ssid string) error
+	// Hotspot brings up an access point on the WiFi device for the ground
+	// station to join
+	Hotspot(ssid, psk string) error
+}
+
+// New picks the WiFi backend: "dbus", "nmcli", "wpa_supplicant", or "" to
+// probe for NetworkManager (over D-Bus, then nmcli) and fall back to
+// wpa_supplicant. iface is only used by the wpa_supplicant backend, and
+// run is how the command-line backends run their tools
+func New(backend, iface string, run CommandRunner) (WifiManager, error) {
+	switch backend {
+	case "dbus":
+		return newDBusManager()
+	case "nmcli":
+		return NewNmcli(run), nil
+	case "wpa_supplicant":
+		return wpaCliManager{iface: iface, run: run}, nil
+	case "":
+		m, err := newDBusManager()
+		if err == nil {
+			return m, nil
+		}
+		slog.Warn("NetworkManager D-Bus unavailable", "error", err)
+		if _, err := exec.LookPath("nmcli"); err == nil {
+			slog.Info("Using nmcli WiFi backend")
+			return NewNmcli(run), nil
+		}
+		if _, err := exec.LookPath("wpa_cli"); err == nil {
+			slog.Info("Using wpa_supplicant WiFi backend")
+			return wpaCliManager{iface: iface, run: run}, nil
+		}
+		return nil, errors.New("found neither NetworkManager nor wpa_supplicant")
+	default:
+		return nil, fmt.Errorf("unknown WiFi backend %q", backend)
+	}
+}
+
+// CommandRunner runs name with args, killing it after timeout, and returns
+// its stdout. Errors include whatever it wrote to stderr, and one that
+// timed out has a Timeout method returning true
+type CommandRunner interface {
+	Run(timeout time.Duration, name string, args ...string) ([]byte, error)
+}
+
+// RunnerFunc is a CommandRunner that's a function
+type RunnerFunc func(timeout time.Duration, name string, args ...string) ([]byte, error)
+
+func (f RunnerFunc) Run(timeout time.Duration, name string, args ...string) ([]byte, error) {
+	return f(timeout, name, args...)
+}
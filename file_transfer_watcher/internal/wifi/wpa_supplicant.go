@@ -0,0 +1,259 @@
+package wifi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	wpaCliTimeout     = 5 * time.Second
+	wpaConnectTimeout = 30 * time.Second
+	wpaDHCPTimeout    = 20 * time.Second
+)
+
+// wpaCliManager talks to wpa_supplicant through wpa_cli, for images (like
+// Raspberry Pi OS Lite) that don't ship NetworkManager
+type wpaCliManager struct {
+	iface string
+	run   CommandRunner
+}
+
+// wpaCli runs a wpa_cli command against the interface and returns its
+// trimmed output. wpa_cli exits 0 even when the command fails, so a bare
+// "FAIL" reply is turned into an error
+func (m wpaCliManager) wpaCli(args ...string) (string, error) {
+	out, err := m.run.Run(wpaCliTimeout, "wpa_cli", append([]string{"-i", m.iface}, args...)...)
+	if err != nil {
+		return "", fmt.Errorf("wpa_cli %s: %w", args[0], err)
+	}
+	reply := strings.TrimSpace(string(out))
+	if reply == "FAIL" {
+		return "", fmt.Errorf("wpa_cli %s: FAIL", args[0])
+	}
+	return reply, nil
+}
+
+// Scan triggers a scan and parses scan_results, which is tab separated:
+// bssid, frequency, signal level (dBm), flags, ssid
+func (m wpaCliManager) Scan() ([]AccessPoint, error) {
+	if _, err := m.wpaCli("scan"); err != nil {
+		// usually "already scanning"; the previous results are still there
+		slog.Debug("wpa_cli scan failed", "error", err)
+	} else {
+		time.Sleep(3 * time.Second)
+	}
+	out, err := m.wpaCli("scan_results")
+	if err != nil {
+		return nil, err
+	}
+	var aps []AccessPoint
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 5)
+		if len(fields) != 5 {
+			continue // header line
+		}
+		dbm, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		aps = append(aps, AccessPoint{
+			SSID:     fields[4],
+			BSSID:    fields[0],
+			Signal:   dbmToQuality(dbm),
+			Security: wpaFlagsSecurity(fields[3]),
+		})
+	}
+	return aps, nil
+}
+
+// dbmToQuality maps dBm onto NetworkManager's 0-100 signal scale so the same
+// MinSignal works with every backend
+func dbmToQuality(dbm int) int {
+	return min(max(2*(dbm+100), 0), 100)
+}
+
+// wpaFlagsSecurity turns scan flags like "[WPA2-PSK+SAE-CCMP][ESS]" into
+// nmcli-style security names
+func wpaFlagsSecurity(flags string) []string {
+	var sec []string
+	if strings.Contains(flags, "[WPA-") {
+		sec = append(sec, "WPA1")
+	}
+	if strings.Contains(flags, "WPA2-") || strings.Contains(flags, "RSN-") {
+		sec = append(sec, "WPA2")
+	}
+	if strings.Contains(flags, "SAE") || strings.Contains(flags, "WPA3") {
+		sec = append(sec, "WPA3")
+	}
+	return sec
+}
+
+// Connect selects the network block for ssid, adding one if needed, waits
+// for wpa_supplicant to reach COMPLETED and then for a DHCP lease
+func (m wpaCliManager) Connect(ssid, psk, bssid string, hidden bool) error {
+	id, err := m.networkID(ssid)
+	if err != nil {
+		return err
+	}
+	added := id == ""
+	if added {
+		if id, err = m.wpaCli("add_network"); err != nil {
+			return err
+		}
+	}
+	settings := [][2]string{{"ssid", strconv.Quote(ssid)}}
+	if psk != "" {
+		settings = append(settings, [2]string{"psk", strconv.Quote(psk)})
+	} else {
+		settings = append(settings, [2]string{"key_mgmt", "NONE"})
+	}
+	if bssid != "" {
+		settings = append(settings, [2]string{"bssid", bssid})
+	}
+	if hidden {
+		settings = append(settings, [2]string{"scan_ssid", "1"})
+	}
+	for _, kv := range settings {
+		if _, err := m.wpaCli("set_network", id, kv[0], kv[1]); err != nil {
+			if added {
+				_, _ = m.wpaCli("remove_network", id)
+			}
+			return err
+		}
+	}
+	slog.Info("Selecting wpa_supplicant network", "id", id, "ssid", ssid)
+	if _, err := m.wpaCli("select_network", id); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(wpaConnectTimeout)
+	for {
+		st, err := m.status()
+		if err == nil && st["wpa_state"] == "COMPLETED" && st["ssid"] == ssid {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not associated after %v (state %s)", ssid, wpaConnectTimeout, st["wpa_state"])
+		}
+		time.Sleep(time.Second)
+	}
+	return m.waitForLease()
+}
+
+// networkID returns the id of the configured network block for ssid, or ""
+// if there isn't one. list_networks is tab separated: id, ssid, bssid, flags
+func (m wpaCliManager) networkID(ssid string) (string, error) {
+	out, err := m.wpaCli("list_networks")
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) >= 2 && fields[1] == ssid {
+			return fields[0], nil
+		}
+	}
+	return "", nil
+}
+
+// waitForLease waits for the interface to get an address, kicking whichever
+// DHCP client is installed if one doesn't show up on its own
+func (m wpaCliManager) waitForLease() error {
+	deadline := time.Now().Add(wpaDHCPTimeout)
+	kicked := false
+	for !hasAddress(m.iface) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no DHCP lease on %s after %v", m.iface, wpaDHCPTimeout)
+		}
+		if !kicked {
+			kicked = true
+			if path, err := exec.LookPath("dhcpcd"); err == nil {
+				_, _ = m.run.Run(wpaDHCPTimeout, path, "-n", m.iface)
+			} else if path, err := exec.LookPath("dhclient"); err == nil {
+				_ = exec.Command(path, m.iface).Start()
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return nil
+}
+
+// hasAddress reports whether the named interface has an IPv4 address yet
+func hasAddress(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// status parses `wpa_cli status` key=value output
+func (m wpaCliManager) status() (map[string]string, error) {
+	out, err := m.wpaCli("status")
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyValues(out), nil
+}
+
+func parseKeyValues(out string) map[string]string {
+	kv := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), "="); ok {
+			kv[k] = v
+		}
+	}
+	return kv
+}
+
+// Active returns the AP wpa_supplicant is associated with
+func (m wpaCliManager) Active() (AccessPoint, bool) {
+	st, err := m.status()
+	if err != nil || st["wpa_state"] != "COMPLETED" {
+		return AccessPoint{}, false
+	}
+	out, err := m.wpaCli("signal_poll")
+	if err != nil {
+		return AccessPoint{}, false
+	}
+	rssi, err := strconv.Atoi(parseKeyValues(out)["RSSI"])
+	if err != nil {
+		return AccessPoint{}, false
+	}
+	return AccessPoint{
+		SSID:     st["ssid"],
+		BSSID:    st["bssid"],
+		Signal:   dbmToQuality(rssi),
+		Security: wpaFlagsSecurity(st["key_mgmt"]),
+	}, true
+}
+
+// Disconnect drops the current association
+func (m wpaCliManager) Disconnect(_ string) error {
+	_, err := m.wpaCli("disconnect")
+	return err
+}
+
+// Hotspot isn't supported without NetworkManager; set up hostapd instead
+func (m wpaCliManager) Hotspot(_, _ string) error {
+	return errors.New("hotspot needs NetworkManager; configure hostapd on this image instead")
+}